@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// accessInfo is what the access log learns inside the router: the route
+// template, set by metricsMiddleware. loggingMiddleware puts an empty one
+// into the context and reads it when the request is done.
+type accessInfo struct {
+	route string
+}
+
+type accessInfoKey struct{}
+
+func withAccessInfo(r *http.Request) (*http.Request, *accessInfo) {
+	info := &accessInfo{route: "unknown"}
+	return r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info)), info
+}
+
+// setAccessRoute tells the access log the route of r, a no-op for requests
+// that didn't come through loggingMiddleware
+func setAccessRoute(r *http.Request, route string) {
+	if info, ok := r.Context().Value(accessInfoKey{}).(*accessInfo); ok {
+		info.route = route
+	}
+}
+
+// accessEntry is one line of the json access log, in the structured format
+// Cloud Logging reads from stdout on GAE flexible, GKE and Cloud Run: severity
+// and httpRequest become the fields of the entry, the rest its jsonPayload.
+// Elsewhere it is one json object per line for any log shipper.
+type accessEntry struct {
+	Severity    string      `json:"severity"`
+	Message     string      `json:"message"`
+	HTTPRequest httpRequest `json:"httpRequest"`
+	Route       string      `json:"route"`
+	User        string      `json:"user,omitempty"`
+	RequestID   string      `json:"request_id"`
+	// groups the entry with the trace of the load balancer
+	Trace string    `json:"logging.googleapis.com/trace,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// httpRequest is the HttpRequest of the Cloud Logging API
+type httpRequest struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp"`
+	Referer       string `json:"referer,omitempty"`
+	// seconds with an s, "0.042s"
+	Latency  string `json:"latency"`
+	Protocol string `json:"protocol"`
+}
+
+// accessSeverity maps the status to the severity of the entry, so the 5xx
+// can be alerted on and the 4xx filtered out
+func accessSeverity(status int) string {
+	switch {
+	case status >= 500:
+		return "ERROR"
+	case status >= 400:
+		return "WARNING"
+	}
+	return "INFO"
+}
+
+// traceName is the trace of r in the form Cloud Logging links, from the
+// X-Cloud-Trace-Context the Google load balancers set: TRACE_ID/SPAN;o=1
+func (srv *Server) traceName(r *http.Request) string {
+	h := r.Header.Get("X-Cloud-Trace-Context")
+	if h == "" || srv.Config.ProjectID == "" {
+		return ""
+	}
+	trace := strings.SplitN(h, "/", 2)[0]
+	return "projects/" + srv.Config.ProjectID + "/traces/" + trace
+}
+
+// loggedURL is the url of r for the log, without the ?token= media links and
+// the event stream carry
+func loggedURL(r *http.Request) string {
+	u := *r.URL
+	q := u.Query()
+	if q.Get("token") != "" {
+		q.Set("token", "-")
+		u.RawQuery = q.Encode()
+	}
+	return u.RequestURI()
+}
+
+// loggingMiddleware writes one access log entry per request once it is done:
+// route, status, latency, user and bytes. access_log picks the format, a
+// line of text or a json entry for Cloud Logging.
+func (srv *Server) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, info := withAccessInfo(withRequestLog(r, srv.Log))
+		next.ServeHTTP(rec, r)
+		latency := time.Since(start)
+		// the token is checked again here, the jwt middleware runs per route
+		// and its context doesn't come back out of the router
+		user, _ := srv.tokenUsername(r)
+
+		if srv.Config.AccessLog != "json" {
+			if user == "" {
+				user = "-"
+			}
+			srv.Log.Printf("[%s] %s %s %s %s %d %dB %v\n", requestID(r), r.Method, r.URL.Path, info.route, user, rec.status, rec.bytes, latency)
+			return
+		}
+		js, err := json.Marshal(accessEntry{
+			Severity: accessSeverity(rec.status),
+			Message:  fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, rec.status),
+			HTTPRequest: httpRequest{
+				RequestMethod: r.Method,
+				RequestURL:    loggedURL(r),
+				Status:        rec.status,
+				ResponseSize:  fmt.Sprint(rec.bytes),
+				UserAgent:     r.UserAgent(),
+				RemoteIP:      srv.clientIP(r),
+				Referer:       r.Referer(),
+				Latency:       fmt.Sprintf("%.6fs", latency.Seconds()),
+				Protocol:      r.Proto,
+			},
+			Route:     info.route,
+			User:      user,
+			RequestID: requestID(r),
+			Trace:     srv.traceName(r),
+			Time:      start.UTC(),
+		})
+		if err != nil {
+			return
+		}
+		// one write per entry, lines of concurrent requests don't mix
+		os.Stdout.Write(append(js, '\n'))
+	})
+}
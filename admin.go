@@ -0,0 +1,48 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/TianyiSun2333/Around/auth"
+)
+
+// isAdmin reports whether username is one of config.Admins
+func (srv *Server) isAdmin(username string) bool {
+	for _, a := range srv.Config.Admins {
+		if a == username {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly lets a request through only with a valid token of an admin user,
+// a scoped token like a service account's is never one even if it acts as an admin
+func (srv *Server) adminOnly(jwtMiddleware *auth.Middleware, h http.Handler) http.Handler {
+	return jwtMiddleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := usernameFromToken(r)
+		if _, scoped := tokenScope(r); scoped || !srv.isAdmin(username) {
+			srv.Log.Printf("Rejected admin request from %s to %s\n", username, r.URL.Path)
+			writeError(w, r, http.StatusForbidden, "Admin only")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// registerDebugHandlers mounts pprof and expvar on mux behind adminOnly. They are
+// registered by hand because importing net/http/pprof alone would put them on
+// http.DefaultServeMux without any authentication.
+//
+//	curl -H "Authorization: Bearer $TOKEN" https://host/debug/pprof/heap > heap.out
+//	go tool pprof heap.out
+func (srv *Server) registerDebugHandlers(mux *http.ServeMux, jwtMiddleware *auth.Middleware) {
+	mux.Handle("/debug/pprof/", srv.adminOnly(jwtMiddleware, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", srv.adminOnly(jwtMiddleware, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", srv.adminOnly(jwtMiddleware, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", srv.adminOnly(jwtMiddleware, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", srv.adminOnly(jwtMiddleware, http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/debug/vars", srv.adminOnly(jwtMiddleware, expvar.Handler()))
+}
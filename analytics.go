@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	ANALYTICS_DAYS     = 30
+	ANALYTICS_MAX_DAYS = 90
+)
+
+// distance bands of the viewers in km, the last one is open ended
+var distanceBands = []struct {
+	Key      string
+	From, To float64
+}{
+	{"0-1", 0, 1},
+	{"1-5", 1, 5},
+	{"5-25", 5, 25},
+	{"25-100", 25, 100},
+	{"100+", 100, 0},
+}
+
+// postAnalytics is what the author of a post sees about it. Totals are the
+// counters on the post, the days are built from the tracking records and only
+// go back to when views were first tracked.
+type postAnalytics struct {
+	PostID      string `json:"post_id"`
+	Views       int64  `json:"views"`
+	Impressions int64  `json:"impressions"`
+	Likes       int64  `json:"likes"`
+	Reactions   int64  `json:"reactions"`
+	// quote posts of this one
+	Shares int64 `json:"shares"`
+	// views per distance band over the whole window, "unknown" when the viewer didn't say
+	Distance map[string]int64 `json:"distance"`
+	// the IANA zone the days are in
+	TimeZone string         `json:"time_zone"`
+	Days     []analyticsDay `json:"days"`
+}
+
+type analyticsDay struct {
+	Day      string           `json:"day"`
+	Views    int64            `json:"views"`
+	Likes    int64            `json:"likes"`
+	Shares   int64            `json:"shares"`
+	Distance map[string]int64 `json:"distance"`
+}
+
+func distanceAggregation() *elastic.RangeAggregation {
+	agg := elastic.NewRangeAggregation().Field("distance_km")
+	for _, b := range distanceBands {
+		if b.To == 0 {
+			agg = agg.AddUnboundedToWithKey(b.Key, b.From)
+		} else {
+			agg = agg.AddRangeWithKey(b.Key, b.From, b.To)
+		}
+	}
+	return agg
+}
+
+// distanceCounts reads the bands of a distance aggregation, total views minus
+// the ones in a band had no location
+func distanceCounts(aggs elastic.Aggregations, total int64) map[string]int64 {
+	counts := map[string]int64{"unknown": total}
+	for _, b := range distanceBands {
+		counts[b.Key] = 0
+	}
+	if bands, ok := aggs.Range("distance"); ok {
+		for _, b := range bands.Buckets {
+			counts[b.Key] = b.DocCount
+			counts["unknown"] -= b.DocCount
+		}
+	}
+	return counts
+}
+
+// perDay buckets by the day of created_at in loc. Times are stored in UTC, ES
+// moves the day boundaries, DST included.
+func perDay(loc *time.Location) *elastic.DateHistogramAggregation {
+	return elastic.NewDateHistogramAggregation().Field("created_at").Interval("day").Format("yyyy-MM-dd").TimeZone(loc.String())
+}
+
+// displayLocation is the time zone days are counted in for the caller: ?tz=,
+// their profile's time zone, UTC. Only for display, what is stored stays UTC.
+func (srv *Server) displayLocation(r *http.Request) (*time.Location, error) {
+	if v := r.URL.Query().Get("tz"); v != "" {
+		loc, err := time.LoadLocation(v)
+		// Local is the server's zone, not one ES knows
+		if err != nil || v == "Local" {
+			return nil, fmt.Errorf("tz should be an IANA time zone like Europe/Berlin")
+		}
+		return loc, nil
+	}
+	if username := usernameFromToken(r); username != "" {
+		if u, ok := srv.getUser(username); ok {
+			return u.location(), nil
+		}
+	}
+	return time.UTC, nil
+}
+
+// startOfDay is midnight of the day of t in loc
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// dailyCounts searches what q finds since from and counts it per day in loc
+func dailyCounts(client *elastic.Client, index, typ string, q elastic.Query, from time.Time, loc *time.Location, sub map[string]elastic.Aggregation) (*elastic.SearchResult, error) {
+	days := perDay(loc)
+	for name, agg := range sub {
+		days = days.SubAggregation(name, agg)
+	}
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		search := client.Search().
+			Index(index).
+			Type(typ).
+			Query(elastic.NewBoolQuery().Filter(q, elastic.NewRangeQuery("created_at").Gte(from))).
+			Aggregation("days", days).
+			Size(0)
+		for name, agg := range sub {
+			search = search.Aggregation(name, agg)
+		}
+		res, err = search.Do()
+		return err
+	})
+	return res, err
+}
+
+// handlerPostAnalytics shows the author how their post does: views, likes and
+// shares per day and how far away the viewers were. Posts have no comments,
+// so there is nothing to count for them.
+//
+//	GET /post/{id}/analytics?days=&tz=
+func (srv *Server) handlerPostAnalytics(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	// types and ranges are checked by validateRequest already
+	n := ANALYTICS_DAYS
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, _ = strconv.Atoi(v)
+	}
+	loc, err := srv.displayLocation(r)
+	if err != nil {
+		writeValidationError(w, r, []fieldError{{Name: "tz", In: "query", Message: err.Error()}})
+		return
+	}
+	client, _, p, ok := srv.ownPost(w, r, id)
+	if !ok {
+		return
+	}
+	today := startOfDay(time.Now(), loc)
+	from := today.AddDate(0, 0, -(n - 1))
+
+	views, err := dailyCounts(client, srv.Names.Index, TYPE_VIEW, elastic.NewTermQuery("post_id", id), from, loc,
+		map[string]elastic.Aggregation{"distance": distanceAggregation()})
+	if err != nil {
+		writeBackendError(w, r, "Failed to read views", err)
+		return
+	}
+	likes, err := dailyCounts(client, srv.Names.Index, TYPE_REACTION,
+		elastic.NewBoolQuery().Filter(elastic.NewTermQuery("post_id", id), elastic.NewTermQuery("type", "like")), from, loc, nil)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read likes", err)
+		return
+	}
+	shares, err := dailyCounts(client, srv.Names.PostReadAlias, TYPE,
+		elastic.NewBoolQuery().Filter(elastic.NewTermQuery("quote_of", id), notDeleted()), from, loc, nil)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read shares", err)
+		return
+	}
+
+	a := postAnalytics{
+		PostID:      p.Id,
+		Views:       p.Views,
+		Impressions: p.Impressions,
+		Likes:       p.Reactions["like"],
+		Reactions:   p.ReactionCount,
+		Distance:    distanceCounts(views.Aggregations, views.TotalHits()),
+		TimeZone:    loc.String(),
+		Days:        []analyticsDay{},
+	}
+	// every day of the window, the histograms leave out the empty ones
+	byDay := map[string]*analyticsDay{}
+	for d := from; !d.After(today); d = d.AddDate(0, 0, 1) {
+		a.Days = append(a.Days, analyticsDay{Day: d.Format(DAY_FORMAT), Distance: distanceCounts(nil, 0)})
+	}
+	for i := range a.Days {
+		byDay[a.Days[i].Day] = &a.Days[i]
+	}
+	each := func(res *elastic.SearchResult, f func(d *analyticsDay, b *elastic.AggregationBucketHistogramItem)) {
+		days, ok := res.Aggregations.DateHistogram("days")
+		if !ok {
+			return
+		}
+		for _, b := range days.Buckets {
+			if b.KeyAsString == nil {
+				continue
+			}
+			if d, ok := byDay[*b.KeyAsString]; ok {
+				f(d, b)
+			}
+		}
+	}
+	each(views, func(d *analyticsDay, b *elastic.AggregationBucketHistogramItem) {
+		d.Views = b.DocCount
+		d.Distance = distanceCounts(b.Aggregations, b.DocCount)
+	})
+	each(likes, func(d *analyticsDay, b *elastic.AggregationBucketHistogramItem) { d.Likes = b.DocCount })
+	each(shares, func(d *analyticsDay, b *elastic.AggregationBucketHistogramItem) { d.Shares = b.DocCount })
+	// all time, unlike the days
+	a.Shares, err = srv.countQuotes(client, id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to count shares", err)
+		return
+	}
+
+	js, _ := json.Marshal(a)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (srv *Server) countQuotes(client *elastic.Client, id string) (int64, error) {
+	var n int64
+	err := esRetry(func() error {
+		var err error
+		n, err = client.Count(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("quote_of", id), notDeleted())).
+			Do()
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/TianyiSun2333/Around/blobstore"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// the tenant is put in front, see tenantNames
+const ARCHIVE_PREFIX = "archive/"
+
+const (
+	ARCHIVE_INTERVAL = 24 * time.Hour
+	// ids deleted from the live index per bulk request
+	ARCHIVE_BULK_SIZE = 500
+)
+
+// archiveOldPosts moves posts created before now-retention out of the live index:
+// they are written as one gzipped NDJSON object to GCS (and copied to frozenIndex
+// if given), and only deleted from the live index after the archive is stored.
+func (srv *Server) archiveOldPosts(retention time.Duration, frozenIndex string) (int, error) {
+	cutoff := time.Now().UTC().Add(-retention)
+
+	es_client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+
+	// canceling ctx before wc is closed aborts the upload, nothing is stored
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// one object per run, named by the cutoff so reruns are easy to tell apart
+	name := srv.Names.ArchivePrefix + cutoff.Format("2006-01-02T15-04-05") + ".ndjson.gz"
+	wc, err := srv.Archive.Create(ctx, name, blobstore.WriteOptions{
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: "gzip",
+	})
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(wc)
+	enc := json.NewEncoder(zw)
+
+	// legacy posts without created_at never match, they stay in the live index
+	q := elastic.NewRangeQuery("created_at").Lt(cutoff)
+	scroll := es_client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(ARCHIVE_BULK_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	// deletes have to name the concrete monthly index, not the alias. Only
+	// that and the id are kept, the posts themselves are in the archive.
+	var archived []archivedPost
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// nothing is deleted and the upload is aborted by the deferred cancel
+			return 0, err
+		}
+
+		frozen := es_client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			if err := enc.Encode(hit.Source); err != nil {
+				return 0, err
+			}
+			if frozenIndex != "" {
+				frozen.Add(elastic.NewBulkIndexRequest().Index(frozenIndex).Type(TYPE).Id(hit.Id).Doc(hit.Source))
+			}
+			archived = append(archived, archivedPost{index: hit.Index, id: hit.Id})
+		}
+		if frozen.NumberOfActions() > 0 {
+			if err := bulkDo(frozen); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(archived) == 0 {
+		// the deferred cancel aborts the upload, no empty archive is left behind
+		return 0, nil
+	}
+
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if err := wc.Close(); err != nil {
+		return 0, err
+	}
+	srv.Log.Printf("Archived %d posts to gs://%s/%s\n", len(archived), srv.Config.ArchiveBucket, name)
+
+	// the archive is safe in GCS, now drop the posts from the live index
+	for start := 0; start < len(archived); start += ARCHIVE_BULK_SIZE {
+		end := start + ARCHIVE_BULK_SIZE
+		if end > len(archived) {
+			end = len(archived)
+		}
+		bulk := es_client.Bulk()
+		for _, a := range archived[start:end] {
+			bulk.Add(elastic.NewBulkDeleteRequest().Index(a.index).Type(TYPE).Id(a.id))
+		}
+		if err := bulkDo(bulk); err != nil {
+			return start, err
+		}
+		for _, a := range archived[start:end] {
+			srv.unindexPost(a.id)
+		}
+	}
+	return len(archived), nil
+}
+
+// archivedPost is where a post stored in the archive is in the live index
+type archivedPost struct {
+	index, id string
+}
+
+// bulkDo runs the bulk request with retries and turns item failures into an error
+func bulkDo(bulk *elastic.BulkService) error {
+	var res *elastic.BulkResponse
+	err := esRetry(func() error {
+		var err error
+		res, err = bulk.Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if failed := res.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d of %d bulk items failed, first: %s %v", len(failed), len(res.Items), failed[0].Id, failed[0].Error)
+	}
+	return nil
+}
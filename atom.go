@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	ATOM_ENTRIES = 50
+	// feed readers poll, a few minutes old is fine
+	ATOM_MAX_AGE = 5 * time.Minute
+)
+
+// Atom 1.0 (RFC 4287) with GeoRSS points, only the elements we fill
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	GeoRSS  string      `xml:"xmlns:georss,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Author    atomPerson  `xml:"author"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+	Point     string      `xml:"georss:point"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// handlerAtom renders the newest posts around lat/lon as an Atom feed. Feed
+// readers can't log in, so like the frontend files it needs no token.
+func (srv *Server) handlerAtom(w http.ResponseWriter, r *http.Request) {
+	// types are checked by validateRequest already
+	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	ran := srv.Config.DefaultDistance
+	if val := r.URL.Query().Get("range"); val != "" {
+		ran = val + "km"
+	}
+
+	ps, err := srv.recentNearby(lat, lon, ran, ATOM_ENTRIES)
+	if err != nil {
+		writeBackendError(w, r, "Failed to search posts", err)
+		return
+	}
+	// nobody is logged in, private accounts stay out
+	ps = srv.visiblePosts("", ps)
+
+	self := externalURL(r, r.URL.Path) + "?" + r.URL.RawQuery
+	feed := atomFeed{
+		Xmlns:  "http://www.w3.org/2005/Atom",
+		GeoRSS: "http://www.georss.org/georss",
+		ID:     self,
+		Title:  fmt.Sprintf("Around %.4f, %.4f (%s)", lat, lon, ran),
+		Links:  []atomLink{{Rel: "self", Type: "application/atom+xml", Href: self}},
+		Author: atomPerson{Name: "Around"},
+		// an empty feed still needs one, nothing changed since the epoch
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+	}
+
+	var newest time.Time
+	for _, p := range ps {
+		updated := postUpdated(p)
+		if updated.After(newest) {
+			newest = updated
+		}
+		entry := atomEntry{
+			// permanent, it is where the post can be read
+			ID:      externalURL(r, API_V1+"/post/"+p.Id),
+			Title:   atomTitle(p),
+			Updated: updated.Format(time.RFC3339),
+			Author:  atomPerson{Name: p.User},
+			Links:   []atomLink{{Rel: "enclosure", Href: p.Url}},
+			Content: atomContent{
+				Type: "html",
+				// encoding/xml escapes it once more, as type="html" requires
+				Body: "<p>" + html.EscapeString(p.Message) + `</p><p><img src="` + html.EscapeString(p.Url) + `"/></p>`,
+			},
+			Point: fmt.Sprintf("%f %f", p.Location.Lat, p.Location.Lon),
+		}
+		if !p.CreatedAt.IsZero() {
+			entry.Published = p.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if !newest.IsZero() {
+		feed.Updated = newest.Format(time.RFC3339)
+		w.Header().Set("Last-Modified", newest.Format(http.TimeFormat))
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		writeBackendError(w, r, "Failed to encode feed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ATOM_MAX_AGE.Seconds())))
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+// postUpdated is the last change of a post, old posts without any time get the one in their id
+func postUpdated(p Post) time.Time {
+	if p.UpdatedAt != nil {
+		return p.UpdatedAt.UTC()
+	}
+	if !p.CreatedAt.IsZero() {
+		return p.CreatedAt.UTC()
+	}
+	if t, ok := postIDTime(p.Id); ok {
+		return t
+	}
+	return time.Unix(0, 0).UTC()
+}
+
+// atomTitle is the start of the message, entries must have a title
+func atomTitle(p Post) string {
+	title := []rune(p.Message)
+	if len(title) == 0 {
+		return "Post by " + p.User
+	}
+	if len(title) > 80 {
+		return string(title[:79]) + "…"
+	}
+	return string(title)
+}
+
+// externalURL is the absolute URL of path as the client reached us, behind
+// the load balancer the scheme is in X-Forwarded-Proto
+func externalURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: path}
+	return u.String()
+}
+
+// recentNearby is searchNearby sorted newest first and limited to size
+func (srv *Server) recentNearby(lat, lon float64, ran string, size int) ([]Post, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	geo := elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(lat).Lon(lon)
+
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(elastic.NewBoolQuery().Filter(geo, notDeleted())).
+			Sort("created_at", false).
+			Size(size).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []Post
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
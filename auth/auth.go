@@ -0,0 +1,101 @@
+// Package auth signs and checks the tokens of the API, HS256 JWTs with the
+// claims of the kind of token.
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// the iss and aud of every token, a token made by someone else with the
+	// same key for another service is no token of the API
+	ISSUER   = "around"
+	AUDIENCE = "around-api"
+	// clocks of instances may be a little apart for exp and nbf
+	LEEWAY = 30 * time.Second
+)
+
+// Tokens signs tokens for one tenant and only accepts its own. Every tenant
+// shares the key, so the tenant claim decides.
+type Tokens struct {
+	Key []byte
+	// "" is the app from before tenants, its tokens have no tenant claim
+	Tenant string
+}
+
+// Sign returns the token of claims, with the tenant, issuer, audience and
+// issued/not before claims added
+func (t *Tokens) Sign(claims jwt.MapClaims) (string, error) {
+	now := time.Now().Unix()
+	c := jwt.MapClaims{
+		"iss": ISSUER,
+		"aud": AUDIENCE,
+		"iat": now,
+		"nbf": now,
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	if t.Tenant != "" {
+		c["tenant"] = t.Tenant
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(t.Key)
+}
+
+// Keyfunc hands out the key for HS256 tokens of this tenant only. alg none
+// and the other algorithms are refused before any signature is checked, so
+// a token can't pick how it gets verified.
+func (t *Tokens) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return nil, fmt.Errorf("signing method %v is not allowed", token.Header["alg"])
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	tenant, _ := claims["tenant"].(string)
+	if tenant != t.Tenant {
+		return nil, fmt.Errorf("token is for another tenant")
+	}
+	return t.Key, nil
+}
+
+// Parse checks raw and returns its claims: the signature, the algorithm, the
+// tenant, iss and aud, and exp and nbf within LEEWAY. Tokens from before iss
+// and aud were signed are rejected, their users log in again.
+func (t *Tokens) Parse(raw string) (jwt.MapClaims, error) {
+	token, err := t.parser().Parse(raw, t.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("token is invalid")
+	}
+	return claims, nil
+}
+
+func (t *Tokens) parser() *jwt.Parser {
+	return jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(ISSUER),
+		jwt.WithAudience(AUDIENCE),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(LEEWAY),
+	)
+}
+
+// TenantOf is the tenant claim of raw without checking the token, to pick the
+// Tokens that check it. ok is false when raw is no token at all.
+func TenantOf(raw string) (tenant string, ok bool) {
+	if raw == "" {
+		return "", false
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, claims); err != nil {
+		return "", false
+	}
+	tenant, _ = claims["tenant"].(string)
+	return tenant, true
+}
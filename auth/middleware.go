@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Middleware lets requests with a token of Tokens through, with the parsed
+// *jwt.Token in the context under "user" where the handlers read the claims.
+// It took over from go-jwt-middleware, its messages are the same.
+type Middleware struct {
+	Tokens *Tokens
+	// also takes the token from this query parameter, for websockets and
+	// event streams that can't set headers. "" only reads the header.
+	QueryParam string
+	// answers a request without a valid token, err is for the client
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err string)
+	// lets requests without a token through without "user", for endpoints
+	// signed out users may call too. A token that is there has to be valid.
+	Optional bool
+}
+
+func (m *Middleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// preflight requests carry no credentials
+		if r.Method == http.MethodOptions {
+			h.ServeHTTP(w, r)
+			return
+		}
+		raw, err := m.extract(r)
+		if err != nil {
+			m.ErrorHandler(w, r, err.Error())
+			return
+		}
+		if raw == "" && m.Optional {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if raw == "" {
+			m.ErrorHandler(w, r, "Required authorization token not found")
+			return
+		}
+		token, err := m.Tokens.parser().Parse(raw, m.Tokens.Keyfunc)
+		if err != nil {
+			m.ErrorHandler(w, r, fmt.Sprintf("Error parsing token: %v", err))
+			return
+		}
+		if !token.Valid {
+			m.ErrorHandler(w, r, "Token is invalid")
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", token)))
+	})
+}
+
+// extract returns the bearer token of the Authorization header, or else of the
+// query parameter. "" when there is none.
+func (m *Middleware) extract(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.Fields(header)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+			return "", fmt.Errorf("Authorization header format must be Bearer {token}")
+		}
+		return parts[1], nil
+	}
+	if m.QueryParam != "" {
+		return r.URL.Query().Get(m.QueryParam), nil
+	}
+	return "", nil
+}
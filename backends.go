@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/TianyiSun2333/Around/bigtablestore"
+	"github.com/TianyiSun2333/Around/blobstore"
+	"github.com/TianyiSun2333/Around/moderation"
+	"github.com/TianyiSun2333/Around/search"
+	// the postgres driver of database/sql, for search_backend postgis
+	_ "github.com/lib/pq"
+)
+
+// the index or table opensearch and postgis keep their copy of the posts in,
+// prefixed with the tenant, see tenantNames. The copy only serves the geo
+// search, ES stays where posts are stored and read.
+const SEARCH_INDEX = "around_search"
+
+// wireBackends sets up the production backends of the config, each with the
+// retries and circuit breaker of resilience.go and the shared clients of srv.
+func (srv *Server) wireBackends() error {
+	c := srv.Config
+	srv.Media = &blobstore.GCS{
+		Bucket: c.BucketName,
+		Client: srv.gcs,
+		Retry:  func(fn func() error) error { return retry(gcsBreaker, fn) },
+		Log:    srv.Log,
+	}
+	srv.Archive = &blobstore.GCS{
+		Bucket: c.ArchiveBucket,
+		Client: srv.gcs,
+		Retry:  func(fn func() error) error { return retry(gcsBreaker, fn) },
+		Log:    srv.Log,
+	}
+	srv.Tables = &bigtablestore.Bigtable{
+		Client: srv.bigtable,
+		Retry:  func(fn func() error) error { return retry(btBreaker, fn) },
+	}
+	srv.Classifier = &moderation.MLEngine{
+		Project: c.ProjectID,
+		Model:   c.MLModel,
+		Retry:   func(fn func() error) error { return retry(mlBreaker, fn) },
+		Log:     srv.Log,
+	}
+	if c.Dev {
+		if err := srv.wireDevBackends(); err != nil {
+			return err
+		}
+	}
+	// the ones the config runs without, see degraded.go
+	if srv.without("gcs") {
+		srv.Media = noMedia{}
+		srv.Archive = noMedia{}
+	}
+	if srv.without("bigtable") {
+		srv.Tables = noTables{}
+	}
+	if srv.without("moderation") {
+		srv.Classifier = noClassifier{}
+	}
+	switch c.SearchBackend {
+	case "opensearch":
+		srv.Search = &search.OpenSearch{
+			URL:   c.OpenSearchURL,
+			Index: srv.Names.SearchIndex,
+			Retry: searchRetry,
+			Log:   srv.Log,
+		}
+	case "memory":
+		srv.Search = &search.Memory{}
+	case "postgis":
+		// the connection is made by the first query
+		db, err := sql.Open("postgres", c.PostgresURL)
+		if err != nil {
+			return err
+		}
+		srv.Search = &search.PostGIS{
+			DB:    db,
+			Table: srv.Names.SearchIndex,
+			Retry: searchRetry,
+		}
+	default:
+		srv.Search = &search.Elasticsearch{
+			Client: srv.es,
+			Index:  srv.Names.PostReadAlias,
+			Type:   TYPE,
+			Retry:  esRetry,
+		}
+	}
+	if _, ok := srv.Search.(search.Indexer); ok {
+		srv.Log.Printf("Searching posts in %s, they are still stored in ES at %s\n", c.SearchBackend, c.ESURL)
+	}
+	srv.Tokens.Tenant = c.Tenant
+	return nil
+}
+
+// setupSearch creates the index or table of a search backend with its own
+// copy of the posts, a copy that is new stays empty until `around reindex -search`
+func (srv *Server) setupSearch() error {
+	if ix, ok := srv.Search.(search.Indexer); ok {
+		return ix.Setup()
+	}
+	return nil
+}
+
+// syncSearch tells a search backend with its own copy of the posts that p was
+// saved or changed, a deleted or scheduled post is taken out. Failures only get logged, the
+// post is saved in ES and `around reindex -search` catches the copy up.
+func (srv *Server) syncSearch(p Post) {
+	ix, ok := srv.Search.(search.Indexer)
+	if !ok {
+		return
+	}
+	var err error
+	if p.hidden() {
+		err = ix.Remove(p.Id)
+	} else {
+		err = ix.Put(searchDoc(p))
+	}
+	if err != nil {
+		srv.Log.Printf("Failed to update post %s in the search backend %v\n", p.Id, err)
+		srv.deadLetter("search.sync", deadLetterPost{Id: p.Id}, err)
+	}
+}
+
+// unindexPost takes the post id out of the search backend, for posts that
+// are gone from ES like purged or archived ones
+func (srv *Server) unindexPost(id string) {
+	if ix, ok := srv.Search.(search.Indexer); ok {
+		if err := ix.Remove(id); err != nil {
+			srv.Log.Printf("Failed to remove post %s from the search backend %v\n", id, err)
+			srv.deadLetter("search.sync", deadLetterPost{Id: id}, err)
+		}
+	}
+}
+
+func searchDoc(p Post) search.Doc {
+	js, _ := json.Marshal(p)
+	return search.Doc{Id: p.Id, Lat: p.Location.Lat, Lon: p.Location.Lon, CreatedAt: p.CreatedAt, Category: p.Category, Message: p.Message, Source: js}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// the daily job catches what ingest missed, e.g. reactions to old posts
+	BADGE_INTERVAL = 24 * time.Hour
+	// geohash cells of about 40km stand in for cities, reverse geocoding every post is too much
+	BADGE_CITY_PRECISION = 4
+)
+
+// Badge is stored on the user document, once awarded it is kept
+type Badge struct {
+	Id        string    `json:"id"`
+	AwardedAt time.Time `json:"awarded_at"`
+}
+
+// what the badge rules look at, computed by one aggregation over the user's posts
+type badgeStats struct {
+	Posts  int64
+	Cities int
+	Likes  int64
+}
+
+type badgeRule struct {
+	Id          string
+	Name        string
+	Description string
+	earned      func(s badgeStats) bool
+}
+
+var badgeRules = []badgeRule{
+	{"first_post", "First post", "Posted for the first time", func(s badgeStats) bool { return s.Posts >= 1 }},
+	{"ten_cities", "Globetrotter", "Posted from 10 different cities", func(s badgeStats) bool { return s.Cities >= 10 }},
+	{"hundred_likes", "Crowd favourite", "Got 100 likes", func(s badgeStats) bool { return s.Likes >= 100 }},
+}
+
+func (srv *Server) userBadgeStats(username string) (badgeStats, error) {
+	var s badgeStats
+	client, err := srv.es()
+	if err != nil {
+		return s, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user", username), notDeleted())).
+			Aggregation("cities", elastic.NewGeoHashGridAggregation().Field("location").Precision(BADGE_CITY_PRECISION).Size(10000)).
+			Aggregation("likes", elastic.NewSumAggregation().Field("reactions.like")).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		return s, err
+	}
+	s.Posts = res.TotalHits()
+	if cities, ok := res.Aggregations.GeoHash("cities"); ok {
+		s.Cities = len(cities.Buckets)
+	}
+	if likes, ok := res.Aggregations.Sum("likes"); ok && likes.Value != nil {
+		s.Likes = int64(*likes.Value)
+	}
+	return s, nil
+}
+
+// evaluateBadges awards the badges username has earned and doesn't have yet.
+// Called after posting and reacting, and for everybody by runBadges.
+func (srv *Server) evaluateBadges(username string) error {
+	// the cached user may miss a badge another instance just awarded
+	srv.userLookupCache.invalidate(username)
+	u, ok := srv.getUser(username)
+	if !ok {
+		return fmt.Errorf("no user %s", username)
+	}
+	has := map[string]bool{}
+	for _, b := range u.Badges {
+		has[b.Id] = true
+	}
+	if len(has) == len(badgeRules) {
+		return nil
+	}
+
+	s, err := srv.userBadgeStats(username)
+	if err != nil {
+		return err
+	}
+	badges := u.Badges
+	now := time.Now().UTC()
+	for _, rule := range badgeRules {
+		if !has[rule.Id] && rule.earned(s) {
+			badges = append(badges, Badge{Id: rule.Id, AwardedAt: now})
+			srv.Log.Printf("%s earned the %s badge\n", username, rule.Id)
+		}
+	}
+	if len(badges) == len(u.Badges) {
+		return nil
+	}
+	// only the badges, a whole document from the cache could undo a profile update
+	return srv.updateUserFields(username, map[string]interface{}{"badges": badges})
+}
+
+// Author is what search results tell about the author of each post
+type Author struct {
+	Username    string  `json:"username"`
+	DisplayName string  `json:"display_name"`
+	Avatar      string  `json:"avatar"`
+	Verified    bool    `json:"verified"`
+	Badges      []Badge `json:"badges"`
+}
+
+// badgesOf never returns nil, so the JSON has a list
+func badgesOf(u User) []Badge {
+	if u.Badges == nil {
+		return []Badge{}
+	}
+	return u.Badges
+}
+
+// withAuthors fills in the author of every post from the user cache, ps itself
+// is not changed. Authors that can't be loaded only get their username.
+func (srv *Server) withAuthors(ps []Post) []Post {
+	authors := map[string]*Author{}
+	out := make([]Post, len(ps))
+	for i, p := range ps {
+		a, ok := authors[p.User]
+		if !ok {
+			a = &Author{Username: p.User, Badges: []Badge{}}
+			if u, ok := srv.getUser(p.User); ok {
+				a.DisplayName, a.Avatar, a.Verified, a.Badges = u.DisplayName, u.Avatar, u.Verified, badgesOf(u)
+			}
+			authors[p.User] = a
+		}
+		out[i] = p
+		out[i].Author = a
+	}
+	return out
+}
+
+// awardBadgesLater evaluates badges in the background, a post or reaction must not wait for it
+func (srv *Server) awardBadgesLater(username string) {
+	go func() {
+		if err := srv.evaluateBadges(username); err != nil {
+			srv.Log.Printf("Failed to evaluate badges of %s %v\n", username, err)
+		}
+	}()
+}
+
+func (srv *Server) evaluateAllBadges() (int, error) {
+	client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+	scroll := client.Scroll(srv.Names.Index).
+		Type(TYPE_USER).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	n := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		for _, hit := range res.Hits.Hits {
+			var u User
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &u) != nil {
+				continue
+			}
+			if err := srv.evaluateBadges(u.Username); err != nil {
+				srv.Log.Printf("Failed to evaluate badges of %s %v\n", u.Username, err)
+			}
+			n++
+		}
+	}
+}
+
+// handlerListBadges tells clients the name and description of every badge id
+func handlerListBadges(w http.ResponseWriter, r *http.Request) {
+	type badgeInfo struct {
+		Id          string `json:"id"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	infos := make([]badgeInfo, len(badgeRules))
+	for i, rule := range badgeRules {
+		infos[i] = badgeInfo{Id: rule.Id, Name: rule.Name, Description: rule.Description}
+	}
+	js, _ := json.Marshal(infos)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// runBadges implements `around badges`, the daily job right now
+func (srv *Server) runBadges(args []string) error {
+	flag.NewFlagSet("badges", flag.ExitOnError).Parse(args)
+	n, err := srv.evaluateAllBadges()
+	srv.Log.Printf("Checked badges of %d users\n", n)
+	return err
+}
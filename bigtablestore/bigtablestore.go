@@ -0,0 +1,113 @@
+// Package bigtablestore writes and reads rows of the Bigtable tables, the
+// copy of posts for analytics and the moderation log.
+package bigtablestore
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/TianyiSun2333/Around/requestid"
+	"google.golang.org/grpc/metadata"
+)
+
+// Store is what the server does with Bigtable
+type Store interface {
+	// Apply writes mut to row of table
+	Apply(ctx context.Context, table, row string, mut *bigtable.Mutation) error
+	// Insert applies mut only when row has no cells yet, false when it had some
+	Insert(ctx context.Context, table, row string, mut *bigtable.Mutation) (bool, error)
+	// ApplyBulk writes many rows, the errors are per row and nil when every row went through
+	ApplyBulk(ctx context.Context, table string, rows []string, muts []*bigtable.Mutation) ([]error, error)
+	// ReadPrefix returns up to limit rows whose key starts with prefix, in key order
+	ReadPrefix(ctx context.Context, table, prefix string, limit int) ([]bigtable.Row, error)
+}
+
+// Bigtable is a Store on an instance. Client returns the client of the
+// instance, the server shares one. Retry wraps every call, the server passes
+// one with its circuit breaker, nil calls once.
+type Bigtable struct {
+	Client func(ctx context.Context) (*bigtable.Client, error)
+	Retry  func(fn func() error) error
+}
+
+func (b *Bigtable) retry(fn func() error) error {
+	if b.Retry == nil {
+		return fn()
+	}
+	return b.Retry(fn)
+}
+
+// outgoing adds the request id of ctx to the gRPC metadata of the calls
+func outgoing(ctx context.Context) context.Context {
+	if id := requestid.From(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, "x-request-id", id)
+	}
+	return ctx
+}
+
+func (b *Bigtable) open(ctx context.Context, table string) (*bigtable.Table, error) {
+	client, err := b.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(table), nil
+}
+
+func (b *Bigtable) Apply(ctx context.Context, table, row string, mut *bigtable.Mutation) error {
+	ctx = outgoing(ctx)
+	tbl, err := b.open(ctx, table)
+	if err != nil {
+		return err
+	}
+	return b.retry(func() error {
+		return tbl.Apply(ctx, row, mut)
+	})
+}
+
+func (b *Bigtable) Insert(ctx context.Context, table, row string, mut *bigtable.Mutation) (bool, error) {
+	ctx = outgoing(ctx)
+	tbl, err := b.open(ctx, table)
+	if err != nil {
+		return false, err
+	}
+	// applied only when the filter matches nothing, an empty row
+	cond := bigtable.NewCondMutation(bigtable.PassAllFilter(), nil, mut)
+	var exists bool
+	err = b.retry(func() error {
+		return tbl.Apply(ctx, row, cond, bigtable.GetCondMutationResult(&exists))
+	})
+	return !exists, err
+}
+
+func (b *Bigtable) ApplyBulk(ctx context.Context, table string, rows []string, muts []*bigtable.Mutation) ([]error, error) {
+	ctx = outgoing(ctx)
+	tbl, err := b.open(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	var rowErrs []error
+	err = b.retry(func() error {
+		var err error
+		rowErrs, err = tbl.ApplyBulk(ctx, rows, muts)
+		return err
+	})
+	return rowErrs, err
+}
+
+func (b *Bigtable) ReadPrefix(ctx context.Context, table, prefix string, limit int) ([]bigtable.Row, error) {
+	ctx = outgoing(ctx)
+	tbl, err := b.open(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	var rows []bigtable.Row
+	err = b.retry(func() error {
+		// a retry starts over
+		rows = nil
+		return tbl.ReadRows(ctx, bigtable.PrefixRange(prefix), func(row bigtable.Row) bool {
+			rows = append(rows, row)
+			return true
+		}, bigtable.LimitRows(int64(limit)))
+	})
+	return rows, err
+}
@@ -0,0 +1,63 @@
+package bigtablestore
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// NewMemory starts the in-memory Bigtable of the client library on a local
+// port and returns a Store on it, for development. tables maps the tables to
+// create to their column families, the data is gone with the process.
+func NewMemory(ctx context.Context, tables map[string][]string) (*Bigtable, error) {
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	client, err := DialEmulator(ctx, srv.Addr, tables)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return &Bigtable{Client: func(ctx context.Context) (*bigtable.Client, error) { return client, nil }}, nil
+}
+
+// DialEmulator connects to the Bigtable emulator at addr, host:port, without
+// credentials and creates the tables it lacks, with their column families.
+// The emulator starts empty and takes any project and instance.
+func DialEmulator(ctx context.Context, addr string, tables map[string][]string) (*bigtable.Client, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	admin, err := bigtable.NewAdminClient(ctx, "emulator", "emulator", option.WithGRPCConn(conn))
+	if err != nil {
+		return nil, err
+	}
+	existing, err := admin.Tables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, t := range existing {
+		have[t] = true
+	}
+	for table, families := range tables {
+		// from an earlier run against the same emulator
+		if have[table] {
+			continue
+		}
+		if err := admin.CreateTable(ctx, table); err != nil {
+			return nil, err
+		}
+		for _, family := range families {
+			if err := admin.CreateColumnFamily(ctx, table, family); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bigtable.NewClient(ctx, "emulator", "emulator", option.WithGRPCConn(conn))
+}
@@ -0,0 +1,232 @@
+// Package blobstore keeps the media of posts, GCS in production.
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/TianyiSun2333/Around/requestid"
+	"google.golang.org/api/iterator"
+)
+
+// Store saves the media objects. They aren't public, the server checks who
+// may see a post and streams its media with Open.
+type Store interface {
+	// Put writes r to the object name, replacing it, and returns where it is
+	// for the logs, like gs://bucket/name
+	Put(ctx context.Context, name string, r io.Reader) (string, error)
+	// Open reads the object name, ErrNotExist when there is none. The caller
+	// closes it.
+	Open(ctx context.Context, name string) (*Object, error)
+	// Delete removes the object name, one that doesn't exist is no error
+	Delete(ctx context.Context, name string) error
+	// List calls fn with every object whose name starts with prefix, an error
+	// of fn stops the listing and is returned
+	List(ctx context.Context, prefix string, fn func(Attrs) error) error
+	// Create returns a writer of the object name for content too big to hold
+	// in memory, Close stores it. Canceling ctx before Close aborts the
+	// write, nothing is stored.
+	Create(ctx context.Context, name string, opts WriteOptions) (io.WriteCloser, error)
+}
+
+// ErrNotExist is Open of an object that isn't there
+var ErrNotExist = errors.New("blobstore: object doesn't exist")
+
+// Object is an object being read
+type Object struct {
+	io.ReadCloser
+	ContentType string
+	Size        int64
+	Updated     time.Time
+	// changes with the content
+	ETag string
+}
+
+// Attrs is an object of a listing
+type Attrs struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// WriteOptions are the headers an object written with Create is served with
+type WriteOptions struct {
+	ContentType     string
+	ContentEncoding string
+}
+
+// GCS is a Store in a bucket. Client returns the client to use, the server
+// shares one. Retry wraps every call, the server passes one with its circuit
+// breaker, nil calls once.
+type GCS struct {
+	Bucket string
+	Client func(ctx context.Context) (*storage.Client, error)
+	Retry  func(fn func() error) error
+	// where Put logs the saved objects, nil doesn't log
+	Log *log.Logger
+}
+
+func (g *GCS) retry(fn func() error) error {
+	if g.Retry == nil {
+		return fn()
+	}
+	return g.Retry(fn)
+}
+
+func (g *GCS) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	client, err := g.Client(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// bucket is like folder
+	bucket := client.Bucket(g.Bucket)
+
+	// <attrs> try to get attribute of the bucket, to see if the bucket exist
+	if err := g.retry(func() error {
+		_, err := bucket.Attrs(ctx)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	obj := bucket.Object(name)
+
+	// the upload can only be repeated if we can rewind the file, uploads are
+	// files of a form so this is rare
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		seeker = bytes.NewReader(b)
+	}
+	attempt := 0
+	err = g.retry(func() error {
+		if attempt++; attempt > 1 {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		// a writer can write to the object in the bucket
+		wc := obj.NewWriter(ctx)
+		// the request that uploaded it, to find it in the logs
+		if id := requestid.From(ctx); id != "" {
+			wc.Metadata = map[string]string{"request_id": id}
+		}
+		if _, err := io.Copy(wc, seeker); err != nil {
+			wc.Close()
+			return err
+		}
+		return wc.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// no read access for all users, media of older posts still has it and
+	// their MediaLink keeps working
+	url := "gs://" + g.Bucket + "/" + name
+	if g.Log != nil {
+		g.Log.Printf("[%s] Post is saved to GCS: %s\n", requestid.From(ctx), url)
+	}
+	return url, nil
+}
+
+func (g *GCS) Open(ctx context.Context, name string) (*Object, error) {
+	client, err := g.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj := client.Bucket(g.Bucket).Object(name)
+
+	var attrs *storage.ObjectAttrs
+	err = g.retry(func() error {
+		var err error
+		attrs, err = obj.Attrs(ctx)
+		return err
+	})
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rc *storage.Reader
+	err = g.retry(func() error {
+		var err error
+		rc, err = obj.NewReader(ctx)
+		return err
+	})
+	if err == storage.ErrObjectNotExist {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		ReadCloser:  rc,
+		ContentType: attrs.ContentType,
+		Size:        rc.Size(),
+		Updated:     attrs.Updated,
+		ETag:        attrs.Etag,
+	}, nil
+}
+
+func (g *GCS) Delete(ctx context.Context, name string) error {
+	client, err := g.Client(ctx)
+	if err != nil {
+		return err
+	}
+	obj := client.Bucket(g.Bucket).Object(name)
+	return g.retry(func() error {
+		err := obj.Delete(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil
+		}
+		return err
+	})
+}
+
+func (g *GCS) List(ctx context.Context, prefix string, fn func(Attrs) error) error {
+	client, err := g.Client(ctx)
+	if err != nil {
+		return err
+	}
+	it := client.Bucket(g.Bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(Attrs{Name: attrs.Name, Size: attrs.Size, Created: attrs.Created}); err != nil {
+			return err
+		}
+	}
+}
+
+// Create isn't retried, what was written is gone by the time Close fails
+func (g *GCS) Create(ctx context.Context, name string, opts WriteOptions) (io.WriteCloser, error) {
+	client, err := g.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wc := client.Bucket(g.Bucket).Object(name).NewWriter(ctx)
+	wc.ContentType = opts.ContentType
+	wc.ContentEncoding = opts.ContentEncoding
+	if id := requestid.From(ctx); id != "" {
+		wc.Metadata = map[string]string{"request_id": id}
+	}
+	return wc, nil
+}
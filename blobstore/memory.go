@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store in the memory of the process, for development. The
+// objects are gone with the process.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	updated time.Time
+}
+
+func (m *Memory) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	m.put(name, b)
+	return "mem://" + name, nil
+}
+
+func (m *Memory) put(name string, b []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = map[string]memoryObject{}
+	}
+	m.objects[name] = memoryObject{data: b, updated: time.Now().UTC()}
+}
+
+func (m *Memory) Open(ctx context.Context, name string) (*Object, error) {
+	m.mu.Lock()
+	obj, ok := m.objects[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, ErrNotExist
+	}
+	// GCS guesses the type from the content the same way
+	return &Object{
+		ReadCloser:  ioutil.NopCloser(bytes.NewReader(obj.data)),
+		ContentType: http.DetectContentType(obj.data),
+		Size:        int64(len(obj.data)),
+		Updated:     obj.updated,
+		ETag:        fmt.Sprintf("%x", md5.Sum(obj.data)),
+	}, nil
+}
+
+func (m *Memory) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix string, fn func(Attrs) error) error {
+	var list []Attrs
+	m.mu.Lock()
+	for name, obj := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			list = append(list, Attrs{Name: name, Size: int64(len(obj.data)), Created: obj.updated})
+		}
+	}
+	m.mu.Unlock()
+	// in name order like GCS
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	for _, a := range list {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the headers of opts aren't kept, Open guesses the type like for Put
+func (m *Memory) Create(ctx context.Context, name string, opts WriteOptions) (io.WriteCloser, error) {
+	return &memoryWriter{m: m, ctx: ctx, name: name}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	m    *Memory
+	ctx  context.Context
+	name string
+}
+
+func (w *memoryWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.m.put(w.name, w.Bytes())
+	return nil
+}
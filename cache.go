@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// map refresh from the same area within this window reuse the same response
+	SEARCH_CACHE_TTL = 30 * time.Second
+	// 2 digits of lat/lon is about 1km, close enough for the same map view
+	SEARCH_CACHE_PRECISION = 2
+	// invalidation grid, 1 degree is about 111km
+	SEARCH_CACHE_CELL = 1.0
+	// a search circle covering more cells than this is simply not cached
+	SEARCH_CACHE_MAX_CELLS = 64
+)
+
+// initSearchCache connects to redis, the cache is optional so failures only get logged.
+func (srv *Server) initSearchCache() {
+	client := redis.NewClient(&redis.Options{
+		Addr: srv.Config.RedisURL,
+		DB:   srv.Config.RedisDB,
+	})
+	if err := client.Ping().Err(); err != nil {
+		srv.Log.Printf("Redis is not setup, search cache disabled %v\n", err)
+		return
+	}
+	srv.Redis = client
+}
+
+// searchHits is what the search cache holds for a key, every post of the
+// search before the ones hidden from a viewer are dropped
+type searchHits struct {
+	Posts []Post `json:"posts"`
+	Total int64  `json:"total"`
+}
+
+// searchCacheKey builds the key from rounded coordinates + radius + filters.
+// filters are "name=value" pairs, sorted by the caller if order matters
+func searchCacheKey(lat, lon float64, ran string, filters ...string) string {
+	key := "search:" + strconv.FormatFloat(lat, 'f', SEARCH_CACHE_PRECISION, 64) +
+		":" + strconv.FormatFloat(lon, 'f', SEARCH_CACHE_PRECISION, 64) +
+		":" + ran
+	if len(filters) > 0 {
+		key += ":" + strings.Join(filters, "&")
+	}
+	return key
+}
+
+// getCachedSearch returns the serialized response, ok is false on miss or when redis is down
+func (srv *Server) getCachedSearch(key string) ([]byte, bool) {
+	if srv.Redis == nil {
+		return nil, false
+	}
+	val, err := srv.Redis.Get(key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			srv.Log.Printf("Failed to read search cache %v\n", err)
+		}
+		return nil, false
+	}
+	return val, true
+}
+
+// cacheSearch stores the response and registers the key in every grid cell the
+// search circle touches, so a new post in any of those cells drops it.
+func (srv *Server) cacheSearch(key string, lat, lon float64, ran string, js []byte) {
+	if srv.Redis == nil {
+		return
+	}
+	km, err := parseKm(ran)
+	if err != nil {
+		return
+	}
+	cells := cellsInRange(lat, lon, km)
+	if len(cells) == 0 {
+		return
+	}
+
+	pipe := srv.Redis.TxPipeline()
+	pipe.Set(key, js, SEARCH_CACHE_TTL)
+	for _, c := range cells {
+		pipe.SAdd(c, key)
+		// the set only needs to live as long as the entries in it
+		pipe.Expire(c, SEARCH_CACHE_TTL)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		srv.Log.Printf("Failed to write search cache %v\n", err)
+	}
+}
+
+// invalidateSearchCache drops every cached search whose circle covers the post location.
+func (srv *Server) invalidateSearchCache(lat, lon float64) {
+	if srv.Redis == nil {
+		return
+	}
+	cell := cellKey(cellIndex(lat), wrapLonCell(cellIndex(lon)))
+	keys, err := srv.Redis.SMembers(cell).Result()
+	if err != nil {
+		srv.Log.Printf("Failed to read search cache cell %v\n", err)
+		return
+	}
+	keys = append(keys, cell)
+	if err := srv.Redis.Del(keys...).Err(); err != nil {
+		srv.Log.Printf("Failed to invalidate search cache %v\n", err)
+	}
+}
+
+// cellsInRange returns the cells of the bounding box around the search circle,
+// nil if the box is bigger than SEARCH_CACHE_MAX_CELLS
+func cellsInRange(lat, lon, km float64) []string {
+	// 111km per degree of latitude, longitude shrinks with cos(lat)
+	dLat := km / 111.0
+	dLon := 180.0
+	if c := math.Cos(lat * math.Pi / 180); c > 0.01 {
+		dLon = math.Min(km/(111.0*c), 180.0)
+	}
+
+	minLat, maxLat := cellIndex(math.Max(lat-dLat, -90)), cellIndex(math.Min(lat+dLat, 90))
+	minLon, maxLon := cellIndex(lon-dLon), cellIndex(lon+dLon)
+	if (maxLat-minLat+1)*(maxLon-minLon+1) > SEARCH_CACHE_MAX_CELLS {
+		return nil
+	}
+
+	var cells []string
+	for i := minLat; i <= maxLat; i++ {
+		for j := minLon; j <= maxLon; j++ {
+			cells = append(cells, cellKey(i, wrapLonCell(j)))
+		}
+	}
+	return cells
+}
+
+func cellIndex(v float64) int {
+	return int(math.Floor(v / SEARCH_CACHE_CELL))
+}
+
+// keep the longitude cell inside [-180, 180) so both sides of the antimeridian match
+func wrapLonCell(j int) int {
+	n := int(360 / SEARCH_CACHE_CELL)
+	j = (j + n/2) % n
+	if j < 0 {
+		j += n
+	}
+	return j - n/2
+}
+
+func cellKey(i, j int) string {
+	return fmt.Sprintf("search-cell:%d:%d", i, j)
+}
+
+// parseKm reads the "200km" style distance used by the geo distance query
+func parseKm(ran string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(ran, "km"), 64)
+}
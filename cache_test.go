@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrapLonCell(t *testing.T) {
+	tests := []struct {
+		j, want int
+	}{
+		{0, 0},
+		{179, 179},
+		{-180, -180},
+		// past the antimeridian on either side
+		{180, -180},
+		{181, -179},
+		{-181, 179},
+		{359, -1},
+		{540, -180},
+	}
+	for _, tt := range tests {
+		if got := wrapLonCell(tt.j); got != tt.want {
+			t.Errorf("wrapLonCell(%d) = %d, want %d", tt.j, got, tt.want)
+		}
+	}
+}
+
+func TestCellsInRange(t *testing.T) {
+	tests := []struct {
+		name         string
+		lat, lon, km float64
+		want         []string
+	}{
+		{"one cell", -0.2, 10.5, 10, []string{"search-cell:-1:10"}},
+		{"around the origin", 0, 0, 50, []string{
+			"search-cell:-1:-1", "search-cell:-1:0",
+			"search-cell:0:-1", "search-cell:0:0",
+		}},
+		{"over the antimeridian", 0.5, 179.8, 50, []string{"search-cell:0:179", "search-cell:0:-180"}},
+		{"too many cells", 0, 0, 1000, nil},
+		// every longitude is in range at the pole
+		{"at the pole", 90, 0, 10, nil},
+	}
+	for _, tt := range tests {
+		if got := cellsInRange(tt.lat, tt.lon, tt.km); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: cellsInRange(%v, %v, %v) = %v, want %v", tt.name, tt.lat, tt.lon, tt.km, got, tt.want)
+		}
+	}
+}
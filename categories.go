@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// PostCategory is one entry of the taxonomy posts are filed under. Clients get
+// the list from GET /categories, so they don't ship their own copy.
+type PostCategory struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// the taxonomy, ids are stored on posts so they never change. A new one needs
+// nothing but an entry here and its translations.
+var postCategories = []PostCategory{
+	{"food", "Food", "Restaurants, street food, a good meal"},
+	{"event", "Event", "Something happening at a time and place"},
+	{"alert", "Alert", "Road closures, hazards and other warnings"},
+	{"lost_found", "Lost & found", "Things and pets lost or found"},
+	{"sale", "Sale", "Things for sale, yard sales, deals"},
+}
+
+func categoryIds() []string {
+	ids := make([]string, len(postCategories))
+	for i, c := range postCategories {
+		ids[i] = c.Id
+	}
+	return ids
+}
+
+// handlerListCategories answers GET /categories, names and descriptions in
+// the language of the request
+func handlerListCategories(w http.ResponseWriter, r *http.Request) {
+	out := make([]PostCategory, len(postCategories))
+	for i, c := range postCategories {
+		out[i] = PostCategory{Id: c.Id, Name: localize(w, r, c.Name), Description: localize(w, r, c.Description)}
+	}
+	js, _ := json.Marshal(out)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
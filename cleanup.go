@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/TianyiSun2333/Around/blobstore"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// handlerPost uploads the media before it indexes the post, younger objects may
+// belong to a post that is being saved right now
+const CLEANUP_MIN_AGE = time.Hour
+
+// how often the worker deletes the orphans, listing the bucket reads every object
+const CLEANUP_INTERVAL = 24 * time.Hour
+
+// runCleanup implements `around cleanup`: lists the objects in the media bucket
+// that have no post in ES, and deletes them with -delete. Soft deleted posts
+// still own their media until the purger removes both.
+//
+//	around cleanup -delete
+func (srv *Server) runCleanup(args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	del := fs.Bool("delete", false, "delete the orphans instead of only listing them")
+	batch := fs.Int("batch", ARCHIVE_BULK_SIZE, "objects looked up in ES at once")
+	fs.Parse(args)
+
+	scanned, orphans, deleted, err := srv.cleanupOrphans(*del, *batch)
+	if err != nil {
+		return err
+	}
+	if *del {
+		srv.Log.Printf("Scanned %d objects, deleted %d of %d orphans\n", scanned, deleted, orphans)
+	} else {
+		srv.Log.Printf("Scanned %d objects, %d orphans, run with -delete to remove them\n", scanned, orphans)
+	}
+	return nil
+}
+
+// mediaPostID is the post an object of the media bucket belongs to, the media
+// itself or one of its resized images. "" for objects that aren't media.
+func (srv *Server) mediaPostID(name string) string {
+	name = strings.TrimPrefix(name, srv.Names.MediaPrefix)
+	if strings.HasPrefix(name, RESIZED_DIR) {
+		name = strings.TrimPrefix(name, RESIZED_DIR)
+		if i := strings.Index(name, "/"); i > 0 {
+			return name[:i]
+		}
+		return ""
+	}
+	// without a tenant the bucket may hold folders of tenants, they aren't ours
+	if strings.Contains(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// cleanupOrphans looks up the media objects in ES in batches of batch and
+// deletes the ones without a post when del, the cleanup job of the worker.
+// Resized images go with the post they were made of.
+func (srv *Server) cleanupOrphans(del bool, batch int) (scanned, orphans, deleted int, err error) {
+	es_client, err := srv.es()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctx := context.Background()
+
+	indices := []string{srv.Names.PostReadAlias}
+	if srv.Config.ArchiveIndex != "" {
+		indices = append(indices, srv.Config.ArchiveIndex)
+	}
+	cutoff := time.Now().Add(-CLEANUP_MIN_AGE)
+	// posts in a write buffer are in no index yet
+	buffered := srv.bufferedPostIDs()
+	// archived posts only live in the archive bucket then, leave their media alone
+	var archivedBefore time.Time
+	if srv.Config.ArchiveRetention > 0 && srv.Config.ArchiveIndex == "" {
+		archivedBefore = time.Now().Add(-srv.Config.ArchiveRetention)
+	}
+
+	check := func(objs []blobstore.Attrs) error {
+		ids := make([]string, len(objs))
+		for i, o := range objs {
+			ids[i] = srv.mediaPostID(o.Name)
+		}
+		var res *elastic.SearchResult
+		err := esRetry(func() error {
+			var err error
+			res, err = es_client.Search().
+				Index(indices...).
+				Type(TYPE).
+				Query(elastic.NewIdsQuery(TYPE).Ids(ids...)).
+				FetchSource(false).
+				Size(len(ids)).
+				Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		found := map[string]bool{}
+		for _, hit := range res.Hits.Hits {
+			found[hit.Id] = true
+		}
+
+		for _, o := range objs {
+			if id := srv.mediaPostID(o.Name); found[id] || buffered[id] {
+				continue
+			}
+			orphans++
+			if !del {
+				srv.Log.Printf("Orphan %s (%d bytes, %v)\n", o.Name, o.Size, o.Created)
+				continue
+			}
+			if err := srv.Media.Delete(ctx, o.Name); err != nil {
+				srv.Log.Printf("Failed to delete orphan %s %v\n", o.Name, err)
+				continue
+			}
+			deleted++
+			srv.Log.Printf("Deleted orphan %s\n", o.Name)
+		}
+		return nil
+	}
+
+	var pending []blobstore.Attrs
+	// only the media of this tenant
+	err = srv.Media.List(ctx, srv.Names.MediaPrefix, func(attrs blobstore.Attrs) error {
+		if srv.mediaPostID(attrs.Name) == "" {
+			return nil
+		}
+		scanned++
+		if attrs.Created.After(cutoff) || attrs.Created.Before(archivedBefore) {
+			return nil
+		}
+		pending = append(pending, attrs)
+		if len(pending) >= batch {
+			if err := check(pending); err != nil {
+				return err
+			}
+			pending = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return scanned, orphans, deleted, err
+	}
+	if len(pending) > 0 {
+		if err := check(pending); err != nil {
+			return scanned, orphans, deleted, err
+		}
+	}
+	return scanned, orphans, deleted, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is one `around <name>` subcommand. All of them run after loadConfig,
+// so they talk to the same ES, GCS and Bigtable as the server does.
+type command struct {
+	name    string
+	summary string
+	run     func(srv *Server, args []string) error
+}
+
+// filled in init, runHelp lists them and would be an initialization cycle otherwise
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "run the API and the web app, the default", (*Server).runServe},
+		{"migrate", "copy posts into a new index with the current mapping and swap the aliases", (*Server).runMigrate},
+		{"migrate-users", "rewrite user documents in the current schema", (*Server).runMigrateUsers},
+		{"reindex", "backfill the Bigtable post table from ES", (*Server).runReindex},
+		{"cleanup", "find and delete media in GCS that no post refers to", (*Server).runCleanup},
+		{"seed", "create demo users with posts around a place", (*Server).runSeed},
+		{"import", "import posts of a user from GeoJSON or NDJSON", (*Server).runImport},
+		{"badges", "award the badges users earned, what the server does daily", (*Server).runBadges},
+		{"digest", "send the email digests that are due, what the server does hourly", (*Server).runDigest},
+		{"dead-letters", "list, replay or drop the side effects that failed after their retries", (*Server).runDeadLetters},
+		{"worker", "run the background jobs of the server without the API", (*Server).runWorker},
+		{"vapid-keys", "print a new key pair for web push", (*Server).runVAPIDKeys},
+		{"help", "list the commands", func(_ *Server, args []string) error { return runHelp(args) }},
+	}
+}
+
+// runCommand runs the command named by args[0], serve when there is none
+func (srv *Server) runCommand(args []string) error {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(srv, args)
+		}
+	}
+	runHelp(nil)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func runHelp(args []string) error {
+	// flag.Parse stops at the command name, so shared flags go before it
+	fmt.Fprintf(os.Stderr, "usage: around [flags] [command] [command flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\n`around <command> -h` shows the flags of a command.\n\nflags:\n")
+	flag.PrintDefaults()
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_COLLECTION = "collection"
+
+	COLLECTION_MAX_NAME        = 100
+	COLLECTION_MAX_DESCRIPTION = 500
+	COLLECTION_MAX_POSTS       = 500
+	COLLECTION_MAX_PER_USER    = 100
+)
+
+// Collection groups posts of its owner in the order they chose, e.g. the stops
+// of a trip. It is shown to whoever may see the owner's posts.
+type Collection struct {
+	Id          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	PostIDs     []string  `json:"post_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// body of POST and PUT /collections, fields left out of a PUT keep their value
+type collectionRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	PostIDs     *[]string `json:"post_ids"`
+}
+
+type bounds struct {
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	West  float64 `json:"west"`
+}
+
+// collectionView is a collection ready to be drawn: its posts in order, deleted
+// ones left out, and the box that fits them, absent when there are none
+type collectionView struct {
+	Collection Collection `json:"collection"`
+	Posts      []Post     `json:"posts"`
+	Bounds     *bounds    `json:"bounds,omitempty"`
+}
+
+func (srv *Server) queryCollections(q elastic.Query) ([]Collection, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_COLLECTION).
+			Query(q).
+			Sort("created_at", false).
+			Size(COLLECTION_MAX_PER_USER).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	collections := []Collection{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var c Collection
+		if err := json.Unmarshal(*hit.Source, &c); err != nil {
+			srv.Log.Printf("Skipping collection %s %v\n", hit.Id, err)
+			continue
+		}
+		collections = append(collections, c)
+	}
+	return collections, nil
+}
+
+// getCollection reads one collection, nil if there is none with that id
+func (srv *Server) getCollection(id string) (*Collection, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_COLLECTION).Id(id).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var c Collection
+	if err := json.Unmarshal(*res.Source, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (srv *Server) saveCollection(c Collection) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	return esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_COLLECTION).
+			Id(c.Id).
+			BodyJson(c).
+			Refresh(true).
+			Do()
+		return err
+	})
+}
+
+// applyCollection copies the fields set in req to c and checks the result, the
+// posts have to be the owner's own and not deleted
+func (srv *Server) applyCollection(req collectionRequest, c *Collection) ([]fieldError, error) {
+	if req.Name != nil {
+		c.Name = *req.Name
+	}
+	if req.Description != nil {
+		c.Description = *req.Description
+	}
+	if req.PostIDs != nil {
+		c.PostIDs = *req.PostIDs
+	}
+	if c.PostIDs == nil {
+		c.PostIDs = []string{}
+	}
+
+	var errs []fieldError
+	bad := func(name, message string) {
+		errs = append(errs, fieldError{Name: name, In: "body", Message: message})
+	}
+	if n := utf8.RuneCountInString(c.Name); n == 0 || n > COLLECTION_MAX_NAME {
+		bad("name", fmt.Sprintf("must be 1 to %d characters", COLLECTION_MAX_NAME))
+	}
+	if utf8.RuneCountInString(c.Description) > COLLECTION_MAX_DESCRIPTION {
+		bad("description", fmt.Sprintf("must be at most %d characters", COLLECTION_MAX_DESCRIPTION))
+	}
+	if len(c.PostIDs) > COLLECTION_MAX_POSTS {
+		bad("post_ids", fmt.Sprintf("must have at most %d posts", COLLECTION_MAX_POSTS))
+		return errs, nil
+	}
+	seen := map[string]bool{}
+	for _, id := range c.PostIDs {
+		if seen[id] {
+			bad("post_ids", "lists "+id+" twice")
+		}
+		seen[id] = true
+	}
+	if len(errs) > 0 || req.PostIDs == nil || len(c.PostIDs) == 0 {
+		return errs, nil
+	}
+
+	posts, err := srv.postsByID(c.PostIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range c.PostIDs {
+		if p, ok := posts[id]; !ok || p.hidden() || p.User != c.Owner {
+			bad("post_ids", id+" is not one of your posts")
+		}
+	}
+	return errs, nil
+}
+
+// ownCollection loads {id} for its owner, answering 404 to everybody else
+func (srv *Server) ownCollection(w http.ResponseWriter, r *http.Request) (*Collection, bool) {
+	c, err := srv.getCollection(mux.Vars(r)["id"])
+	if err != nil {
+		writeBackendError(w, r, "Failed to read collection", err)
+		return nil, false
+	}
+	if c == nil || c.Owner != usernameFromToken(r) {
+		writeError(w, r, http.StatusNotFound, "Collection not found")
+		return nil, false
+	}
+	return c, true
+}
+
+// handlerCreateCollection makes a collection of the caller's posts
+//
+//	POST /collections {"name":"Japan trip","post_ids":[...]}
+func (srv *Server) handlerCreateCollection(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req collectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode collection")
+		return
+	}
+	existing, err := srv.queryCollections(elastic.NewTermQuery("owner", username))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read collections", err)
+		return
+	}
+	if len(existing) >= COLLECTION_MAX_PER_USER {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("At most %d collections per user", COLLECTION_MAX_PER_USER))
+		return
+	}
+
+	now := time.Now().UTC()
+	c := Collection{Id: newPostID(now), Owner: username, CreatedAt: now, UpdatedAt: now}
+	errs, err := srv.applyCollection(req, &c)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read posts", err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+	if err := srv.saveCollection(c); err != nil {
+		writeBackendError(w, r, "Failed to save collection", err)
+		return
+	}
+	srv.Log.Printf("Collection %s created by %s with %d posts\n", c.Id, username, len(c.PostIDs))
+	writeCollection(w, http.StatusCreated, c)
+}
+
+// handlerListCollections lists the collections of ?user=, the caller by default, newest first
+func (srv *Server) handlerListCollections(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	owner := r.URL.Query().Get("user")
+	if owner == "" {
+		owner = viewer
+	}
+	collections := []Collection{}
+	if srv.canSee(viewer, owner) {
+		var err error
+		collections, err = srv.queryCollections(elastic.NewTermQuery("owner", owner))
+		if err != nil {
+			writeBackendError(w, r, "Failed to read collections", err)
+			return
+		}
+	}
+	js, _ := json.Marshal(collections)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerGetCollection renders a collection with its posts in order and the
+// bounds to fit the map to
+//
+//	GET /collections/{id}
+func (srv *Server) handlerGetCollection(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	c, err := srv.getCollection(mux.Vars(r)["id"])
+	if err != nil {
+		writeBackendError(w, r, "Failed to read collection", err)
+		return
+	}
+	// the posts of a private account are as missing as its collections
+	if c == nil || !srv.canSee(viewer, c.Owner) {
+		writeError(w, r, http.StatusNotFound, "Collection not found")
+		return
+	}
+
+	view := collectionView{Collection: *c, Posts: []Post{}}
+	if len(c.PostIDs) > 0 {
+		posts, err := srv.postsByID(c.PostIDs)
+		if err != nil {
+			writeBackendError(w, r, "Failed to read posts", err)
+			return
+		}
+		for _, id := range c.PostIDs {
+			// deleted after they were added
+			if p, ok := posts[id]; ok && p.DeletedAt == nil {
+				view.Posts = append(view.Posts, p)
+			}
+		}
+	}
+	view.Posts = srv.withQuotes(viewer, view.Posts)
+	view.Bounds = boundsOf(view.Posts)
+
+	js, _ := json.Marshal(view)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerUpdateCollection renames a collection or changes its posts and their
+// order, post_ids replaces the whole list
+//
+//	PUT /collections/{id}
+func (srv *Server) handlerUpdateCollection(w http.ResponseWriter, r *http.Request) {
+	var req collectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode collection")
+		return
+	}
+	c, ok := srv.ownCollection(w, r)
+	if !ok {
+		return
+	}
+	errs, err := srv.applyCollection(req, c)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read posts", err)
+		return
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+	c.UpdatedAt = time.Now().UTC()
+	if err := srv.saveCollection(*c); err != nil {
+		writeBackendError(w, r, "Failed to save collection", err)
+		return
+	}
+	writeCollection(w, http.StatusOK, *c)
+}
+
+// handlerDeleteCollection deletes the collection, not its posts
+func (srv *Server) handlerDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	c, ok := srv.ownCollection(w, r)
+	if !ok {
+		return
+	}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_COLLECTION).Id(c.Id).Refresh(true).Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to delete collection", err)
+		return
+	}
+	srv.Log.Printf("Collection %s deleted by %s\n", c.Id, c.Owner)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// boundsOf is the smallest box around the posts, nil without posts.
+// It doesn't try to wrap the antimeridian.
+func boundsOf(ps []Post) *bounds {
+	if len(ps) == 0 {
+		return nil
+	}
+	b := &bounds{North: -90, South: 90, East: -180, West: 180}
+	for _, p := range ps {
+		b.North = math.Max(b.North, p.Location.Lat)
+		b.South = math.Min(b.South, p.Location.Lat)
+		b.East = math.Max(b.East, p.Location.Lon)
+		b.West = math.Min(b.West, p.Location.Lon)
+	}
+	return b
+}
+
+func writeCollection(w http.ResponseWriter, status int, c Collection) {
+	js, _ := json.Marshal(c)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// responses smaller than this are not worth the CPU and the gzip header
+const COMPRESS_MIN_SIZE = 1024
+
+// gzip and deflate writers are big, reuse them between requests
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// compressMiddleware compresses responses with gzip or deflate, whichever the
+// client prefers in Accept-Encoding. Media that is already compressed (images,
+// video, archives) and responses that set their own Content-Encoding pass through.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		// a websocket upgrade needs the bare connection
+		if encoding == "" || r.Method == "HEAD" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+		// not deferred: after a panic nothing must be sent, so that
+		// recoveryMiddleware can still answer 500
+		cw.Close()
+	})
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, ties
+// go to gzip. q=0 means the client refuses that encoding.
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, q := parseQValue(part)
+		if name == "*" {
+			name = "gzip"
+		}
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+func parseQValue(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	name := strings.ToLower(strings.TrimSpace(fields[0]))
+	q := 1.0
+	for _, f := range fields[1:] {
+		f = strings.TrimSpace(f)
+		if strings.HasPrefix(f, "q=") {
+			if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return name, q
+}
+
+// isCompressedType reports media types that gain nothing from another round of compression
+func isCompressedType(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.TrimSpace(ct)
+	if strings.HasPrefix(ct, "image/") && ct != "image/svg+xml" {
+		return true
+	}
+	if strings.HasPrefix(ct, "video/") || strings.HasPrefix(ct, "audio/") {
+		return true
+	}
+	switch ct {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/octet-stream", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the decision to compress until the handler has set
+// its headers and written enough bytes to know whether it pays off.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	// set once headers went out, either compressed (enc != nil) or plain
+	started bool
+	enc     io.WriteCloser
+	buf     []byte
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.started {
+		return
+	}
+	c.status = code
+	// no body, or a body that is not ours to touch: decide right now
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		c.Header().Get("Content-Encoding") != "" || isCompressedType(c.Header().Get("Content-Type")) {
+		c.start(false)
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.started {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		if c.Header().Get("Content-Encoding") != "" || isCompressedType(c.Header().Get("Content-Type")) {
+			c.start(false)
+		} else {
+			c.buf = append(c.buf, b...)
+			if len(c.buf) < COMPRESS_MIN_SIZE {
+				return len(b), nil
+			}
+			c.start(true)
+			return len(b), nil
+		}
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// start sends the headers and whatever was buffered so far
+func (c *compressWriter) start(compress bool) {
+	c.started = true
+	if compress {
+		h := c.Header()
+		h.Set("Content-Encoding", c.encoding)
+		// length of the uncompressed body, wrong after compression
+		h.Del("Content-Length")
+		// a strong ETag must change with the encoding
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		c.ResponseWriter.WriteHeader(c.status)
+		if c.encoding == "gzip" {
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(c.ResponseWriter)
+			c.enc = gz
+		} else {
+			fl := flateWriters.Get().(*flate.Writer)
+			fl.Reset(c.ResponseWriter)
+			c.enc = fl
+		}
+	} else {
+		c.ResponseWriter.WriteHeader(c.status)
+	}
+	if len(c.buf) > 0 {
+		if c.enc != nil {
+			c.enc.Write(c.buf)
+		} else {
+			c.ResponseWriter.Write(c.buf)
+		}
+		c.buf = nil
+	}
+}
+
+// Flush is needed by streaming handlers like /export, whatever was written is
+// compressed and pushed to the client right away.
+func (c *compressWriter) Flush() {
+	if !c.started {
+		c.start(len(c.buf) > 0)
+	}
+	switch enc := c.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *flate.Writer:
+		enc.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close ends the compressed stream, a small response that never reached
+// COMPRESS_MIN_SIZE is sent as is.
+func (c *compressWriter) Close() {
+	if !c.started {
+		c.start(false)
+	}
+	if c.enc == nil {
+		return
+	}
+	c.enc.Close()
+	switch enc := c.enc.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(enc)
+	case *flate.Writer:
+		flateWriters.Put(enc)
+	}
+	c.enc = nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the in-memory cooldowns without redis forget everything past this many accounts
+const POST_COOLDOWN_LOCAL_MAX = 100000
+
+// when redis is not setup, per instance like the rate limit counters
+type localCooldowns struct {
+	sync.Mutex
+	last map[string]time.Time
+	day  string
+	// posts per user on day
+	counts map[string]int
+}
+
+// checkPostCooldown takes a post of username against config.PostInterval and
+// config.PostDailyCap. ok is false when the account has to wait until retry,
+// daily tells it is the cap and not the interval. Admins are exempt. The post
+// counts once it is let through, a failed save still uses up its slot.
+func (srv *Server) checkPostCooldown(username string, now time.Time) (retry time.Time, daily, ok bool, err error) {
+	interval, limit := srv.Config.PostInterval, srv.Config.PostDailyCap
+	if (interval <= 0 && limit <= 0) || srv.isAdmin(username) {
+		return time.Time{}, false, true, nil
+	}
+	now = now.UTC()
+	day := now.Format(DAY_FORMAT)
+	midnight := now.Truncate(24*time.Hour).AddDate(0, 0, 1)
+
+	if srv.Redis != nil {
+		if interval > 0 {
+			key := "around:post:last:" + username
+			set, err := srv.Redis.SetNX(key, now.Unix(), interval).Result()
+			if err != nil {
+				return time.Time{}, false, false, err
+			}
+			if !set {
+				left, err := srv.Redis.PTTL(key).Result()
+				if err != nil {
+					return time.Time{}, false, false, err
+				}
+				return now.Add(left), false, false, nil
+			}
+		}
+		if limit > 0 {
+			// the interval was checked first, a post it refuses doesn't count here
+			key := "around:post:day:" + username + ":" + day
+			pipe := srv.Redis.TxPipeline()
+			incr := pipe.Incr(key)
+			pipe.Expire(key, 25*time.Hour)
+			if _, err := pipe.Exec(); err != nil {
+				return time.Time{}, false, false, err
+			}
+			if incr.Val() > int64(limit) {
+				return midnight, true, false, nil
+			}
+		}
+		return time.Time{}, false, true, nil
+	}
+
+	c := &srv.postCooldownLocal
+	c.Lock()
+	defer c.Unlock()
+	if c.day != day || len(c.counts) >= POST_COOLDOWN_LOCAL_MAX || len(c.last) >= POST_COOLDOWN_LOCAL_MAX {
+		c.day = day
+		c.counts = map[string]int{}
+		c.last = map[string]time.Time{}
+	}
+	if last, ok := c.last[username]; ok && interval > 0 && now.Sub(last) < interval {
+		return last.Add(interval), false, false, nil
+	}
+	if limit > 0 && c.counts[username] >= limit {
+		return midnight, true, false, nil
+	}
+	c.last[username] = now
+	c.counts[username]++
+	return time.Time{}, false, true, nil
+}
+
+// postCooldown answers 429 with Retry-After when username has to wait before
+// posting again, false then and the handler is done
+func (srv *Server) postCooldown(w http.ResponseWriter, r *http.Request, username string) bool {
+	now := time.Now()
+	retry, daily, ok, err := srv.checkPostCooldown(username, now)
+	if err != nil {
+		// like the rate limiter, a cooldown that is down lets posts through
+		srv.Log.Printf("[%s] Post cooldown failed, post let through %v\n", requestID(r), err)
+		return true
+	}
+	if ok {
+		return true
+	}
+	// rounded up, a client retrying after 0 seconds would just be refused again
+	wait := int64((retry.Sub(now) + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+	srv.Log.Printf("Post of %s refused until %s\n", username, retry.UTC().Format(time.RFC3339))
+	msg := fmt.Sprintf("Posting too often, retry in %ds", wait)
+	if daily {
+		msg = fmt.Sprintf("Daily limit of %d posts reached, retry in %ds", srv.Config.PostDailyCap, wait)
+	}
+	writeError(w, r, http.StatusTooManyRequests, msg)
+	return false
+}
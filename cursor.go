@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// bumped when what a cursor holds changes, older cursors are refused and the
+// client starts over from the first page
+const CURSOR_VERSION = 1
+
+// pageCursor is where the next page of a search starts. Clients get it signed
+// and base64 encoded as next_cursor and send it back as ?cursor=, they can't
+// read or change it, so the sort keys behind it are free to change.
+//
+// ES can't search_after in this version, so the cursor seeks: the next page
+// has the posts created at or before After, minus the ones already returned
+// that were created in that same millisecond.
+type pageCursor struct {
+	V int `json:"v"`
+	// the search the cursor belongs to, see searchCacheKey
+	Query string `json:"q"`
+	// created_at of the last post, unix milliseconds
+	After int64 `json:"a"`
+	// ids of the posts created at After that were returned
+	Skip []string `json:"s,omitempty"`
+	// total of the first page, the seek leaves out what came before
+	Total int64 `json:"t"`
+}
+
+func (srv *Server) cursorMAC(payload string) string {
+	mac := hmac.New(sha256.New, srv.Tokens.Key)
+	mac.Write([]byte("cursor:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeCursor is c as the client sees it, payload.signature
+func (srv *Server) encodeCursor(c pageCursor) string {
+	c.V = CURSOR_VERSION
+	js, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + srv.cursorMAC(payload)
+}
+
+// decodeCursor checks s was made by encodeCursor for query
+func (srv *Server) decodeCursor(s, query string) (*pageCursor, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(srv.cursorMAC(parts[0]))) {
+		return nil, fmt.Errorf("is not a cursor this server made")
+	}
+	js, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("is not a cursor this server made")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(js, &c); err != nil {
+		return nil, fmt.Errorf("is not a cursor this server made")
+	}
+	if c.V != CURSOR_VERSION {
+		return nil, fmt.Errorf("is from an older version, start again from the first page")
+	}
+	if c.Query != query {
+		return nil, fmt.Errorf("belongs to another search")
+	}
+	return &c, nil
+}
+
+// nextCursor is the cursor after ps, newest first, "" when ps is the last
+// page. ps are the posts ES returned, before any are hidden from the caller,
+// so hidden ones don't end the paging early. after is the cursor of ps, the
+// first page only has the total in it.
+func (srv *Server) nextCursor(query string, ps []Post, size int, after *pageCursor) string {
+	if len(ps) < size || len(ps) == 0 {
+		return ""
+	}
+	last := ps[len(ps)-1].CreatedAt.UnixNano() / 1e6
+	c := pageCursor{Query: query, After: last, Total: after.Total}
+	// a run of posts in the same millisecond can span pages
+	if after.Query != "" && after.After == last {
+		c.Skip = append(c.Skip, after.Skip...)
+	}
+	for _, p := range ps {
+		if p.CreatedAt.UnixNano()/1e6 == last {
+			c.Skip = append(c.Skip, p.Id)
+		}
+	}
+	return srv.encodeCursor(c)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TianyiSun2333/Around/auth"
+)
+
+func cursorServer(key string) *Server {
+	return &Server{Tokens: &auth.Tokens{Key: []byte(key)}}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	srv := cursorServer("secret")
+	c := pageCursor{Query: "q", After: 1530403200000, Skip: []string{"a"}, Total: 42}
+	signed := srv.encodeCursor(c)
+	old := func() string {
+		js, _ := json.Marshal(pageCursor{V: CURSOR_VERSION - 1, Query: "q"})
+		payload := base64.RawURLEncoding.EncodeToString(js)
+		return payload + "." + srv.cursorMAC(payload)
+	}()
+	garbage := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+
+	tests := []struct {
+		name    string
+		cursor  string
+		query   string
+		wantErr bool
+	}{
+		{"round trip", signed, "q", false},
+		{"other search", signed, "other", true},
+		{"other key", cursorServer("other").encodeCursor(c), "q", true},
+		{"changed signature", signed + "x", "q", true},
+		{"no signature", signed[:len(signed)-len(srv.cursorMAC(""))-1], "q", true},
+		{"empty", "", "q", true},
+		{"too many parts", signed + ".x", "q", true},
+		{"not json", garbage + "." + srv.cursorMAC(garbage), "q", true},
+		{"older version", old, "q", true},
+	}
+	for _, tt := range tests {
+		got, err := srv.decodeCursor(tt.cursor, tt.query)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: decodeCursor = %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: decodeCursor: %v", tt.name, err)
+			continue
+		}
+		want := c
+		want.V = CURSOR_VERSION
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("%s: decodeCursor = %+v, want %+v", tt.name, *got, want)
+		}
+	}
+}
+
+func TestNextCursor(t *testing.T) {
+	srv := cursorServer("secret")
+	t0 := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	ms := t0.UnixNano() / 1e6
+	post := func(id string, millis int64) Post {
+		return Post{Id: id, CreatedAt: t0.Add(time.Duration(millis) * time.Millisecond)}
+	}
+	page := []Post{post("c", 3), post("b", 2), post("a", 2)}
+
+	tests := []struct {
+		name  string
+		ps    []Post
+		size  int
+		after pageCursor
+		// nil when there is no next page
+		want *pageCursor
+	}{
+		{"empty", nil, 3, pageCursor{}, nil},
+		{"last page", page[:2], 3, pageCursor{}, nil},
+		{"first page", page, 3, pageCursor{Total: 10},
+			&pageCursor{Query: "q", After: ms + 2, Skip: []string{"b", "a"}, Total: 10}},
+		{"a run over the page", []Post{post("e", 2), post("d", 2)}, 2, pageCursor{Query: "q", After: ms + 2, Skip: []string{"b", "a"}, Total: 10},
+			&pageCursor{Query: "q", After: ms + 2, Skip: []string{"b", "a", "e", "d"}, Total: 10}},
+		{"a run ended", []Post{post("e", 1), post("d", 0)}, 2, pageCursor{Query: "q", After: ms + 2, Skip: []string{"b", "a"}, Total: 10},
+			&pageCursor{Query: "q", After: ms, Skip: []string{"d"}, Total: 10}},
+	}
+	for _, tt := range tests {
+		after := tt.after
+		got := srv.nextCursor("q", tt.ps, tt.size, &after)
+		if tt.want == nil {
+			if got != "" {
+				t.Errorf("%s: nextCursor = %q, want none", tt.name, got)
+			}
+			continue
+		}
+		c, err := srv.decodeCursor(got, "q")
+		if err != nil {
+			t.Errorf("%s: decodeCursor(nextCursor): %v", tt.name, err)
+			continue
+		}
+		want := *tt.want
+		want.V = CURSOR_VERSION
+		if !reflect.DeepEqual(*c, want) {
+			t.Errorf("%s: nextCursor = %+v, want %+v", tt.name, *c, want)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/mux"
+)
+
+// the dead letters of every instance, a hash of id to entry
+const DEAD_LETTER_KEY = "around:dead-letters"
+
+// DeadLetter is a side effect that failed after its retries, kept with what
+// it needs to be done again. An admin looks at them and replays or drops them.
+type DeadLetter struct {
+	Id      string          `json:"id"`
+	Op      string          `json:"op"`
+	Payload json.RawMessage `json:"payload"`
+	Error   string          `json:"error"`
+	// 1 for the original try, one more per failed replay
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// the payload of the ops about one post, they read the post again when they
+// are replayed so a replay doesn't undo a later edit
+type deadLetterPost struct {
+	Id string `json:"id"`
+}
+
+// deadLetterOps redo the operations by their op. Each one is safe to run
+// again, a replay may follow a try that did go through after all.
+var deadLetterOps = map[string]func(srv *Server, payload json.RawMessage) error{
+	// the search backend copy of a post, see syncSearch
+	"search.sync": func(srv *Server, payload json.RawMessage) error {
+		var d deadLetterPost
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return err
+		}
+		ix, ok := srv.Search.(search.Indexer)
+		if !ok {
+			return nil
+		}
+		p, err := srv.deadLetterPost(d.Id)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return ix.Remove(d.Id)
+		}
+		return ix.Put(searchDoc(*p))
+	},
+	// the analytics copy of a post in Bigtable, see runReindex
+	"bigtable.post": func(srv *Server, payload json.RawMessage) error {
+		var d deadLetterPost
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return err
+		}
+		p, err := srv.deadLetterPost(d.Id)
+		if err != nil || p == nil {
+			return err
+		}
+		return srv.Tables.Apply(context.Background(), srv.Names.PostTable, d.Id, postMutation(*p))
+	},
+	// a buffered post ES refused, after the cause is fixed
+	"es.post": func(srv *Server, payload json.RawMessage) error {
+		var b bufferedPost
+		if err := json.Unmarshal(payload, &b); err != nil {
+			return err
+		}
+		if err := srv.saveToES(&b.Post, b.Id); err != nil {
+			return err
+		}
+		srv.postSaved(b.Post)
+		return nil
+	},
+	// what a user has under their previous name, see moveUserDataLater
+	"username.move": func(srv *Server, payload json.RawMessage) error {
+		var d deadLetterRename
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return err
+		}
+		return srv.moveUserData(d.Old, d.Name)
+	},
+	// the face score of an uploaded jpeg, see handlerPost
+	"moderation.face": func(srv *Server, payload json.RawMessage) error {
+		var d deadLetterPost
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return err
+		}
+		client, err := srv.es()
+		if err != nil {
+			return err
+		}
+		hit, p, err := srv.findPost(client, d.Id)
+		if err != nil || p == nil {
+			return err
+		}
+		ctx := context.Background()
+		obj, err := srv.Media.Open(ctx, srv.Names.MediaPrefix+d.Id)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+		score, err := srv.Classifier.FaceScore(ctx, obj)
+		if err != nil {
+			return err
+		}
+		return esRetry(func() error {
+			_, err := client.Update().
+				Index(hit.Index).
+				Type(TYPE).
+				Id(hit.Id).
+				Doc(map[string]interface{}{"face": score}).
+				Do()
+			return err
+		})
+	},
+}
+
+// deadLetterPost reads post id for a replay, nil when it is gone or deleted
+// and there is nothing left to do for it
+func (srv *Server) deadLetterPost(id string) (*Post, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	_, p, err := srv.findPost(client, id)
+	if err != nil || p == nil || p.DeletedAt != nil {
+		return nil, err
+	}
+	// hits of old posts may lack the id
+	p.Id = id
+	return p, nil
+}
+
+// deadLetter keeps the failed operation op with its payload. In redis for all
+// instances to see, without redis in the dead_letters directory of this one.
+// A dead letter that can't be kept is only logged like before.
+func (srv *Server) deadLetter(op string, payload interface{}, cause error) {
+	js, err := json.Marshal(payload)
+	if err == nil {
+		now := time.Now().UTC()
+		err = srv.saveDeadLetter(&DeadLetter{
+			Id:        newPostID(now),
+			Op:        op,
+			Payload:   js,
+			Error:     cause.Error(),
+			Attempts:  1,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	}
+	if err != nil {
+		srv.Log.Printf("Failed to keep dead letter %s %s %v, it failed with %v\n", op, js, err, cause)
+		return
+	}
+	srv.Log.Printf("Dead letter %s %s %v\n", op, js, cause)
+}
+
+func (srv *Server) saveDeadLetter(d *DeadLetter) error {
+	js, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if srv.Redis != nil {
+		return srv.Redis.HSet(DEAD_LETTER_KEY, d.Id, js).Err()
+	}
+	if err := os.MkdirAll(srv.Config.DeadLetters, 0700); err != nil {
+		return err
+	}
+	// rename over the old one, a crash leaves one of them whole
+	tmp := filepath.Join(srv.Config.DeadLetters, "."+d.Id+".tmp")
+	if err := ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(srv.Config.DeadLetters, d.Id+".json"))
+}
+
+// listDeadLetters returns the dead letters of op, all with "", oldest first
+func (srv *Server) listDeadLetters(op string) ([]DeadLetter, error) {
+	var raw []string
+	if srv.Redis != nil {
+		m, err := srv.Redis.HGetAll(DEAD_LETTER_KEY).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range m {
+			raw = append(raw, v)
+		}
+	} else {
+		names, _ := filepath.Glob(filepath.Join(srv.Config.DeadLetters, "*.json"))
+		for _, name := range names {
+			js, err := ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, string(js))
+		}
+	}
+	out := []DeadLetter{}
+	for _, js := range raw {
+		var d DeadLetter
+		if err := json.Unmarshal([]byte(js), &d); err != nil {
+			continue
+		}
+		if op == "" || d.Op == op {
+			out = append(out, d)
+		}
+	}
+	// ids are time ordered
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out, nil
+}
+
+// getDeadLetter returns the dead letter id, nil when there is none
+func (srv *Server) getDeadLetter(id string) (*DeadLetter, error) {
+	var js []byte
+	if srv.Redis != nil {
+		v, err := srv.Redis.HGet(DEAD_LETTER_KEY, id).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		js = []byte(v)
+	} else {
+		var err error
+		js, err = ioutil.ReadFile(filepath.Join(srv.Config.DeadLetters, filepath.Base(id)+".json"))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var d DeadLetter
+	if err := json.Unmarshal(js, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (srv *Server) removeDeadLetter(id string) error {
+	if srv.Redis != nil {
+		return srv.Redis.HDel(DEAD_LETTER_KEY, id).Err()
+	}
+	err := os.Remove(filepath.Join(srv.Config.DeadLetters, filepath.Base(id)+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// replayDeadLetter runs d again, removes it when that went through and keeps
+// it with the new error otherwise
+func (srv *Server) replayDeadLetter(d *DeadLetter) error {
+	run, ok := deadLetterOps[d.Op]
+	if !ok {
+		return fmt.Errorf("unknown op %q", d.Op)
+	}
+	if err := run(srv, d.Payload); err != nil {
+		d.Attempts++
+		d.Error = err.Error()
+		d.UpdatedAt = time.Now().UTC()
+		if serr := srv.saveDeadLetter(d); serr != nil {
+			srv.Log.Printf("Failed to update dead letter %s %v\n", d.Id, serr)
+		}
+		return err
+	}
+	srv.Log.Printf("Replayed dead letter %s %s after %d attempts\n", d.Id, d.Op, d.Attempts)
+	return srv.removeDeadLetter(d.Id)
+}
+
+// handlerDeadLetters lists the dead letters for admins
+//
+//	GET /admin/dead-letters?op=search.sync
+func (srv *Server) handlerDeadLetters(w http.ResponseWriter, r *http.Request) {
+	list, err := srv.listDeadLetters(r.URL.Query().Get("op"))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read dead letters", err)
+		return
+	}
+	js, _ := json.Marshal(list)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerReplayDeadLetter runs a dead letter again, 204 when it went through
+// and it is gone
+//
+//	POST /admin/dead-letters/{id}/replay
+func (srv *Server) handlerReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	d, err := srv.getDeadLetter(mux.Vars(r)["id"])
+	if err != nil {
+		writeBackendError(w, r, "Failed to read dead letters", err)
+		return
+	}
+	if d == nil {
+		writeError(w, r, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	// a failed one is kept with the new error
+	if err := srv.replayDeadLetter(d); err != nil {
+		writeBackendError(w, r, "Replay failed", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerDropDeadLetter removes a dead letter without running it
+//
+//	DELETE /admin/dead-letters/{id}
+func (srv *Server) handlerDropDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	d, err := srv.getDeadLetter(id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read dead letters", err)
+		return
+	}
+	if d == nil {
+		writeError(w, r, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	if err := srv.removeDeadLetter(id); err != nil {
+		writeBackendError(w, r, "Failed to drop dead letter", err)
+		return
+	}
+	srv.Log.Printf("Dropped dead letter %s %s %s\n", d.Id, d.Op, d.Payload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runDeadLetters implements `around dead-letters`: lists them, or replays or
+// drops them with -replay and -drop. -id picks one, -op those of an op.
+//
+//	around dead-letters -op search.sync -replay
+func (srv *Server) runDeadLetters(args []string) error {
+	fs := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	op := fs.String("op", "", "only the dead letters of this op")
+	id := fs.String("id", "", "only this dead letter")
+	replay := fs.Bool("replay", false, "run them again, the ones that go through are removed")
+	drop := fs.Bool("drop", false, "remove them without running them")
+	fs.Parse(args)
+	if *replay && *drop {
+		return fmt.Errorf("-replay or -drop, not both")
+	}
+	srv.initSearchCache()
+
+	list, err := srv.listDeadLetters(*op)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i := range list {
+		d := &list[i]
+		if *id != "" && d.Id != *id {
+			continue
+		}
+		switch {
+		case *replay:
+			if err := srv.replayDeadLetter(d); err != nil {
+				srv.Log.Printf("Failed to replay dead letter %s %v\n", d.Id, err)
+				failed++
+			}
+		case *drop:
+			if err := srv.removeDeadLetter(d.Id); err != nil {
+				return err
+			}
+			srv.Log.Printf("Dropped dead letter %s %s %s\n", d.Id, d.Op, d.Payload)
+		default:
+			fmt.Printf("%s %s %s attempts=%d %s\n", d.Id, d.Op, d.Payload, d.Attempts, d.Error)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d dead letters failed again", failed)
+	}
+	return nil
+}
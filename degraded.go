@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/TianyiSun2333/Around/blobstore"
+)
+
+// the backends the server runs without when they are in the config's without:
+//
+//	without: [bigtable, moderation, gcs]
+//
+// bigtable: no analytics copy of the posts, the moderation log only goes to
+// the process log. moderation: uploaded images aren't scored. gcs: text-only
+// posts, uploads are refused and there is no archival. For local development
+// and for riding out an outage of one of them.
+var OPTIONAL_BACKENDS = []string{"bigtable", "moderation", "gcs"}
+
+// how long /readyz waits for ES and redis
+const READY_TIMEOUT = 2 * time.Second
+
+// without tells if the config turned off the backend name of OPTIONAL_BACKENDS
+func (srv *Server) without(name string) bool {
+	return contains(srv.Config.Without, name)
+}
+
+// DisabledError is the error of a backend the config turned off
+type DisabledError struct {
+	Name string
+}
+
+func (e *DisabledError) Error() string {
+	return e.Name + " is turned off in this deployment"
+}
+
+// noMedia is the blobstore without gcs, posts have no media
+type noMedia struct{}
+
+func (noMedia) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	return "", &DisabledError{Name: "gcs"}
+}
+
+func (noMedia) Open(ctx context.Context, name string) (*blobstore.Object, error) {
+	return nil, blobstore.ErrNotExist
+}
+
+// nothing was put, nothing is left to delete
+func (noMedia) Delete(ctx context.Context, name string) error {
+	return nil
+}
+
+func (noMedia) List(ctx context.Context, prefix string, fn func(blobstore.Attrs) error) error {
+	return nil
+}
+
+func (noMedia) Create(ctx context.Context, name string, opts blobstore.WriteOptions) (io.WriteCloser, error) {
+	return nil, &DisabledError{Name: "gcs"}
+}
+
+// noTables is the bigtablestore without bigtable, writes are dropped and
+// reads are errors, an empty moderation history would be a lie
+type noTables struct{}
+
+func (noTables) Apply(ctx context.Context, table, row string, mut *bigtable.Mutation) error {
+	return nil
+}
+
+func (noTables) Insert(ctx context.Context, table, row string, mut *bigtable.Mutation) (bool, error) {
+	return true, nil
+}
+
+func (noTables) ApplyBulk(ctx context.Context, table string, rows []string, muts []*bigtable.Mutation) ([]error, error) {
+	return nil, nil
+}
+
+func (noTables) ReadPrefix(ctx context.Context, table, prefix string, limit int) ([]bigtable.Row, error) {
+	return nil, &DisabledError{Name: "bigtable"}
+}
+
+// noClassifier is the moderation without the ML engine
+type noClassifier struct{}
+
+func (noClassifier) FaceScore(ctx context.Context, r io.Reader) (float64, error) {
+	return 0, &DisabledError{Name: "moderation"}
+}
+
+// readiness is the answer of /readyz. Each dependency is "up", "down" or
+// "off". Status is "ok", "degraded" when an optional one is down or off, and
+// "unavailable" without ES, nothing works then.
+type readiness struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// handlerReady is for the readiness probe of the load balancer:
+//
+//	GET /readyz
+//
+// 503 only when ES can't be reached, a degraded instance still serves. ES and
+// redis are asked, the others go by their circuit breaker so a probe doesn't
+// cost a call to each of them.
+func (srv *Server) handlerReady(w http.ResponseWriter, r *http.Request) {
+	res := readiness{Status: "ok", Dependencies: map[string]string{}}
+	state := func(up bool) string {
+		if up {
+			return "up"
+		}
+		return "down"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), READY_TIMEOUT)
+	defer cancel()
+	esUp := make(chan bool, 1)
+	go func() {
+		client, err := srv.es()
+		if err == nil {
+			_, err = client.ClusterHealth().Do()
+		}
+		esUp <- err == nil
+	}()
+	select {
+	case up := <-esUp:
+		res.Dependencies["elasticsearch"] = state(up)
+	case <-ctx.Done():
+		res.Dependencies["elasticsearch"] = "down"
+	}
+	res.Dependencies["redis"] = state(srv.Redis != nil && srv.Redis.Ping().Err() == nil)
+
+	breakers := map[string]*circuitBreaker{"gcs": gcsBreaker, "bigtable": btBreaker, "moderation": mlBreaker}
+	for _, name := range OPTIONAL_BACKENDS {
+		if srv.without(name) {
+			res.Dependencies[name] = "off"
+		} else {
+			res.Dependencies[name] = state(!breakers[name].isOpen())
+		}
+	}
+
+	for _, s := range res.Dependencies {
+		if s != "up" {
+			res.Status = "degraded"
+		}
+	}
+	status := http.StatusOK
+	if res.Dependencies["elasticsearch"] != "up" {
+		res.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	js, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(js)
+}
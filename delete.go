@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/TianyiSun2333/Around/blobstore"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const PURGE_INTERVAL = 24 * time.Hour
+
+// notDeleted matches posts that are not soft deleted and not waiting for
+// their publish_at, every post query has to include it
+func notDeleted() elastic.Query {
+	return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("deleted_at"), elastic.NewExistsQuery("publish_at"))
+}
+
+// findPost looks a post up by id through the read alias, the hit tells which
+// monthly index it lives in. Soft deleted posts are returned too.
+func (srv *Server) findPost(client *elastic.Client, id string) (*elastic.SearchHit, *Post, error) {
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(elastic.NewIdsQuery(TYPE).Ids(id)).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.Hits == nil || len(res.Hits.Hits) == 0 || res.Hits.Hits[0].Source == nil {
+		return nil, nil, nil
+	}
+
+	hit := res.Hits.Hits[0]
+	var p Post
+	if err := json.Unmarshal(*hit.Source, &p); err != nil {
+		return nil, nil, err
+	}
+	return hit, &p, nil
+}
+
+// setDeletedAt updates deleted_at of the post in its concrete index, nil restores it
+func setDeletedAt(client *elastic.Client, hit *elastic.SearchHit, t *time.Time) error {
+	return esRetry(func() error {
+		_, err := client.Update().
+			Index(hit.Index).
+			Type(TYPE).
+			Id(hit.Id).
+			Doc(map[string]interface{}{"deleted_at": t}).
+			Refresh(true).
+			Do()
+		return err
+	})
+}
+
+// handlerDelete soft deletes a post of the caller, it disappears from every query
+// but can be restored within the restore window. The purge job takes it out of
+// ES, GCS and Bigtable after that, see purgeDeletedPosts. With permanent=true
+// it is taken out of all three right away, a soft deleted one too.
+func (srv *Server) handlerDelete(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	srv.Log.Printf("Received one request to delete post %s\n", id)
+
+	client, hit, p, ok := srv.ownPost(w, r, id)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("permanent") == "true" {
+		// the document goes last, a failed purge can be retried
+		if err := srv.purgePostData(requestContext(r), id); err != nil {
+			writeBackendError(w, r, "Failed to delete the media or Bigtable row of the post", err)
+			return
+		}
+		err := esRetry(func() error {
+			_, err := client.Delete().Index(hit.Index).Type(TYPE).Id(hit.Id).Refresh(true).Do()
+			return err
+		})
+		if err != nil && !elastic.IsNotFound(err) {
+			writeError(w, r, statusForError(err), "Failed to delete post")
+			srv.Log.Printf("Failed to delete post %s %v\n", id, err)
+			return
+		}
+		srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+		srv.unindexPost(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if p.DeletedAt != nil {
+		// deleting twice is fine, keep the first timestamp
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	now := time.Now().UTC()
+	if err := setDeletedAt(client, hit, &now); err != nil {
+		writeError(w, r, statusForError(err), "Failed to delete post")
+		srv.Log.Printf("Failed to delete post %s %v\n", id, err)
+		return
+	}
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+	srv.unindexPost(p.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRestore undoes a soft delete while the post is still inside config.RestoreWindow.
+func (srv *Server) handlerRestore(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	srv.Log.Printf("Received one request to restore post %s\n", id)
+
+	client, hit, p, ok := srv.ownPost(w, r, id)
+	if !ok {
+		return
+	}
+	if p.DeletedAt == nil {
+		writeError(w, r, http.StatusConflict, "Post is not deleted")
+		return
+	}
+	if p.RemovedBy != "" {
+		writeError(w, r, http.StatusForbidden, "Post was removed by a moderator")
+		return
+	}
+	if p.ExpiresAt != nil && !p.ExpiresAt.After(time.Now()) {
+		writeError(w, r, http.StatusGone, "Post has expired")
+		return
+	}
+	if time.Since(*p.DeletedAt) > srv.Config.RestoreWindow {
+		writeError(w, r, http.StatusGone, "Post can no longer be restored")
+		return
+	}
+
+	if err := setDeletedAt(client, hit, nil); err != nil {
+		writeError(w, r, statusForError(err), "Failed to restore post")
+		srv.Log.Printf("Failed to restore post %s %v\n", id, err)
+		return
+	}
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+
+	p.DeletedAt = nil
+	srv.syncSearch(*p)
+	js, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// ownPost loads the post and checks the caller wrote it, on failure the response is already written
+func (srv *Server) ownPost(w http.ResponseWriter, r *http.Request, id string) (*elastic.Client, *elastic.SearchHit, *Post, bool) {
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return nil, nil, nil, false
+	}
+
+	hit, p, err := srv.findPost(client, id)
+	if err != nil {
+		writeError(w, r, statusForError(err), "Failed to read post")
+		srv.Log.Printf("Failed to read post %s %v\n", id, err)
+		return nil, nil, nil, false
+	}
+	if p == nil {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return nil, nil, nil, false
+	}
+	if p.User != usernameFromToken(r) {
+		writeError(w, r, http.StatusForbidden, "Only the author can change this post")
+		return nil, nil, nil, false
+	}
+	return client, hit, p, true
+}
+
+// purgeDeletedPosts deletes the ES document, the GCS media and the Bigtable row
+// of every post deleted before now-window
+func (srv *Server) purgeDeletedPosts(window time.Duration) (int, error) {
+	es_client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+
+	q := elastic.NewRangeQuery("deleted_at").Lt(time.Now().UTC().Add(-window))
+	scroll := es_client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(ARCHIVE_BULK_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	total := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+
+		bulk := es_client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			if err := srv.purgePostData(ctx, hit.Id); err != nil {
+				// keep the document so the next run tries again
+				srv.Log.Printf("Failed to delete media or Bigtable row of post %s %v\n", hit.Id, err)
+				continue
+			}
+			bulk.Add(elastic.NewBulkDeleteRequest().Index(hit.Index).Type(TYPE).Id(hit.Id))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		n := bulk.NumberOfActions()
+		if err := bulkDo(bulk); err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// purgePostData deletes what post id has besides its ES document: the media,
+// its resized images and the Bigtable row. What isn't there is no error.
+func (srv *Server) purgePostData(ctx context.Context, id string) error {
+	// the media object is named after the post id
+	if err := srv.Media.Delete(ctx, srv.Names.MediaPrefix+id); err != nil {
+		return err
+	}
+	err := srv.Media.List(ctx, srv.Names.MediaPrefix+RESIZED_DIR+id+"/", func(a blobstore.Attrs) error {
+		return srv.Media.Delete(ctx, a.Name)
+	})
+	if err != nil {
+		return err
+	}
+	// the row is keyed by post id too
+	del := bigtable.NewMutation()
+	del.DeleteRow()
+	return srv.Tables.Apply(ctx, srv.Names.PostTable, id, del)
+}
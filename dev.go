@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/TianyiSun2333/Around/bigtablestore"
+	"github.com/TianyiSun2333/Around/blobstore"
+	"github.com/TianyiSun2333/Around/moderation"
+)
+
+// with dev and no es_url of its own the server talks to a node on this
+// machine, like the one of
+//
+//	docker run -p 9200:9200 elasticsearch:2.4
+const DEV_ES_URL = "http://localhost:9200"
+
+// applyDev turns the settings the config left at their production defaults
+// into ones for a laptop: ES on localhost, the search in memory and a token
+// key of its own. What the config sets itself stays.
+func (c *Config) applyDev() {
+	if !c.Dev {
+		return
+	}
+	d := defaultConfig()
+	if c.ESURL == d.ESURL {
+		c.ESURL = DEV_ES_URL
+	}
+	if c.SearchBackend == d.SearchBackend {
+		c.SearchBackend = "memory"
+	}
+	// tokens of a laptop server last until it restarts
+	if c.TokenKey == "" {
+		key := make([]byte, TOKEN_KEY_MIN_LENGTH)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		c.TokenKey = base64.RawURLEncoding.EncodeToString(key)
+	}
+}
+
+// wireDevBackends puts in the backends of `around --dev`: media, Bigtable and
+// moderation in memory, so the API runs without GCP credentials. It doesn't
+// run without ES: users, posts and most other documents are only stored
+// there, so a real node is dialed at once and its absence said up front.
+// Redis stays optional like always.
+func (srv *Server) wireDevBackends() error {
+	tables, err := bigtablestore.NewMemory(context.Background(), srv.bigtableTables())
+	if err != nil {
+		return err
+	}
+	srv.Media = &blobstore.Memory{}
+	srv.Archive = &blobstore.Memory{}
+	srv.Tables = tables
+	srv.Classifier = moderation.Fake{}
+	srv.Log.Printf("Dev mode: media, Bigtable and moderation in memory, ES at %s, search in %s\n", srv.Config.ESURL, srv.Config.SearchBackend)
+	if _, err := srv.es(); err != nil {
+		srv.Log.Printf("Dev mode needs ES for users and posts, none answers at %s %v\nStart one with: docker run -p 9200:9200 elasticsearch:2.4\n", srv.Config.ESURL, err)
+	}
+	return nil
+}
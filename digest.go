@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"math"
+	"text/template"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// how often the digest job looks for subscribers that are due
+	DIGEST_INTERVAL = time.Hour
+	// local time from which digests go out
+	DIGEST_HOUR = 8
+	// weekly digests go out on this day
+	DIGEST_WEEKDAY = time.Monday
+	// around the home location, smaller than search as it is about the neighbourhood
+	DIGEST_RANGE = "25km"
+	DIGEST_SIZE  = 5
+)
+
+var digestFrequencies = []string{"daily", "weekly"}
+
+// digestPost is one highlight as the email shows it
+type digestPost struct {
+	Post
+	DistanceKm int
+	Reactions  int64
+}
+
+type digestData struct {
+	User   User
+	Period string
+	Posts  []digestPost
+}
+
+var digestText = template.Must(template.New("digest").Parse(
+	`Hi {{if .User.DisplayName}}{{.User.DisplayName}}{{else}}{{.User.Username}}{{end}},
+
+this is what was popular around your home {{.Period}}:
+{{range .Posts}}
+{{.User}}, {{.DistanceKm}} km away, {{.Reactions}} reactions
+{{.Message}}
+{{.Url}}
+{{end}}
+You get this because you subscribed to the {{if eq .Period "today"}}daily{{else}}weekly{{end}} digest, turn it off in your profile.
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Parse(`<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<p>Hi {{if .User.DisplayName}}{{.User.DisplayName}}{{else}}{{.User.Username}}{{end}},</p>
+<p>this is what was popular around your home {{.Period}}:</p>
+{{range .Posts}}
+<div style="margin:16px 0">
+<img src="{{.Url}}" alt="" style="max-width:100%;max-height:300px"><br>
+<b>{{.User}}</b> &middot; {{.DistanceKm}} km away &middot; {{.Reactions}} reactions<br>
+{{.Message}}
+</div>
+{{end}}
+<p style="color:#888">You get this because you subscribed to the {{if eq .Period "today"}}daily{{else}}weekly{{end}} digest, turn it off in your profile.</p>
+</body></html>
+`))
+
+// digestDue is the period the digest of u covers if one should go out at now,
+// ok is false otherwise
+func digestDue(u User, now time.Time) (since time.Time, period string, ok bool) {
+	if u.Digest == "" || u.Email == "" || u.Home == nil {
+		return
+	}
+	loc := u.location()
+	local := now.In(loc)
+	if local.Hour() < DIGEST_HOUR {
+		return
+	}
+	// once per local day at most, whatever the frequency
+	if u.DigestSentAt != nil && localDay(*u.DigestSentAt, loc) == localDay(now, loc) {
+		return
+	}
+	switch u.Digest {
+	case "daily":
+		return now.AddDate(0, 0, -1), "today", true
+	case "weekly":
+		if local.Weekday() != DIGEST_WEEKDAY {
+			return
+		}
+		return now.AddDate(0, 0, -7), "this week", true
+	}
+	return
+}
+
+// digestHighlights are the posts near the home of u since then with the most
+// reactions, leaving out the user's own and those they may not see
+func (srv *Server) digestHighlights(client *elastic.Client, u User, since time.Time) ([]digestPost, error) {
+	home := *u.Home
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewGeoDistanceQuery("location").Distance(DIGEST_RANGE).Lat(home.Lat).Lon(home.Lon)).
+		Filter(elastic.NewRangeQuery("created_at").Gte(since), notDeleted()).
+		MustNot(elastic.NewTermQuery("user", u.Username))
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			// indices from before reactions have no mapping for it
+			SortBy(elastic.NewFieldSort("reaction_count").Desc().UnmappedType("long"), elastic.NewFieldSort("created_at").Desc()).
+			// some of them may be hidden from u
+			Size(4 * DIGEST_SIZE).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var posts []digestPost
+	for _, hit := range res.Hits.Hits {
+		var p Post
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &p) != nil {
+			continue
+		}
+		if !srv.inFeed(u.Username, p.User) {
+			continue
+		}
+		d := distanceKm(home.Lat, home.Lon, p.Location.Lat, p.Location.Lon)
+		posts = append(posts, digestPost{Post: p, DistanceKm: int(math.Max(1, math.Round(d))), Reactions: p.ReactionCount})
+		if len(posts) == DIGEST_SIZE {
+			break
+		}
+	}
+	return posts, nil
+}
+
+// sendDigest emails the digest to u if one is due, reporting whether it did
+func (srv *Server) sendDigest(client *elastic.Client, u User, now time.Time) (bool, error) {
+	since, period, ok := digestDue(u, now)
+	if !ok {
+		return false, nil
+	}
+	posts, err := srv.digestHighlights(client, u, since)
+	if err != nil {
+		return false, err
+	}
+	// an empty digest is not sent, but counts as sent so the next hour doesn't try again
+	if len(posts) > 0 {
+		data := digestData{User: u, Period: period, Posts: posts}
+		var text, html bytes.Buffer
+		if err := digestText.Execute(&text, data); err != nil {
+			return false, err
+		}
+		if err := digestHTML.Execute(&html, data); err != nil {
+			return false, err
+		}
+		if err := srv.sendEmail(u.Email, "Popular around you "+period, text.String(), html.String()); err != nil {
+			return false, err
+		}
+	}
+	sent := now.UTC()
+	if err := srv.updateUserFields(u.Username, map[string]interface{}{"digest_sent_at": sent}); err != nil {
+		return false, err
+	}
+	return len(posts) > 0, nil
+}
+
+func (srv *Server) sendDigests(now time.Time) (int, error) {
+	client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+	scroll := client.Scroll(srv.Names.Index).
+		Type(TYPE_USER).
+		Query(elastic.NewExistsQuery("digest")).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	sent := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		for _, hit := range res.Hits.Hits {
+			var u User
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &u) != nil {
+				continue
+			}
+			ok, err := srv.sendDigest(client, u, now)
+			if err != nil {
+				// the next run tries again
+				srv.Log.Printf("Failed to send the digest of %s %v\n", u.Username, err)
+				continue
+			}
+			if ok {
+				sent++
+			}
+		}
+	}
+}
+
+// runDigest implements `around digest`, sends the digests that are due right now
+func (srv *Server) runDigest(args []string) error {
+	flag.NewFlagSet("digest", flag.ExitOnError).Parse(args)
+	if !srv.emailEnabled() {
+		return fmt.Errorf("smtp_addr is not set, digests can't be sent")
+	}
+	n, err := srv.sendDigests(time.Now())
+	srv.Log.Printf("Sent %d digests\n", n)
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// body of PUT /post/{id}, version is the one the client last read
+type editRequest struct {
+	Message string `json:"message"`
+	Version int64  `json:"version"`
+}
+
+// returned with 409 so the client can reload and merge
+type conflictResponse struct {
+	Message string `json:"message"`
+	Version int64  `json:"version"`
+	Post    *Post  `json:"post"`
+}
+
+// handlerEdit changes the message of a post. The client must send the version it
+// read (body or If-Match header), if somebody else saved in between ES rejects the
+// write and we answer 409 with the current version instead of overwriting it.
+func (srv *Server) handlerEdit(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	srv.Log.Printf("Received one request to edit post %s\n", id)
+
+	var req editRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode edit request")
+		return
+	}
+	if v := r.Header.Get("If-Match"); v != "" {
+		version, err := strconv.ParseInt(trimETag(v), 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "If-Match should be a post version")
+			return
+		}
+		req.Version = version
+	}
+	if req.Version <= 0 {
+		writeError(w, r, http.StatusPreconditionRequired, "Missing post version")
+		return
+	}
+
+	if !srv.checkMessage(w, r, cleanText(req.Message), "body") {
+		return
+	}
+
+	client, hit, p, ok := srv.ownPost(w, r, id)
+	if !ok {
+		return
+	}
+	if p.DeletedAt != nil {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return
+	}
+
+	now := time.Now().UTC()
+	p.Message = cleanText(req.Message)
+	p.Lang = search.Language(p.Message)
+	p.UpdatedAt = &now
+
+	var res *elastic.IndexResponse
+	err := esRetry(func() error {
+		var err error
+		// ES compares with the stored version and refuses stale writes
+		res, err = client.Index().
+			Index(hit.Index).
+			Type(TYPE).
+			Id(id).
+			Version(req.Version).
+			BodyJson(p).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+		writeConflict(w, client, hit)
+		return
+	}
+	if err != nil {
+		writeError(w, r, statusForError(err), "Failed to save post")
+		srv.Log.Printf("Failed to save post %s %v\n", id, err)
+		return
+	}
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+	srv.syncSearch(*p)
+	srv.saveToBigTable(requestContext(r), *p)
+
+	js, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(res.Version, 10)))
+	w.Write(js)
+}
+
+// handlerGetPost returns one post with its version as ETag, to be sent back as If-Match when editing.
+func (srv *Server) handlerGetPost(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	srv.Log.Printf("Received one request for post %s\n", id)
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	hit, p, err := srv.findPost(client, id)
+	if err != nil {
+		writeError(w, r, statusForError(err), "Failed to read post")
+		srv.Log.Printf("Failed to read post %s %v\n", id, err)
+		return
+	}
+	// a private post is as missing as a deleted one to those who can't see it
+	if p == nil || p.hidden() || !srv.canSee(usernameFromToken(r), p.User) {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return
+	}
+
+	// search hits carry no version, a realtime get on the concrete index does
+	if doc, err := client.Get().Index(hit.Index).Type(TYPE).Id(id).Do(); err == nil && doc.Version != nil {
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(*doc.Version, 10)))
+	}
+
+	js, _ := json.Marshal(srv.withQuotes(usernameFromToken(r), []Post{*p})[0])
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// writeConflict answers 409 with the post as it is stored now
+func writeConflict(w http.ResponseWriter, client *elastic.Client, hit *elastic.SearchHit) {
+	resp := conflictResponse{Message: "Post was changed by someone else"}
+
+	doc, err := client.Get().Index(hit.Index).Type(TYPE).Id(hit.Id).Do()
+	if err == nil && doc.Found && doc.Source != nil {
+		var p Post
+		if json.Unmarshal(*doc.Source, &p) == nil {
+			resp.Post = &p
+		}
+		if doc.Version != nil {
+			resp.Version = *doc.Version
+			w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(resp.Version, 10)))
+		}
+	}
+
+	js, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	w.Write(js)
+}
+
+// trimETag turns `W/"3"` or `"3"` into `3`
+func trimETag(v string) string {
+	if len(v) > 2 && v[:2] == "W/" {
+		v = v[2:]
+	}
+	if s, err := strconv.Unquote(v); err == nil {
+		return s
+	}
+	return v
+}
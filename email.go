@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// anything speaking SMTP with STARTTLS works as the provider: SendGrid, Mailgun,
+// SES, a local postfix
+func (srv *Server) emailEnabled() bool {
+	return srv.Config.SMTPAddr != ""
+}
+
+// sendEmail sends one message with a plain text and an HTML part, the mail
+// client picks which one to show
+func (srv *Server) sendEmail(to, subject, text, html string) error {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	var msg bytes.Buffer
+	headers := []struct{ name, value string }{
+		{"From", srv.Config.MailFrom},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.name, h.value)
+	}
+	msg.WriteString("\r\n")
+
+	for _, p := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return err
+		}
+		w.Write([]byte(p.content))
+	}
+	parts.Close()
+	msg.Write(body.Bytes())
+
+	host, _, _ := net.SplitHostPort(srv.Config.SMTPAddr)
+	var auth smtp.Auth
+	if srv.Config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", srv.Config.SMTPUsername, srv.Config.SMTPPassword, host)
+	}
+	// mail_from may have a name, "Around <noreply@example.com>", the envelope takes the address only
+	from, err := mail.ParseAddress(srv.Config.MailFrom)
+	if err != nil {
+		return err
+	}
+	// SendMail upgrades to TLS when the server offers STARTTLS
+	if err := smtp.SendMail(srv.Config.SMTPAddr, auth, from.Address, []string{to}, msg.Bytes()); err != nil {
+		return err
+	}
+	srv.Log.Printf("Sent email %q to %s\n", subject, to)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/storage"
+	"github.com/TianyiSun2333/Around/bigtablestore"
+	"google.golang.org/api/option"
+)
+
+// Integration tests run the server against emulators instead of a GCP
+// project, all by config:
+//
+//	bigtable_emulator: localhost:8086            # gcloud beta emulators bigtable start
+//	gcs_endpoint: http://localhost:4443/storage/v1/  # fake-gcs-server -scheme http
+//	es_url: http://localhost:9200                # docker run elasticsearch:2.4
+//
+// Neither needs application default credentials, nothing goes to the project
+// of project_id. The ML engine has no emulator, run those tests without
+// moderation or with dev.
+
+// the tables of the in-memory Bigtable and the emulator with their column
+// families, named for the tenant
+func (srv *Server) bigtableTables() map[string][]string {
+	return map[string][]string{
+		srv.Names.PostTable:       {"post", "location"},
+		srv.Names.ModerationTable: {MODERATION_FAMILY},
+	}
+}
+
+// newBigtableClient makes the client of the instance of the config, or of
+// the emulator of bigtable_emulator with the tables created
+func (srv *Server) newBigtableClient(ctx context.Context) (*bigtable.Client, error) {
+	if addr := srv.Config.BigtableEmulator; addr != "" {
+		return bigtablestore.DialEmulator(ctx, addr, srv.bigtableTables())
+	}
+	// <project id> <bt-instance> globally locate the table
+	return bigtable.NewClient(ctx, srv.Config.ProjectID, srv.Config.BTInstance)
+}
+
+// newGCSClient makes the GCS client, of gcs_endpoint without credentials
+// when it is set. The buckets are made on the fake server by the test setup,
+// e.g. the folders of fake-gcs-server -data.
+func (srv *Server) newGCSClient(ctx context.Context) (*storage.Client, error) {
+	if endpoint := srv.Config.GCSEndpoint; endpoint != "" {
+		return storage.NewClient(ctx, option.WithEndpoint(endpoint), option.WithoutAuthentication())
+	}
+	return storage.NewClient(ctx)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/TianyiSun2333/Around/requestid"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// apiError is the body of every error response
+type apiError struct {
+	// stable, machine readable, e.g. "bad_request"
+	Code string `json:"code"`
+	// for humans, may change any time
+	Message string `json:"message"`
+	// the X-Request-ID of the failed request, to find it in the logs
+	RequestID string `json:"request_id"`
+	// what is wrong with which parameter, only for validation errors
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:           "bad_request",
+	http.StatusUnauthorized:         "unauthorized",
+	http.StatusForbidden:            "forbidden",
+	http.StatusNotFound:             "not_found",
+	http.StatusConflict:             "conflict",
+	http.StatusGone:                 "gone",
+	http.StatusPreconditionRequired: "precondition_required",
+	http.StatusTooManyRequests:      "rate_limited",
+	http.StatusInternalServerError:  "internal",
+	http.StatusServiceUnavailable:   "unavailable",
+}
+
+// writeError sends the JSON error envelope with the given status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "error"
+	}
+	writeErrorCode(w, r, status, code, message)
+}
+
+// writeErrorCode is writeError with a more specific code than the status implies
+func writeErrorCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	js, _ := json.Marshal(apiError{
+		Code:      code,
+		Message:   localize(w, r, message),
+		RequestID: requestID(r),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+// writeBackendError logs err and answers with the status that fits it: an open
+// circuit or unreachable backend is 503, a missing document 404, anything else 500.
+// Backend details stay in the log, the client only gets message.
+func writeBackendError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	requestLog(r).Printf("[%s] %s %v\n", requestID(r), message, err)
+	writeError(w, r, statusForError(err), message)
+}
+
+func statusForError(err error) int {
+	switch e := err.(type) {
+	case *CircuitOpenError, *DisabledError:
+		return http.StatusServiceUnavailable
+	case *elastic.Error:
+		if e.Status == http.StatusNotFound {
+			return http.StatusNotFound
+		}
+		if e.Status >= 500 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusInternalServerError
+	}
+	if elastic.IsTimeout(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// jwtError is the ErrorHandler of the token checks, the same envelope as every other error
+func jwtError(w http.ResponseWriter, r *http.Request, err string) {
+	writeError(w, r, http.StatusUnauthorized, err)
+}
+
+// requestIDMiddleware keeps the X-Request-ID sent by the client (or a proxy),
+// generates one otherwise, and echoes it in the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.HEADER)
+		if id == "" || len(id) > 128 {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.HEADER, id)
+		next.ServeHTTP(w, r.WithContext(requestid.With(r.Context(), id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	return requestid.From(r.Context())
+}
+
+type requestLogKey struct{}
+
+// withRequestLog returns r carrying l, the logger of the server answering it
+func withRequestLog(r *http.Request, l *log.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l))
+}
+
+// requestLog is the logger of the server answering r, see loggingMiddleware.
+// Requests that didn't come through it log to stdout.
+func requestLog(r *http.Request) *log.Logger {
+	if l, ok := r.Context().Value(requestLogKey{}).(*log.Logger); ok {
+		return l
+	}
+	return stdoutLog
+}
+
+// requestContext is the context for the backend calls of r. It has the
+// request id the backends get along, and it isn't canceled with r: a post
+// whose client went away is still saved to the end.
+func requestContext(r *http.Request) context.Context {
+	return requestid.With(context.Background(), requestID(r))
+}
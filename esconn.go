@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// how long a start waits for the first node to answer, the client is made
+	// again by the next call when none does
+	ES_STARTUP_TIMEOUT = 5 * time.Second
+	// how often the watchdog asks the cluster, and after how many failures in
+	// a row it makes a new client. A new one resolves the hosts again and
+	// drops connections to nodes that came back somewhere else.
+	ES_WATCHDOG_INTERVAL = 30 * time.Second
+	ES_WATCHDOG_FAILURES = 3
+)
+
+// ES 2 has no X-Opaque-Id and the client of it no per request headers, so
+// the request id doesn't go to ES with the calls. New posts keep it in
+// request_id, the access log and the error responses have it too.
+
+// newESClient makes a client of the nodes in es_url. Requests go round robin
+// over the nodes that answer, a node that fails is skipped until the health
+// check sees it up again. With es_sniff the client asks the cluster for the
+// rest of its nodes, for clusters whose nodes can reach each other under the
+// addresses they publish.
+func (srv *Server) newESClient() (*elastic.Client, error) {
+	c := srv.Config
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(splitList(c.ESURL)...),
+		elastic.SetSniff(c.ESSniff),
+		elastic.SetHealthcheck(c.ESHealthcheck > 0),
+		elastic.SetHealthcheckTimeoutStartup(ES_STARTUP_TIMEOUT),
+		// a request that fails on one node goes to the next, esRetry
+		// retries on top when all of them failed
+		elastic.SetMaxRetries(len(splitList(c.ESURL)) - 1),
+	}
+	if c.ESHealthcheck > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(c.ESHealthcheck))
+	}
+	if c.SlowQuery > 0 {
+		options = append(options, elastic.SetHttpClient(&http.Client{Transport: &slowQueryTransport{srv: srv, next: http.DefaultTransport}}))
+	}
+	return elastic.NewClient(options...)
+}
+
+// resetES drops the client, the next srv.es() makes a new one
+func (srv *Server) resetES(client *elastic.Client) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	// another caller may have made a new one already
+	if srv.esClient != client {
+		return
+	}
+	srv.esClient = nil
+	client.Stop()
+}
+
+// runESWatchdog makes a new client when the cluster didn't answer for
+// ES_WATCHDOG_FAILURES checks in a row. The health check of the client revives
+// nodes that restart under the same address, this is for the rest: nodes
+// with new addresses behind the same name, a client that stopped.
+func (srv *Server) runESWatchdog() {
+	failures := 0
+	for {
+		time.Sleep(ES_WATCHDOG_INTERVAL)
+		client, err := srv.es()
+		if err != nil {
+			// es() tries again with the next call
+			srv.Log.Printf("ES watchdog: no client %v\n", err)
+			continue
+		}
+		_, err = client.ClusterHealth().Do()
+		if err == nil && !client.IsRunning() {
+			err = errors.New("client is stopped")
+		}
+		if err == nil {
+			if failures > 0 {
+				srv.Log.Printf("ES watchdog: cluster is back after %d failed checks\n", failures)
+			}
+			failures = 0
+			continue
+		}
+		failures++
+		srv.Log.Printf("ES watchdog: check %d failed %v\n", failures, err)
+		if failures >= ES_WATCHDOG_FAILURES {
+			srv.Log.Println("ES watchdog: making a new ES client")
+			srv.resetES(client)
+			failures = 0
+		}
+	}
+}
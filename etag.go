@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// weakETag is a weak validator of the content in parts, the same content
+// gives the same tag on every instance. Weak because the bytes can differ,
+// compression and took_ms change them but not what the response says.
+func weakETag(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		// so ["ab", "c"] and ["a", "bc"] differ
+		h.Write([]byte{0})
+	}
+	return `W/"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets etag on the response and answers 304 when the client sent
+// it back in If-None-Match, true then and the handler is done. Only GET and
+// HEAD are answered 304, on other methods If-None-Match is a precondition of
+// the change and not about the response.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches is the weak comparison of If-None-Match: any of the listed tags
+// or * matches, with or without W/
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header, etag string
+		want         bool
+	}{
+		{"", `"a"`, false},
+		{`"a"`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		// weak comparison, W/ on either side
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`W/"a"`, `W/"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`"b",W/"a"`, `"a"`, true},
+		{`"b", "c"`, `"a"`, false},
+		{"*", `"a"`, true},
+		// the quotes are part of the tag
+		{"a", `"a"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
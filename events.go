@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_RSVP = "rsvp"
+
+	// festivals, not semesters
+	EVENT_MAX_LENGTH   = 31 * 24 * time.Hour
+	EVENT_MAX_CAPACITY = 100000
+	// event searches are sorted by start, not cut off at the ES default of 10
+	EVENT_SEARCH_SIZE       = 100
+	ATTENDEES_PAGE_SIZE     = 50
+	ATTENDEES_PAGE_MAX_SIZE = 500
+)
+
+// Event makes a post an event, the message describes it and the location is where it happens
+type Event struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	// 0 is no limit
+	Capacity int `json:"capacity,omitempty"`
+}
+
+// RSVP is stored in INDEX with id post>user, one per attendee
+type RSVP struct {
+	PostID    string    `json:"post_id"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type attendeesPage struct {
+	Count     int64  `json:"count"`
+	Capacity  int    `json:"capacity"`
+	Attendees []RSVP `json:"attendees"`
+	// offset of the next page, absent on the last one
+	Next *int `json:"next,omitempty"`
+}
+
+// post ids are ULIDs and usernames can't contain '>'
+func rsvpID(postID, username string) string {
+	return postID + ">" + username
+}
+
+// eventFromForm reads event_start, event_end and capacity of a new post,
+// nil when none of them is set
+func eventFromForm(r *http.Request, now time.Time) (*Event, error) {
+	start, end, capacity := r.FormValue("event_start"), r.FormValue("event_end"), r.FormValue("capacity")
+	if start == "" && end == "" && capacity == "" {
+		return nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("an event needs event_start and event_end")
+	}
+	e := &Event{}
+	var err error
+	if e.StartsAt, err = time.Parse(time.RFC3339, start); err != nil {
+		return nil, fmt.Errorf("event_start should be an RFC 3339 time")
+	}
+	if e.EndsAt, err = time.Parse(time.RFC3339, end); err != nil {
+		return nil, fmt.Errorf("event_end should be an RFC 3339 time")
+	}
+	e.StartsAt, e.EndsAt = e.StartsAt.UTC(), e.EndsAt.UTC()
+	if !e.EndsAt.After(e.StartsAt) {
+		return nil, fmt.Errorf("event_end should be after event_start")
+	}
+	if e.EndsAt.Sub(e.StartsAt) > EVENT_MAX_LENGTH {
+		return nil, fmt.Errorf("an event can't be longer than %d days", int(EVENT_MAX_LENGTH.Hours()/24))
+	}
+	if !e.EndsAt.After(now) {
+		return nil, fmt.Errorf("event_end is in the past")
+	}
+	if capacity != "" {
+		if e.Capacity, err = strconv.Atoi(capacity); err != nil || e.Capacity < 0 || e.Capacity > EVENT_MAX_CAPACITY {
+			return nil, fmt.Errorf("capacity should be between 0 and %d", EVENT_MAX_CAPACITY)
+		}
+	}
+	return e, nil
+}
+
+// eventWindow reads the event filters of /search. ok is false when there are
+// none, otherwise only events overlapping [from, to) are wanted, a zero to is open.
+//
+//	events=true             not over yet
+//	when=today|weekend&tz=  the rest of today or the coming weekend in tz, UTC by default
+//	event_from=&event_to=   RFC 3339, override the bounds of the above
+func eventWindow(q url.Values, now time.Time) (from, to time.Time, ok bool, err error) {
+	if q.Get("events") == "" && q.Get("when") == "" && q.Get("event_from") == "" && q.Get("event_to") == "" {
+		return
+	}
+	ok = true
+	from = now
+
+	loc := time.UTC
+	if v := q.Get("tz"); v != "" {
+		if loc, err = time.LoadLocation(v); err != nil {
+			err = fmt.Errorf("tz should be an IANA time zone like Europe/Berlin")
+			return
+		}
+	}
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	switch q.Get("when") {
+	case "today":
+		to = midnight.AddDate(0, 0, 1)
+	case "weekend":
+		// Saturday 00:00 until Monday 00:00, on a weekend day what is left of it
+		days := (int(time.Saturday) - int(local.Weekday()) + 7) % 7
+		if local.Weekday() == time.Sunday {
+			days = -1
+		}
+		saturday := midnight.AddDate(0, 0, days)
+		if saturday.After(now) {
+			from = saturday
+		}
+		to = saturday.AddDate(0, 0, 2)
+	}
+
+	if v := q.Get("event_from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			err = fmt.Errorf("event_from should be an RFC 3339 time")
+			return
+		}
+	}
+	if v := q.Get("event_to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			err = fmt.Errorf("event_to should be an RFC 3339 time")
+			return
+		}
+	}
+	if !to.IsZero() && !to.After(from) {
+		err = fmt.Errorf("the event window ends before it starts")
+	}
+	return
+}
+
+// searchEvents returns the events within ran of lat/lon that overlap
+// [from, to), the ones starting first first, and how many there are in all
+func (srv *Server) searchEvents(lat, lon float64, ran string, from, to time.Time) ([]Post, int64, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, 0, err
+	}
+	geo := elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(lat).Lon(lon)
+	q := elastic.NewBoolQuery().Filter(geo, notDeleted(), elastic.NewRangeQuery("event.ends_at").Gt(from))
+	if !to.IsZero() {
+		q = q.Filter(elastic.NewRangeQuery("event.starts_at").Lt(to))
+	}
+
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			Sort("event.starts_at", true).
+			Size(EVENT_SEARCH_SIZE).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	srv.Log.Printf("Found a total of %d events\n", res.TotalHits())
+
+	var ps []Post
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			srv.Log.Printf("Skipping post %s %v\n", hit.Id, err)
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps, res.TotalHits(), nil
+}
+
+// countRSVPs is the number of attendees of the event
+func (srv *Server) countRSVPs(client *elastic.Client, postID string) (int64, error) {
+	var n int64
+	err := esRetry(func() error {
+		var err error
+		n, err = client.Count(srv.Names.Index).Type(TYPE_RSVP).Query(elastic.NewTermQuery("post_id", postID)).Do()
+		return err
+	})
+	return n, err
+}
+
+func (srv *Server) deleteRSVP(client *elastic.Client, postID, username string) error {
+	return esRetry(func() error {
+		_, err := client.Delete().
+			Index(srv.Names.Index).
+			Type(TYPE_RSVP).
+			Id(rsvpID(postID, username)).
+			Refresh(true).
+			Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// eventPost loads the event {id} for the caller, answering 404 for posts they
+// can't see and 400 for posts that aren't events
+func (srv *Server) eventPost(w http.ResponseWriter, r *http.Request) (*elastic.Client, *Post, bool) {
+	client, _, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if p.Event == nil {
+		writeError(w, r, http.StatusBadRequest, "Post is not an event")
+		return nil, nil, false
+	}
+	return client, p, true
+}
+
+// handlerRSVP signs the caller up for an event, 201 the first time and 200 when
+// they already are. Full events answer 409.
+//
+//	POST /post/{id}/rsvp
+func (srv *Server) handlerRSVP(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	client, p, ok := srv.eventPost(w, r)
+	if !ok {
+		return
+	}
+	srv.Log.Printf("Received one RSVP to %s from %s\n", p.Id, username)
+	now := time.Now().UTC()
+	if !p.Event.EndsAt.After(now) {
+		writeError(w, r, http.StatusBadRequest, "Event is over")
+		return
+	}
+	if p.Event.Capacity > 0 {
+		n, err := srv.countRSVPs(client, p.Id)
+		if err != nil {
+			writeBackendError(w, r, "Failed to count attendees", err)
+			return
+		}
+		if n >= int64(p.Event.Capacity) {
+			// the caller may be one of them
+			if existing, err := client.Get().Index(srv.Names.Index).Type(TYPE_RSVP).Id(rsvpID(p.Id, username)).Do(); err == nil && existing.Found {
+				writeRSVP(w, http.StatusOK, existing.Source)
+				return
+			}
+			writeError(w, r, http.StatusConflict, "Event is full")
+			return
+		}
+	}
+
+	rsvp := RSVP{PostID: p.Id, User: username, CreatedAt: now}
+	err := esRetry(func() error {
+		// create fails if the caller already answered, their first RSVP keeps its time
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_RSVP).
+			Id(rsvpID(p.Id, username)).
+			OpType("create").
+			BodyJson(rsvp).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+		existing, err := client.Get().Index(srv.Names.Index).Type(TYPE_RSVP).Id(rsvpID(p.Id, username)).Do()
+		if err == nil && !existing.Found {
+			// cancelled in between
+			err = fmt.Errorf("RSVP %s is gone", rsvpID(p.Id, username))
+		}
+		if err != nil {
+			writeBackendError(w, r, "Failed to read RSVP", err)
+			return
+		}
+		writeRSVP(w, http.StatusOK, existing.Source)
+		return
+	}
+	if err != nil {
+		writeBackendError(w, r, "Failed to save RSVP", err)
+		return
+	}
+
+	// two RSVPs for the last seat can both pass the count above, whoever sees
+	// too many afterwards steps back so the event is never overbooked
+	if p.Event.Capacity > 0 {
+		n, err := srv.countRSVPs(client, p.Id)
+		if err == nil && n > int64(p.Event.Capacity) {
+			if err := srv.deleteRSVP(client, p.Id, username); err != nil {
+				srv.Log.Printf("Failed to withdraw RSVP to %s of %s %v\n", p.Id, username, err)
+			}
+			writeError(w, r, http.StatusConflict, "Event is full")
+			return
+		}
+	}
+	js, _ := json.Marshal(rsvp)
+	raw := json.RawMessage(js)
+	writeRSVP(w, http.StatusCreated, &raw)
+}
+
+// handlerCancelRSVP frees the seat of the caller
+//
+//	DELETE /post/{id}/rsvp
+func (srv *Server) handlerCancelRSVP(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	client, p, ok := srv.eventPost(w, r)
+	if !ok {
+		return
+	}
+	if err := srv.deleteRSVP(client, p.Id, username); err != nil {
+		writeBackendError(w, r, "Failed to cancel RSVP", err)
+		return
+	}
+	srv.Log.Printf("%s cancelled the RSVP to %s\n", username, p.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerAttendees lists who RSVPed to an event, first come first
+//
+//	GET /post/{id}/attendees?offset=&limit=
+func (srv *Server) handlerAttendees(w http.ResponseWriter, r *http.Request) {
+	// types and ranges are checked by validateRequest already
+	limit := ATTENDEES_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset+limit > USER_PAGE_MAX_OFFSET {
+		writeError(w, r, http.StatusBadRequest, "Cannot page that far")
+		return
+	}
+	client, p, ok := srv.eventPost(w, r)
+	if !ok {
+		return
+	}
+
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_RSVP).
+			Query(elastic.NewTermQuery("post_id", p.Id)).
+			Sort("created_at", true).
+			From(offset).
+			Size(limit).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to read attendees", err)
+		return
+	}
+
+	page := attendeesPage{Count: res.TotalHits(), Capacity: p.Event.Capacity, Attendees: []RSVP{}}
+	for _, hit := range res.Hits.Hits {
+		var rsvp RSVP
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &rsvp) != nil {
+			continue
+		}
+		page.Attendees = append(page.Attendees, rsvp)
+	}
+	if next := offset + len(res.Hits.Hits); int64(next) < page.Count && len(res.Hits.Hits) > 0 {
+		page.Next = &next
+	}
+
+	js, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func writeRSVP(w http.ResponseWriter, status int, js *json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(*js)
+}
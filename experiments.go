@@ -0,0 +1,177 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_EXPOSURE = "exposure"
+
+	// exposures are buffered and written this often, like the view counters
+	EXPOSURE_FLUSH_INTERVAL = 10 * time.Second
+	// the in-memory dedup forgets everything past this many
+	EXPOSURE_LOCAL_MAX = 100000
+)
+
+// experiment splits users evenly between its variants, the first one is the
+// control that behaves like before the experiment
+type experiment struct {
+	Name     string
+	Variants []string
+}
+
+// the running experiments. A user keeps the variants of their token until they
+// log in again, so changing the variants of one takes up to a day to reach all.
+var experiments = []experiment{
+	// search results nearest first instead of in ES order
+	{Name: "search_ranking", Variants: []string{"control", "nearest"}},
+}
+
+// Exposure records that a user got a variant of an experiment, stored in
+// INDEX as experiment>user>day so a user counts once per day. Analysis joins
+// these with views and reactions of the same users, e.g. a terms aggregation
+// on variant filtered by experiment.
+type Exposure struct {
+	Experiment string    `json:"experiment"`
+	Variant    string    `json:"variant"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type pendingExposures struct {
+	sync.Mutex
+	// exposures not written yet
+	pending []Exposure
+	// ids seen today, dropped when the day changes
+	seen map[string]bool
+	day  string
+}
+
+// assignBucket is the variant of e for username. The hash is of the experiment
+// name too, so being in the first variant of one experiment says nothing about
+// the others.
+func assignBucket(e experiment, username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + username))
+	return e.Variants[h.Sum32()%uint32(len(e.Variants))]
+}
+
+// assignBuckets is the "experiments" claim of a new token
+func assignBuckets(username string) map[string]string {
+	buckets := map[string]string{}
+	for _, e := range experiments {
+		buckets[e.Name] = assignBucket(e, username)
+	}
+	return buckets
+}
+
+// experimentBucket is the variant of experiment name the caller is in and logs
+// the exposure. Tokens from before the experiment started have no claim for
+// it, they get the same assignment a new login would. "" for unknown
+// experiments and requests without a user, handlers treat that as control.
+func (srv *Server) experimentBucket(r *http.Request, name string) string {
+	username := usernameFromToken(r)
+	if username == "" {
+		return ""
+	}
+	var e *experiment
+	for i := range experiments {
+		if experiments[i].Name == name {
+			e = &experiments[i]
+		}
+	}
+	if e == nil {
+		return ""
+	}
+	variant := assignBucket(*e, username)
+	if token, ok := r.Context().Value("user").(*jwt.Token); ok {
+		claims, _ := token.Claims.(jwt.MapClaims)
+		buckets, _ := claims["experiments"].(map[string]interface{})
+		// a variant the experiment no longer has is assigned again
+		if v, ok := buckets[name].(string); ok && contains(e.Variants, v) {
+			variant = v
+		}
+	}
+	srv.logExposure(Exposure{Experiment: name, Variant: variant, User: username, CreatedAt: time.Now().UTC()})
+	return variant
+}
+
+func exposureID(x Exposure) string {
+	return x.Experiment + ">" + x.User + ">" + x.CreatedAt.Format(DAY_FORMAT)
+}
+
+// logExposure queues x for the next flush unless the user was already exposed
+// today. Per instance, the deterministic id makes the rest harmless.
+func (srv *Server) logExposure(x Exposure) {
+	id := exposureID(x)
+	day := x.CreatedAt.Format(DAY_FORMAT)
+	srv.exposures.Lock()
+	defer srv.exposures.Unlock()
+	if day != srv.exposures.day || len(srv.exposures.seen) >= EXPOSURE_LOCAL_MAX {
+		srv.exposures.seen = map[string]bool{}
+		srv.exposures.day = day
+	}
+	if srv.exposures.seen[id] {
+		return
+	}
+	srv.exposures.seen[id] = true
+	srv.exposures.pending = append(srv.exposures.pending, x)
+}
+
+// runExposureFlush writes the pending exposures every EXPOSURE_FLUSH_INTERVAL,
+// started by the server
+func (srv *Server) runExposureFlush() {
+	for {
+		time.Sleep(EXPOSURE_FLUSH_INTERVAL)
+		srv.flushExposures()
+	}
+}
+
+// flushExposures puts what fails back for the next flush
+func (srv *Server) flushExposures() {
+	srv.exposures.Lock()
+	pending := srv.exposures.pending
+	srv.exposures.pending = nil
+	srv.exposures.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := srv.writeExposures(pending); err != nil {
+		srv.Log.Printf("Failed to write %d exposures %v\n", len(pending), err)
+		srv.exposures.Lock()
+		srv.exposures.pending = append(srv.exposures.pending, pending...)
+		srv.exposures.Unlock()
+	}
+}
+
+func (srv *Server) writeExposures(xs []Exposure) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	bulk := client.Bulk()
+	for _, x := range xs {
+		bulk.Add(elastic.NewBulkIndexRequest().Index(srv.Names.Index).Type(TYPE_EXPOSURE).Id(exposureID(x)).Doc(x))
+	}
+	return bulkDo(bulk)
+}
+
+// rankSearch orders search results for the search_ranking variant of the
+// caller, the control keeps them as they are
+func (srv *Server) rankSearch(r *http.Request, lat, lon float64, ps []Post) []Post {
+	if srv.experimentBucket(r, "search_ranking") != "nearest" {
+		return ps
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return distanceKm(lat, lon, ps[i].Location.Lat, ps[i].Location.Lon) <
+			distanceKm(lat, lon, ps[j].Location.Lat, ps[j].Location.Lon)
+	})
+	return ps
+}
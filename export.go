@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// posts fetched per scroll round trip
+	EXPORT_BATCH_SIZE = 500
+	// how long ES keeps the scroll context between batches
+	EXPORT_KEEP_ALIVE = "1m"
+)
+
+// handlerExport streams every post of the caller as NDJSON (one post per line),
+// optionally limited to lat/lon/range like /search. Unlike /search the result is
+// not bounded, ES scroll hands out the matches batch by batch.
+func (srv *Server) handlerExport(w http.ResponseWriter, r *http.Request) {
+
+	username := usernameFromToken(r)
+
+	// only your own posts can be exported
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user", username), notDeleted())
+	if r.URL.Query().Get("lat") != "" && r.URL.Query().Get("lon") != "" {
+		lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "lat should be a number")
+			return
+		}
+		lon, err := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "lon should be a number")
+			return
+		}
+		ran := srv.Config.DefaultDistance
+		if val := r.URL.Query().Get("range"); val != "" {
+			ran = val + "km"
+		}
+		q = q.Filter(elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(lat).Lon(lon))
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	// Encode writes a newline after every value, which is exactly NDJSON
+	enc := json.NewEncoder(w)
+
+	total := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			srv.Log.Printf("Failed to scroll posts %v\n", err)
+			if total == 0 {
+				writeError(w, r, http.StatusServiceUnavailable, "Failed to export posts")
+			}
+			// the status line is already sent, a client sees a truncated stream
+			return
+		}
+
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				srv.Log.Printf("Skipping post %s in export %v\n", hit.Id, err)
+				continue
+			}
+			if err := enc.Encode(p); err != nil {
+				// client went away
+				srv.Log.Printf("Export aborted %v\n", err)
+				return
+			}
+			total++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	srv.Log.Printf("Exported %d posts for %s\n", total, username)
+}
+
+// handlerExportCSV streams every post of the caller as CSV, oldest first, for
+// spreadsheets and personal archives. Same scroll as handlerExport, without filters.
+func (srv *Server) handlerExportCSV(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	srv.Log.Printf("Received one request for CSV export from %s\n", username)
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user", username), notDeleted())).
+		Sort("created_at", true).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	// the first batch decides the status, after that errors can only truncate the file
+	res, err := scroll.Do()
+	if err != nil && err != io.EOF {
+		writeBackendError(w, r, "Failed to export posts", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="posts.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "created_at", "lat", "lon", "message", "url", "type"})
+
+	total := 0
+	for err == nil {
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				srv.Log.Printf("Skipping post %s in CSV export %v\n", hit.Id, err)
+				continue
+			}
+			created := ""
+			if !p.CreatedAt.IsZero() {
+				created = p.CreatedAt.UTC().Format(time.RFC3339)
+			}
+			cw.Write([]string{
+				p.Id,
+				created,
+				strconv.FormatFloat(p.Location.Lat, 'f', -1, 64),
+				strconv.FormatFloat(p.Location.Lon, 'f', -1, 64),
+				csvSafe(p.Message),
+				p.Url,
+				p.Type,
+			})
+			total++
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			// client went away
+			srv.Log.Printf("CSV export aborted %v\n", err)
+			return
+		}
+		res, err = scroll.Do()
+	}
+	if err != io.EOF {
+		srv.Log.Printf("Failed to scroll posts for CSV %v\n", err)
+	}
+	srv.Log.Printf("Exported %d posts as CSV for %s\n", total, username)
+}
+
+// csvSafe keeps spreadsheets from running a message like =HYPERLINK(...) as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// redis channel every instance publishes new posts to and listens on, channels
+// are not per database so tenants get their own name
+const FEED_CHANNEL = "around:feed:posts"
+
+const (
+	// posts queued for a slow client before it starts missing some
+	FEED_BUFFER = 32
+	// the connection is dropped if a pong is not back within this time
+	FEED_PONG_WAIT   = 60 * time.Second
+	FEED_PING_PERIOD = FEED_PONG_WAIT * 9 / 10
+	FEED_WRITE_WAIT  = 10 * time.Second
+	// subscribe messages are tiny
+	FEED_MAX_MESSAGE = 1024
+	// a live feed over a whole continent is not a feed
+	FEED_MAX_RANGE_KM = 500
+	EARTH_RADIUS_KM   = 6371.0
+)
+
+var feedUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the token is what protects /ws, not the origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// feedSubscription is what the client sends to pick the area it wants to watch,
+// it may send a new one any time, e.g. when the map moves
+type feedSubscription struct {
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Range float64 `json:"range"` // km
+}
+
+func (s feedSubscription) valid() bool {
+	return s.Lat >= -90 && s.Lat <= 90 && s.Lon >= -180 && s.Lon <= 180 &&
+		s.Range > 0 && s.Range <= FEED_MAX_RANGE_KM
+}
+
+// feedEvent is one message to the client
+type feedEvent struct {
+	Type string `json:"type"` // "post" or "error"
+	Post *Post  `json:"post,omitempty"`
+	// for "error"
+	Message string `json:"message,omitempty"`
+}
+
+type feedSubscriber struct {
+	username string
+	send     chan feedEvent
+
+	mu  sync.Mutex
+	sub feedSubscription
+}
+
+func (s *feedSubscriber) area() feedSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sub
+}
+
+func (s *feedSubscriber) setArea(sub feedSubscription) {
+	s.mu.Lock()
+	s.sub = sub
+	s.mu.Unlock()
+}
+
+// feedHub fans new posts out to the websocket clients of this instance
+type feedHub struct {
+	mu   sync.RWMutex
+	subs map[*feedSubscriber]struct{}
+}
+
+func (h *feedHub) add(s *feedSubscriber) {
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *feedHub) remove(s *feedSubscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// broadcast hands p to every subscriber watching its location. A client that
+// can't keep up misses posts instead of slowing everybody else down.
+func (srv *Server) broadcast(p Post) {
+	h := srv.liveFeed
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ev := feedEvent{Type: "post", Post: &p}
+	for s := range h.subs {
+		area := s.area()
+		// nothing subscribed yet
+		if area.Range == 0 {
+			continue
+		}
+		if distanceKm(area.Lat, area.Lon, p.Location.Lat, p.Location.Lon) > area.Range {
+			continue
+		}
+		select {
+		case s.send <- ev:
+		default:
+			srv.Log.Printf("Live feed of %s is full, dropping post %s\n", s.username, p.Id)
+		}
+	}
+}
+
+// publishPost is called once a post is saved. With redis every instance gets it
+// through FEED_CHANNEL, without it only the clients connected here do.
+func (srv *Server) publishPost(p Post) {
+	if srv.Redis == nil {
+		srv.broadcast(p)
+		return
+	}
+	js, err := json.Marshal(p)
+	if err != nil {
+		srv.Log.Printf("Failed to encode post for the live feed %v\n", err)
+		return
+	}
+	if err := srv.Redis.Publish(srv.Names.FeedChannel, js).Err(); err != nil {
+		srv.Log.Printf("Failed to publish post to redis, only local clients get it %v\n", err)
+		srv.broadcast(p)
+	}
+}
+
+// runFeedRelay forwards posts published by any instance to the local clients,
+// needs initSearchCache to have connected redis first.
+func (srv *Server) runFeedRelay() {
+	if srv.Redis == nil {
+		return
+	}
+	pubsub := srv.Redis.Subscribe(srv.Names.FeedChannel)
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		var p Post
+		if err := json.Unmarshal([]byte(msg.Payload), &p); err != nil {
+			srv.Log.Printf("Skipping bad live feed message %v\n", err)
+			continue
+		}
+		srv.broadcast(p)
+	}
+}
+
+// handlerFeed upgrades to a websocket and streams new posts within range of
+// the subscribed location. The first area can be given as lat/lon/range query
+// parameters, later ones are sent as feedSubscription messages.
+func (srv *Server) handlerFeed(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+
+	s := &feedSubscriber{username: username, send: make(chan feedEvent, FEED_BUFFER)}
+	// types are checked by validateRequest already
+	if q := r.URL.Query(); q.Get("lat") != "" && q.Get("lon") != "" {
+		lat, _ := strconv.ParseFloat(q.Get("lat"), 64)
+		lon, _ := strconv.ParseFloat(q.Get("lon"), 64)
+		ran, _ := parseKm(srv.Config.DefaultDistance)
+		if v := q.Get("range"); v != "" {
+			ran, _ = strconv.ParseFloat(v, 64)
+		}
+		sub := feedSubscription{Lat: lat, Lon: lon, Range: ran}
+		if !sub.valid() {
+			writeError(w, r, http.StatusBadRequest, "Invalid lat, lon or range")
+			return
+		}
+		s.setArea(sub)
+	}
+
+	conn, err := feedUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already answered with an error
+		srv.Log.Printf("Websocket upgrade failed for %s %v\n", username, err)
+		return
+	}
+	srv.Log.Printf("Live feed opened by %s\n", username)
+
+	srv.liveFeed.add(s)
+	done := make(chan struct{})
+	go srv.feedWriter(conn, s, done)
+
+	// the read loop only takes new subscriptions and notices when the client is gone
+	conn.SetReadLimit(FEED_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(FEED_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(FEED_PONG_WAIT))
+	})
+	for {
+		var sub feedSubscription
+		if err := conn.ReadJSON(&sub); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				srv.Log.Printf("Live feed of %s closed %v\n", username, err)
+			}
+			break
+		}
+		if !sub.valid() {
+			// the writer owns the connection, tell the client through it
+			select {
+			case s.send <- feedEvent{Type: "error", Message: fmt.Sprintf("lat, lon or range invalid, range is up to %dkm", FEED_MAX_RANGE_KM)}:
+			default:
+			}
+			continue
+		}
+		s.setArea(sub)
+	}
+
+	srv.liveFeed.remove(s)
+	close(done)
+	conn.Close()
+	srv.Log.Printf("Live feed closed by %s\n", username)
+}
+
+// feedWriter is the only goroutine writing to conn, websocket connections
+// support one concurrent writer.
+func (srv *Server) feedWriter(conn *websocket.Conn, s *feedSubscriber, done chan struct{}) {
+	ticker := time.NewTicker(FEED_PING_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-s.send:
+			// checked here and not in broadcast, it may have to ask ES
+			if ev.Post != nil && !srv.inFeed(s.username, ev.Post.User) {
+				continue
+			}
+			// what a quote shows depends on the viewer, ev.Post is shared with the other subscribers
+			if ev.Post != nil && ev.Post.QuoteOf != "" {
+				ev.Post = &srv.withQuotes(s.username, []Post{*ev.Post})[0]
+			}
+			conn.SetWriteDeadline(time.Now().Add(FEED_WRITE_WAIT))
+			if err := conn.WriteJSON(ev); err != nil {
+				conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(FEED_WRITE_WAIT)); err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(FEED_WRITE_WAIT))
+			return
+		}
+	}
+}
+
+// distanceKm is the great circle distance (haversine)
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Sqrt(a))
+}
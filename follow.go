@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_FOLLOW = "follow"
+
+	FOLLOW_PENDING  = "pending"
+	FOLLOW_ACCEPTED = "accepted"
+
+	// how long other instances may use an old privacy setting or follow list
+	PRIVACY_CACHE_TTL = time.Minute
+	// users whose follow or mute lists are kept, the map starts over beyond that
+	USER_SETS_CACHE_SIZE = 10000
+)
+
+// Follow is stored in INDEX with id follower>followee. Follows of public
+// accounts are accepted right away, of private ones they wait for the followee.
+type Follow struct {
+	Follower  string    `json:"follower"`
+	Followee  string    `json:"followee"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// usernames can't contain '>'
+func followID(follower, followee string) string {
+	return follower + ">" + followee
+}
+
+// canSee tells whether viewer may see the posts of author: always their own,
+// those of public accounts, and those of private accounts they follow. viewer
+// is "" for anonymous requests. When ES can't tell, the post stays hidden.
+func (srv *Server) canSee(viewer, author string) bool {
+	if viewer == author {
+		return true
+	}
+	private, err := srv.isPrivate(author)
+	if err != nil {
+		srv.Log.Printf("Failed to load private accounts, hiding posts of %s %v\n", author, err)
+		return false
+	}
+	if !private {
+		return true
+	}
+	if viewer == "" {
+		return false
+	}
+	followees, err := srv.followingCache.get(viewer)
+	if err != nil {
+		srv.Log.Printf("Failed to load follows of %s %v\n", viewer, err)
+		return false
+	}
+	return followees[author]
+}
+
+// visiblePosts is ps without the posts viewer may not see, ps itself is not changed
+func (srv *Server) visiblePosts(viewer string, ps []Post) []Post {
+	visible := make([]Post, 0, len(ps))
+	for _, p := range ps {
+		if srv.canSee(viewer, p.User) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
+
+// private accounts, loaded at once since there are few and every search needs them
+type privateUsers struct {
+	sync.Mutex
+	users    map[string]bool
+	loadedAt time.Time
+}
+
+func (srv *Server) isPrivate(username string) (bool, error) {
+	srv.privateCache.Lock()
+	defer srv.privateCache.Unlock()
+	if srv.privateCache.users == nil || time.Since(srv.privateCache.loadedAt) >= PRIVACY_CACHE_TTL {
+		client, err := srv.es()
+		if err != nil {
+			return false, err
+		}
+		var res *elastic.SearchResult
+		err = esRetry(func() error {
+			var err error
+			res, err = client.Search().
+				Index(srv.Names.Index).
+				Type(TYPE_USER).
+				Query(elastic.NewTermQuery("private", true)).
+				Size(10000).
+				Do()
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		users := map[string]bool{}
+		for _, hit := range res.Hits.Hits {
+			var u User
+			if hit.Source != nil && json.Unmarshal(*hit.Source, &u) == nil {
+				users[u.Username] = true
+			}
+		}
+		srv.privateCache.users = users
+		srv.privateCache.loadedAt = time.Now()
+	}
+	return srv.privateCache.users[username], nil
+}
+
+// invalidatePrivateUsers is called when someone changes their privacy setting
+func (srv *Server) invalidatePrivateUsers() {
+	srv.privateCache.Lock()
+	srv.privateCache.users = nil
+	srv.privateCache.Unlock()
+}
+
+// userSets caches a set of usernames per user, like whom they follow or mute
+type userSets struct {
+	mu     sync.Mutex
+	byUser map[string]userSetEntry
+	load   func(username string) (map[string]bool, error)
+}
+
+type userSetEntry struct {
+	set      map[string]bool
+	loadedAt time.Time
+}
+
+func newUserSets(load func(username string) (map[string]bool, error)) *userSets {
+	return &userSets{byUser: map[string]userSetEntry{}, load: load}
+}
+
+func (c *userSets) get(username string) (map[string]bool, error) {
+	c.mu.Lock()
+	e, ok := c.byUser[username]
+	c.mu.Unlock()
+	if ok && time.Since(e.loadedAt) < PRIVACY_CACHE_TTL {
+		return e.set, nil
+	}
+
+	set, err := c.load(username)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.byUser) >= USER_SETS_CACHE_SIZE {
+		c.byUser = map[string]userSetEntry{}
+	}
+	c.byUser[username] = userSetEntry{set: set, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return set, nil
+}
+
+func (c *userSets) invalidate(username string) {
+	c.mu.Lock()
+	delete(c.byUser, username)
+	c.mu.Unlock()
+}
+
+// loadFollowing is the loader of followingCache, whom viewer follows
+func (srv *Server) loadFollowing(viewer string) (map[string]bool, error) {
+	follows, err := srv.queryFollows(elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("follower", viewer),
+		elastic.NewTermQuery("state", FOLLOW_ACCEPTED)))
+	if err != nil {
+		return nil, err
+	}
+	followees := map[string]bool{}
+	for _, f := range follows {
+		followees[f.Followee] = true
+	}
+	return followees, nil
+}
+
+func (srv *Server) queryFollows(q elastic.Query) ([]Follow, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_FOLLOW).
+			Query(q).
+			Size(10000).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	follows := []Follow{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var f Follow
+		if err := json.Unmarshal(*hit.Source, &f); err != nil {
+			srv.Log.Printf("Skipping follow %s %v\n", hit.Id, err)
+			continue
+		}
+		follows = append(follows, f)
+	}
+	return follows, nil
+}
+
+// getFollow returns nil when follower doesn't follow or asked to follow followee
+func (srv *Server) getFollow(follower, followee string) (*Follow, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_FOLLOW).Id(followID(follower, followee)).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var f Follow
+	if err := json.Unmarshal(*res.Source, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (srv *Server) saveFollow(f Follow) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_FOLLOW).
+			Id(followID(f.Follower, f.Followee)).
+			BodyJson(f).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	srv.followingCache.invalidate(f.Follower)
+	return nil
+}
+
+func (srv *Server) deleteFollow(follower, followee string) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	err = esRetry(func() error {
+		_, err := client.Delete().
+			Index(srv.Names.Index).
+			Type(TYPE_FOLLOW).
+			Id(followID(follower, followee)).
+			Refresh(true).
+			Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	srv.followingCache.invalidate(follower)
+	return nil
+}
+
+// acceptPendingFollows accepts every request to followee, when the account goes public
+func (srv *Server) acceptPendingFollows(followee string) {
+	follows, err := srv.queryFollows(elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("followee", followee),
+		elastic.NewTermQuery("state", FOLLOW_PENDING)))
+	if err != nil {
+		srv.Log.Printf("Failed to load follow requests of %s %v\n", followee, err)
+		return
+	}
+	for _, f := range follows {
+		f.State = FOLLOW_ACCEPTED
+		if err := srv.saveFollow(f); err != nil {
+			srv.Log.Printf("Failed to accept follow of %s by %s %v\n", followee, f.Follower, err)
+		}
+	}
+}
+
+// handlerFollow follows a user, or asks to when the account is private:
+//
+//	POST /users/{username}/follow
+func (srv *Server) handlerFollow(w http.ResponseWriter, r *http.Request) {
+	follower := usernameFromToken(r)
+	followee := mux.Vars(r)["username"]
+	srv.Log.Printf("Received one follow of %s by %s\n", followee, follower)
+	if follower == followee {
+		writeError(w, r, http.StatusBadRequest, "Cannot follow yourself")
+		return
+	}
+	u, ok := srv.getUser(followee)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+
+	f, err := srv.getFollow(follower, followee)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read follow", err)
+		return
+	}
+	status := http.StatusOK
+	if f == nil {
+		f = &Follow{Follower: follower, Followee: followee, State: FOLLOW_ACCEPTED, CreatedAt: time.Now().UTC()}
+		if u.Private {
+			f.State = FOLLOW_PENDING
+		}
+		if err := srv.saveFollow(*f); err != nil {
+			writeBackendError(w, r, "Failed to save follow", err)
+			return
+		}
+		status = http.StatusCreated
+		message := follower + " followed you"
+		if f.State == FOLLOW_PENDING {
+			message = follower + " asked to follow you"
+		}
+		srv.notifyLater(Notification{
+			User:    followee,
+			Kind:    "follow",
+			Message: message,
+			Data:    map[string]string{"follower": follower, "state": f.State},
+		})
+	}
+	writeFollow(w, status, *f)
+}
+
+// handlerUnfollow ends a follow or withdraws a pending request
+func (srv *Server) handlerUnfollow(w http.ResponseWriter, r *http.Request) {
+	follower := usernameFromToken(r)
+	followee := mux.Vars(r)["username"]
+	if err := srv.deleteFollow(follower, followee); err != nil {
+		writeBackendError(w, r, "Failed to delete follow", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerFollowRequests lists who is waiting for the caller to accept them
+func (srv *Server) handlerFollowRequests(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	follows, err := srv.queryFollows(elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("followee", username),
+		elastic.NewTermQuery("state", FOLLOW_PENDING)))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read follow requests", err)
+		return
+	}
+	js, _ := json.Marshal(follows)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerAcceptFollow lets {username} see the caller's posts
+func (srv *Server) handlerAcceptFollow(w http.ResponseWriter, r *http.Request) {
+	followee := usernameFromToken(r)
+	follower := mux.Vars(r)["username"]
+	f, ok := srv.pendingFollow(w, r, follower, followee)
+	if !ok {
+		return
+	}
+	f.State = FOLLOW_ACCEPTED
+	if err := srv.saveFollow(*f); err != nil {
+		writeBackendError(w, r, "Failed to accept follow", err)
+		return
+	}
+	srv.Log.Printf("%s accepted the follow request of %s\n", followee, follower)
+	srv.notifyLater(Notification{
+		User:    follower,
+		Kind:    "follow",
+		Message: followee + " accepted your follow request",
+		Data:    map[string]string{"followee": followee, "state": f.State},
+	})
+	writeFollow(w, http.StatusOK, *f)
+}
+
+// handlerDeclineFollow drops the request, {username} may ask again
+func (srv *Server) handlerDeclineFollow(w http.ResponseWriter, r *http.Request) {
+	followee := usernameFromToken(r)
+	follower := mux.Vars(r)["username"]
+	if _, ok := srv.pendingFollow(w, r, follower, followee); !ok {
+		return
+	}
+	if err := srv.deleteFollow(follower, followee); err != nil {
+		writeBackendError(w, r, "Failed to decline follow", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pendingFollow loads the request of follower, answering 404 if there is none
+func (srv *Server) pendingFollow(w http.ResponseWriter, r *http.Request, follower, followee string) (*Follow, bool) {
+	f, err := srv.getFollow(follower, followee)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read follow", err)
+		return nil, false
+	}
+	if f == nil || f.State != FOLLOW_PENDING {
+		writeError(w, r, http.StatusNotFound, "No follow request from "+follower)
+		return nil, false
+	}
+	return f, true
+}
+
+func writeFollow(w http.ResponseWriter, status int, f Follow) {
+	js, _ := json.Marshal(f)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/TianyiSun2333/Around/blobstore"
+)
+
+// the web app, copied into web/ before `go build`. Only a placeholder page is
+// checked in, deployments with their own copy set frontend in the config.
+//
+//go:embed web
+var embeddedWeb embed.FS
+
+const (
+	// the SPA build puts content hashed files here, they never change
+	FRONTEND_ASSET_DIR = "/static/"
+	FRONTEND_INDEX     = "index.html"
+)
+
+// frontendHandler serves the SPA from where config.Frontend says: "embed",
+// a local directory, or gs://bucket/prefix. Paths that are not a file get
+// index.html so the client side router can handle them.
+func (srv *Server) frontendHandler() (http.Handler, error) {
+	switch {
+	case srv.Config.Frontend == "embed":
+		web, err := fs.Sub(embeddedWeb, "web")
+		if err != nil {
+			return nil, err
+		}
+		return spaHandler{web}, nil
+
+	case strings.HasPrefix(srv.Config.Frontend, "gs://"):
+		bucket, prefix := srv.Config.Frontend[len("gs://"):], ""
+		if i := strings.Index(bucket, "/"); i >= 0 {
+			bucket, prefix = bucket[:i], strings.Trim(bucket[i+1:], "/")
+		}
+		// no retries, a failed page load is retried by the browser
+		files := &blobstore.GCS{Bucket: bucket, Client: srv.gcs}
+		return gcsFrontend{files: files, prefix: prefix, log: srv.Log}, nil
+	}
+
+	if info, err := os.Stat(srv.Config.Frontend); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("frontend %s is not a directory", srv.Config.Frontend)
+	}
+	return spaHandler{os.DirFS(srv.Config.Frontend)}, nil
+}
+
+type spaHandler struct {
+	files fs.FS
+}
+
+func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = FRONTEND_INDEX
+	}
+	if info, err := fs.Stat(h.files, name); err != nil || info.IsDir() {
+		if !spaRoute(name) {
+			http.NotFound(w, r)
+			return
+		}
+		name = FRONTEND_INDEX
+	}
+	f, err := h.files.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	content, ok := f.(io.ReadSeeker)
+	if err != nil || !ok {
+		http.Error(w, "Failed to load the page", http.StatusInternalServerError)
+		return
+	}
+	setFrontendCache(w, name)
+	// ServeContent does the Range, If-Modified-Since and content type handling
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// gcsFrontend serves the SPA from a bucket, so a new frontend is a gsutil rsync away
+type gcsFrontend struct {
+	files  blobstore.Store
+	prefix string
+	log    *log.Logger
+}
+
+func (h gcsFrontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" {
+		name = FRONTEND_INDEX
+	}
+	obj, err := h.files.Open(r.Context(), path.Join(h.prefix, name))
+	if err == blobstore.ErrNotExist && spaRoute(name) {
+		name = FRONTEND_INDEX
+		obj, err = h.files.Open(r.Context(), path.Join(h.prefix, name))
+	}
+	if err == blobstore.ErrNotExist {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.log.Printf("Failed to read frontend file %s from GCS %v\n", name, err)
+		http.Error(w, "Failed to load the page", http.StatusBadGateway)
+		return
+	}
+	defer obj.Close()
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = obj.ContentType
+	}
+	w.Header().Set("Content-Type", ctype)
+	setFrontendCache(w, name)
+	io.Copy(w, obj)
+}
+
+// spaRoute tells a client side route like /user/alice from a missing file like /logo.png
+func spaRoute(name string) bool {
+	return path.Ext(name) == ""
+}
+
+func setFrontendCache(w http.ResponseWriter, name string) {
+	switch {
+	case name == FRONTEND_INDEX:
+		// it names the current assets, always check for a new one
+		w.Header().Set("Cache-Control", "no-cache")
+	case strings.HasPrefix("/"+name, FRONTEND_ASSET_DIR):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+}
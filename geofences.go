@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_GEOFENCE = "geofence"
+	// geofences are matched in memory like webhooks, reloaded this often
+	GEOFENCE_CACHE_TTL    = time.Minute
+	GEOFENCE_MAX_PER_USER = 10
+	GEOFENCE_MAX_NAME     = 50
+	// a busy area alerts its owner once in this long, not for every post
+	GEOFENCE_COOLDOWN = 10 * time.Minute
+)
+
+// Geofence is an area a user wants to hear about, every new post inside is a
+// "geofence" notification for them
+type Geofence struct {
+	Id        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	Location  Location  `json:"location"`
+	Range     float64   `json:"range"` // km
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// body of POST /geofences
+type geofenceRequest struct {
+	Name  string  `json:"name"`
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Range float64 `json:"range"`
+}
+
+// the geofences of every user, checked against each new post
+type geofenceSet struct {
+	sync.Mutex
+	fences   []Geofence
+	loadedAt time.Time
+	// geofence id -> last alert, for GEOFENCE_COOLDOWN
+	alertedAt map[string]time.Time
+}
+
+func (srv *Server) allGeofences() ([]Geofence, error) {
+	srv.geofenceCache.Lock()
+	defer srv.geofenceCache.Unlock()
+	if srv.geofenceCache.fences != nil && time.Since(srv.geofenceCache.loadedAt) < GEOFENCE_CACHE_TTL {
+		return srv.geofenceCache.fences, nil
+	}
+	fences, err := srv.queryGeofences(elastic.NewMatchAllQuery(), 10000)
+	if err != nil {
+		return nil, err
+	}
+	srv.geofenceCache.fences = fences
+	srv.geofenceCache.loadedAt = time.Now()
+	return fences, nil
+}
+
+func (srv *Server) invalidateGeofences() {
+	srv.geofenceCache.Lock()
+	srv.geofenceCache.fences = nil
+	srv.geofenceCache.Unlock()
+}
+
+func (srv *Server) queryGeofences(q elastic.Query, size int) ([]Geofence, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_GEOFENCE).
+			Query(q).
+			Sort("created_at", true).
+			Size(size).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fences := []Geofence{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var g Geofence
+		if err := json.Unmarshal(*hit.Source, &g); err != nil {
+			srv.Log.Printf("Skipping geofence %s %v\n", hit.Id, err)
+			continue
+		}
+		fences = append(fences, g)
+	}
+	return fences, nil
+}
+
+// cooledDown is true, and starts the next cooldown, when g may alert again
+func (srv *Server) cooledDown(g Geofence, now time.Time) bool {
+	srv.geofenceCache.Lock()
+	defer srv.geofenceCache.Unlock()
+	if srv.geofenceCache.alertedAt == nil {
+		srv.geofenceCache.alertedAt = map[string]time.Time{}
+	}
+	if now.Sub(srv.geofenceCache.alertedAt[g.Id]) < GEOFENCE_COOLDOWN {
+		return false
+	}
+	srv.geofenceCache.alertedAt[g.Id] = now
+	return true
+}
+
+// notifyGeofences alerts the owners of the geofences p is in, called after a
+// post is saved. Owners only hear of posts their feed would show.
+func (srv *Server) notifyGeofences(p Post) {
+	fences, err := srv.allGeofences()
+	if err != nil {
+		srv.Log.Printf("Failed to load geofences, post %s not matched %v\n", p.Id, err)
+		return
+	}
+	now := time.Now()
+	for _, g := range fences {
+		if g.Owner == p.User || distanceKm(g.Location.Lat, g.Location.Lon, p.Location.Lat, p.Location.Lon) > g.Range {
+			continue
+		}
+		if !srv.inFeed(g.Owner, p.User) || !srv.cooledDown(g, now) {
+			continue
+		}
+		srv.notifyLater(Notification{
+			User:    g.Owner,
+			Kind:    "geofence",
+			Message: fmt.Sprintf("%s posted in %s", p.User, g.Name),
+			Data:    map[string]string{"geofence_id": g.Id, "post_id": p.Id},
+		})
+	}
+}
+
+// handlerCreateGeofence adds an area the caller gets alerts for
+//
+//	POST /geofences {"name":"Home","lat":..,"lon":..,"range":2}
+func (srv *Server) handlerCreateGeofence(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req geofenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode geofence")
+		return
+	}
+	// lat, lon and range are checked by validateRequest already
+	req.Name = strings.TrimSpace(req.Name)
+	if n := utf8.RuneCountInString(req.Name); n == 0 || n > GEOFENCE_MAX_NAME {
+		writeValidationError(w, r, []fieldError{{Name: "name", In: "body", Message: fmt.Sprintf("must be 1 to %d characters", GEOFENCE_MAX_NAME)}})
+		return
+	}
+	own, err := srv.queryGeofences(elastic.NewTermQuery("owner", username), GEOFENCE_MAX_PER_USER)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read geofences", err)
+		return
+	}
+	if len(own) >= GEOFENCE_MAX_PER_USER {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("At most %d geofences per user", GEOFENCE_MAX_PER_USER))
+		return
+	}
+
+	now := time.Now().UTC()
+	g := Geofence{
+		Id:        newPostID(now),
+		Owner:     username,
+		Name:      req.Name,
+		Location:  Location{Lat: req.Lat, Lon: req.Lon},
+		Range:     req.Range,
+		CreatedAt: now,
+	}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_GEOFENCE).
+			Id(g.Id).
+			BodyJson(g).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to save geofence", err)
+		return
+	}
+	srv.invalidateGeofences()
+	srv.Log.Printf("Geofence %s created by %s\n", g.Id, username)
+
+	js, _ := json.Marshal(g)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handlerListGeofences lists the geofences of the caller, oldest first
+func (srv *Server) handlerListGeofences(w http.ResponseWriter, r *http.Request) {
+	fences, err := srv.queryGeofences(elastic.NewTermQuery("owner", usernameFromToken(r)), GEOFENCE_MAX_PER_USER)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read geofences", err)
+		return
+	}
+	js, _ := json.Marshal(fences)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerDeleteGeofence stops the alerts of one geofence of the caller
+//
+//	DELETE /geofences/{id}
+func (srv *Server) handlerDeleteGeofence(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	id := mux.Vars(r)["id"]
+	fences, err := srv.queryGeofences(elastic.NewIdsQuery(TYPE_GEOFENCE).Ids(id), 1)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read geofence", err)
+		return
+	}
+	// somebody else's geofence is as missing as one that doesn't exist
+	if len(fences) == 0 || fences[0].Owner != username {
+		writeError(w, r, http.StatusNotFound, "Geofence not found")
+		return
+	}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_GEOFENCE).Id(id).Refresh(true).Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to delete geofence", err)
+		return
+	}
+	srv.invalidateGeofences()
+	w.WriteHeader(http.StatusNoContent)
+}
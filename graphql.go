@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// default and maximum for the first: argument of post lists
+	GRAPHQL_PAGE_SIZE = 20
+	GRAPHQL_MAX_PAGE  = 100
+	// post -> author -> posts -> author ... has to end somewhere
+	GRAPHQL_MAX_DEPTH = 6
+)
+
+// graphqlSchemaText is served at /api/v1/graphql. Every field is resolved lazily,
+// so a query only costs the lookups for the fields it asks for: search results
+// without author never read a user.
+const graphqlSchemaText = `
+schema {
+	query: Query
+}
+
+type Query {
+	# the caller
+	me: User
+	user(username: String!): User
+	post(id: ID!): Post
+	# posts within range km (server default when missing) of lat/lon, of one
+	# category of GET /categories when given
+	search(lat: Float!, lon: Float!, range: Float, category: String): [Post!]!
+}
+
+type Post {
+	id: ID!
+	message: String!
+	url: String!
+	type: String!
+	face: Float!
+	category: String
+	location: Location!
+	createdAt: String
+	updatedAt: String
+	author: User
+}
+
+type Location {
+	lat: Float!
+	lon: Float!
+}
+
+type User {
+	username: String!
+	age: Int
+	gender: String
+	# newest first
+	posts(first: Int = 20): [Post!]!
+}
+`
+
+// graphqlSchema is the schema with its resolvers, made once by runServe
+func (srv *Server) graphqlSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchemaText, &graphqlResolver{srv},
+		graphql.MaxDepth(GRAPHQL_MAX_DEPTH))
+}
+
+type graphqlResolver struct {
+	srv *Server
+}
+
+func (q *graphqlResolver) Me(ctx context.Context) *userResolver {
+	return q.srv.lookupUser(usernameFromContext(ctx))
+}
+
+func (q *graphqlResolver) User(args struct{ Username string }) *userResolver {
+	return q.srv.lookupUser(args.Username)
+}
+
+func (q *graphqlResolver) Post(ctx context.Context, args struct{ ID graphql.ID }) (*postResolver, error) {
+	client, err := q.srv.es()
+	if err != nil {
+		return nil, err
+	}
+	_, p, err := q.srv.findPost(client, string(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	// deleted is the same as missing, like GET /post/{id}
+	if p == nil || p.hidden() || !q.srv.canSee(usernameFromContext(ctx), p.User) {
+		return nil, nil
+	}
+	return &postResolver{q.srv, *p}, nil
+}
+
+func (q *graphqlResolver) Search(ctx context.Context, args struct {
+	Lat      float64
+	Lon      float64
+	Range    *float64
+	Category *string
+}) ([]*postResolver, error) {
+	if args.Lat < -90 || args.Lat > 90 || args.Lon < -180 || args.Lon > 180 {
+		return nil, fmt.Errorf("lat/lon out of range")
+	}
+	ran := q.srv.Config.DefaultDistance
+	if args.Range != nil {
+		if *args.Range < 0 || *args.Range > SEARCH_MAX_RANGE_KM {
+			return nil, fmt.Errorf("range must be 0 to %d km", SEARCH_MAX_RANGE_KM)
+		}
+		ran = fmt.Sprintf("%gkm", *args.Range)
+	}
+	var category string
+	var filters []string
+	if args.Category != nil {
+		if !contains(categoryIds(), *args.Category) {
+			return nil, fmt.Errorf("category must be one of %s", strings.Join(categoryIds(), ", "))
+		}
+		category = *args.Category
+		filters = append(filters, "category="+category)
+	}
+
+	// same cache as /search, it holds every post and is filtered per viewer
+	viewer := usernameFromContext(ctx)
+	key := searchCacheKey(args.Lat, args.Lon, ran, filters...)
+	var cached searchHits
+	if js, ok := q.srv.getCachedSearch(key); ok && json.Unmarshal(js, &cached) == nil {
+		return q.srv.postResolvers(q.srv.feedPosts(viewer, cached.Posts)), nil
+	}
+	ps, total, err := q.srv.searchNearby(args.Lat, args.Lon, ran, category, "", time.Time{}, time.Time{}, SEARCH_PAGE_SIZE, nil)
+	if err != nil {
+		return nil, err
+	}
+	if js, err := json.Marshal(searchHits{Posts: ps, Total: total}); err == nil {
+		q.srv.cacheSearch(key, args.Lat, args.Lon, ran, js)
+	}
+	return q.srv.postResolvers(q.srv.feedPosts(viewer, ps)), nil
+}
+
+func (srv *Server) lookupUser(username string) *userResolver {
+	if username == "" {
+		return nil
+	}
+	u, ok := srv.getUser(username)
+	if !ok {
+		return nil
+	}
+	return &userResolver{srv, u}
+}
+
+type postResolver struct {
+	srv *Server
+	p   Post
+}
+
+func (srv *Server) postResolvers(ps []Post) []*postResolver {
+	rs := make([]*postResolver, len(ps))
+	for i := range ps {
+		rs[i] = &postResolver{srv, ps[i]}
+	}
+	return rs
+}
+
+func (r *postResolver) ID() graphql.ID        { return graphql.ID(r.p.Id) }
+func (r *postResolver) Message() string       { return r.p.Message }
+func (r *postResolver) Url() string           { return r.p.Url }
+func (r *postResolver) Type() string          { return r.p.Type }
+func (r *postResolver) Face() float64         { return r.p.Face }
+func (r *postResolver) Author() *userResolver { return r.srv.lookupUser(r.p.User) }
+
+func (r *postResolver) Location() *locationResolver {
+	return &locationResolver{r.p.Location}
+}
+
+func (r *postResolver) Category() *string {
+	if r.p.Category == "" {
+		return nil
+	}
+	return &r.p.Category
+}
+
+// posts from before created_at existed have none
+func (r *postResolver) CreatedAt() *string {
+	if r.p.CreatedAt.IsZero() {
+		return nil
+	}
+	return formatTime(r.p.CreatedAt)
+}
+
+func (r *postResolver) UpdatedAt() *string {
+	if r.p.UpdatedAt == nil {
+		return nil
+	}
+	return formatTime(*r.p.UpdatedAt)
+}
+
+func formatTime(t time.Time) *string {
+	s := t.UTC().Format(time.RFC3339)
+	return &s
+}
+
+type locationResolver struct {
+	l Location
+}
+
+func (r *locationResolver) Lat() float64 { return r.l.Lat }
+func (r *locationResolver) Lon() float64 { return r.l.Lon }
+
+type userResolver struct {
+	srv *Server
+	u   User
+}
+
+func (r *userResolver) Username() string { return r.u.Username }
+
+func (r *userResolver) Age() *int32 {
+	if r.u.age(time.Now()) == 0 {
+		return nil
+	}
+	age := int32(r.u.age(time.Now()))
+	return &age
+}
+
+func (r *userResolver) Gender() *string {
+	if r.u.Gender == "" {
+		return nil
+	}
+	return &r.u.Gender
+}
+
+func (r *userResolver) Posts(ctx context.Context, args struct{ First int32 }) ([]*postResolver, error) {
+	if !r.srv.canSee(usernameFromContext(ctx), r.u.Username) {
+		return []*postResolver{}, nil
+	}
+	first := int(args.First)
+	if first <= 0 {
+		first = GRAPHQL_PAGE_SIZE
+	}
+	if first > GRAPHQL_MAX_PAGE {
+		first = GRAPHQL_MAX_PAGE
+	}
+	ps, _, err := r.srv.postsByUser(r.u.Username, 0, first)
+	if err != nil {
+		return nil, err
+	}
+	return r.srv.postResolvers(ps), nil
+}
+
+// postsByUser returns a page of the posts of username, newest first, and how many there are
+func (srv *Server) postsByUser(username string, from, size int) ([]Post, int64, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, 0, err
+	}
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user", username), notDeleted())
+
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			Sort("created_at", false).
+			From(from).
+			Size(size).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ps []Post
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			srv.Log.Printf("Skipping post %s %v\n", hit.Id, err)
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps, res.TotalHits(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// guest tokens let the app show what is around before anyone signs up
+const (
+	TOKEN_KIND_GUEST = "guest"
+	GUEST_TOKEN_TTL  = time.Hour
+)
+
+// the operations a guest token may call, anything else is 403
+var guestAllowed = []string{"searchPosts", "searchPostsV2", "listCategories", "getTile", "getMedia"}
+
+// handlerGuestToken hands out a guest token without credentials. It has no
+// username, so requests with it see what signed out users may see, and it is
+// rate limited like anonymous requests by client address, a new token doesn't
+// get a new budget.
+//
+//	POST /guest
+func (srv *Server) handlerGuestToken(w http.ResponseWriter, r *http.Request) {
+	tokenString, err := srv.Tokens.Sign(jwt.MapClaims{
+		"kind": TOKEN_KIND_GUEST,
+		"exp":  time.Now().Add(GUEST_TOKEN_TTL).Unix(),
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to sign token", err)
+		return
+	}
+	srv.Log.Printf("Guest token issued to %s\n", srv.clientIP(r))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(tokenString))
+}
+
+// isGuest reports whether the request comes with a guest token
+func isGuest(r *http.Request) bool {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		return false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	return claims["kind"] == TOKEN_KIND_GUEST
+}
+
+// tokenScope is the operations the token of r may call, guestAllowed for
+// guests and the scope claim of service accounts. scoped is false for user
+// tokens, they may call everything.
+func tokenScope(r *http.Request) (scope []string, scoped bool) {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		return nil, false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	switch claims["kind"] {
+	case TOKEN_KIND_GUEST:
+		return guestAllowed, true
+	case TOKEN_KIND_SERVICE:
+		// a JSON array once it went through the token
+		list, _ := claims["scope"].([]interface{})
+		for _, s := range list {
+			if op, ok := s.(string); ok {
+				scope = append(scope, op)
+			}
+		}
+		return scope, true
+	}
+	return nil, false
+}
+
+// scopeMiddleware keeps guest and service account tokens to their scope, see
+// tokenScope. Runs after the token check, every handler behind it can count
+// on a username unless it is in guestAllowed.
+func (srv *Server) scopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, scoped := tokenScope(r)
+		if !scoped {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if op, ok := operationFor(r); ok && contains(scope, op.OperationID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isGuest(r) {
+			writeError(w, r, http.StatusForbidden, "Guests can only search, sign up to do more")
+			return
+		}
+		srv.Log.Printf("Rejected %s %s outside the scope of %s\n", r.Method, r.URL.Path, usernameFromToken(r))
+		writeError(w, r, http.StatusForbidden, "Not in the scope of this token")
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Messages are written in English where they happen and translated on the way
+// out, per Accept-Language. locales/<language>.json maps the English text to
+// the translation. Messages built with fmt have the verbs of their format in
+// the key, the translation takes the values in the same order or picks them
+// with %[n]v:
+//
+//	"must be at least %d characters": "muss mindestens %v Zeichen lang sein"
+//	"Account suspended until %s":     "账号已被暂停至 %v"
+//
+// Messages missing from a catalog stay English, the code of an error is never
+// translated.
+//
+//go:embed locales
+var embeddedLocales embed.FS
+
+// the language messages are written in
+const DEFAULT_LANGUAGE = "en"
+
+// messageCatalog is the translations of one language
+type messageCatalog struct {
+	exact map[string]string
+	// keys with verbs, longest literal text first so "must be at least %d
+	// characters" is tried before "must be at least %v"
+	patterns []messagePattern
+}
+
+type messagePattern struct {
+	re          *regexp.Regexp
+	translation string
+	// length of the key without its verbs
+	literal int
+}
+
+var (
+	// language -> catalog, loaded at startup
+	catalogs = mustLoadCatalogs()
+
+	formatVerb  = regexp.MustCompile(`%[vdsq]`)
+	indexedVerb = regexp.MustCompile(`%\[(\d+)\][vdsq]`)
+)
+
+func mustLoadCatalogs() map[string]*messageCatalog {
+	files, err := embeddedLocales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]*messageCatalog{}
+	for _, f := range files {
+		data, err := embeddedLocales.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		c := &messageCatalog{exact: map[string]string{}}
+		for key, translation := range messages {
+			if !formatVerb.MatchString(key) {
+				c.exact[key] = translation
+				continue
+			}
+			parts := formatVerb.Split(key, -1)
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			c.patterns = append(c.patterns, messagePattern{
+				re:          regexp.MustCompile("^" + strings.Join(parts, "(.+?)") + "$"),
+				translation: translation,
+				literal:     len(formatVerb.ReplaceAllString(key, "")),
+			})
+		}
+		sort.Slice(c.patterns, func(i, j int) bool { return c.patterns[i].literal > c.patterns[j].literal })
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = c
+	}
+	return catalogs
+}
+
+// translate is message in lang, message itself when the catalog doesn't have it
+func translate(lang, message string) string {
+	c, ok := catalogs[lang]
+	if !ok {
+		return message
+	}
+	if t, ok := c.exact[message]; ok {
+		return t
+	}
+	for _, p := range c.patterns {
+		m := p.re.FindStringSubmatch(message)
+		if m == nil {
+			continue
+		}
+		args := m[1:]
+		t := indexedVerb.ReplaceAllStringFunc(p.translation, func(v string) string {
+			n, _ := strconv.Atoi(indexedVerb.FindStringSubmatch(v)[1])
+			if n < 1 || n > len(args) {
+				return v
+			}
+			return args[n-1]
+		})
+		next := 0
+		return formatVerb.ReplaceAllStringFunc(t, func(v string) string {
+			if next >= len(args) {
+				return v
+			}
+			next++
+			return args[next-1]
+		})
+	}
+	return message
+}
+
+// requestLanguage is the language of the Accept-Language header the catalogs
+// have, from the highest q down. A region falls back to its language, de-AT
+// gets de. DEFAULT_LANGUAGE when none fits.
+func requestLanguage(r *http.Request) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	// stable, equal q keeps the order of the header
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if c.lang == DEFAULT_LANGUAGE || strings.HasPrefix(c.lang, DEFAULT_LANGUAGE+"-") {
+			return DEFAULT_LANGUAGE
+		}
+		if _, ok := catalogs[c.lang]; ok {
+			return c.lang
+		}
+		if i := strings.Index(c.lang, "-"); i > 0 {
+			if _, ok := catalogs[c.lang[:i]]; ok {
+				return c.lang[:i]
+			}
+		}
+	}
+	return DEFAULT_LANGUAGE
+}
+
+// localize is message in the language of r and says so in the response
+func localize(w http.ResponseWriter, r *http.Request, message string) string {
+	lang := requestLanguage(r)
+	h := w.Header()
+	h.Set("Content-Language", lang)
+	if !strings.Contains(strings.Join(h["Vary"], ","), "Accept-Language") {
+		h.Add("Vary", "Accept-Language")
+	}
+	return translate(lang, message)
+}
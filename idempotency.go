@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// mobile clients retry within minutes, a day is plenty
+	IDEMPOTENCY_TTL = 24 * time.Hour
+	// stored while the first request is still running
+	idempotencyPending = "pending"
+)
+
+// used when redis is not setup, only protects retries that hit the same instance
+type localIdempotencyEntries struct {
+	sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	value   string
+	expires time.Time
+}
+
+func idempotencyKey(username, key string) string {
+	return "idem:" + username + ":" + key
+}
+
+// claimIdempotencyKey reserves the key for a new post. If the key was seen before
+// it returns the post id stored for it, or idempotencyPending while that request
+// is still in flight; claimed is true only for the first request.
+func (srv *Server) claimIdempotencyKey(key string) (existing string, claimed bool) {
+	if srv.Redis != nil {
+		ok, err := srv.Redis.SetNX(key, idempotencyPending, IDEMPOTENCY_TTL).Result()
+		if err == nil {
+			if ok {
+				return "", true
+			}
+			val, err := srv.Redis.Get(key).Result()
+			if err == nil {
+				return val, false
+			}
+		}
+		srv.Log.Printf("Redis idempotency lookup failed, using local store %v\n", err)
+	}
+
+	srv.localIdempotency.Lock()
+	defer srv.localIdempotency.Unlock()
+	if e, ok := srv.localIdempotency.entries[key]; ok && time.Now().Before(e.expires) {
+		return e.value, false
+	}
+	srv.localIdempotency.entries[key] = idempotencyEntry{idempotencyPending, time.Now().Add(IDEMPOTENCY_TTL)}
+	return "", true
+}
+
+// completeIdempotencyKey remembers which post the key created
+func (srv *Server) completeIdempotencyKey(key, postID string) {
+	if srv.Redis != nil {
+		if err := srv.Redis.Set(key, postID, IDEMPOTENCY_TTL).Err(); err == nil {
+			return
+		}
+	}
+	srv.localIdempotency.Lock()
+	defer srv.localIdempotency.Unlock()
+	srv.localIdempotency.entries[key] = idempotencyEntry{postID, time.Now().Add(IDEMPOTENCY_TTL)}
+	// drop expired entries while we hold the lock anyway
+	for k, e := range srv.localIdempotency.entries {
+		if time.Now().After(e.expires) {
+			delete(srv.localIdempotency.entries, k)
+		}
+	}
+}
+
+// releaseIdempotencyKey forgets a claim whose post failed, so the client may retry
+func (srv *Server) releaseIdempotencyKey(key string) {
+	if srv.Redis != nil {
+		srv.Redis.Del(key)
+	}
+	srv.localIdempotency.Lock()
+	defer srv.localIdempotency.Unlock()
+	delete(srv.localIdempotency.entries, key)
+}
+
+// replayPost answers a retried request with the post its first attempt created
+func (srv *Server) replayPost(w http.ResponseWriter, r *http.Request, id string) {
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	_, p, err := srv.findPost(client, id)
+	if err != nil || p == nil {
+		writeError(w, r, statusForError(err), "Failed to read post")
+		srv.Log.Printf("Failed to read post %s for replay %v\n", id, err)
+		return
+	}
+	srv.Log.Printf("Replaying post %s for a retried request\n", id)
+	js, _ := json.Marshal(p)
+	w.Write(js)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+	"github.com/oklog/ulid"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	IMPORT_BATCH_SIZE = 500
+	// bigger imports go through `around import`
+	IMPORT_MAX_BYTES   = 64 << 20
+	IMPORT_MAX_RECORDS = 100000
+	// the response lists at most this many rejected records
+	IMPORT_MAX_ERRORS = 100
+	// one NDJSON line
+	IMPORT_MAX_LINE = 1 << 20
+)
+
+// importRecord is one post of the NDJSON format, the GeoJSON format carries the
+// same fields as Feature properties with a Point geometry.
+type importRecord struct {
+	// id on the platform it comes from, importing the same record again replaces it
+	SourceID  string     `json:"source_id"`
+	Message   string     `json:"message"`
+	Url       string     `json:"url"`
+	Type      string     `json:"type"`
+	Lat       *float64   `json:"lat"`
+	Lon       *float64   `json:"lon"`
+	Location  *Location  `json:"location"`
+	CreatedAt *time.Time `json:"created_at"`
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry *struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties importRecord `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// importError points at a rejected record, Record counts from 1 (the line for NDJSON)
+type importError struct {
+	Record int    `json:"record"`
+	Error  string `json:"error"`
+}
+
+// badImportError is a problem with the uploaded document rather than with ES
+type badImportError struct {
+	err error
+}
+
+func (e *badImportError) Error() string {
+	return e.err.Error()
+}
+
+type importResult struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+func (res *importResult) reject(record int, err string) {
+	res.Failed++
+	if len(res.Errors) < IMPORT_MAX_ERRORS {
+		res.Errors = append(res.Errors, importError{Record: record, Error: err})
+	}
+}
+
+// toPost validates a record and turns it into a post of username
+func (rec importRecord) toPost(username string, now time.Time) (*Post, error) {
+	loc := rec.Location
+	if loc == nil && rec.Lat != nil && rec.Lon != nil {
+		loc = &Location{Lat: *rec.Lat, Lon: *rec.Lon}
+	}
+	if loc == nil {
+		return nil, fmt.Errorf("missing location")
+	}
+	if loc.Lat < -90 || loc.Lat > 90 || loc.Lon < -180 || loc.Lon > 180 {
+		return nil, fmt.Errorf("location out of range")
+	}
+	if rec.Url != "" {
+		if u, err := url.Parse(rec.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("url should be http or https")
+		}
+	}
+	if rec.Message == "" && rec.Url == "" {
+		return nil, fmt.Errorf("needs a message or a url")
+	}
+	created := now
+	if rec.CreatedAt != nil {
+		if rec.CreatedAt.After(now) {
+			return nil, fmt.Errorf("created_at is in the future")
+		}
+		created = rec.CreatedAt.UTC()
+	}
+	typ := rec.Type
+	if typ == "" {
+		typ = "image"
+	}
+	if typ != "image" && typ != "video" {
+		return nil, fmt.Errorf("type should be image or video")
+	}
+
+	message := cleanText(rec.Message)
+	return &Post{
+		Id:        importPostID(username, rec.SourceID, created),
+		User:      username,
+		Message:   message,
+		Lang:      search.Language(message),
+		Url:       rec.Url,
+		Type:      typ,
+		Location:  *loc,
+		CreatedAt: created,
+	}, nil
+}
+
+// importPostID is a ULID of the original creation time. With a source id the
+// random part comes from it, so a repeated import overwrites instead of duplicating.
+func importPostID(username, sourceID string, created time.Time) string {
+	if sourceID == "" {
+		return newPostID(created)
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + sourceID))
+	return ulid.MustNew(ulid.Timestamp(created), bytes.NewReader(sum[:])).String()
+}
+
+// readImport calls fn for every record of the GeoJSON FeatureCollection or NDJSON
+// in r. NDJSON lines may also be single GeoJSON Features.
+func readImport(r io.Reader, format string, fn func(n int, rec importRecord, err error) error) error {
+	feature := func(f geoJSONFeature) (importRecord, error) {
+		if f.Type != "Feature" || f.Geometry == nil || f.Geometry.Type != "Point" || len(f.Geometry.Coordinates) < 2 {
+			return importRecord{}, fmt.Errorf("should be a Feature with a Point geometry")
+		}
+		rec := f.Properties
+		// GeoJSON is lon, lat
+		rec.Location = &Location{Lat: f.Geometry.Coordinates[1], Lon: f.Geometry.Coordinates[0]}
+		return rec, nil
+	}
+
+	switch format {
+	case "geojson":
+		var fc geoJSONCollection
+		if err := json.NewDecoder(r).Decode(&fc); err != nil {
+			return fmt.Errorf("not a GeoJSON document: %v", err)
+		}
+		if fc.Type != "FeatureCollection" {
+			return fmt.Errorf("expected a FeatureCollection, got %q", fc.Type)
+		}
+		for i, f := range fc.Features {
+			rec, err := feature(f)
+			if err := fn(i+1, rec, err); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "ndjson":
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), IMPORT_MAX_LINE)
+		n := 0
+		for scanner.Scan() {
+			n++
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var f geoJSONFeature
+			var rec importRecord
+			err := json.Unmarshal(line, &f)
+			if err == nil && f.Type == "Feature" {
+				rec, err = feature(f)
+			} else if err == nil {
+				err = json.Unmarshal(line, &rec)
+			}
+			if err := fn(n, rec, err); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+	return fmt.Errorf("unknown import format %q, use geojson or ndjson", format)
+}
+
+// importPosts validates and bulk indexes every record in r as a post of username.
+// Invalid records are reported and skipped, an ES failure stops the import.
+// Imported posts are history, they don't go to live feeds or webhooks.
+func (srv *Server) importPosts(r io.Reader, format, username string) (importResult, error) {
+	var res importResult
+	client, err := srv.es()
+	if err != nil {
+		return res, err
+	}
+
+	now := time.Now().UTC()
+	cells := map[string]Location{}
+	// the posts of the next bulk request and their record numbers, to report failed items
+	var batch []Post
+	pending := map[string]int{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		// a record imported before is replaced in the index it is in, the
+		// write alias would put a second copy into the current month
+		ids := make([]string, len(batch))
+		for i, p := range batch {
+			ids[i] = p.Id
+		}
+		indices, err := srv.postIndices(client, ids)
+		if err != nil {
+			return err
+		}
+		bulk := client.Bulk()
+		for _, p := range batch {
+			index, ok := indices[p.Id]
+			if !ok {
+				// new posts go to the current month, retention looks at created_at anyway
+				index = srv.Names.PostWriteAlias
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().Index(index).Type(TYPE).Id(p.Id).Doc(p))
+		}
+		var br *elastic.BulkResponse
+		err = esRetry(func() error {
+			var err error
+			br, err = bulk.Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		failed := map[string]bool{}
+		for _, item := range br.Failed() {
+			failed[item.Id] = true
+			reason := "rejected by ES"
+			if item.Error != nil {
+				reason = item.Error.Reason
+			}
+			res.reject(pending[item.Id], reason)
+		}
+		res.Imported += len(pending) - len(failed)
+		for _, p := range batch {
+			if !failed[p.Id] {
+				srv.syncSearch(p)
+			}
+		}
+		pending = map[string]int{}
+		batch = nil
+		return nil
+	}
+
+	err = readImport(r, format, func(n int, rec importRecord, err error) error {
+		if res.Imported+res.Failed+len(pending) >= IMPORT_MAX_RECORDS {
+			return &badImportError{fmt.Errorf("more than %d records", IMPORT_MAX_RECORDS)}
+		}
+		if err != nil {
+			res.reject(n, err.Error())
+			return nil
+		}
+		p, err := rec.toPost(username, now)
+		if err != nil {
+			res.reject(n, err.Error())
+			return nil
+		}
+		// the rules of new posts, imported ones are no way around them
+		if errs := srv.Config.Messages.check(p.Message, "message", "body"); len(errs) > 0 {
+			res.reject(n, "message "+errs[0].Message)
+			return nil
+		}
+		pending[p.Id] = n
+		batch = append(batch, *p)
+		cells[cellKey(cellIndex(p.Location.Lat), wrapLonCell(cellIndex(p.Location.Lon)))] = p.Location
+		if len(batch) >= IMPORT_BATCH_SIZE {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	} else if _, ok := err.(*badImportError); !ok && !isESError(err) {
+		// from reading the body: not JSON, line too long, over IMPORT_MAX_BYTES
+		err = &badImportError{err}
+	}
+
+	// one invalidation per touched cell, not per post
+	for _, loc := range cells {
+		srv.invalidateSearchCache(loc.Lat, loc.Lon)
+	}
+	return res, err
+}
+
+func isESError(err error) bool {
+	switch err.(type) {
+	case *elastic.Error, *CircuitOpenError:
+		return true
+	}
+	return elastic.IsTimeout(err)
+}
+
+// importFormat picks the format from an explicit name, a content type or a file name
+func importFormat(explicit, contentType, filename string) string {
+	if explicit != "" {
+		return explicit
+	}
+	switch {
+	case strings.Contains(contentType, "geo+json"), strings.HasSuffix(filename, ".geojson"):
+		return "geojson"
+	case strings.Contains(contentType, "ndjson"), strings.HasSuffix(filename, ".ndjson"), strings.HasSuffix(filename, ".jsonl"):
+		return "ndjson"
+	}
+	return ""
+}
+
+// handlerImport bulk imports the posts in the body for the caller:
+//
+//	POST /import  Content-Type: application/geo+json or application/x-ndjson
+//
+// ?format=geojson|ndjson overrides the content type. The response counts the
+// imported and the rejected records and tells what was wrong with the latter.
+func (srv *Server) handlerImport(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	format := importFormat(r.URL.Query().Get("format"), r.Header.Get("Content-Type"), "")
+	if format == "" {
+		writeError(w, r, http.StatusBadRequest, "Send application/geo+json or application/x-ndjson, or set format")
+		return
+	}
+	srv.Log.Printf("Received one %s import from %s\n", format, username)
+
+	body := http.MaxBytesReader(w, r.Body, IMPORT_MAX_BYTES)
+	res, err := srv.importPosts(body, format, username)
+	if _, ok := err.(*badImportError); ok {
+		// what came before the problem is imported
+		srv.Log.Printf("[%s] Import of %s stopped after %d posts %v\n", requestID(r), username, res.Imported, err)
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Import stopped after %d posts: %v", res.Imported, err))
+		return
+	}
+	if err != nil {
+		writeBackendError(w, r, fmt.Sprintf("Failed to import posts, %d imported before", res.Imported), err)
+		return
+	}
+	srv.Log.Printf("Imported %d posts for %s, %d rejected\n", res.Imported, username, res.Failed)
+
+	js, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// runImport implements `around import`, the same import without the HTTP size limit:
+//
+//	around import -user alice posts.geojson
+func (srv *Server) runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	user := fs.String("user", "", "username the posts are imported for")
+	format := fs.String("format", "", "geojson or ndjson, guessed from the file name when empty")
+	fs.Parse(args)
+
+	if *user == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: around import -user <username> [-format geojson|ndjson] <file>")
+	}
+	if _, ok := srv.getUser(*user); !ok {
+		return fmt.Errorf("no user %s", *user)
+	}
+	name := fs.Arg(0)
+	f := importFormat(*format, "", name)
+	if f == "" {
+		return fmt.Errorf("cannot tell the format of %s, set -format", name)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the servers' search cache has to forget the imported areas too
+	srv.initSearchCache()
+	res, err := srv.importPosts(file, f, *user)
+	srv.Log.Printf("Imported %d posts, %d rejected\n", res.Imported, res.Failed)
+	for _, e := range res.Errors {
+		srv.Log.Printf("  record %d: %s\n", e.Record, e.Error)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// posts are written to one index per month behind POST_WRITE_ALIAS,
+// searches go through POST_READ_ALIAS which covers every month (and the legacy
+// INDEX). Prefixed with the tenant, see tenantNames.
+const (
+	POST_INDEX_PREFIX = "around-posts-"
+	POST_WRITE_ALIAS  = "around-posts-write"
+	POST_READ_ALIAS   = "around-posts"
+)
+
+const (
+	// how often the rollover job checks whether a new month started
+	ROLLOVER_CHECK_INTERVAL = time.Hour
+)
+
+// postIndexName is the monthly index a post created at t belongs to, e.g. around-posts-2018.06
+func (srv *Server) postIndexName(t time.Time) string {
+	return srv.Names.PostIndexPrefix + t.UTC().Format("2006.01")
+}
+
+// postIndices finds the monthly index each of ids is in, ids of no post are
+// left out. They are looked up ARCHIVE_BULK_SIZE at a time, a search returns
+// no more than 10000 hits.
+func (srv *Server) postIndices(client *elastic.Client, ids []string) (map[string]string, error) {
+	indices := map[string]string{}
+	for start := 0; start < len(ids); start += ARCHIVE_BULK_SIZE {
+		end := start + ARCHIVE_BULK_SIZE
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var res *elastic.SearchResult
+		err := esRetry(func() error {
+			var err error
+			res, err = client.Search().
+				Index(srv.Names.PostReadAlias).
+				Type(TYPE).
+				Query(elastic.NewIdsQuery(TYPE).Ids(ids[start:end]...)).
+				FetchSource(false).
+				Size(end - start).
+				Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range res.Hits.Hits {
+			indices[hit.Id] = hit.Index
+		}
+	}
+	return indices, nil
+}
+
+// ensurePostIndices makes sure the index of the current month exists and both aliases
+// point at it, the legacy INDEX is kept in the read alias so old posts stay searchable.
+func (srv *Server) ensurePostIndices(client *elastic.Client) error {
+	if err := srv.rolloverPostIndex(client, time.Now()); err != nil {
+		return err
+	}
+
+	aliases, err := client.Aliases().Index(srv.Names.Index).Do()
+	if err != nil {
+		return err
+	}
+	for _, name := range aliases.IndicesByAlias(srv.Names.PostReadAlias) {
+		if name == srv.Names.Index {
+			return nil
+		}
+	}
+	_, err = client.Alias().Add(srv.Names.Index, srv.Names.PostReadAlias).Do()
+	return err
+}
+
+// rolloverPostIndex creates the index for the month of now if missing and atomically
+// moves the write alias to it. Safe to call repeatedly.
+func (srv *Server) rolloverPostIndex(client *elastic.Client, now time.Time) error {
+	name := srv.postIndexName(now)
+
+	exists, err := client.IndexExists(name).Do()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := client.CreateIndex(name).Body(postMapping).Do(); err != nil {
+			return err
+		}
+		srv.Log.Printf("Created post index %s\n", name)
+	}
+
+	// find where the write alias points right now
+	res, err := client.Aliases().Do()
+	if err != nil {
+		return err
+	}
+	current := res.IndicesByAlias(srv.Names.PostWriteAlias)
+	if len(current) == 1 && current[0] == name {
+		return nil
+	}
+
+	// a single alias request is atomic, no post is written to nowhere
+	alias := client.Alias().Add(name, srv.Names.PostWriteAlias).Add(name, srv.Names.PostReadAlias)
+	for _, old := range current {
+		alias = alias.Remove(old, srv.Names.PostWriteAlias)
+	}
+	if _, err := alias.Do(); err != nil {
+		return err
+	}
+	srv.Log.Printf("Write alias %s now points to %s\n", srv.Names.PostWriteAlias, name)
+	return nil
+}
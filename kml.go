@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Google Earth gets slow long before this
+const KML_MAX_PLACEMARKS = 10000
+
+type kmlPlacemark struct {
+	XMLName     xml.Name  `xml:"Placemark"`
+	ID          string    `xml:"id,attr"`
+	Name        string    `xml:"name"`
+	Description string    `xml:"description"`
+	TimeStamp   *kmlWhen  `xml:"TimeStamp,omitempty"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Point       kmlPoint  `xml:"Point"`
+}
+
+type kmlWhen struct {
+	When string `xml:"when"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	// KML wants lon,lat, the other way round than everywhere else
+	Coordinates string `xml:"coordinates"`
+}
+
+// handlerExportKML streams the posts inside a bounding box as KML, one Placemark
+// per post, for Google Earth and GIS tools:
+//
+//	GET /export.kml?north=&south=&east=&west=[&from=&to=]
+//
+// from/to are RFC 3339 and limit created_at, a west greater than east crosses
+// the antimeridian.
+func (srv *Server) handlerExportKML(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	q := r.URL.Query()
+
+	// types and ranges are checked by validateRequest already
+	north, _ := strconv.ParseFloat(q.Get("north"), 64)
+	south, _ := strconv.ParseFloat(q.Get("south"), 64)
+	east, _ := strconv.ParseFloat(q.Get("east"), 64)
+	west, _ := strconv.ParseFloat(q.Get("west"), 64)
+	if south > north {
+		writeError(w, r, http.StatusBadRequest, "south should not be above north")
+		return
+	}
+
+	box := elastic.NewGeoBoundingBoxQuery("location").TopLeft(north, west).BottomRight(south, east)
+	filter := elastic.NewBoolQuery().Filter(box, notDeleted())
+	if v := q.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "from should be an RFC 3339 time")
+			return
+		}
+		filter = filter.Filter(elastic.NewRangeQuery("created_at").Gte(from))
+	}
+	if v := q.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "to should be an RFC 3339 time")
+			return
+		}
+		filter = filter.Filter(elastic.NewRangeQuery("created_at").Lte(to))
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(filter).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	// the first batch decides the status, after that errors can only truncate the file
+	res, err := scroll.Do()
+	if err != nil && err != io.EOF {
+		writeBackendError(w, r, "Failed to export posts", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+	w.Header().Set("Content-Disposition", `attachment; filename="around.kml"`)
+	io.WriteString(w, xml.Header)
+	io.WriteString(w, `<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>Around posts</name>`+"\n")
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	total := 0
+	for err == nil && total < KML_MAX_PLACEMARKS {
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil || total >= KML_MAX_PLACEMARKS {
+				continue
+			}
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				srv.Log.Printf("Skipping post %s in KML export %v\n", hit.Id, err)
+				continue
+			}
+			if !srv.canSee(viewer, p.User) {
+				continue
+			}
+			if err := enc.Encode(placemark(p)); err != nil {
+				srv.Log.Printf("KML export aborted %v\n", err)
+				return
+			}
+			total++
+		}
+		res, err = scroll.Do()
+	}
+	if err != nil && err != io.EOF {
+		srv.Log.Printf("Failed to scroll posts for KML %v\n", err)
+	}
+	io.WriteString(w, "\n</Document></kml>\n")
+	srv.Log.Printf("Exported %d posts as KML\n", total)
+}
+
+func placemark(p Post) kmlPlacemark {
+	pm := kmlPlacemark{
+		ID:          "post-" + p.Id,
+		Name:        atomTitle(p),
+		Description: p.Message,
+		Data: []kmlData{
+			{Name: "user", Value: p.User},
+			{Name: "url", Value: p.Url},
+			{Name: "type", Value: p.Type},
+		},
+		Point: kmlPoint{Coordinates: fmt.Sprintf("%f,%f", p.Location.Lon, p.Location.Lat)},
+	}
+	if !p.CreatedAt.IsZero() {
+		pm.TimeStamp = &kmlWhen{When: p.CreatedAt.UTC().Format(time.RFC3339)}
+	}
+	return pm
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// a leaderboard moves slowly, unlike search results it is not invalidated by new posts
+	LEADERBOARD_CACHE_TTL = 5 * time.Minute
+	LEADERBOARD_SIZE      = 10
+	LEADERBOARD_MAX_SIZE  = 50
+)
+
+var leaderboardPeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	// "all" has no start
+}
+
+type leaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Avatar      string `json:"avatar"`
+	Posts       int64  `json:"posts"`
+	Reactions   int64  `json:"reactions"`
+}
+
+// topPosters aggregates the posts within ran of lat/lon since from (zero for
+// all time) by user, ordered by post count or by the reactions they got
+func (srv *Server) topPosters(lat, lon float64, ran string, from time.Time, by string, size int) ([]leaderboardEntry, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	geo := elastic.NewGeoDistanceQuery("location").Distance(ran).Lat(lat).Lon(lon)
+	q := elastic.NewBoolQuery().Filter(geo, notDeleted())
+	if !from.IsZero() {
+		q = q.Filter(elastic.NewRangeQuery("created_at").Gte(from))
+	}
+	users := elastic.NewTermsAggregation().Field("user").Size(size).
+		SubAggregation("reactions", elastic.NewSumAggregation().Field("reaction_count"))
+	if by == "reactions" {
+		users = users.OrderByAggregation("reactions", false)
+	} else {
+		users = users.OrderByCountDesc()
+	}
+
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			Aggregation("users", users).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []leaderboardEntry{}
+	agg, ok := res.Aggregations.Terms("users")
+	if !ok {
+		return entries, nil
+	}
+	for _, b := range agg.Buckets {
+		name, ok := b.Key.(string)
+		if !ok {
+			continue
+		}
+		e := leaderboardEntry{Username: name, Posts: b.DocCount}
+		if sum, ok := b.Aggregations.Sum("reactions"); ok && sum.Value != nil {
+			e.Reactions = int64(*sum.Value)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// handlerLeaderboard ranks the most active posters of an area, or those whose
+// posts got the most reactions:
+//
+//	GET /leaderboard?lat=&lon=&range=&period=day|week|month|all&by=posts|reactions&limit=
+//
+// The ranking is cached for everybody, entries the caller may not see (private
+// or muted) are dropped afterwards and the rest ranked again.
+func (srv *Server) handlerLeaderboard(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	q := r.URL.Query()
+	// types and enums are checked by validateRequest already
+	lat, _ := strconv.ParseFloat(q.Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(q.Get("lon"), 64)
+	ran := srv.Config.DefaultDistance
+	if v := q.Get("range"); v != "" {
+		ran = v + "km"
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = "week"
+	}
+	by := q.Get("by")
+	if by == "" {
+		by = "posts"
+	}
+	limit := LEADERBOARD_SIZE
+	if v := q.Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	srv.Log.Printf("Received one leaderboard request for %f %f %s by %s over %s\n", lat, lon, ran, by, period)
+
+	var entries []leaderboardEntry
+	key := "leaderboard:" + searchCacheKey(lat, lon, ran, "period="+period, "by="+by)
+	if js, ok := srv.getCachedSearch(key); !ok || json.Unmarshal(js, &entries) != nil {
+		var from time.Time
+		if d, ok := leaderboardPeriods[period]; ok {
+			from = time.Now().Add(-d)
+		}
+		// the hidden ones are taken out later, fetch enough for the biggest page anyway
+		var err error
+		entries, err = srv.topPosters(lat, lon, ran, from, by, 2*LEADERBOARD_MAX_SIZE)
+		if err != nil {
+			writeBackendError(w, r, "Failed to compute leaderboard", err)
+			return
+		}
+		if srv.Redis != nil {
+			js, _ := json.Marshal(entries)
+			if err := srv.Redis.Set(key, js, LEADERBOARD_CACHE_TTL).Err(); err != nil {
+				srv.Log.Printf("Failed to cache leaderboard %v\n", err)
+			}
+		}
+	}
+
+	board := []leaderboardEntry{}
+	for _, e := range entries {
+		if len(board) >= limit {
+			break
+		}
+		if !srv.inFeed(viewer, e.Username) {
+			continue
+		}
+		if u, ok := srv.getUser(e.Username); ok {
+			e.DisplayName = u.DisplayName
+			e.Avatar = u.Avatar
+		}
+		e.Rank = len(board) + 1
+		board = append(board, e)
+	}
+
+	js, _ := json.Marshal(board)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ids per POST /posts/lookup, a screen full of feed or notifications
+const POST_LOOKUP_MAX = 100
+
+type lookupRequest struct {
+	Ids []string `json:"ids"`
+}
+
+type lookupResponse struct {
+	// in the order of the request, each once
+	Posts []Post `json:"posts"`
+	// ids that don't exist, are deleted or the caller may not see
+	Missing []string `json:"missing"`
+}
+
+// handlerLookupPosts returns the posts of many ids at once, so clients don't
+// GET them one by one. The posts are spread over the monthly indices and an
+// mget needs the concrete index of each, so it is one ids search through the
+// read alias like findPost does for one.
+//
+//	POST /posts/lookup {"ids": ["01CK...", ...]}
+func (srv *Server) handlerLookupPosts(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	// the number of ids is checked by validateRequest already
+	var req lookupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode lookup")
+		return
+	}
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range req.Ids {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	found, err := srv.postsByID(ids)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read posts", err)
+		return
+	}
+	resp := lookupResponse{Posts: []Post{}, Missing: []string{}}
+	for _, id := range ids {
+		// hidden posts are as missing as deleted ones, like GET /post/{id}
+		if p, ok := found[id]; ok && p.DeletedAt == nil && srv.canSee(viewer, p.User) {
+			resp.Posts = append(resp.Posts, p)
+		} else {
+			resp.Missing = append(resp.Missing, id)
+		}
+	}
+	resp.Posts = srv.withQuotes(viewer, resp.Posts)
+	srv.Log.Printf("Looked up %d posts for %s, %d missing\n", len(ids), viewer, len(resp.Missing))
+
+	js, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -1,22 +1,22 @@
 package main
 
 import (
-	//	"cloud.google.com/go/bigtable"
-	"cloud.google.com/go/storage"
 	"context"
 	"encoding/json"
-	"fmt"
-	"github.com/auth0/go-jwt-middleware"
-	"github.com/dgrijalva/jwt-go"
+	"flag"
+	"github.com/TianyiSun2333/Around/auth"
+	"github.com/TianyiSun2333/Around/search"
 	"github.com/gorilla/mux"
-	"github.com/pborman/uuid"
+	"github.com/graph-gophers/graphql-go/relay"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	elastic "gopkg.in/olivere/elastic.v3"
-	"io"
 	"log"
 	"net/http"
 	"path/filepath" // for using prefix API
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // multi thread read and write:
@@ -34,6 +34,8 @@ type Location struct {
 
 // post behavior of user
 type Post struct {
+	// same as the ES document id and the GCS object name
+	Id string `json:"id"`
 	// exported name must be capital
 	User    string `json:"user"`
 	Message string `json:"message"`
@@ -43,22 +45,72 @@ type Post struct {
 	Face float64 `json:"face"`
 
 	Location Location `json:"location"`
+	// when the post was created, posts made before this field existed have the zero time
+	CreatedAt time.Time `json:"created_at"`
+	// set when the author deletes the post, it is purged after the restore window
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// the moderator who took it down, such posts can't be restored, see modlog.go
+	RemovedBy string `json:"removed_by,omitempty"`
+	// last edit by the author
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// a scheduled post is hidden until then, see publishScheduledPosts
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	// an ephemeral post is deleted then, see expirePosts
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// set on event posts, see events.go
+	Event *Event `json:"event,omitempty"`
+	// one of postCategories, see categories.go. Optional.
+	Category string `json:"category,omitempty"`
+	// zh, ja or ko when the message is in one of them, see search.Language.
+	// Searches in these languages run on message.cjk.
+	Lang string `json:"lang,omitempty"`
+	// the X-Request-ID of the request that created the post, also on its media
+	// in GCS and in the logs of the backends it went through
+	RequestID string `json:"request_id,omitempty"`
+	// reactions per type, kept up to date by reactions.go
+	Reactions map[string]int64 `json:"reactions,omitempty"`
+	// all reactions together, what the leaderboard sums up
+	ReactionCount int64 `json:"reaction_count,omitempty"`
+	// distinct viewers per day and appearances in search results, added up by views.go
+	Views       int64 `json:"views,omitempty"`
+	Impressions int64 `json:"impressions,omitempty"`
+	// id of the post this one quotes, see quotes.go
+	QuoteOf string `json:"quote_of,omitempty"`
+	// filled in for the viewer when the post goes out, never stored
+	Quoted *QuotedPost `json:"quoted,omitempty"`
+	// filled in by search responses, never stored
+	Author *Author `json:"author,omitempty"`
+	// snippets of the message with the words of the q of /search in <em>,
+	// escaped HTML otherwise. Filled in by search responses, never stored.
+	Highlight []string `json:"highlight,omitempty"`
 }
 
 const (
 	// since sometime the frontend and backend have the same name of the endpoint, so we need to distinguish whether the given endpoint is for front end or backend
-	API_PREFIX  = "/api/v1"
-	BUCKET_NAME = "post-images-206505"
-	DISTANCE    = "200km"
-	INDEX       = "around" // to tell elastic that the user is around, not jupiter, like the name of DB
-	TYPE        = "post"
-	ES_URL      = "http://35.238.11.119:9200/" // the actually elastic server in GCE
-	PROJECT_ID  = "sigma-sunlight-206505"
-	BT_INSTANCE = "around-post"
+	API_ROOT = "/api"
+	// every breaking change gets a new version next to it, e.g. /api/v2
+	API_V1 = API_ROOT + "/v1"
+	// /search and /cluster answer with a listPage there, v1 keeps the bare array
+	API_V2 = API_ROOT + "/v2"
+	TYPE   = "post"
+	// characters of a message, new or edited
+	POST_MAX_MESSAGE = 2000
+	// about half the circumference of the earth, farther is everywhere
+	SEARCH_MAX_RANGE_KM = 20000
+	// posts per page of /search, the rest is paged with next_cursor
+	SEARCH_PAGE_SIZE     = 10
+	SEARCH_MAX_PAGE_SIZE = 100
+	// characters of the q of /search
+	SEARCH_MAX_QUERY = 200
+	// bucket, ES url, project etc. differ per deployment and live in Config
 )
 
-// slice of byte
-var mySigningKey = []byte("secret")
+// names data is stored under, each tenant has its own, see tenantNames
+const (
+	INDEX = "around" // to tell elastic that the user is around, not jupiter, like the name of DB
+	// media objects are named after the post, MEDIA_PREFIX in front
+	MEDIA_PREFIX = ""
+)
 
 var (
 	mediaTypes = map[string]string{
@@ -75,57 +127,171 @@ var (
 )
 
 func main() {
+	flag.Usage = func() { runHelp(nil) }
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := NewServer(cfg)
+	srv.useUsernamePolicy()
+	breakerLog = srv.Log
+	if err := srv.wireBackends(); err != nil {
+		log.Fatal(err)
+	}
+
+	// subcommands share the flags and config of the server, see cli.go
+	err = srv.runCommand(flag.Args())
+	srv.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runServe implements `around serve`, what the binary does without a command
+func (srv *Server) runServe(args []string) error {
+	flag.NewFlagSet("serve", flag.ExitOnError).Parse(args)
+
+	// every tenant has a server of its own, srv is the one of config.Tenant
+	servers, err := srv.tenantServers()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, s := range servers {
+			if s != srv {
+				s.Close()
+			}
+		}
+	}()
+
+	// rate limits from config, SIGHUP reloads them
+	setRateLimits(srv.Config)
+	go srv.runConfigReload()
+
+	handlers := map[string]http.Handler{}
+	for name, s := range servers {
+		h, err := s.startTenant()
+		if err != nil {
+			return err
+		}
+		handlers[name] = h
+	}
+
+	srv.Log.Println("Started-service")
+
+	// once error happens
+	// <port> <handler>
+	// handler has been create in last line
+	// bound the handler to the port
+	// wait for request, and call the callback function, once request coming,
+	// create a go routine to call handler
+	// SIGTERM lets in-flight posts finish before exiting
+	return srv.serve(srv.Config.ListenAddr, srv.tenantHandler(handlers))
+}
 
+// startTenant gets the indices and tables of the tenant of srv ready, starts
+// its background work and returns the handler of its requests
+func (srv *Server) startTenant() (http.Handler, error) {
 	// map location to geopoint
 
 	// Create a client
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	client, err := srv.es()
 	if err != nil {
-		panic(err)
-		return
+		return nil, err
 	}
 
 	// check if the connections is right, check also need a client
 	// only need to create instance once
 	// Use the IndexExists service to check if a specified index exists.
-	exists, err := client.IndexExists(INDEX).Do()
+	exists, err := client.IndexExists(srv.Names.Index).Do()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if !exists {
 		// make location to a geopoint
-		// Create a new index.
-		mapping := `{
-			"mappings":{
-				"post":{
-					"properties":{
-						"location":{
-							"type":"geo_point"
-						}
-					}
-				}
-			}
-		}`
-		_, err := client.CreateIndex(INDEX).Body(mapping).Do()
+		// Create a new index, the mappings are in mappings/
+		_, err := client.CreateIndex(srv.Names.Index).Body(indexBody(append([]indexMapping{userIndexMapping, postIndexMapping}, postRecordMappings...)...)).Do()
 		if err != nil {
 			// Handle error
-			panic(err)
+			return nil, err
+		}
+	}
+
+	// posts live in monthly indices behind aliases, users stay in INDEX
+	if err := srv.ensurePostIndices(client); err != nil {
+		return nil, err
+	}
+	// indices made with older mapping files, every month and the legacy INDEX
+	if err := srv.ensureMappings(client, postIndexMapping, srv.Config.MappingDrift, srv.Names.PostReadAlias); err != nil {
+		return nil, err
+	}
+	if err := srv.ensureMappings(client, userIndexMapping, srv.Config.MappingDrift, srv.Names.Index); err != nil {
+		return nil, err
+	}
+	for _, m := range postRecordMappings {
+		if err := srv.ensureMappings(client, m, srv.Config.MappingDrift, srv.Names.Index); err != nil {
+			return nil, err
+		}
+	}
+	// the index or table of opensearch or postgis
+	if err := srv.setupSearch(); err != nil {
+		return nil, err
+	}
+	// the search in memory starts empty, the posts already in ES go in first
+	if _, ok := srv.Search.(*search.Memory); ok {
+		if err := srv.runReindex([]string{"-search"}); err != nil {
+			return nil, err
 		}
 	}
 
-	fmt.Println("Started-service")
+	// search cache is optional, searches still work without redis
+	srv.initSearchCache()
+	// new posts of other instances reach our websocket clients through redis
+	go srv.runFeedRelay()
+
+	// views and impressions are counted in memory and written in batches
+	go srv.runCounterFlush()
+	// and who got which variant of an experiment
+	go srv.runExposureFlush()
+
+	// a new ES client when the cluster stops answering the old one
+	go srv.runESWatchdog()
+	// posts buffered while ES was down, by a previous run too
+	if srv.writeBufferDir() != "" {
+		go srv.runWriteBuffer()
+	}
+
+	// purging, archiving, digests and the other jobs of worker.go, unless
+	// `around worker` runs them
+	if srv.Config.Worker {
+		srv.startWorker(nil)
+	}
 
 	r := mux.NewRouter()
 
-	// token checker
-	var jwtMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
+	// token checker, tokens of other tenants, issuers or algorithms are rejected here
+	var jwtMiddleware = &auth.Middleware{
+		Tokens: srv.Tokens,
+		// same JSON error body as every other endpoint
+		ErrorHandler: jwtError,
+	}
 
-		// get server signing key
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return mySigningKey, nil
-		},
-		SigningMethod: jwt.SigningMethodHS256,
-	})
+	// same check, but also accepts the token as query parameter
+	var queryJWT = &auth.Middleware{
+		Tokens:       srv.Tokens,
+		QueryParam:   "token",
+		ErrorHandler: jwtError,
+	}
+
+	// and lets requests without one through as signed out
+	var optionalJWT = &auth.Middleware{
+		Tokens:       srv.Tokens,
+		QueryParam:   "token",
+		ErrorHandler: jwtError,
+		Optional:     true,
+	}
 
 	// <endpoint> <which function endpoint are using>
 	// like <servlet> <doPost>
@@ -134,27 +300,181 @@ func main() {
 
 	// middleware make sure that the token user send is can match
 	// if match, pass the request to our http handler
+	// requests that don't match apiSpec are rejected before the handler runs,
+	// but only after the token check so anonymous uploads aren't even parsed
+	auth := func(h http.HandlerFunc) http.Handler {
+		return jwtMiddleware.Handler(srv.scopeMiddleware(srv.renamedMiddleware(srv.suspensionMiddleware(validateRequest(h)))))
+	}
 	// Method(): to see whether post or get
-	r.Handle(API_PREFIX+"/post", jwtMiddleware.Handler(http.HandlerFunc(handlerPost))).Methods("POST")
-	r.Handle(API_PREFIX+"/search", jwtMiddleware.Handler(http.HandlerFunc(handlerSearch))).Methods("GET")
-	r.Handle(API_PREFIX+"/cluster", jwtMiddleware.Handler(http.HandlerFunc(handlerCluster)))
+	v1 := r.PathPrefix(API_V1).Subrouter()
+	v1.Handle("/post", auth(srv.handlerPost)).Methods("POST")
+	v1.Handle("/search", auth(srv.handlerSearch)).Methods("GET")
+	v1.Handle("/cluster", auth(srv.handlerCluster)).Methods("GET")
+	v1.Handle("/export", auth(srv.handlerExport)).Methods("GET")
+	v1.Handle("/export.kml", auth(srv.handlerExportKML)).Methods("GET")
+	v1.Handle("/account/posts.csv", auth(srv.handlerExportCSV)).Methods("GET")
+	v1.Handle("/account/usage", auth(srv.handlerUsage)).Methods("GET")
+	// the old name redirects, tokens of it stop working
+	v1.Handle("/account/username", auth(srv.handlerChangeUsername)).Methods("PUT")
+	v1.Handle("/import", auth(srv.handlerImport)).Methods("POST")
+	v1.Handle("/post/{id}", auth(srv.handlerGetPost)).Methods("GET")
+	// many posts in one request, e.g. the posts of a screen of notifications
+	v1.Handle("/posts/lookup", auth(srv.handlerLookupPosts)).Methods("POST")
+	v1.Handle("/post/{id}", auth(srv.handlerEdit)).Methods("PUT")
+	v1.Handle("/post/{id}", auth(srv.handlerDelete)).Methods("DELETE")
+	v1.Handle("/post/{id}/restore", auth(srv.handlerRestore)).Methods("POST")
+	v1.Handle("/post/{id}/rsvp", auth(srv.handlerRSVP)).Methods("POST")
+	v1.Handle("/post/{id}/rsvp", auth(srv.handlerCancelRSVP)).Methods("DELETE")
+	v1.Handle("/post/{id}/attendees", auth(srv.handlerAttendees)).Methods("GET")
+	v1.Handle("/post/{id}/reactions", auth(srv.handlerReact)).Methods("PUT")
+	v1.Handle("/post/{id}/reactions", auth(srv.handlerUnreact)).Methods("DELETE")
+	v1.Handle("/post/{id}/reactions", auth(srv.handlerListReactions)).Methods("GET")
+	// clients report that a post was opened, counted once per user and day
+	v1.Handle("/post/{id}/view", auth(srv.handlerView)).Methods("POST")
+	// a short link to the post for chat apps, its page is outside the API
+	v1.Handle("/post/{id}/share", auth(srv.handlerShare)).Methods("POST")
+	// QR codes of those links and of profiles, for flyers and venues
+	v1.Handle("/post/{id}/qr", auth(srv.handlerPostQR)).Methods("GET")
+	// only for the author
+	v1.Handle("/post/{id}/analytics", auth(srv.handlerPostAnalytics)).Methods("GET")
+	// browsers can't set headers on a websocket or EventSource, the token may come as ?token= there
+	v1.Handle("/ws", queryJWT.Handler(srv.scopeMiddleware(validateRequest(http.HandlerFunc(srv.handlerFeed))))).Methods("GET")
+	v1.Handle("/stream", queryJWT.Handler(srv.scopeMiddleware(validateRequest(http.HandlerFunc(srv.handlerStream))))).Methods("GET")
+	// feed readers can't log in
+	v1.Handle("/feed.atom", validateRequest(http.HandlerFunc(srv.handlerAtom))).Methods("GET")
+	// image tags can't send a token, media of public accounts needs none
+	v1.Handle("/media/{id}", optionalJWT.Handler(srv.scopeMiddleware(validateRequest(http.HandlerFunc(srv.handlerMedia))))).Methods("GET")
+	// the same handlers, writeList tells the versions apart
+	v2 := r.PathPrefix(API_V2).Subrouter()
+	v2.Handle("/search", auth(srv.handlerSearch)).Methods("GET")
+	v2.Handle("/cluster", auth(srv.handlerCluster)).Methods("GET")
+	// integrations get new posts of an area pushed to their URL
+	v1.Handle("/webhooks", auth(srv.handlerCreateWebhook)).Methods("POST")
+	v1.Handle("/webhooks", auth(srv.handlerListWebhooks)).Methods("GET")
+	v1.Handle("/webhooks/{id}/rotate", auth(srv.handlerRotateWebhook)).Methods("POST")
+	v1.Handle("/webhooks/{id}/disable", auth(srv.handlerDisableWebhook)).Methods("POST")
+	v1.Handle("/webhooks/{id}/enable", auth(srv.handlerEnableWebhook)).Methods("POST")
+	// one query for what takes several REST calls, e.g. posts with their authors
+	v1.Handle("/graphql", auth((&relay.Handler{Schema: srv.graphqlSchema()}).ServeHTTP)).Methods("POST")
+	// albums of the caller's own posts, in their order
+	v1.Handle("/collections", auth(srv.handlerCreateCollection)).Methods("POST")
+	v1.Handle("/collections", auth(srv.handlerListCollections)).Methods("GET")
+	v1.Handle("/collections/{id}", auth(srv.handlerGetCollection)).Methods("GET")
+	v1.Handle("/collections/{id}", auth(srv.handlerUpdateCollection)).Methods("PUT")
+	v1.Handle("/collections/{id}", auth(srv.handlerDeleteCollection)).Methods("DELETE")
+	v1.Handle("/users/{username}", auth(srv.handlerUserPage)).Methods("GET")
+	v1.Handle("/users/{username}/qr", auth(srv.handlerUserQR)).Methods("GET")
+	v1.Handle("/users/{username}/previous-usernames", auth(srv.handlerUsernameHistory)).Methods("GET")
+	// following a private account needs its approval
+	v1.Handle("/users/{username}/follow", auth(srv.handlerFollow)).Methods("POST")
+	v1.Handle("/users/{username}/follow", auth(srv.handlerUnfollow)).Methods("DELETE")
+	// muted users don't show up in the caller's searches and feeds, and don't know
+	v1.Handle("/users/{username}/mute", auth(srv.handlerMute)).Methods("POST")
+	v1.Handle("/users/{username}/mute", auth(srv.handlerUnmute)).Methods("DELETE")
+	v1.Handle("/mutes", auth(srv.handlerListMutes)).Methods("GET")
+	v1.Handle("/follow-requests", auth(srv.handlerFollowRequests)).Methods("GET")
+	v1.Handle("/follow-requests/{username}/accept", auth(srv.handlerAcceptFollow)).Methods("POST")
+	v1.Handle("/follow-requests/{username}/decline", auth(srv.handlerDeclineFollow)).Methods("POST")
+	v1.Handle("/leaderboard", auth(srv.handlerLeaderboard)).Methods("GET")
+	v1.Handle("/badges", auth(handlerListBadges)).Methods("GET")
+	v1.Handle("/categories", auth(handlerListCategories)).Methods("GET")
+	v1.Handle("/tiles/{z}/{x}/{y}", auth(srv.handlerTile)).Methods("GET")
+	v1.Handle("/admin/stats", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerAdminStats)))).Methods("GET")
+	// suspended users can log in and read, but not post, react or follow
+	v1.Handle("/admin/users/{username}/suspension", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerSuspendUser)))).Methods("POST")
+	v1.Handle("/admin/users/{username}/suspension", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerLiftSuspension)))).Methods("DELETE")
+	v1.Handle("/admin/users/{username}/verification", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerRevokeVerification)))).Methods("DELETE")
+	v1.Handle("/admin/verifications", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerPendingVerifications)))).Methods("GET")
+	v1.Handle("/admin/verifications/{username}/approve", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerApproveVerification)))).Methods("POST")
+	v1.Handle("/admin/verifications/{username}/reject", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerRejectVerification)))).Methods("POST")
+	v1.Handle("/admin/posts/{id}/remove", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerRemovePost)))).Methods("POST")
+	// every moderator action above is on record in Bigtable
+	v1.Handle("/admin/dead-letters", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerDeadLetters)))).Methods("GET")
+	v1.Handle("/admin/dead-letters/{id}/replay", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerReplayDeadLetter)))).Methods("POST")
+	v1.Handle("/admin/dead-letters/{id}", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerDropDeadLetter)))).Methods("DELETE")
+	v1.Handle("/admin/moderation", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerModerationLog)))).Methods("GET")
+	v1.Handle("/admin/service-accounts", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerCreateServiceAccount)))).Methods("POST")
+	v1.Handle("/admin/service-accounts", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerListServiceAccounts)))).Methods("GET")
+	v1.Handle("/admin/service-accounts/{id}", srv.adminOnly(jwtMiddleware, validateRequest(http.HandlerFunc(srv.handlerDisableServiceAccount)))).Methods("DELETE")
+	v1.Handle("/notifications", auth(srv.handlerListNotifications)).Methods("GET")
+	v1.Handle("/notifications/unread", auth(srv.handlerUnreadNotifications)).Methods("GET")
+	v1.Handle("/notifications/read-all", auth(srv.handlerReadAllNotifications)).Methods("POST")
+	v1.Handle("/notifications/{id}/read", auth(srv.handlerReadNotification)).Methods("POST")
+	// phones and browsers notifications are pushed to through FCM
+	v1.Handle("/devices", auth(srv.handlerRegisterDevice)).Methods("POST")
+	v1.Handle("/devices/{token}", auth(srv.handlerUnregisterDevice)).Methods("DELETE")
+	// and browsers, through their push service
+	v1.Handle("/webpush/key", auth(srv.handlerWebPushKey)).Methods("GET")
+	v1.Handle("/webpush/subscriptions", auth(srv.handlerWebPushSubscribe)).Methods("POST")
+	v1.Handle("/webpush/subscriptions", auth(srv.handlerWebPushUnsubscribe)).Methods("DELETE")
+	// areas the caller is notified of new posts in
+	v1.Handle("/geofences", auth(srv.handlerCreateGeofence)).Methods("POST")
+	v1.Handle("/geofences", auth(srv.handlerListGeofences)).Methods("GET")
+	v1.Handle("/geofences/{id}", auth(srv.handlerDeleteGeofence)).Methods("DELETE")
+	v1.Handle("/presence", auth(srv.handlerPresence)).Methods("POST")
+	v1.Handle("/presence", auth(srv.handlerLeavePresence)).Methods("DELETE")
+	v1.Handle("/nearby-users", auth(srv.handlerNearbyUsers)).Methods("GET")
+	v1.Handle("/profile", auth(srv.handlerGetProfile)).Methods("GET")
+	v1.Handle("/profile", auth(srv.handlerUpdateProfile)).Methods("PUT")
+	// asking admins for the verified badge, they answer under /admin/verifications
+	v1.Handle("/verification", auth(srv.handlerRequestVerification)).Methods("POST")
+	v1.Handle("/verification", auth(srv.handlerGetVerification)).Methods("GET")
+	// phone verification, two factor login texts to the verified phone
+	v1.Handle("/phone", auth(srv.handlerSetPhone)).Methods("POST")
+	v1.Handle("/phone", auth(srv.handlerDeletePhone)).Methods("DELETE")
+	v1.Handle("/phone/verify", auth(srv.handlerVerifyPhone)).Methods("POST")
 	// user input password, no tokens generate yet
-	r.Handle(API_PREFIX+"/login", http.HandlerFunc(loginHandler)).Methods("POST")
-	r.Handle(API_PREFIX+"/signup", http.HandlerFunc(signupHandler)).Methods("POST")
+	v1.Handle("/login", validateRequest(http.HandlerFunc(srv.loginHandler))).Methods("POST")
+	v1.Handle("/signup", validateRequest(http.HandlerFunc(srv.signupHandler))).Methods("POST")
+	// a token that can only search, for the app before sign up
+	v1.Handle("/guest", validateRequest(http.HandlerFunc(srv.handlerGuestToken))).Methods("POST")
+	// bots and integrations trade their client credentials for a scoped token
+	v1.Handle("/oauth/token", validateRequest(http.HandlerFunc(srv.handlerServiceToken))).Methods("POST")
+
+	// no token needed to read the API description
+	v1.HandleFunc("/openapi.json", handlerOpenAPI).Methods("GET")
+
+	// runs after routing, so it can label by route template
+	r.Use(metricsMiddleware)
+	// counts what every principal uses, also the requests the rate limit refuses
+	r.Use(srv.usageMiddleware)
+	// after routing too, limits can differ per route
+	r.Use(srv.rateLimitMiddleware)
+
+	// our own mux instead of http.DefaultServeMux, importing net/http/pprof
+	// or expvar registers unprotected handlers on the default one
+	root := http.NewServeMux()
 
 	// Backend endpoints.
-	http.Handle(API_PREFIX+"/", r)
+	// every API request goes through the same chain, outermost first: request id,
+	// panic recovery, access log, CORS (answers preflight before auth), compression,
+	// then the router with metrics, rate limit and per route jwt
+	api := chain(r, requestIDMiddleware, srv.recoveryMiddleware, srv.loggingMiddleware, corsMiddleware, compressMiddleware)
+	root.Handle(API_V1+"/", api)
+	root.Handle(API_V2+"/", api)
+	// /api/post etc. from apps released before versioning
+	root.Handle(API_ROOT+"/", legacyAPIShim(api))
+	// the API description at the conventional place too
+	root.Handle("/openapi.json", http.HandlerFunc(handlerOpenAPI))
+	// Prometheus scrapes this, not behind jwt
+	root.Handle("/metrics", promhttp.Handler())
+	// and the load balancer asks this, see degraded.go
+	root.Handle("/readyz", http.HandlerFunc(srv.handlerReady))
+	// the pages of share links, public and in HTML for the crawlers of chat apps
+	shares := mux.NewRouter()
+	shares.Handle(SHARE_PATH+"{token}", http.HandlerFunc(srv.handlerSharePage)).Methods("GET")
+	root.Handle(SHARE_PATH, chain(shares, requestIDMiddleware, srv.recoveryMiddleware, srv.loggingMiddleware))
+	// profiling in production, admins only
+	srv.registerDebugHandlers(root, jwtMiddleware)
 	// Frontend endpoints.
-	// in the build folder
-	http.Handle("/", http.FileServer(http.Dir("build")))
+	// the SPA, from the binary, a folder or GCS depending on config.Frontend
+	frontend, err := srv.frontendHandler()
+	if err != nil {
+		return nil, err
+	}
+	root.Handle("/", compressMiddleware(frontend))
 
-	// once error happens
-	// <port> <handler>
-	// handler has been create in last line
-	// bound the handler to the port
-	// wait for request, and call the callback function, once request coming,
-	// create a go routine to call handler
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return root, nil
 }
 
 // to handle post request
@@ -172,18 +492,39 @@ func main() {
 //
 // }
 // JSON: snake case; to uniform the name writing between JSON and GO
-func handlerPost(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) handlerPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
 
-	// "user" now is the token
-	// .(*jwt.Token) cast to a token type
-	// .(jwt.MapClaims) cast to a map token
-	// this map can get value from token string
-	user := r.Context().Value("user")
-	claims := user.(*jwt.Token).Claims
-	username := claims.(jwt.MapClaims)["username"]
+	username := usernameFromToken(r)
+
+	// a retried request with the same Idempotency-Key gets the post created the first time
+	saved := false
+	idemKey := ""
+	if k := r.Header.Get("Idempotency-Key"); k != "" {
+		idemKey = idempotencyKey(username, k)
+		existing, claimed := srv.claimIdempotencyKey(idemKey)
+		if !claimed {
+			if existing == idempotencyPending {
+				writeError(w, r, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+				return
+			}
+			srv.replayPost(w, r, existing)
+			return
+		}
+		defer func() {
+			if !saved {
+				srv.releaseIdempotencyKey(idemKey)
+			}
+		}()
+	}
+	// before the cooldown, a refused message doesn't use up a post
+	if !srv.checkMessage(w, r, cleanText(r.FormValue("message")), "body") {
+		return
+	}
+	// after the replay check, a retry of a created post isn't another post
+	if !srv.postCooldown(w, r, username) {
+		return
+	}
 
 	// 32 << 20 is the maxMemory param for ParseMultipartForm, equals to 32MB (1MB = 1024 * 1024 bytes = 2^20 bytes)
 	// After you call ParseMultipartForm, the file will be saved in the server memory with maxMemory size.
@@ -191,260 +532,335 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(32 << 20)
 
 	// Parse form data
-	fmt.Printf("Received one post request %s\n", r.FormValue("message"))
+	srv.Log.Printf("[%s] Received one post request %s\n", requestID(r), r.FormValue("message"))
+	// types and ranges are checked by validateRequest already
 	lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
 	lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
 	// get the string data
+	now := time.Now().UTC()
 	p := &Post{
-		User:    username.(string),
-		Message: r.FormValue("message"),
+		User:    username,
+		Message: cleanText(r.FormValue("message")),
 		Location: Location{
 			Lat: lat,
 			Lon: lon,
 		},
+		CreatedAt: now,
+		// one of the taxonomy, checked by validateRequest
+		Category:  r.FormValue("category"),
+		RequestID: requestID(r),
+	}
+	p.Lang = search.Language(p.Message)
+	// event_start and friends make it an event people can RSVP to
+	event, err := eventFromForm(r, now)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.Event = event
+	p.PublishAt, p.ExpiresAt, err = scheduleFromForm(r, now)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if p.PublishAt != nil {
+		// it is new when it goes out, feeds and the id sort by that
+		p.CreatedAt = *p.PublishAt
+	}
+	// quote_of embeds another post, the message is the commentary on it
+	if q := r.FormValue("quote_of"); q != "" {
+		ok, err := srv.checkQuotable(username, q)
+		if err != nil {
+			writeBackendError(w, r, "Failed to read the quoted post", err)
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "quote_of is not a post you can see")
+			return
+		}
+		p.QuoteOf = q
 	}
 
-	id := uuid.New()
+	// time ordered, sorts like created_at
+	id := newPostID(p.CreatedAt)
+	p.Id = id
 
 	// get the image we post
 	// <file> <header>
 	// FormFile: read file data
 	file, _, err := r.FormFile("image")
-	if err != nil {
-		http.Error(w, "GCS is not setup", http.StatusInternalServerError)
-		fmt.Printf("GCS is not setup %v.\n", err)
-		panic(err)
+	if err == nil && srv.without("gcs") {
+		file.Close()
+		writeError(w, r, http.StatusBadRequest, "Media uploads are turned off, post without an image")
+		return
 	}
-	defer file.Close()
-
-	// like java ticket master api key
-	// like a personal id
-	// when save to GCS, need access
-	// generate a api key
-	// when on GAE, my account is bonded to GAE, so we do not need to install key manually
-	ctx := context.Background()
-
-	_, attrs, err := saveToGCS(ctx, file, BUCKET_NAME, id)
-	if err != nil {
-		http.Error(w, "GCS is not setup", http.StatusInternalServerError)
-		fmt.Printf("GCS is not setup %v\n", err)
-		panic(err)
+	// without gcs every post is text
+	if err != nil && p.QuoteOf == "" && !srv.without("gcs") {
+		writeError(w, r, http.StatusBadRequest, "Missing image")
+		return
 	}
-
-	// now need to read it again, since last time the readed file
-	// has been passed to GCS, now the file buffer is empty, so need to read again
-	im, header, _ := r.FormFile("image")
-	defer im.Close()
-	// get the suffix of this file
-	suffix := filepath.Ext(header.Filename)
-
-	// Client needs to know the media type so as to render it.
-	if t, ok := mediaTypes[suffix]; ok {
-		p.Type = t
+	// a quote may be only commentary on the quoted post
+	if err != nil && p.QuoteOf != "" {
+		p.Type = "quote"
+	} else if err != nil {
+		p.Type = "text"
 	} else {
-		p.Type = "unknown"
-	}
-	// ML Engine only supports jpeg.
-	if suffix == ".jpeg" {
-		if score, err := annotate(im); err != nil {
-			http.Error(w, "Failed to annotate the image", http.StatusInternalServerError)
-			fmt.Printf("Failed to annotate the image %v\n", err)
+		defer file.Close()
+
+		// like java ticket master api key
+		// like a personal id
+		// when save to GCS, need access
+		// generate a api key
+		// when on GAE, my account is bonded to GAE, so we do not need to install key manually
+		// the request id goes along to GCS and the ML engine
+		ctx := requestContext(r)
+
+		// the bucket is private, the post links to the media through handlerMedia
+		_, err := srv.Media.Put(ctx, srv.Names.MediaPrefix+id, file)
+		if err != nil {
+			writeBackendError(w, r, "GCS is not setup", err)
 			return
-		} else {
-			p.Face = score
 		}
-	}
 
-	// when stored in GCS, the return url is attrs, save it to p.Url
-	p.Url = attrs.MediaLink
+		// now need to read it again, since last time the readed file
+		// has been passed to GCS, now the file buffer is empty, so need to read again
+		im, header, _ := r.FormFile("image")
+		defer im.Close()
+		// get the suffix of this file
+		suffix := filepath.Ext(header.Filename)
 
-	// save user post to es
-	saveToES(p, id)
-	//	saveToBigTable(p, id)
-}
-
-// <metadata of the object> <content of the file, including URL of the object we post>
-// storage: GCS api
-func saveToGCS(ctx context.Context, r io.Reader, bucketName, name string) (*storage.ObjectHandle, *storage.ObjectAttrs, error) {
-	// like creating a client when using elastic search
-	// create a client, like a connection
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// bucket is like folder
-	// create a bucket handle with a target name
-	bucket := client.Bucket(bucketName)
+		// Client needs to know the media type so as to render it.
+		if t, ok := mediaTypes[suffix]; ok {
+			p.Type = t
+		} else {
+			p.Type = "unknown"
+		}
+		// ML Engine only supports jpeg.
+		if suffix == ".jpeg" && !srv.without("moderation") {
+			// the post doesn't wait for the ML engine, the score comes with the replay
+			if score, err := srv.Classifier.FaceScore(ctx, im); err != nil {
+				srv.deadLetter("moderation.face", deadLetterPost{Id: id}, err)
+			} else {
+				p.Face = score
+			}
+		}
 
-	// ckeck if this bucket can be use
-	// <attrs> try to get attribute of the bucket, to see if the bucket exist
-	if _, err := bucket.Attrs(ctx); err != nil {
-		return nil, nil, err
+		p.Url = mediaURL(r, id)
 	}
 
-	// uuid in distinguish the file
-	obj := bucket.Object(name)
-	// a writer can write to the object in the bucket
-	wc := obj.NewWriter(ctx)
-
-	// r is file
-	// write to GCS
-	if _, err := io.Copy(wc, r); err != nil {
-		return nil, nil, err
+	// save user post to es, or to the write buffer while es can't be reached
+	buffered := false
+	if err := srv.saveToES(p, id); err != nil {
+		if srv.writeBufferDir() == "" || esRejected(err) {
+			writeBackendError(w, r, "Failed to save post to ES", err)
+			return
+		}
+		if berr := srv.bufferPost(p, id); berr != nil {
+			srv.Log.Printf("Failed to buffer post %s %v\n", id, berr)
+			writeBackendError(w, r, "Failed to save post to ES", err)
+			return
+		}
+		buffered = true
 	}
+	srv.saveToBigTable(requestContext(r), *p)
 
-	if err := wc.Close(); err != nil {
-		return nil, nil, err
+	saved = true
+	if idemKey != "" {
+		srv.completeIdempotencyKey(idemKey, id)
 	}
 
-	// offer read access to all users
-	// access control lease
-	// RoleReader: reader only
-	if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
-		return nil, nil, err
+	js, _ := json.Marshal(srv.withQuotes(username, []Post{*p})[0])
+	if buffered {
+		// searchable once replayWriteBuffer indexed it, which does the rest then
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+		return
 	}
-
-	// return the attribute of the object, like url in the object
-	attrs, err := obj.Attrs(ctx)
-	fmt.Printf("Post is saved to GCS: %s\n", attrs.MediaLink)
-
-	return obj, attrs, err
+	srv.postSaved(*p)
+	w.Write(js)
 }
 
-/*
-func saveToBigTable(p *Post, id string) {
-	// contains meta data for creating the connection with big table
-	ctx := context.Background()
-	// you must update project name here
-	// <project id> <bt-instance> globally locate the table
-	// create a bigtable instance to link big table
-	bt_client, err := bigtable.NewClient(ctx, PROJECT_ID, BT_INSTANCE)
-	if err != nil {
-		panic(err)
+// postSaved is what follows a new post in ES: caches, live feeds and the
+// notifications. Those of a scheduled post follow when it is published.
+func (srv *Server) postSaved(p Post) {
+	if p.PublishAt != nil {
 		return
 	}
+	// cached searches around this post are stale now
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+	// live feeds watching this area
+	srv.publishPost(p)
+	// and integrations, delivery retries take a while so don't wait for it
+	go srv.notifyWebhooks(p)
+	// first_post and friends
+	srv.awardBadgesLater(p.User)
+	// and one more day of the streak
+	srv.checkInLater(p.User, p.CreatedAt)
+	// users mentioned with @name and those watching the area
+	go srv.notifyMentions(p)
+	go srv.notifyGeofences(p)
+}
 
-	tbl := bt_client.Open("post")
-	// mutation: operation unit
-	// set one row data
-	mut := bigtable.NewMutation()
-	// write a timestamp
-	t := bigtable.Now()
-
-	// []byte stored in the bigtable
-	mut.Set("post", "user", t, []byte(p.User))
-	mut.Set("post", "message", t, []byte(p.Message))
-	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
-	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
-
-	// client apply the mutator
-	err = tbl.Apply(ctx, id, mut)
-	if err != nil {
-		panic(err)
-		return
+// saveToBigTable writes the Bigtable row of p, see postMutation. The post is
+// saved already, a failed write goes to the dead letters and is retried from
+// what ES has.
+func (srv *Server) saveToBigTable(ctx context.Context, p Post) {
+	if err := srv.Tables.Apply(ctx, srv.Names.PostTable, p.Id, postMutation(p)); err != nil {
+		srv.deadLetter("bigtable.post", deadLetterPost{Id: p.Id}, err)
 	}
-	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
-
 }
 
-*/
-
 // elastic search also stores data, is a DB
-func saveToES(p *Post, id string) {
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+func (srv *Server) saveToES(p *Post, id string) error {
+	es_client, err := srv.es()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	_, err = es_client.Index().
-		Index(INDEX).
-		Type(TYPE).
-		Id(id).
-		BodyJson(p).
-		Refresh(true).
-		Do()
-
+	err = esRetry(func() error {
+		_, err := es_client.Index().
+			Index(srv.Names.PostWriteAlias).
+			Type(TYPE).
+			Id(id).
+			BodyJson(p).
+			Refresh(true).
+			Do()
+		return err
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Printf("Post is saved to index: %s\n", p.Message)
+	srv.Log.Printf("[%s] Post is saved to index: %s\n", p.RequestID, p.Message)
+	srv.syncSearch(*p)
+	return nil
+}
+
+// searchResults is what a search answers viewer with, the posts they may see
+// with quotes and authors. Each one counts as an impression.
+func (srv *Server) searchResults(viewer string, ps []Post) []Post {
+	out := srv.withAuthors(srv.withQuotes(viewer, srv.feedPosts(viewer, ps)))
+	srv.countImpressions(out)
+	return out
 }
 
 // get parameter from url
-func handlerSearch(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one request for search.")
+func (srv *Server) handlerSearch(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
 
 	// <target string> <length of float>
 	// _: I dont care about the value of return, (err)
 	// in GO, cannot just initialize a varaible and not use it
+	// types and ranges are checked by validateRequest already
 	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
 	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
 
-	ran := DISTANCE
+	ran := srv.Config.DefaultDistance
 	if val := r.URL.Query().Get("range"); val != "" {
 		ran = val + "km"
 	}
 
-	fmt.Printf("Search received: %f %f %s\n", lat, lon, ran)
+	srv.Log.Printf("Search received: %f %f %s\n", lat, lon, ran)
+	viewer := usernameFromToken(r)
 
-	// client handle: like ticket master API
-	// sniff: log (book-keeping by callback)
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
-	if err != nil {
-		panic(err)
+	// events=, when= etc. ask for upcoming events only, by start time and not cached
+	if from, to, ok, err := eventWindow(r.URL.Query(), time.Now()); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	} else if ok {
+		ps, total, err := srv.searchEvents(lat, lon, ran, from, to)
+		if err != nil {
+			writeBackendError(w, r, "Failed to search events", err)
+			return
+		}
+		writeList(w, r, nonNilPosts(srv.searchResults(viewer, ps)), total, "", started)
+		return
 	}
 
-	// location: name of query
-	// Define geo distance query as specified in
-	// https://www.elastic.co/guide/en/elasticsearch/reference/5.2/query-dsl-geo-distance-query.html
-	q := elastic.NewGeoDistanceQuery("location")
-	q = q.Distance(ran).Lat(lat).Lon(lon)
+	// within=, from= and to= only take posts created in that window
+	from, to, err := postWindow(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// interface(object)
-	searchResult, err := client.Search().
-		Index(INDEX).
-		Query(q).
-		Pretty(true).
-		Do()
+	size := SEARCH_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		size, _ = strconv.Atoi(v)
+	}
 
-	if err != nil {
-		panic(err)
+	// repeated map refreshes from the same area hit redis instead of ES,
+	// the cache holds every post, private and muted ones are dropped per viewer
+	filters := windowFilters(r.URL.Query())
+	category := r.URL.Query().Get("category")
+	if category != "" {
+		filters = append(filters, "category="+category)
+	}
+	// words, "phrases", OR and -word in the message
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text != "" {
+		filters = append(filters, "q="+text)
+	}
+	query := searchCacheKey(lat, lon, ran, filters...)
+	key := searchCacheKey(lat, lon, ran, append(filters, "limit="+strconv.Itoa(size))...)
+
+	// admins diagnosing ranking or latency get how ES ran the query, the
+	// first page only and past the cache
+	if r.URL.Query().Get("profile") == "true" {
+		if _, scoped := tokenScope(r); scoped || !srv.isAdmin(viewer) {
+			writeError(w, r, http.StatusForbidden, "Profiling is for admins")
+			return
+		}
+		q := search.Nearby{Lat: lat, Lon: lon, Range: ran, Category: category, Text: text, From: from, To: to, Size: size, Profile: true}
+		srv.writeSearchProfile(w, r, q, viewer, started)
+		return
 	}
 
-	fmt.Println("Query took %d milliseconds\n", searchResult.TookInMillis)
-	fmt.Printf("Found a total of %d posts\n", searchResult.TotalHits())
+	// later pages seek past the cursor and aren't cached, few are asked for twice
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		after, err := srv.decodeCursor(v, query)
+		if err != nil {
+			writeValidationError(w, r, []fieldError{{Name: "cursor", In: "query", Message: err.Error()}})
+			return
+		}
+		ps, _, err := srv.searchNearby(lat, lon, ran, category, text, from, to, size, after)
+		if err != nil {
+			writeBackendError(w, r, "Failed to search posts", err)
+			return
+		}
+		writeList(w, r, nonNilPosts(srv.rankSearch(r, lat, lon, srv.searchResults(viewer, ps))), after.Total, srv.nextCursor(query, ps, size, after), started)
+		return
+	}
 
-	// put the result in Post
-	var typ Post
-	var ps []Post
+	if js, ok := srv.getCachedSearch(key); ok {
+		var cached searchHits
+		if err := json.Unmarshal(js, &cached); err == nil {
+			next := srv.nextCursor(query, cached.Posts, size, &pageCursor{Total: cached.Total})
+			writeList(w, r, nonNilPosts(srv.rankSearch(r, lat, lon, srv.searchResults(viewer, cached.Posts))), cached.Total, next, started)
+			return
+		}
+	}
 
-	// elastic not know what type of element in the result, tell him it's Post
-	// reflection: instance of Post
-	// only pick Post type
-	for _, item := range searchResult.Each(reflect.TypeOf(typ)) {
-		p := item.(Post) // p = (Post) item
-		fmt.Printf("Post by %s: %s at lat %v and lon %v\n",
-			p.User, p.Message, p.Location.Lat, p.Location.Lon)
-		ps = append(ps, p)
+	ps, total, err := srv.searchNearby(lat, lon, ran, category, text, from, to, size, nil)
+	if err != nil {
+		writeBackendError(w, r, "Failed to search posts", err)
+		return
 	}
+	next := srv.nextCursor(query, ps, size, &pageCursor{Total: total})
 
-	js, err := json.Marshal(ps)
+	js, err := json.Marshal(searchHits{Posts: ps, Total: total})
 	if err != nil {
 		// right error processing
 		// fmt.PrintF(w, "search input should be double value")
 		// panic(err) or return (both can shutdown the go routine)
 		// panic(err) can print the stack trace in the console
 		// return will not
-
-		panic(err)
+		// but a panic kills the connection and the client gets no answer at all
+		writeBackendError(w, r, "Failed to encode posts", err)
+		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	// allow front end to have access
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Write(js)
+	srv.cacheSearch(key, lat, lon, ran, js)
+	writeList(w, r, nonNilPosts(srv.rankSearch(r, lat, lon, srv.searchResults(viewer, ps))), total, next, started)
 	// Return a fake post
 	// convenient to transfer to JSON
 	/*	p := &Post{
@@ -469,54 +885,89 @@ func handlerSearch(w http.ResponseWriter, r *http.Request) {
 	*/
 }
 
-func handlerCluster(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one request for clustering")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+// searchNearby returns a page of size of the posts within ran (e.g. "200km")
+// of lat/lon, newest first, and how many are left from there. category ""
+// takes every category, text "" every message. after is where the page starts,
+// nil for the first. Used by /search and the GraphQL search field.
+func (srv *Server) searchNearby(lat, lon float64, ran, category, text string, from, to time.Time, size int, after *pageCursor) ([]Post, int64, error) {
+	q := search.Nearby{Lat: lat, Lon: lon, Range: ran, Category: category, Text: text, From: from, To: to, Size: size}
+	if after != nil {
+		q.Before, q.Skip = after.After, after.Skip
+	}
+	res, err := srv.Search.Nearby(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	return srv.searchPosts(res), res.Total, nil
+}
 
-	// browser will send OPTIONS to check if the endpoint exist
-	// if OPTIONS, only return the header
-	// otherwise run the rest of the code
-	if r.Method != "GET" {
-		return
+// searchPosts decodes the hits of res
+func (srv *Server) searchPosts(res search.Result) []Post {
+	srv.Log.Printf("Query took %d milliseconds, found a total of %d posts\n", res.TookMs, res.Total)
+	// put the result in Post
+	var ps []Post
+	for i, hit := range res.Hits {
+		var p Post
+		if err := json.Unmarshal(hit, &p); err != nil {
+			srv.Log.Printf("Skipping a post that doesn't decode %v\n", err)
+			continue
+		}
+		if i < len(res.Highlights) {
+			p.Highlight = res.Highlights[i]
+		}
+		srv.Log.Printf("Post by %s: %s at lat %v and lon %v\n",
+			p.User, p.Message, p.Location.Lat, p.Location.Lon)
+		ps = append(ps, p)
 	}
+	return ps
+}
+
+func (srv *Server) handlerCluster(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
 
 	// Get("") is getting "term" param in URL
 	// now we only have one ML model "face"
 	// if we have multiple model, we can use Prdiction[0] or[1] to refer to diferent model
 	term := r.URL.Query().Get("term")
+	if term == "" {
+		writeError(w, r, http.StatusBadRequest, "Missing term")
+		return
+	}
 
 	// Create a client
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+	client, err := srv.es()
 	if err != nil {
-		http.Error(w, "ES is not setup", http.StatusInternalServerError)
-		fmt.Printf("ES is not setup %v\n", err)
+		writeBackendError(w, r, "ES is not setup", err)
 		return
 	}
 
 	// Range query.
 	// For details, https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-range-query.html
 	// Gte: greater than equal
-	q := elastic.NewRangeQuery(term).Gte(0.9)
-
-	searchResult, err := client.Search().
-		Index(INDEX).
-		Query(q).
-		Pretty(true).
-		Do()
+	q := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery(term).Gte(0.9), notDeleted())
+
+	var searchResult *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		searchResult, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			Pretty(true).
+			Do()
+		return err
+	})
 	if err != nil {
 		// Handle error
-		m := fmt.Sprintf("Failed to query ES %v", err)
-		fmt.Println(m)
-		http.Error(w, m, http.StatusInternalServerError)
+		writeBackendError(w, r, "Failed to query ES", err)
+		return
 	}
 
 	// searchResult is of type SearchResult and returns hits, suggestions,
 	// and all kinds of other information from Elasticsearch.
-	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
+	srv.Log.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
 	// TotalHits is another convenience function that works even when something goes wrong.
-	fmt.Printf("Found a total of %d post\n", searchResult.TotalHits())
+	srv.Log.Printf("Found a total of %d post\n", searchResult.TotalHits())
 
 	// Each is a convenience function that iterates over hits in a search result.
 	// It makes sure you don't need to check for nil values in the response.
@@ -528,13 +979,5 @@ func handlerCluster(w http.ResponseWriter, r *http.Request) {
 		ps = append(ps, p)
 
 	}
-	js, err := json.Marshal(ps)
-	if err != nil {
-		m := fmt.Sprintf("Failed to parse post object %v", err)
-		fmt.Println(m)
-		http.Error(w, m, http.StatusInternalServerError)
-		return
-	}
-
-	w.Write(js)
+	writeList(w, r, nonNilPosts(srv.withQuotes(usernameFromToken(r), srv.feedPosts(usernameFromToken(r), ps))), searchResult.TotalHits(), "", started)
 }
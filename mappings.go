@@ -0,0 +1,209 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// The ES mappings are in mappings/<name>.json, one document type each:
+//
+//	{"version": 2, "type": "post", "mapping": {"properties": {...}}}
+//
+// A change to a file bumps its version. The version goes into the _meta of
+// the mapping, so an index tells which file it was created or last updated
+// with. Startup compares the indices with the files, see ensureMappings.
+//
+//go:embed mappings
+var embeddedMappings embed.FS
+
+// indexMapping is a file of mappings/
+type indexMapping struct {
+	Name    string                 `json:"-"`
+	Version int                    `json:"version"`
+	Type    string                 `json:"type"`
+	Mapping map[string]interface{} `json:"mapping"`
+}
+
+var (
+	// the posts in the monthly indices and the legacy ones in INDEX, and the
+	// users in INDEX. Loaded at startup, a broken file doesn't start.
+	postIndexMapping = mustLoadMapping("posts")
+	userIndexMapping = mustLoadMapping("users")
+	// what else is in INDEX and points at a post by its post_id, a term. ES 2
+	// wants a field mapped the same in every type of an index.
+	postRecordMappings = []indexMapping{
+		mustLoadMapping("reactions"),
+		mustLoadMapping("rsvps"),
+		mustLoadMapping("shares"),
+		mustLoadMapping("views"),
+	}
+
+	// what every monthly post index is created with
+	postMapping = indexBody(postIndexMapping)
+)
+
+func mustLoadMapping(name string) indexMapping {
+	js, err := embeddedMappings.ReadFile("mappings/" + name + ".json")
+	if err != nil {
+		panic(err)
+	}
+	m := indexMapping{Name: name}
+	if err := json.Unmarshal(js, &m); err != nil {
+		panic(fmt.Sprintf("mappings/%s.json: %v", name, err))
+	}
+	if m.Version < 1 || m.Type == "" || m.Mapping == nil {
+		panic(fmt.Sprintf("mappings/%s.json needs a version, type and mapping", name))
+	}
+	return m
+}
+
+// typeMapping is the mapping of the file with its version in _meta
+func (m indexMapping) typeMapping() map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range m.Mapping {
+		out[k] = v
+	}
+	out["_meta"] = map[string]interface{}{"version": m.Version}
+	return out
+}
+
+// indexBody is the create index body with the types of ms
+func indexBody(ms ...indexMapping) string {
+	types := map[string]interface{}{}
+	for _, m := range ms {
+		types[m.Type] = m.typeMapping()
+	}
+	js, _ := json.Marshal(map[string]interface{}{"mappings": types})
+	return string(js)
+}
+
+// mappingDrift compares the properties of an index with those of a file.
+// missing are fields the index doesn't have yet, put mapping adds them.
+// conflicts are fields mapped differently, ES can't change those in place.
+func mappingDrift(want, have map[string]interface{}, prefix string) (missing, conflicts []string) {
+	for name, w := range want {
+		wf, _ := w.(map[string]interface{})
+		hf, ok := have[name].(map[string]interface{})
+		if !ok {
+			missing = append(missing, prefix+name)
+			continue
+		}
+		wt, ht := fieldType(wf), fieldType(hf)
+		switch {
+		case wt != ht:
+			conflicts = append(conflicts, fmt.Sprintf("%s%s is %s, the file has %s", prefix, name, ht, wt))
+		case wt == "string" && fieldIndex(wf) != fieldIndex(hf):
+			conflicts = append(conflicts, fmt.Sprintf("%s%s is %s, the file has %s", prefix, name, fieldIndex(hf), fieldIndex(wf)))
+		case wt == "object":
+			wp, _ := wf["properties"].(map[string]interface{})
+			hp, _ := hf["properties"].(map[string]interface{})
+			m, c := mappingDrift(wp, hp, prefix+name+".")
+			missing, conflicts = append(missing, m...), append(conflicts, c...)
+		default:
+			// multi fields like message.cjk, put mapping adds them too
+			wsub, _ := wf["fields"].(map[string]interface{})
+			hsub, _ := hf["fields"].(map[string]interface{})
+			m, c := mappingDrift(wsub, hsub, prefix+name+".")
+			missing, conflicts = append(missing, m...), append(conflicts, c...)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(conflicts)
+	return missing, conflicts
+}
+
+// objects have properties and no type
+func fieldType(f map[string]interface{}) string {
+	if t, ok := f["type"].(string); ok {
+		return t
+	}
+	return "object"
+}
+
+// how a string is indexed, ES 2 leaves out the default
+func fieldIndex(f map[string]interface{}) string {
+	if i, ok := f["index"].(string); ok {
+		return i
+	}
+	return "analyzed"
+}
+
+// ensureMappings checks the indices and aliases in indices against m. Fields
+// the file has and an index lacks are put with drift "migrate" and fail the
+// start with "fail". A field mapped differently always fails, the documents
+// have to be copied into a new index, `around migrate` does that for posts.
+func (srv *Server) ensureMappings(client *elastic.Client, m indexMapping, drift string, indices ...string) error {
+	var res map[string]interface{}
+	err := esRetry(func() error {
+		var err error
+		res, err = client.GetMapping().Index(indices...).Type(m.Type).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		// none of the indices has the type yet, every field is missing
+		res = map[string]interface{}{}
+		for _, name := range indices {
+			res[name] = nil
+		}
+	} else if err != nil {
+		return err
+	}
+	want, _ := m.Mapping["properties"].(map[string]interface{})
+
+	// the concrete indices, aliases are resolved by ES
+	var names []string
+	for name := range res {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var problems []string
+	for _, name := range names {
+		index, _ := res[name].(map[string]interface{})
+		types, _ := index["mappings"].(map[string]interface{})
+		typ, _ := types[m.Type].(map[string]interface{})
+		have, _ := typ["properties"].(map[string]interface{})
+		version := 0
+		if meta, ok := typ["_meta"].(map[string]interface{}); ok {
+			if v, ok := meta["version"].(float64); ok {
+				version = int(v)
+			}
+		}
+
+		missing, conflicts := mappingDrift(want, have, "")
+		if len(conflicts) > 0 {
+			problems = append(problems, fmt.Sprintf("%s/%s: %s", name, m.Type, strings.Join(conflicts, ", ")))
+			continue
+		}
+		if version > m.Version {
+			srv.Log.Printf("Index %s has mapping %s v%d, newer than v%d of this build\n", name, m.Name, version, m.Version)
+			continue
+		}
+		if len(missing) == 0 && version == m.Version {
+			continue
+		}
+		if drift != "migrate" {
+			// an older version with every field is no drift
+			if len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("%s/%s is at v%d of mappings/%s.json v%d, missing %s", name, m.Type, version, m.Name, m.Version, strings.Join(missing, ", ")))
+			}
+			continue
+		}
+		err := esRetry(func() error {
+			_, err := client.PutMapping().Index(name).Type(m.Type).BodyJson(m.typeMapping()).Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		srv.Log.Printf("Updated mapping of %s/%s to %s v%d, added %s\n", name, m.Type, m.Name, m.Version, strings.Join(missing, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("mappings differ from mappings/%s.json (mapping_drift %s): %s", m.Name, drift, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TianyiSun2333/Around/blobstore"
+	"github.com/gorilla/mux"
+)
+
+// media of posts anyone may see can be cached by browsers and a CDN in front
+// this long, a deleted post's media is gone from caches after it
+const MEDIA_MAX_AGE = 10 * time.Minute
+
+// mediaURL is where the media of post id is served, the url that goes into
+// the post. Absolute for emails and feeds.
+func mediaURL(r *http.Request, id string) string {
+	return externalURL(r, API_V1+"/media/"+id)
+}
+
+// handlerMedia streams the media of a post from the bucket to those who may
+// see the post, so the bucket stays private and a deleted post or a private
+// account takes its media along:
+//
+//	GET /media/{id}?w=&h=&fit=
+//
+// It needs no token for posts of public accounts, image tags can't send one.
+// Others pass it in ?token=. w and h ask for an image of that size, see
+// serveResized, a thumbnail of a list doesn't need the full image.
+func (srv *Server) handlerMedia(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	viewer := usernameFromToken(r)
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	_, p, err := srv.findPost(client, id)
+	if err != nil {
+		writeError(w, r, statusForError(err), "Failed to read post")
+		srv.Log.Printf("Failed to read post %s %v\n", id, err)
+		return
+	}
+	// not telling a private post from a missing one
+	if p == nil || p.hidden() || !srv.canSee(viewer, p.User) {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return
+	}
+
+	obj, err := srv.Media.Open(context.Background(), srv.Names.MediaPrefix+id)
+	if err == blobstore.ErrNotExist {
+		writeError(w, r, http.StatusNotFound, "Post has no media")
+		return
+	}
+	if err != nil {
+		writeBackendError(w, r, "GCS is not setup", err)
+		return
+	}
+	defer obj.Close()
+
+	// who else may see it decides whether shared caches may keep it
+	cache := "private"
+	if srv.canSee("", p.User) {
+		cache = "public"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", cache, int(MEDIA_MAX_AGE.Seconds())))
+
+	if size := parseMediaSize(r); size.W > 0 || size.H > 0 {
+		if srv.serveResized(w, r, id, size) {
+			return
+		}
+	}
+	srv.writeMedia(w, r, id, obj)
+}
+
+// writeMedia streams obj with its headers
+func (srv *Server) writeMedia(w http.ResponseWriter, r *http.Request, id string, obj *blobstore.Object) {
+	h := w.Header()
+	if !obj.Updated.IsZero() {
+		h.Set("Last-Modified", obj.Updated.UTC().Format(http.TimeFormat))
+	}
+	if obj.ETag != "" && notModified(w, r, strconv.Quote(obj.ETag)) {
+		return
+	}
+	if obj.ContentType != "" {
+		h.Set("Content-Type", obj.ContentType)
+	}
+	h.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	h.Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, obj); err != nil {
+		srv.Log.Printf("Failed to stream media of post %s %v\n", id, err)
+	}
+}
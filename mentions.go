@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// a post mentioning more people than this is spam, the rest are not notified
+const MENTION_MAX = 10
+
+// @username, with the same characters signup allows
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([a-z0-9_]+)`)
+
+// mentions are the distinct usernames message mentions, in order
+func mentions(message string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(message, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// notifyMentions tells the users mentioned in p, the ones who exist, may see
+// it and didn't mute the author. Called after a post is saved.
+func (srv *Server) notifyMentions(p Post) {
+	names := mentions(p.Message)
+	if len(names) > MENTION_MAX {
+		names = names[:MENTION_MAX]
+	}
+	for _, name := range names {
+		if name == p.User || !srv.inFeed(name, p.User) {
+			continue
+		}
+		if _, ok := srv.getUser(name); !ok {
+			continue
+		}
+		srv.notifyLater(Notification{
+			User:    name,
+			Kind:    "mention",
+			Message: fmt.Sprintf("%s mentioned you", p.User),
+			Data:    map[string]string{"post_id": p.Id},
+		})
+	}
+}
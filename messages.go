@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// the description of the message fields in the API description
+const messageDescription = "Checked against the message rules of the deployment: at most max_length characters, 2000 unless configured, at most max_urls links and no banned words. A message that breaks them is a 422 with the problems in fields."
+
+// links in a message as people type them, with or without the scheme
+var messageURL = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// the compiled banned patterns of the config, by pattern
+var (
+	bannedPatterns   = map[string]*regexp.Regexp{}
+	bannedPatternsMu sync.Mutex
+)
+
+// bannedPattern compiles the banned pattern p once, case doesn't matter.
+// validate checked that it compiles.
+func bannedPattern(p string) *regexp.Regexp {
+	bannedPatternsMu.Lock()
+	defer bannedPatternsMu.Unlock()
+	re, ok := bannedPatterns[p]
+	if !ok {
+		re = regexp.MustCompile("(?i)" + p)
+		bannedPatterns[p] = re
+	}
+	return re
+}
+
+// check returns what is wrong with message by the rules, nothing for a
+// message that may be posted. The problems are in the form of the
+// validation errors, for the field name in in.
+func (m MessageRules) check(message, name, in string) []fieldError {
+	var errs []fieldError
+	if n := utf8.RuneCountInString(message); m.MaxLength > 0 && n > m.MaxLength {
+		errs = append(errs, fieldError{Name: name, In: in, Message: fmt.Sprintf("must be at most %d characters", m.MaxLength)})
+	}
+	if n := len(messageURL.FindAllStringIndex(message, -1)); m.MaxURLs > 0 && n > m.MaxURLs {
+		errs = append(errs, fieldError{Name: name, In: in, Message: fmt.Sprintf("must have at most %d links", m.MaxURLs)})
+	}
+	for _, p := range m.Banned {
+		if bannedPattern(p).MatchString(message) {
+			// which pattern stays in the log, spammers shouldn't learn it
+			errs = append(errs, fieldError{Name: name, In: in, Message: "has words that aren't allowed here"})
+			break
+		}
+	}
+	return errs
+}
+
+// checkMessage answers with a 422 when message breaks the messages rules
+// of the config and returns false then
+func (srv *Server) checkMessage(w http.ResponseWriter, r *http.Request, message, in string) bool {
+	errs := srv.Config.Messages.check(message, "message", in)
+	if len(errs) == 0 {
+		return true
+	}
+	srv.Log.Printf("[%s] Rejected message by %s: %s\n", requestID(r), usernameFromToken(r), srv.Config.Messages.explain(message))
+	writeFieldErrors(w, r, http.StatusUnprocessableEntity, "invalid_content", errs)
+	return false
+}
+
+// explain is what check found, with the banned patterns that matched, for the log
+func (m MessageRules) explain(message string) string {
+	out := []string{fmt.Sprintf("%d characters, %d links", utf8.RuneCountInString(message), len(messageURL.FindAllStringIndex(message, -1)))}
+	for _, p := range m.Banned {
+		if bannedPattern(p).MatchString(message) {
+			out = append(out, "banned "+p)
+		}
+	}
+	return strings.Join(out, ", ")
+}
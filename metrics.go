@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	httpInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "around_http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+
+	// one sample per attempt, retries show up as several calls
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_backend_call_duration_seconds",
+		Help:    "Latency of calls to ES, GCS, Bigtable and the ML engine.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "result"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_backend_errors_total",
+		Help: "Failed calls to ES, GCS, Bigtable and the ML engine, including rejections by an open circuit.",
+	}, []string{"backend", "kind"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, httpInFlight, backendDuration, backendErrors)
+}
+
+// metricsMiddleware records count, latency and in-flight requests per route. It is
+// installed on the mux router so the matched route template is known, which keeps
+// label cardinality bounded (/post/{id} instead of one label per post).
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		setAccessRoute(r, route)
+
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// statusRecorder remembers the status code written by the handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// whether the response has been started
+	wrote bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.wrote = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming handlers like /export working behind the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the websocket upgrade of /ws through the recorder
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	r.wrote = true
+	return h.Hijack()
+}
+
+// observeBackend is called by retry for every attempt
+func observeBackend(backend string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		kind := "transient"
+		if _, ok := err.(*permanentError); ok {
+			kind = "permanent"
+		}
+		backendErrors.WithLabelValues(backend, kind).Inc()
+	}
+	backendDuration.WithLabelValues(backend, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+const (
+	CORS_ALLOW_HEADERS  = "Content-Type,Authorization,If-Match,If-None-Match,Idempotency-Key,X-Request-ID"
+	CORS_ALLOW_METHODS  = "GET,POST,PUT,DELETE,OPTIONS"
+	CORS_EXPOSE_HEADERS = "ETag,X-Request-ID,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset,Retry-After,X-Total-Count,X-Next-Cursor"
+)
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h so that the first middleware is the outermost one:
+// chain(h, a, b) serves a(b(h)).
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// recoveryMiddleware turns a panic in any handler into a 500 for that request
+// instead of a dropped connection, the stack trace goes to the log.
+func (srv *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			if err := recover(); err != nil {
+				srv.Log.Printf("[%s] panic serving %s %s: %v\n%s", requestID(r), r.Method, r.URL.Path, err, debug.Stack())
+				// too late for a clean error if the handler already started the response
+				if !rec.wrote {
+					writeError(rec, r, http.StatusInternalServerError, "Internal error")
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// corsMiddleware sets the CORS headers for every API response and answers
+// preflight requests itself, before routing and authentication.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// allow front end to have access
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSE_HEADERS)
+
+		// browser will send OPTIONS to check if the endpoint exist
+		// if OPTIONS, only return the header
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOW_HEADERS)
+			w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOW_METHODS)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// postMigration changes a post document in place while it is copied to the new index
+type postMigration func(doc map[string]interface{})
+
+// every document goes through all of these, in order
+var postMigrations = []postMigration{
+	addCreatedAt,
+	addLang,
+}
+
+// migrationStart stands in for the creation time of posts that never had one
+var migrationStart = time.Now().UTC()
+
+// addCreatedAt fills created_at for posts indexed before the field existed
+func addCreatedAt(doc map[string]interface{}) {
+	if v, ok := doc["created_at"].(string); ok && v != "" && v != (time.Time{}).Format(time.RFC3339) {
+		return
+	}
+	doc["created_at"] = migrationStart
+}
+
+// addLang detects the language of posts from before lang, the copy also
+// analyzes their message into message.cjk and message.english
+func addLang(doc map[string]interface{}) {
+	if _, ok := doc["lang"]; ok {
+		return
+	}
+	message, _ := doc["message"].(string)
+	if lang := search.Language(message); lang != "" {
+		doc["lang"] = lang
+	}
+}
+
+// runMigrate implements `around migrate`: copy the posts of one index into a freshly
+// created index with the current postMapping, apply postMigrations, then swap the
+// aliases so the new index replaces the old one in a single step.
+//
+//	around migrate -from around -to around-posts-legacy-v2
+func (srv *Server) runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", srv.Names.Index, "index to migrate posts from")
+	to := fs.String("to", "", "index to create, defaults to <from>-v<unix time>")
+	batch := fs.Int("batch", EXPORT_BATCH_SIZE, "documents per bulk request")
+	fs.Parse(args)
+
+	if *to == "" {
+		*to = fmt.Sprintf("%s-v%d", *from, time.Now().Unix())
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.IndexExists(*to).Do()
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("index %s already exists", *to)
+	}
+	if _, err := client.CreateIndex(*to).Body(postMapping).Do(); err != nil {
+		return err
+	}
+	srv.Log.Printf("Created index %s\n", *to)
+
+	// only posts move, user documents in the legacy index stay where they are
+	scroll := client.Scroll(*from).
+		Type(TYPE).
+		Size(*batch).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	total := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		bulk := client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+				srv.Log.Printf("Skipping post %s %v\n", hit.Id, err)
+				continue
+			}
+			for _, m := range postMigrations {
+				m(doc)
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().Index(*to).Type(TYPE).Id(hit.Id).Doc(doc))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		n := bulk.NumberOfActions()
+		if err := bulkDo(bulk); err != nil {
+			// the old index is untouched and still behind the aliases
+			return err
+		}
+		total += n
+		srv.Log.Printf("Migrated %d posts\n", total)
+	}
+
+	// replace the old index in every post alias it belongs to
+	aliases, err := client.Aliases().Index(*from).Do()
+	if err != nil {
+		return err
+	}
+	swap := client.Alias()
+	swapped := false
+	for _, alias := range []string{srv.Names.PostReadAlias, srv.Names.PostWriteAlias} {
+		for _, name := range aliases.IndicesByAlias(alias) {
+			if name == *from {
+				swap = swap.Remove(*from, alias).Add(*to, alias)
+				swapped = true
+			}
+		}
+	}
+	if !swapped {
+		srv.Log.Printf("%s is not behind any post alias, nothing to swap\n", *from)
+		return nil
+	}
+	if _, err := swap.Do(); err != nil {
+		return err
+	}
+	srv.Log.Printf("Migrated %d posts from %s to %s, aliases swapped\n", total, *from, *to)
+	return nil
+}
+
+// legacyGenders maps what the old free text gender field held to the enum
+var legacyGenders = map[string]string{
+	"f":          "female",
+	"woman":      "female",
+	"m":          "male",
+	"man":        "male",
+	"nonbinary":  "non_binary",
+	"non-binary": "non_binary",
+	"nb":         "non_binary",
+}
+
+// migrateUser turns a user document of any older shape into the current User:
+// "Age"/"Gender" from the broken tags, free text gender, no created_at
+func migrateUser(u *User) {
+	normalizeUser(u)
+	if g, ok := legacyGenders[u.Gender]; ok {
+		u.Gender = g
+	} else if u.Gender != "" && !contains(genders, u.Gender) {
+		u.Gender = "other"
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = migrationStart
+	}
+}
+
+// runMigrateUsers implements `around migrate-users`: rewrites every user document
+// in the current schema. Documents keep their id, running it twice changes nothing.
+// Indexing them again also fills fields added to the mapping since, e.g. username.raw.
+func (srv *Server) runMigrateUsers(args []string) error {
+	fs := flag.NewFlagSet("migrate-users", flag.ExitOnError)
+	batch := fs.Int("batch", EXPORT_BATCH_SIZE, "documents per bulk request")
+	fs.Parse(args)
+
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	scroll := client.Scroll(srv.Names.Index).
+		Type(TYPE_USER).
+		Size(*batch).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	total := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		bulk := client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			// field names match case insensitively, so "Age" lands in LegacyAge
+			var u User
+			if err := json.Unmarshal(*hit.Source, &u); err != nil {
+				srv.Log.Printf("Skipping user %s %v\n", hit.Id, err)
+				continue
+			}
+			migrateUser(&u)
+			if errs := validateUser(u, time.Now()); len(errs) > 0 {
+				// still migrated, the user fixes it on the next profile update
+				srv.Log.Printf("User %s has invalid fields %v\n", u.Username, errs)
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().Index(hit.Index).Type(TYPE_USER).Id(hit.Id).Doc(u))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		n := bulk.NumberOfActions()
+		if err := bulkDo(bulk); err != nil {
+			return err
+		}
+		total += n
+		srv.Log.Printf("Migrated %d users\n", total)
+	}
+	srv.Log.Printf("Migrated %d users to the current schema\n", total)
+	return nil
+}
@@ -0,0 +1,23 @@
+package moderation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Fake is a Classifier for development that scores without a model. The
+// score follows from the bytes of the image, the same image always gets the
+// same one, and about a tenth of the images score 0.9 or more so /cluster has
+// posts to show.
+type Fake struct{}
+
+func (Fake) FaceScore(ctx context.Context, r io.Reader) (float64, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return 0, err
+	}
+	sum := h.Sum(nil)
+	return float64(binary.BigEndian.Uint16(sum)) / 65536, nil
+}
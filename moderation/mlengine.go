@@ -1,13 +1,16 @@
-package main
+// Package moderation scores uploaded images, so far how likely they show a
+// face, with a model on Google ML Engine.
+package moderation
 
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/TianyiSun2333/Around/requestid"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2/google"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
 )
@@ -46,27 +49,53 @@ type MlRequest struct {
 }
 
 var (
-	// TODO: Replace this project name and model name with your configuration.
-	project = "sigma-sunlight-206505"
-	model   = "face"
-	url     = "https://ml.googleapis.com/v1/projects/" + project + "/models/" + model + ":predict"
-	scope   = "https://www.googleapis.com/auth/cloud-platform"
+	scope = "https://www.googleapis.com/auth/cloud-platform"
 )
 
+// Classifier scores images
+type Classifier interface {
+	// FaceScore is the probability that the jpeg in r shows a face
+	FaceScore(ctx context.Context, r io.Reader) (float64, error)
+}
+
+// MLEngine is a Classifier with a model deployed on ML Engine. Retry wraps
+// every call, the server passes one with its circuit breaker, nil calls once.
+type MLEngine struct {
+	Project string
+	Model   string
+	Retry   func(fn func() error) error
+	// where the requests and their failures are logged, nil doesn't log
+	Log *log.Logger
+}
+
+func (m *MLEngine) logf(format string, v ...interface{}) {
+	if m.Log != nil {
+		m.Log.Printf(format, v...)
+	}
+}
+
+func (m *MLEngine) url() string {
+	return "https://ml.googleapis.com/v1/projects/" + m.Project + "/models/" + m.Model + ":predict"
+}
+
 // <io.Reader>: this image
 // return <float64>: the final score(probability)
 // Annotate a image file based on ml model, return score and error if exists.
-func annotate(r io.Reader) (float64, error) {
-	ctx := context.Background()
+func (m *MLEngine) FaceScore(ctx context.Context, r io.Reader) (float64, error) {
+	url := m.url()
 	// read to byte array from image
 	buf, _ := ioutil.ReadAll(r)
 
 	ts, err := google.DefaultTokenSource(ctx, scope)
 	if err != nil {
-		fmt.Printf("failed to create token %v\n", err)
+		m.logf("failed to create token %v\n", err)
+		return 0.0, err
+	}
+	tt, err := ts.Token()
+	if err != nil {
+		m.logf("failed to get token %v\n", err)
 		return 0.0, err
 	}
-	tt, _ := ts.Token()
 
 	// Construct a ml request.
 	// MLRequest is in the memory, so use pointer
@@ -83,45 +112,68 @@ func annotate(r io.Reader) (float64, error) {
 	// change this request to json
 	body, _ := json.Marshal(request)
 
-	// Construct a http request.
-	req, _ := http.NewRequest("POST", url, strings.NewReader(string(body)))
-	req.Header.Set("Authorization", "Bearer "+tt.AccessToken)
-
-	fmt.Printf("Sending request to ml engine for prediction %s with token as %s\n", url, tt.AccessToken)
+	m.logf("[%s] Sending request to ml engine for prediction %s\n", requestid.From(ctx), url)
 
 	// Send request to Google.
 	client := &http.Client{}
-	res, err := client.Do(req)
+	var res *http.Response
+	send := func() error {
+		// a request body can only be read once, build a new one per attempt
+		req, _ := http.NewRequest("POST", url, strings.NewReader(string(body)))
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+tt.AccessToken)
+		// Google logs it with the request
+		if id := requestid.From(ctx); id != "" {
+			req.Header.Set(requestid.HEADER, id)
+		}
+
+		var err error
+		res, err = client.Do(req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode >= 500 {
+			res.Body.Close()
+			return errors.Errorf("ml engine returned %d", res.StatusCode)
+		}
+		return nil
+	}
+	if m.Retry != nil {
+		err = m.Retry(send)
+	} else {
+		err = send()
+	}
 	if err != nil {
-		fmt.Printf("failed to send ml request %v\n", err)
+		m.logf("failed to send ml request %v\n", err)
 		return 0.0, err
 	}
+	defer res.Body.Close()
 	var resp MlResponse
 	body, _ = ioutil.ReadAll(res.Body)
 
 	// Double check if the response is empty. Sometimes Google does not return an error instead just an
 	// empty response while usually it's due to auth.
 	if len(body) == 0 {
-		fmt.Println("empty google response")
+		m.logf("empty google response\n")
 		return 0.0, errors.New("empty google response")
 	}
 
 	// Unmarshal:
 	// transfer the response to our type
 	if err := json.Unmarshal(body, &resp); err != nil {
-		fmt.Printf("failed to parse response %v\n", err)
+		m.logf("failed to parse response %v\n", err)
 		return 0.0, err
 	}
 
 	if len(resp.Predictions) == 0 {
 		// If the response is not empty, Google returns a different format. Check the raw message.
 		// Sometimes it's due to the image format. Google only accepts jpeg don't send png or others.
-		fmt.Printf("failed to parse response %s\n", string(body))
+		m.logf("failed to parse response %s\n", string(body))
 		return 0.0, errors.Errorf("cannot parse response %s\n", string(body))
 	}
 	// TODO: update index based on your ml model.
 	results := resp.Predictions[0]
-	fmt.Printf("Received a prediction result %f\n", results.Scores[0])
+	m.logf("Received a prediction result %f\n", results.Scores[0])
 	// Score[0]: the probability that this graph is a face
 	return results.Scores[0], nil
 }
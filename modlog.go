@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+)
+
+// created once per instance like the post table, tenants get their own:
+//
+//	cbt createtable moderation families=action
+const MODERATION_TABLE = "moderation"
+
+const (
+	MODERATION_FAMILY = "action"
+
+	MODERATION_PAGE_SIZE     = 50
+	MODERATION_PAGE_MAX_SIZE = 500
+	MODERATION_MAX_REASON    = 500
+)
+
+// what moderators do, appeals don't exist yet so neither does approving one
+const (
+	MODERATION_SUSPEND         = "suspend"
+	MODERATION_LIFT_SUSPENSION = "lift_suspension"
+	MODERATION_REMOVE_POST     = "remove_post"
+	// verification requests, see verification.go
+	MODERATION_VERIFY              = "verify"
+	MODERATION_REJECT_VERIFICATION = "reject_verification"
+	MODERATION_UNVERIFY            = "unverify"
+)
+
+// ModerationAction is one record of the moderation log. Records are only ever
+// added, a row that exists is never written again.
+type ModerationAction struct {
+	Id        string    `json:"id"`
+	Moderator string    `json:"moderator"`
+	Action    string    `json:"action"`
+	User      string    `json:"user,omitempty"`
+	PostID    string    `json:"post_id,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// action specific, e.g. the end of a suspension
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// moderationKeys are the rows of a record, one per user and one per post it is
+// about. The reversed time makes a prefix scan return the newest first, the id
+// keeps two records of the same nanosecond apart.
+func moderationKeys(a ModerationAction) []string {
+	suffix := fmt.Sprintf("#%019d#%s", math.MaxInt64-a.CreatedAt.UnixNano(), a.Id)
+	var keys []string
+	if a.User != "" {
+		keys = append(keys, "user#"+a.User+suffix)
+	}
+	if a.PostID != "" {
+		keys = append(keys, "post#"+a.PostID+suffix)
+	}
+	return keys
+}
+
+// logModeration appends a to the log, filling in id and time. Callers log
+// before acting, an action that isn't on record doesn't happen.
+func (srv *Server) logModeration(a ModerationAction) error {
+	a.CreatedAt = time.Now().UTC()
+	a.Id = newPostID(a.CreatedAt)
+	value, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	set := bigtable.NewMutation()
+	set.Set(MODERATION_FAMILY, "json", bigtable.Time(a.CreatedAt), value)
+	for _, key := range moderationKeys(a) {
+		// only applied when the row has no cells yet, nothing overwrites a record
+		inserted, err := srv.Tables.Insert(ctx, srv.Names.ModerationTable, key, set)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			return fmt.Errorf("moderation record %s already exists", key)
+		}
+	}
+	srv.Log.Printf("Moderation: %s %s user=%s post=%s\n", a.Moderator, a.Action, a.User, a.PostID)
+	return nil
+}
+
+// moderationHistory reads the newest records of prefix, "user#name#" or "post#id#"
+func (srv *Server) moderationHistory(prefix string, limit int) ([]ModerationAction, error) {
+	rows, err := srv.Tables.ReadPrefix(context.Background(), srv.Names.ModerationTable, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	actions := []ModerationAction{}
+	for _, row := range rows {
+		for _, item := range row[MODERATION_FAMILY] {
+			var a ModerationAction
+			if err := json.Unmarshal(item.Value, &a); err != nil {
+				srv.Log.Printf("Skipping moderation record %s %v\n", row.Key(), err)
+				continue
+			}
+			actions = append(actions, a)
+		}
+	}
+	return actions, nil
+}
+
+// handlerModerationLog lists what moderators did to a user or a post, newest
+// first, admins only
+//
+//	GET /admin/moderation?user=&post=&limit=
+func (srv *Server) handlerModerationLog(w http.ResponseWriter, r *http.Request) {
+	user, post := r.URL.Query().Get("user"), r.URL.Query().Get("post")
+	if (user == "") == (post == "") {
+		writeValidationError(w, r, []fieldError{{Name: "user", In: "query", Message: "exactly one of user and post is needed"}})
+		return
+	}
+	// types and ranges are checked by validateRequest already
+	limit := MODERATION_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	prefix := "user#" + user + "#"
+	if post != "" {
+		prefix = "post#" + post + "#"
+	}
+	actions, err := srv.moderationHistory(prefix, limit)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read moderation log", err)
+		return
+	}
+	js, _ := json.Marshal(actions)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// body of POST /admin/posts/{id}/remove
+type removalRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handlerRemovePost takes a post down for a moderator. It is soft deleted like
+// by its author and purged after the restore window, but the author can't
+// restore it.
+//
+//	POST /admin/posts/{id}/remove {"reason":"spam"}
+func (srv *Server) handlerRemovePost(w http.ResponseWriter, r *http.Request) {
+	moderator := usernameFromToken(r)
+	id := mux.Vars(r)["id"]
+	var req removalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode removal")
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if n := utf8.RuneCountInString(req.Reason); n == 0 || n > MODERATION_MAX_REASON {
+		writeValidationError(w, r, []fieldError{{Name: "reason", In: "body", Message: fmt.Sprintf("must be 1 to %d characters", MODERATION_MAX_REASON)}})
+		return
+	}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	hit, p, err := srv.findPost(client, id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read post", err)
+		return
+	}
+	if p == nil {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return
+	}
+	if p.RemovedBy != "" {
+		writeError(w, r, http.StatusConflict, "Post is already removed")
+		return
+	}
+
+	err = srv.logModeration(ModerationAction{Moderator: moderator, Action: MODERATION_REMOVE_POST, User: p.User, PostID: p.Id, Reason: req.Reason})
+	if err != nil {
+		writeBackendError(w, r, "Failed to log removal", err)
+		return
+	}
+	now := time.Now().UTC()
+	fields := map[string]interface{}{"removed_by": moderator}
+	// an earlier delete by the author keeps its time, the purge is not pushed back
+	if p.DeletedAt == nil {
+		fields["deleted_at"] = now
+	}
+	err = esRetry(func() error {
+		_, err := client.Update().
+			Index(hit.Index).
+			Type(TYPE).
+			Id(hit.Id).
+			Doc(fields).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to remove post", err)
+		return
+	}
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+	srv.unindexPost(p.Id)
+	w.WriteHeader(http.StatusNoContent)
+}
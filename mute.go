@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const TYPE_MUTE = "mute"
+
+// Mute hides the posts of Muted from the searches and live feeds of Muter. It is
+// stored in INDEX with id muter>muted and never shown to the muted user.
+type Mute struct {
+	Muter     string    `json:"muter"`
+	Muted     string    `json:"muted"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// loadMuted is the loader of mutedCache, who muter muted
+func (srv *Server) loadMuted(muter string) (map[string]bool, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_MUTE).
+			Query(elastic.NewTermQuery("muter", muter)).
+			Size(10000).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	muted := map[string]bool{}
+	for _, hit := range res.Hits.Hits {
+		var m Mute
+		if hit.Source != nil && json.Unmarshal(*hit.Source, &m) == nil {
+			muted[m.Muted] = true
+		}
+	}
+	return muted, nil
+}
+
+// inFeed is canSee minus the users viewer muted. It is for searches and live
+// feeds, a muted user's posts still open by link and on their page.
+func (srv *Server) inFeed(viewer, author string) bool {
+	if !srv.canSee(viewer, author) {
+		return false
+	}
+	if viewer == "" || viewer == author {
+		return true
+	}
+	muted, err := srv.mutedCache.get(viewer)
+	if err != nil {
+		// a mute is a preference, showing too much beats an empty map
+		srv.Log.Printf("Failed to load mutes of %s %v\n", viewer, err)
+		return true
+	}
+	return !muted[author]
+}
+
+// feedPosts is ps with only the posts inFeed lets through, ps itself is not changed
+func (srv *Server) feedPosts(viewer string, ps []Post) []Post {
+	shown := make([]Post, 0, len(ps))
+	for _, p := range ps {
+		if srv.inFeed(viewer, p.User) {
+			shown = append(shown, p)
+		}
+	}
+	return shown
+}
+
+// handlerMute mutes {username} for the caller, muting twice is fine
+func (srv *Server) handlerMute(w http.ResponseWriter, r *http.Request) {
+	muter := usernameFromToken(r)
+	muted := mux.Vars(r)["username"]
+	if muter == muted {
+		writeError(w, r, http.StatusBadRequest, "Cannot mute yourself")
+		return
+	}
+	if _, ok := srv.getUser(muted); !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	m := Mute{Muter: muter, Muted: muted, CreatedAt: time.Now().UTC()}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_MUTE).
+			Id(muter + ">" + muted).
+			BodyJson(m).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to save mute", err)
+		return
+	}
+	srv.mutedCache.invalidate(muter)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUnmute shows the posts of {username} to the caller again
+func (srv *Server) handlerUnmute(w http.ResponseWriter, r *http.Request) {
+	muter := usernameFromToken(r)
+	muted := mux.Vars(r)["username"]
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Delete().
+			Index(srv.Names.Index).
+			Type(TYPE_MUTE).
+			Id(muter + ">" + muted).
+			Refresh(true).
+			Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to delete mute", err)
+		return
+	}
+	srv.mutedCache.invalidate(muter)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerListMutes returns the usernames the caller muted, sorted
+func (srv *Server) handlerListMutes(w http.ResponseWriter, r *http.Request) {
+	// fresh from ES, the cache may lag behind another instance
+	username := usernameFromToken(r)
+	srv.mutedCache.invalidate(username)
+	muted, err := srv.mutedCache.get(username)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read mutes", err)
+		return
+	}
+	names := make([]string, 0, len(muted))
+	for name := range muted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	js, _ := json.Marshal(names)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_NOTIFICATION = "notification"
+
+	NOTIFICATIONS_PAGE_SIZE     = 20
+	NOTIFICATIONS_PAGE_MAX_SIZE = 100
+)
+
+// what users are notified of, each kind can be turned on or off per channel.
+// Posts have no comments, so there is no kind for them.
+var notificationKinds = []string{"like", "mention", "follow", "geofence", "streak_reminder", "verification"}
+
+// NotificationPrefs turns kinds of notifications on or off per channel. Kinds
+// left out are pushed but not emailed, mail is opt in like the digest. The
+// inbox always gets everything.
+type NotificationPrefs struct {
+	Push  map[string]bool `json:"push,omitempty"`
+	Email map[string]bool `json:"email,omitempty"`
+}
+
+func (p NotificationPrefs) pushes(kind string) bool {
+	on, ok := p.Push[kind]
+	return !ok || on
+}
+
+func (p NotificationPrefs) emails(kind string) bool {
+	return p.Email[kind]
+}
+
+func (p NotificationPrefs) validate() []fieldError {
+	var errs []fieldError
+	for channel, kinds := range map[string]map[string]bool{"push": p.Push, "email": p.Email} {
+		for kind := range kinds {
+			if !contains(notificationKinds, kind) {
+				errs = append(errs, fieldError{Name: "notification_prefs." + channel, In: "body", Message: "unknown kind " + kind})
+			}
+		}
+	}
+	return errs
+}
+
+// Notification is a message to one user, kept in INDEX until they read it and
+// listed by GET /notifications
+type Notification struct {
+	Id   string `json:"id"`
+	User string `json:"user"`
+	// what it is about, e.g. "streak_reminder", clients pick an icon by it
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// kind specific, e.g. the streak length
+	Data      map[string]string `json:"data,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ReadAt    *time.Time        `json:"read_at,omitempty"`
+}
+
+type notificationsPage struct {
+	Unread        int64          `json:"unread"`
+	Notifications []Notification `json:"notifications"`
+	// offset of the next page, absent on the last one
+	Next *int `json:"next,omitempty"`
+}
+
+// unread counts of GET /notifications/unread
+type unreadCounts struct {
+	Total int64            `json:"total"`
+	Kinds map[string]int64 `json:"kinds"`
+}
+
+// notify stores a notification for n.User, filling in id and time, and pushes
+// or emails it as their preferences say
+func (srv *Server) notify(n Notification) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	n.CreatedAt = time.Now().UTC()
+	n.Id = newPostID(n.CreatedAt)
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_NOTIFICATION).
+			Id(n.Id).
+			BodyJson(n).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	srv.Log.Printf("Notified %s of %s\n", n.User, n.Kind)
+
+	if !srv.pushEnabled() && !srv.webPushEnabled() && !srv.emailEnabled() {
+		return nil
+	}
+	u, ok := srv.getUser(n.User)
+	if !ok {
+		return nil
+	}
+	if (srv.pushEnabled() || srv.webPushEnabled()) && u.NotificationPrefs.pushes(n.Kind) {
+		if err := srv.pushNotification(n); err != nil {
+			srv.Log.Printf("Failed to push %s to %s %v\n", n.Kind, n.User, err)
+		}
+	}
+	if srv.emailEnabled() && u.Email != "" && u.NotificationPrefs.emails(n.Kind) {
+		if err := srv.emailNotification(u, n); err != nil {
+			srv.Log.Printf("Failed to email %s to %s %v\n", n.Kind, n.User, err)
+		}
+	}
+	return nil
+}
+
+func (srv *Server) emailNotification(u User, n Notification) error {
+	footer := "You get these because you turned on emails for " + n.Kind + " notifications, turn them off in your profile."
+	text := n.Message + "\n\n" + footer + "\n"
+	body := `<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<p>` + html.EscapeString(n.Message) + `</p>
+<p style="color:#888">` + html.EscapeString(footer) + `</p>
+</body></html>
+`
+	return srv.sendEmail(u.Email, "Around: "+n.Message, text, body)
+}
+
+// notifyLater is notify in the background, a request must not wait for pushes
+func (srv *Server) notifyLater(n Notification) {
+	go func() {
+		if err := srv.notify(n); err != nil {
+			srv.Log.Printf("Failed to notify %s of %s %v\n", n.User, n.Kind, err)
+		}
+	}()
+}
+
+func unreadNotifications(username string) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("user", username)).
+		MustNot(elastic.NewExistsQuery("read_at"))
+}
+
+// handlerListNotifications lists the notifications of the caller, newest first
+//
+//	GET /notifications?unread=true&offset=&limit=
+func (srv *Server) handlerListNotifications(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	// types and ranges are checked by validateRequest already
+	limit := NOTIFICATIONS_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset+limit > USER_PAGE_MAX_OFFSET {
+		writeError(w, r, http.StatusBadRequest, "Cannot page that far")
+		return
+	}
+	var q elastic.Query = elastic.NewTermQuery("user", username)
+	if r.URL.Query().Get("unread") == "true" {
+		q = unreadNotifications(username)
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_NOTIFICATION).
+			Query(q).
+			Sort("created_at", false).
+			From(offset).
+			Size(limit).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to read notifications", err)
+		return
+	}
+	var unread int64
+	err = esRetry(func() error {
+		var err error
+		unread, err = client.Count(srv.Names.Index).Type(TYPE_NOTIFICATION).Query(unreadNotifications(username)).Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to count notifications", err)
+		return
+	}
+
+	page := notificationsPage{Unread: unread, Notifications: []Notification{}}
+	for _, hit := range res.Hits.Hits {
+		var n Notification
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &n) != nil {
+			continue
+		}
+		page.Notifications = append(page.Notifications, n)
+	}
+	if next := offset + len(res.Hits.Hits); int64(next) < res.TotalHits() && len(res.Hits.Hits) > 0 {
+		page.Next = &next
+	}
+
+	js, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerReadNotification marks one notification of the caller as read
+//
+//	POST /notifications/{id}/read
+func (srv *Server) handlerReadNotification(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	id := mux.Vars(r)["id"]
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_NOTIFICATION).Id(id).Do()
+		return err
+	})
+	if err != nil && !elastic.IsNotFound(err) {
+		writeBackendError(w, r, "Failed to read notification", err)
+		return
+	}
+	var n Notification
+	// somebody else's is as missing as one that doesn't exist
+	if err != nil || !res.Found || res.Source == nil || json.Unmarshal(*res.Source, &n) != nil || n.User != username {
+		writeError(w, r, http.StatusNotFound, "Notification not found")
+		return
+	}
+
+	if n.ReadAt == nil {
+		now := time.Now().UTC()
+		n.ReadAt = &now
+		err = esRetry(func() error {
+			_, err := client.Update().
+				Index(srv.Names.Index).
+				Type(TYPE_NOTIFICATION).
+				Id(id).
+				Doc(map[string]interface{}{"read_at": now}).
+				Refresh(true).
+				Do()
+			return err
+		})
+		if err != nil {
+			writeBackendError(w, r, "Failed to mark notification read", err)
+			return
+		}
+	}
+
+	js, _ := json.Marshal(n)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerUnreadNotifications counts the unread notifications of the caller per
+// kind, for badges that shouldn't load the whole list
+//
+//	GET /notifications/unread
+func (srv *Server) handlerUnreadNotifications(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_NOTIFICATION).
+			Query(unreadNotifications(username)).
+			Aggregation("kinds", elastic.NewTermsAggregation().Field("kind").Size(len(notificationKinds))).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to count notifications", err)
+		return
+	}
+	counts := unreadCounts{Total: res.TotalHits(), Kinds: map[string]int64{}}
+	if agg, ok := res.Aggregations.Terms("kinds"); ok {
+		for _, b := range agg.Buckets {
+			if kind, ok := b.Key.(string); ok {
+				counts.Kinds[kind] = b.DocCount
+			}
+		}
+	}
+	js, _ := json.Marshal(counts)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerReadAllNotifications marks every unread notification of the caller
+// read, or only those of one kind
+//
+//	POST /notifications/read-all?kind=
+func (srv *Server) handlerReadAllNotifications(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	q := unreadNotifications(username)
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		q = q.Filter(elastic.NewTermQuery("kind", kind))
+	}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	scroll := client.Scroll(srv.Names.Index).
+		Type(TYPE_NOTIFICATION).
+		Query(q).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	now := time.Now().UTC()
+	marked := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeBackendError(w, r, "Failed to read notifications", err)
+			return
+		}
+		bulk := client.Bulk().Refresh(true)
+		for _, hit := range res.Hits.Hits {
+			bulk.Add(elastic.NewBulkUpdateRequest().
+				Index(srv.Names.Index).
+				Type(TYPE_NOTIFICATION).
+				Id(hit.Id).
+				Doc(map[string]interface{}{"read_at": now}))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		if err := bulkDo(bulk); err != nil {
+			writeBackendError(w, r, "Failed to mark notifications read", err)
+			return
+		}
+		marked += len(res.Hits.Hits)
+	}
+	srv.Log.Printf("Marked %d notifications of %s read\n", marked, username)
+
+	js, _ := json.Marshal(map[string]int{"marked": marked})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,2239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The subset of OpenAPI 3.0 we need to describe the API. The same values are
+// served at /openapi.json and used by validateRequest, so the document can't
+// drift from what the server actually accepts.
+
+type openAPISpec struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       openAPIInfo                     `json:"info"`
+	Servers    []openAPIServer                 `json:"servers"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components openAPIComponents               `json:"components"`
+	Security   []map[string][]string           `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+type operation struct {
+	Summary     string              `json:"summary"`
+	OperationID string              `json:"operationId"`
+	Parameters  []parameter         `json:"parameters,omitempty"`
+	RequestBody *requestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]response `json:"responses"`
+	// nil for the global requirement, pointer so an empty list (no auth) is kept
+	Security *[]map[string][]string `json:"security,omitempty"`
+	// API_ROOT for the operations of later versions, their paths start with
+	// the version, e.g. /v2/search
+	Servers []openAPIServer `json:"servers,omitempty"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // query, path or header
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]mediaType `json:"content"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type response struct {
+	Description string               `json:"description"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Properties  map[string]*schema `json:"properties,omitempty"`
+	Items       *schema            `json:"items,omitempty"`
+	MinItems    *int               `json:"minItems,omitempty"`
+	MaxItems    *int               `json:"maxItems,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	// false rejects fields that aren't in Properties, a typo isn't silently ignored
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+}
+
+func num(v float64) *float64 { return &v }
+func length(v int) *int      { return &v }
+func boolean(v bool) *bool   { return &v }
+
+func ref(name string) *schema { return &schema{Ref: "#/components/schemas/" + name} }
+
+// the usual bodies, every error is an apiError
+func jsonContent(s *schema) map[string]mediaType {
+	return map[string]mediaType{"application/json": {Schema: s}}
+}
+
+// the body of list responses, see listPage
+func listPageSchema(items *schema) *schema {
+	return &schema{Type: "object", Properties: map[string]*schema{
+		"items":       {Type: "array", Items: items},
+		"total":       {Type: "integer", Description: "Every match, also sent as X-Total-Count. Items can be fewer, some are hidden from the caller."},
+		"next_cursor": {Type: "string", Nullable: true, Description: "Where the next page starts, null on the last page."},
+		"took_ms":     {Type: "integer", Description: "Milliseconds the server took."},
+	}}
+}
+
+func errorResponse(description string) response {
+	return response{Description: description, Content: jsonContent(ref("Error"))}
+}
+
+var (
+	latSchema = &schema{Type: "number", Format: "double", Minimum: num(-90), Maximum: num(90)}
+	lonSchema = &schema{Type: "number", Format: "double", Minimum: num(-180), Maximum: num(180)}
+	// km, without the unit
+	rangeSchema = &schema{Type: "number", Minimum: num(0), Maximum: num(SEARCH_MAX_RANGE_KM), Description: "Distance in km, the server default when missing."}
+	// views per band of km from the post, see distanceBands
+	distanceSchema = &schema{Type: "object", Description: "Views per distance band in km (0-1, 1-5, 5-25, 25-100, 100+) and unknown."}
+
+	collectionIDParam   = parameter{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}
+	notificationIDParam = parameter{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}
+	postIDParam         = parameter{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}
+	webhookIDParam      = parameter{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string"}}
+	usernameParam       = parameter{Name: "username", In: "path", Required: true, Schema: usernameSchema}
+	qrFormatParam       = parameter{Name: "format", In: "query", Description: "png by default.", Schema: &schema{Type: "string", Enum: []string{"png", "svg"}}}
+	qrSizeParam         = parameter{Name: "size", In: "query", Description: "Pixels of a PNG, the side of the square. SVGs scale.", Schema: &schema{Type: "integer", Minimum: num(QR_MIN_SIZE), Maximum: num(QR_MAX_SIZE)}}
+	dayZoneParam        = parameter{Name: "tz", In: "query", Description: "IANA time zone the days are in, the caller's profile time zone or UTC by default.", Schema: &schema{Type: "string", MaxLength: length(64)}}
+	ifNoneMatchParam    = parameter{Name: "If-None-Match", In: "header", Description: "ETag of the response the client has, 304 while it is unchanged.", Schema: &schema{Type: "string"}}
+	ifMatchParam        = parameter{Name: "If-Match", In: "header", Description: "ETag of the version being edited.", Schema: &schema{Type: "string"}}
+
+	noAuth = &[]map[string][]string{}
+
+	qrResponse = response{Description: "The code", Content: map[string]mediaType{
+		"image/png":     {Schema: &schema{Type: "string", Format: "binary"}},
+		"image/svg+xml": {Schema: &schema{Type: "string"}},
+	}}
+
+	// the pattern follows config.Usernames, see useUsernamePolicy
+	usernameSchema = &schema{Type: "string", Pattern: `^[a-z0-9_]+$`}
+
+	// validateUser has the checks formats can't express, like the minimum age
+	emailSchema       = &schema{Type: "string", Format: "email", MaxLength: length(254)}
+	phoneSchema       = &schema{Type: "string", Description: "With country code like +4915112345678.", MaxLength: length(32)}
+	displayNameSchema = &schema{Type: "string", MaxLength: length(PROFILE_MAX_DISPLAY_NAME)}
+	birthdateSchema   = &schema{Type: "string", Format: "date", Pattern: `^(\d{4}-\d{2}-\d{2})?$`}
+	genderSchema      = &schema{Type: "string", Enum: append([]string{""}, genders...)}
+)
+
+// the same on /search and /api/v2/search, only the body of the answer differs
+var searchParams = []parameter{
+	{Name: "lat", In: "query", Required: true, Schema: latSchema},
+	{Name: "lon", In: "query", Required: true, Schema: lonSchema},
+	{Name: "range", In: "query", Schema: rangeSchema},
+	{Name: "category", In: "query", Description: "Only posts of this category, not for events.", Schema: &schema{Type: "string", Enum: categoryIds()}},
+	{Name: "q", In: "query", Description: `Only posts whose message has all the words. "Quoted phrases" match as a whole, OR between words takes either and -word or -"phrase" leaves posts with it out. Not for events.`, Schema: &schema{Type: "string", MaxLength: length(SEARCH_MAX_QUERY)}},
+	{Name: "within", In: "query", Description: "Only posts created in the last minutes, hours or days, like 30m, 24h or 7d.", Schema: &schema{Type: "string", Pattern: `^[0-9]+[mhd]$`}},
+	{Name: "from", In: "query", Description: "Only posts created at or after this, not with within.", Schema: &schema{Type: "string", Format: "date-time"}},
+	{Name: "to", In: "query", Description: "Only posts created before this.", Schema: &schema{Type: "string", Format: "date-time"}},
+	{Name: "limit", In: "query", Description: "Posts per page, newest first.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(SEARCH_MAX_PAGE_SIZE)}},
+	{Name: "cursor", In: "query", Description: "Where the page starts: next_cursor of the previous page, X-Next-Cursor in v1, with the same other parameters. Not for events.", Schema: &schema{Type: "string", MaxLength: length(8192)}},
+	ifNoneMatchParam,
+	{Name: "events", In: "query", Description: "Only events that are not over.", Schema: &schema{Type: "boolean"}},
+	{Name: "when", In: "query", Description: "Only events during the rest of today or the coming weekend.", Schema: &schema{Type: "string", Enum: []string{"today", "weekend"}}},
+	{Name: "tz", In: "query", Description: "IANA time zone for when, UTC by default.", Schema: &schema{Type: "string", MaxLength: length(64)}},
+	{Name: "event_from", In: "query", Description: "Only events ending after this.", Schema: &schema{Type: "string", Format: "date-time"}},
+	{Name: "event_to", In: "query", Description: "Only events starting before this.", Schema: &schema{Type: "string", Format: "date-time"}},
+	{Name: "profile", In: "query", Description: "Admins only: the first page past the cache, with the ES profile of the query in profile.", Schema: &schema{Type: "boolean"}},
+}
+
+var clusterParams = []parameter{
+	{Name: "term", In: "query", Required: true, Schema: &schema{Type: "string", Enum: []string{"face"}}},
+	ifNoneMatchParam,
+}
+
+var apiSpec = openAPISpec{
+	OpenAPI: "3.0.3",
+	Info: openAPIInfo{Title: "Around", Version: "1", Description: "Requests are rate limited per user, or per address without a token. " +
+		"Limits differ between anonymous clients, users, API keys and admins, some routes have their own. " +
+		"Every response has X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (unix time the window ends), " +
+		"a 429 also Retry-After in seconds. " +
+		"Error messages are translated per Accept-Language where a translation exists (de, es, zh), Content-Language tells which, the error codes never change."},
+	Servers: []openAPIServer{{URL: API_V1}},
+	// everything needs a token unless the operation says otherwise
+	Security: []map[string][]string{{"bearer": {}}},
+	Components: openAPIComponents{
+		SecuritySchemes: map[string]securityScheme{
+			"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+		},
+		Schemas: map[string]*schema{
+			"Error": {Type: "object", Required: []string{"code", "message"}, Properties: map[string]*schema{
+				"code":       {Type: "string"},
+				"message":    {Type: "string"},
+				"request_id": {Type: "string"},
+				"fields": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+					"name":    {Type: "string"},
+					"in":      {Type: "string"},
+					"message": {Type: "string"},
+				}}},
+			}},
+			"Location": {Type: "object", Required: []string{"lat", "lon"}, Properties: map[string]*schema{
+				"lat": latSchema,
+				"lon": lonSchema,
+			}},
+			"Post": {Type: "object", Properties: map[string]*schema{
+				"id":             {Type: "string"},
+				"user":           {Type: "string"},
+				"message":        {Type: "string"},
+				"url":            {Type: "string", Format: "uri"},
+				"type":           {Type: "string", Enum: []string{"image", "video", "quote", "text"}, Description: "quote for quote posts without media of their own, text for posts of deployments without media."},
+				"face":           {Type: "number"},
+				"location":       ref("Location"),
+				"created_at":     {Type: "string", Format: "date-time"},
+				"updated_at":     {Type: "string", Format: "date-time"},
+				"deleted_at":     {Type: "string", Format: "date-time"},
+				"publish_at":     {Type: "string", Format: "date-time", Description: "Set until the post is published, it is in no search or feed before."},
+				"expires_at":     {Type: "string", Format: "date-time"},
+				"event":          ref("Event"),
+				"category":       {Type: "string", Enum: categoryIds(), Description: "GET /categories has the names."},
+				"lang":           {Type: "string", Enum: []string{"zh", "ja", "ko"}, Description: "Set by the server for messages in Chinese, Japanese or Korean."},
+				"request_id":     {Type: "string", Description: "X-Request-ID of the request that created the post."},
+				"reactions":      {Type: "object", Description: "Count per reaction type, types nobody used are left out."},
+				"reaction_count": {Type: "integer"},
+				"views":          {Type: "integer", Description: "Distinct viewers per day, written every few seconds."},
+				"impressions":    {Type: "integer", Description: "Times the post was in search results, written every few seconds."},
+				"quote_of":       {Type: "string", Description: "Id of the quoted post."},
+				"author": {Type: "object", Description: "Only in search results.", Properties: map[string]*schema{
+					"username":     {Type: "string"},
+					"display_name": {Type: "string"},
+					"avatar":       {Type: "string", Format: "uri"},
+					"verified":     {Type: "boolean", Description: "An admin checked who the account belongs to."},
+					"badges":       {Type: "array", Items: ref("Badge")},
+				}},
+				"quoted":    ref("QuotedPost"),
+				"highlight": {Type: "array", Items: &schema{Type: "string"}, Description: "Only in search results with q. Snippets of the message with the matching words in <em>, HTML escaped otherwise."},
+			}},
+			"QuotedPost": {Type: "object", Description: "The quoted post as the caller may see it, a tombstone when it was deleted or is hidden from them.", Properties: map[string]*schema{
+				"id":        {Type: "string"},
+				"post":      ref("Post"),
+				"tombstone": {Type: "boolean"},
+			}},
+			"Reaction": {Type: "object", Properties: map[string]*schema{
+				"post_id":    {Type: "string"},
+				"user":       {Type: "string"},
+				"type":       {Type: "string", Enum: reactionNames()},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"Event": {Type: "object", Properties: map[string]*schema{
+				"starts_at": {Type: "string", Format: "date-time"},
+				"ends_at":   {Type: "string", Format: "date-time"},
+				"capacity":  {Type: "integer", Description: "Missing or 0 is no limit."},
+			}},
+			"RSVP": {Type: "object", Properties: map[string]*schema{
+				"post_id":    {Type: "string"},
+				"user":       {Type: "string"},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"PostCategory": {Type: "object", Properties: map[string]*schema{
+				"id":          {Type: "string"},
+				"name":        {Type: "string"},
+				"description": {Type: "string"},
+			}},
+			"Badge": {Type: "object", Description: "GET /badges has the names.", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"awarded_at": {Type: "string", Format: "date-time"},
+			}},
+			"Collection": {Type: "object", Properties: map[string]*schema{
+				"id":          {Type: "string"},
+				"owner":       {Type: "string"},
+				"name":        {Type: "string"},
+				"description": {Type: "string"},
+				"post_ids":    {Type: "array", Items: &schema{Type: "string"}},
+				"created_at":  {Type: "string", Format: "date-time"},
+				"updated_at":  {Type: "string", Format: "date-time"},
+			}},
+			"CollectionRequest": {Type: "object", AdditionalProperties: boolean(false), Description: "Fields left out of a PUT keep their value, post_ids replaces the list.", Properties: map[string]*schema{
+				"name":        {Type: "string", MinLength: length(1), MaxLength: length(COLLECTION_MAX_NAME)},
+				"description": {Type: "string", MaxLength: length(COLLECTION_MAX_DESCRIPTION)},
+				"post_ids":    {Type: "array", Items: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}},
+			}},
+			"LookupRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"ids"}, Properties: map[string]*schema{
+				"ids": {Type: "array", MinItems: length(1), MaxItems: length(POST_LOOKUP_MAX), Items: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}},
+			}},
+			"Credentials": {Type: "object", Required: []string{"username", "password"}, Properties: map[string]*schema{
+				"username":     usernameSchema,
+				"password":     {Type: "string", MinLength: length(1)},
+				"email":        emailSchema,
+				"display_name": displayNameSchema,
+				"birthdate":    birthdateSchema,
+				"gender":       genderSchema,
+				"phone":        phoneSchema,
+				"code":         {Type: "string", Description: "Login only, the SMS code of a two factor login."},
+			}},
+			"Profile": {Type: "object", Properties: map[string]*schema{
+				"username":           {Type: "string"},
+				"email":              {Type: "string", Format: "email"},
+				"display_name":       {Type: "string"},
+				"bio":                {Type: "string"},
+				"avatar":             {Type: "string", Format: "uri"},
+				"birthdate":          {Type: "string", Format: "date"},
+				"age":                {Type: "integer", Description: "From the birthdate, 0 when unknown."},
+				"gender":             {Type: "string"},
+				"private":            {Type: "boolean"},
+				"share_presence":     {Type: "boolean"},
+				"verified":           {Type: "boolean", Description: "Set by admins, see POST /verification."},
+				"badges":             {Type: "array", Items: ref("Badge")},
+				"time_zone":          {Type: "string", Description: "Streak days end at its midnight, UTC when empty."},
+				"streak":             ref("Streak"),
+				"digest":             {Type: "string", Description: "Empty when not subscribed."},
+				"home":               ref("Location"),
+				"notification_prefs": ref("NotificationPrefs"),
+				"phone":              {Type: "string"},
+				"phone_verified":     {Type: "boolean"},
+				"two_factor":         {Type: "boolean", Description: "Login needs a code texted to the phone."},
+				"suspended_until":    {Type: "string", Format: "date-time", Description: "Only while suspended, the account is read only until then."},
+				"created_at":         {Type: "string", Format: "date-time"},
+			}},
+			"ProfileUpdate": {Type: "object", AdditionalProperties: boolean(false), Description: "Fields left out keep their value, an empty string clears one.", Properties: map[string]*schema{
+				"email":              emailSchema,
+				"display_name":       displayNameSchema,
+				"bio":                {Type: "string", MaxLength: length(PROFILE_MAX_BIO)},
+				"avatar":             {Type: "string", Format: "uri", MaxLength: length(2048)},
+				"birthdate":          birthdateSchema,
+				"gender":             genderSchema,
+				"private":            {Type: "boolean", Description: "Only accepted followers see the posts."},
+				"share_presence":     {Type: "boolean", Description: "Needed to send presence heartbeats and to list nearby users."},
+				"time_zone":          {Type: "string", Description: "IANA name like Europe/Berlin.", MaxLength: length(64)},
+				"digest":             {Type: "string", Enum: append([]string{""}, digestFrequencies...), Description: "Email of what is popular around home, needs email and home. Empty unsubscribes."},
+				"home":               ref("Location"),
+				"notification_prefs": ref("NotificationPrefs"),
+				"two_factor":         {Type: "boolean", Description: "Needs a verified phone."},
+			}},
+			"DeadLetter": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"op":         {Type: "string", Description: "What failed: search.sync, bigtable.post, es.post, moderation.face or username.move."},
+				"payload":    {Type: "object", Description: "What the op needs to run again, most ops only have the id of a post."},
+				"error":      {Type: "string", Description: "Of the last try."},
+				"attempts":   {Type: "integer"},
+				"created_at": {Type: "string", Format: "date-time"},
+				"updated_at": {Type: "string", Format: "date-time"},
+			}},
+			"ModerationAction": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"moderator":  {Type: "string"},
+				"action":     {Type: "string", Enum: []string{MODERATION_SUSPEND, MODERATION_LIFT_SUSPENSION, MODERATION_REMOVE_POST, MODERATION_VERIFY, MODERATION_REJECT_VERIFICATION, MODERATION_UNVERIFY}},
+				"user":       {Type: "string"},
+				"post_id":    {Type: "string"},
+				"reason":     {Type: "string"},
+				"created_at": {Type: "string", Format: "date-time"},
+				"details":    {Type: "object", Description: "Action specific, until for suspend."},
+			}},
+			"Suspension": {Type: "object", Properties: map[string]*schema{
+				"username":          {Type: "string"},
+				"suspended":         {Type: "boolean"},
+				"suspended_until":   {Type: "string", Format: "date-time"},
+				"suspension_reason": {Type: "string"},
+			}},
+			"VerificationRequest": {Type: "object", Properties: map[string]*schema{
+				"username":   {Type: "string"},
+				"reason":     {Type: "string", Description: "What the user told the admins."},
+				"state":      {Type: "string", Enum: []string{VERIFICATION_PENDING, VERIFICATION_APPROVED, VERIFICATION_REJECTED}},
+				"created_at": {Type: "string", Format: "date-time"},
+				"decided_by": {Type: "string", Description: "The admin, once approved or rejected."},
+				"decided_at": {Type: "string", Format: "date-time"},
+				"note":       {Type: "string", Description: "Why it was rejected."},
+			}},
+			"NearbyUser": {Type: "object", Properties: map[string]*schema{
+				"username":     {Type: "string"},
+				"display_name": {Type: "string"},
+				"avatar":       {Type: "string", Format: "uri"},
+				"distance_km":  {Type: "integer", Description: "Rounded to whole km, at least 1."},
+			}},
+			"PublicProfile": {Type: "object", Properties: map[string]*schema{
+				"username":     {Type: "string"},
+				"display_name": {Type: "string"},
+				"bio":          {Type: "string"},
+				"avatar":       {Type: "string", Format: "uri"},
+				"private":      {Type: "boolean", Description: "Posts are empty unless the caller follows the user."},
+				"bot":          {Type: "boolean", Description: "Posts through a service account, not a person."},
+				"verified":     {Type: "boolean", Description: "An admin checked who the account belongs to."},
+				"badges":       {Type: "array", Items: ref("Badge")},
+				"streak":       ref("Streak"),
+				"created_at":   {Type: "string", Format: "date-time"},
+				"post_count":   {Type: "integer"},
+			}},
+			"PostAnalytics": {Type: "object", Description: "Totals are all time, distance and days only cover the requested window.", Properties: map[string]*schema{
+				"post_id":     {Type: "string"},
+				"views":       {Type: "integer"},
+				"impressions": {Type: "integer"},
+				"likes":       {Type: "integer"},
+				"reactions":   {Type: "integer"},
+				"shares":      {Type: "integer", Description: "Quote posts of this one."},
+				"distance":    distanceSchema,
+				"time_zone":   {Type: "string", Description: "The zone of the days."},
+				"days": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+					"day":      {Type: "string", Format: "date"},
+					"views":    {Type: "integer"},
+					"likes":    {Type: "integer"},
+					"shares":   {Type: "integer"},
+					"distance": distanceSchema,
+				}}},
+			}},
+			"Streak": {Type: "object", Description: "Consecutive days with a post, in the user's time zone.", Properties: map[string]*schema{
+				"current":  {Type: "integer", Description: "0 once a day went by without a post."},
+				"best":     {Type: "integer"},
+				"last_day": {Type: "string", Format: "date"},
+			}},
+			"Notification": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"user":       {Type: "string"},
+				"kind":       {Type: "string", Enum: notificationKinds},
+				"message":    {Type: "string"},
+				"data":       {Type: "object", Description: "Depends on the kind, string values."},
+				"created_at": {Type: "string", Format: "date-time"},
+				"read_at":    {Type: "string", Format: "date-time"},
+			}},
+			"Follow": {Type: "object", Properties: map[string]*schema{
+				"follower":   {Type: "string"},
+				"followee":   {Type: "string"},
+				"state":      {Type: "string", Enum: []string{FOLLOW_PENDING, FOLLOW_ACCEPTED}},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"Webhook": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"owner":      {Type: "string"},
+				"url":        {Type: "string", Format: "uri"},
+				"location":   ref("Location"),
+				"range":      {Type: "number"},
+				"keywords":   {Type: "array", Items: &schema{Type: "string"}},
+				"secret":     {Type: "string", Description: "Only returned when created or rotated."},
+				"disabled":   {Type: "boolean"},
+				"failures":   {Type: "integer"},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"ServiceAccount": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string", Description: "The client_id."},
+				"name":       {Type: "string"},
+				"account":    {Type: "string", Description: "The user its tokens act as."},
+				"scopes":     {Type: "array", Description: "Operation ids its tokens may call.", Items: &schema{Type: "string"}},
+				"secret":     {Type: "string", Description: "The client_secret, only returned when created."},
+				"created_by": {Type: "string"},
+				"created_at": {Type: "string", Format: "date-time"},
+				"disabled":   {Type: "boolean"},
+			}},
+			"ServiceAccountRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"name", "account", "scopes"}, Properties: map[string]*schema{
+				"name":    {Type: "string", MinLength: length(1), MaxLength: length(SERVICE_ACCOUNT_MAX_NAME)},
+				"account": usernameSchema,
+				"scopes":  {Type: "array", MinItems: length(1), MaxItems: length(SERVICE_ACCOUNT_MAX_SCOPES), Items: &schema{Type: "string"}},
+			}},
+			"Usage": {Type: "object", Properties: map[string]*schema{
+				"principal": {Type: "string"},
+				"class":     {Type: "string", Enum: append([]string{""}, rateLimitClasses...), Description: "Empty when an admin looks up a principal."},
+				"quota": {Type: "object", Description: "Per UTC day, 0 is no quota. Past it requests are answered 429 until midnight UTC.", Properties: map[string]*schema{
+					"requests": {Type: "integer"},
+					"bytes":    {Type: "integer", Description: "Of responses, before compression."},
+				}},
+				"days": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+					"day":           {Type: "string", Format: "date"},
+					"requests":      {Type: "integer"},
+					"client_errors": {Type: "integer"},
+					"server_errors": {Type: "integer"},
+					"error_rate":    {Type: "number", Minimum: num(0), Maximum: num(1)},
+					"bytes_in":      {Type: "integer"},
+					"bytes_out":     {Type: "integer"},
+				}}},
+			}},
+			"WebhookRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"url", "lat", "lon", "range"}, Properties: map[string]*schema{
+				"url":      {Type: "string", Format: "uri", MaxLength: length(2048)},
+				"lat":      latSchema,
+				"lon":      lonSchema,
+				"range":    {Type: "number", Minimum: num(0), Maximum: num(FEED_MAX_RANGE_KM)},
+				"keywords": {Type: "array", Items: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}},
+			}},
+			"Device": {Type: "object", Properties: map[string]*schema{
+				"token":      {Type: "string"},
+				"user":       {Type: "string"},
+				"platform":   {Type: "string", Enum: devicePlatforms},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"DeviceRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"token", "platform"}, Properties: map[string]*schema{
+				"token":    {Type: "string", MinLength: length(1), MaxLength: length(DEVICE_MAX_TOKEN), Description: "FCM registration token."},
+				"platform": {Type: "string", Enum: devicePlatforms},
+			}},
+			"WebPushSubscription": {Type: "object", Description: "PushSubscription.toJSON() of the browser.", Required: []string{"endpoint", "keys"}, Properties: map[string]*schema{
+				"endpoint": {Type: "string", Format: "uri", MaxLength: length(2048)},
+				"keys": {Type: "object", Required: []string{"p256dh", "auth"}, Properties: map[string]*schema{
+					"p256dh": {Type: "string"},
+					"auth":   {Type: "string"},
+				}},
+				"user":       {Type: "string", Description: "Set by the server."},
+				"created_at": {Type: "string", Format: "date-time", Description: "Set by the server."},
+			}},
+			"Geofence": {Type: "object", Properties: map[string]*schema{
+				"id":         {Type: "string"},
+				"owner":      {Type: "string"},
+				"name":       {Type: "string"},
+				"location":   ref("Location"),
+				"range":      {Type: "number"},
+				"created_at": {Type: "string", Format: "date-time"},
+			}},
+			"GeofenceRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"name", "lat", "lon", "range"}, Properties: map[string]*schema{
+				"name":  {Type: "string", MinLength: length(1), MaxLength: length(GEOFENCE_MAX_NAME)},
+				"lat":   latSchema,
+				"lon":   lonSchema,
+				"range": {Type: "number", Minimum: num(0), Maximum: num(FEED_MAX_RANGE_KM)},
+			}},
+			"NotificationPrefs": {Type: "object", Description: "Kinds of notifications turned on or off per channel, kinds are " + strings.Join(notificationKinds, ", ") + ".", Properties: map[string]*schema{
+				"push":  {Type: "object", Description: "Kind to on or off, kinds left out are on."},
+				"email": {Type: "object", Description: "Kind to on or off, kinds left out are off. Needs an email in the profile."},
+			}},
+			"EditRequest": {Type: "object", AdditionalProperties: boolean(false), Required: []string{"message"}, Properties: map[string]*schema{
+				"message": {Type: "string", Description: messageDescription},
+				"version": {Type: "integer", Minimum: num(1), Description: "Version last read, may be sent as If-Match instead."},
+			}},
+		},
+	},
+	Paths: map[string]map[string]operation{
+		"/post": {
+			"post": {
+				Summary:     "Create a post with an image or video",
+				OperationID: "createPost",
+				Parameters: []parameter{
+					{Name: "Idempotency-Key", In: "header", Description: "Retries with the same key return the first post.", Schema: &schema{Type: "string", MaxLength: length(255)}},
+				},
+				RequestBody: &requestBody{Required: true, Content: map[string]mediaType{
+					"multipart/form-data": {Schema: &schema{Type: "object", Required: []string{"lat", "lon"}, Properties: map[string]*schema{
+						"lat":         latSchema,
+						"lon":         lonSchema,
+						"message":     {Type: "string", Description: messageDescription},
+						"image":       {Type: "string", Format: "binary", Description: "Required unless quote_of is set."},
+						"quote_of":    {Type: "string", MaxLength: length(64), Description: "Id of a post to quote, the message is the commentary."},
+						"event_start": {Type: "string", Format: "date-time", Description: "Makes the post an event, needs event_end."},
+						"event_end":   {Type: "string", Format: "date-time"},
+						"capacity":    {Type: "integer", Minimum: num(0), Maximum: num(EVENT_MAX_CAPACITY), Description: "Seats of the event, 0 is no limit."},
+						"category":    {Type: "string", Enum: categoryIds(), Description: "One of GET /categories."},
+						"publish_at":  {Type: "string", Format: "date-time", Description: "Holds the post back until then, at most 30 days ahead."},
+						"expires_at":  {Type: "string", Format: "date-time", Description: "Deletes the post then, after publish_at."},
+					}}},
+				}},
+				Responses: map[string]response{
+					"200": {Description: "The new post", Content: jsonContent(ref("Post"))},
+					"202": {Description: "The new post, ES can't be reached and it is searchable once ES is back", Content: jsonContent(ref("Post"))},
+					"400": errorResponse("Invalid form"),
+					"422": errorResponse("The message breaks the message rules, fields says how"),
+					"429": errorResponse("Posted too recently or too often today, Retry-After says when to try again"),
+				},
+			},
+		},
+		"/search": {
+			"get": {
+				Summary:     "Posts around a location, or with any event filter the events overlapping a time window by start",
+				OperationID: "searchPosts",
+				Parameters:  searchParams,
+				Responses: map[string]response{
+					"200": {Description: "Matching posts, the cursor of the next page in X-Next-Cursor", Content: jsonContent(&schema{Type: "array", Items: ref("Post")})},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"400": errorResponse("Invalid query"),
+					"403": errorResponse("profile without being an admin"),
+				},
+			},
+		},
+		"/v2/search": {
+			"get": {
+				Summary:     "Posts around a location in a list page with total and next_cursor",
+				OperationID: "searchPostsV2",
+				Servers:     []openAPIServer{{URL: API_ROOT}},
+				Parameters:  searchParams,
+				Responses: map[string]response{
+					"200": {Description: "Matching posts", Content: jsonContent(listPageSchema(ref("Post")))},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"400": errorResponse("Invalid query"),
+					"403": errorResponse("profile without being an admin"),
+				},
+			},
+		},
+		"/cluster": {
+			"get": {
+				Summary:     "Posts the ML model tagged with term",
+				OperationID: "clusterPosts",
+				Parameters:  clusterParams,
+				Responses: map[string]response{
+					"200": {Description: "Matching posts", Content: jsonContent(&schema{Type: "array", Items: ref("Post")})},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/v2/cluster": {
+			"get": {
+				Summary:     "Posts the ML model tagged with term in a list page with total",
+				OperationID: "clusterPostsV2",
+				Servers:     []openAPIServer{{URL: API_ROOT}},
+				Parameters:  clusterParams,
+				Responses: map[string]response{
+					"200": {Description: "Matching posts", Content: jsonContent(listPageSchema(ref("Post")))},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/export": {
+			"get": {
+				Summary:     "All posts of the caller as NDJSON",
+				OperationID: "exportPosts",
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Schema: latSchema},
+					{Name: "lon", In: "query", Schema: lonSchema},
+					{Name: "range", In: "query", Schema: rangeSchema},
+				},
+				Responses: map[string]response{
+					"200": {Description: "One post per line", Content: map[string]mediaType{"application/x-ndjson": {Schema: ref("Post")}}},
+				},
+			},
+		},
+		"/export.kml": {
+			"get": {
+				Summary:     "Posts inside a bounding box as KML, west > east crosses the antimeridian",
+				OperationID: "exportKML",
+				Parameters: []parameter{
+					{Name: "north", In: "query", Required: true, Schema: latSchema},
+					{Name: "south", In: "query", Required: true, Schema: latSchema},
+					{Name: "east", In: "query", Required: true, Schema: lonSchema},
+					{Name: "west", In: "query", Required: true, Schema: lonSchema},
+					{Name: "from", In: "query", Description: "Created at or after, RFC 3339.", Schema: &schema{Type: "string", Format: "date-time"}},
+					{Name: "to", In: "query", Description: "Created at or before, RFC 3339.", Schema: &schema{Type: "string", Format: "date-time"}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "KML 2.2 document", Content: map[string]mediaType{"application/vnd.google-earth.kml+xml": {Schema: &schema{Type: "string"}}}},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/account/posts.csv": {
+			"get": {
+				Summary:     "All posts of the caller as CSV, oldest first",
+				OperationID: "exportCSV",
+				Responses: map[string]response{
+					"200": {Description: "id, created_at, lat, lon, message, url, type", Content: map[string]mediaType{"text/csv": {Schema: &schema{Type: "string"}}}},
+				},
+			},
+		},
+		"/account/usage": {
+			"get": {
+				Summary:     "Requests, errors and bytes of the caller's token per UTC day, and the daily quota they count against",
+				OperationID: "accountUsage",
+				Parameters: []parameter{
+					{Name: "days", In: "query", Description: "Days back from today, " + strconv.Itoa(USAGE_DEFAULT_DAYS) + " by default.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(USAGE_RETENTION_DAYS)}},
+					{Name: "principal", In: "query", Description: "Someone else's usage like user:alice or service:<client id>, admins only.", Schema: &schema{Type: "string", Pattern: `^(ip|user|service):.+$`, MaxLength: length(128)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "The usage, newest day first", Content: jsonContent(ref("Usage"))},
+					"403": errorResponse("principal without being an admin"),
+				},
+			},
+		},
+		"/account/username": {
+			"put": {
+				Summary:     "Change the caller's username, the old one redirects to it. Once per " + strconv.Itoa(int(USERNAME_CHANGE_COOLDOWN.Hours()/24)) + " days",
+				OperationID: "changeUsername",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"username"}, Properties: map[string]*schema{
+					"username": usernameSchema,
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "Changed. Tokens of the old name get 401 from now on, posts and follows move over within minutes", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"username": {Type: "string"},
+						"token":    {Type: "string", Description: "For the new name, like the one of POST /login."},
+					}})},
+					"409": errorResponse("Taken by a user or as someone's previous username"),
+					"429": errorResponse("Changed too recently, Retry-After says when to try again"),
+				},
+			},
+		},
+		"/import": {
+			"post": {
+				Summary:     "Bulk import posts of the caller from application/geo+json or application/x-ndjson, a repeated source_id replaces the earlier record",
+				OperationID: "importPosts",
+				Parameters: []parameter{
+					{Name: "format", In: "query", Description: "Overrides the content type.", Schema: &schema{Type: "string", Enum: []string{"geojson", "ndjson"}}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "imported and failed counts, errors lists the rejected records", Content: jsonContent(&schema{Type: "object"})},
+					"400": errorResponse("Not GeoJSON or NDJSON, or too large"),
+				},
+			},
+		},
+		"/post/{id}": {
+			"get": {
+				Summary:     "One post, its version is the ETag",
+				OperationID: "getPost",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The post", Content: jsonContent(ref("Post"))},
+					"404": errorResponse("No such post"),
+				},
+			},
+			"put": {
+				Summary:     "Edit the message of a post",
+				OperationID: "editPost",
+				Parameters:  []parameter{postIDParam, ifMatchParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("EditRequest"))},
+				Responses: map[string]response{
+					"200": {Description: "The edited post", Content: jsonContent(ref("Post"))},
+					"409": {Description: "Edited by somebody else in between"},
+					"422": errorResponse("The message breaks the message rules, fields says how"),
+					"428": errorResponse("No version sent"),
+				},
+			},
+			"delete": {
+				Summary:     "Soft delete a post, its document, media and Bigtable row are purged after the restore window",
+				OperationID: "deletePost",
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "permanent", In: "query", Description: "Purge the document, media and Bigtable row right away, a soft deleted post too. It can't be restored.", Schema: &schema{Type: "boolean"}},
+				},
+				Responses: map[string]response{
+					"204": {Description: "Deleted, can be restored for a while unless permanent"},
+					"403": errorResponse("Not the author"),
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/restore": {
+			"post": {
+				Summary:     "Undo a delete",
+				OperationID: "restorePost",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The restored post", Content: jsonContent(ref("Post"))},
+					"409": errorResponse("Post is not deleted"),
+					"410": errorResponse("Restore window has passed"),
+				},
+			},
+		},
+		"/post/{id}/rsvp": {
+			"post": {
+				Summary:     "Attend the event",
+				OperationID: "rsvp",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"201": {Description: "Signed up", Content: jsonContent(ref("RSVP"))},
+					"200": {Description: "Already signed up", Content: jsonContent(ref("RSVP"))},
+					"400": errorResponse("Not an event or over"),
+					"404": errorResponse("No such post"),
+					"409": errorResponse("Event is full"),
+				},
+			},
+			"delete": {
+				Summary:     "Give the seat back",
+				OperationID: "cancelRSVP",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"204": {Description: "Not attending"},
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/attendees": {
+			"get": {
+				Summary:     "Who RSVPed to the event, first come first",
+				OperationID: "listAttendees",
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "offset", In: "query", Schema: &schema{Type: "integer", Minimum: num(0)}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(ATTENDEES_PAGE_MAX_SIZE)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "Count, capacity and a page of attendees, next is the offset of the following page", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"count":     {Type: "integer"},
+						"capacity":  {Type: "integer"},
+						"attendees": {Type: "array", Items: ref("RSVP")},
+						"next":      {Type: "integer"},
+					}})},
+					"400": errorResponse("Not an event"),
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/view": {
+			"post": {
+				Summary:     "Count a view of the post by the caller, once a day",
+				OperationID: "viewPost",
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "lat", In: "query", Description: "Where the viewer is, for the distance analytics of the author.", Schema: latSchema},
+					{Name: "lon", In: "query", Schema: lonSchema},
+				},
+				Responses: map[string]response{
+					"204": {Description: "Counted, or already counted today"},
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/share": {
+			"post": {
+				Summary:     "Mint a short link to the post, its page unfurls in chat apps",
+				OperationID: "sharePost",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"201": {Description: "The link, " + SHARE_PATH + "{token} on this host: an HTML page with Open Graph and Twitter Card tags that sends visitors on to the post", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"token": {Type: "string"},
+						"url":   {Type: "string", Format: "uri"},
+					}})},
+					"403": errorResponse("Post of a private account"),
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/qr": {
+			"get": {
+				Summary:     "QR code of the share link of the post, the same link every time",
+				OperationID: "getPostQR",
+				Parameters:  []parameter{postIDParam, qrFormatParam, qrSizeParam},
+				Responses: map[string]response{
+					"200": qrResponse,
+					"403": errorResponse("Post of a private account"),
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/admin/stats": {
+			"get": {
+				Summary:     "Service wide users, posts, daily activity, top regions and storage, admins only",
+				OperationID: "adminStats",
+				Parameters: []parameter{
+					{Name: "days", In: "query", Description: "How many days back, today included.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(ANALYTICS_MAX_DAYS)}},
+					dayZoneParam,
+				},
+				Responses: map[string]response{
+					"200": {Description: "The stats, up to " + ADMIN_STATS_CACHE_TTL.String() + " old", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"generated_at": {Type: "string", Format: "date-time"},
+						"users":        {Type: "integer"},
+						"posts":        {Type: "integer", Description: "Not deleted ones."},
+						"time_zone":    {Type: "string", Description: "The zone of the days."},
+						"days": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+							"day":          {Type: "string", Format: "date"},
+							"active_users": {Type: "integer", Description: "Posted, reacted or viewed a post that day."},
+							"posts":        {Type: "integer"},
+						}}},
+						"top_regions": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+							"geohash": {Type: "string"},
+							"lat":     latSchema,
+							"lon":     lonSchema,
+							"posts":   {Type: "integer"},
+						}}},
+						"storage": {Type: "object", Description: "Elasticsearch only, replicas included.", Properties: map[string]*schema{
+							"bytes":   {Type: "integer"},
+							"indices": {Type: "object", Description: "Index name to bytes."},
+							"docs":    {Type: "integer"},
+						}},
+					}})},
+					"403": errorResponse("Not an admin"),
+				},
+			},
+		},
+		"/admin/users/{username}/suspension": {
+			"post": {
+				Summary:     "Make an account read only until a time, admins only",
+				OperationID: "suspendUser",
+				Parameters:  []parameter{usernameParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"until"}, Properties: map[string]*schema{
+					"until":  {Type: "string", Format: "date-time"},
+					"reason": {Type: "string", MaxLength: length(SUSPENSION_MAX_REASON)},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "The suspension", Content: jsonContent(ref("Suspension"))},
+					"400": errorResponse("Invalid suspension"),
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such user"),
+				},
+			},
+			"delete": {
+				Summary:     "End a suspension early, admins only",
+				OperationID: "liftSuspension",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"200": {Description: "The account, no longer suspended", Content: jsonContent(ref("Suspension"))},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such user"),
+				},
+			},
+		},
+		"/admin/users/{username}/verification": {
+			"delete": {
+				Summary:     "Take the verified badge off an account, admins only",
+				OperationID: "revokeVerification",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"204": {Description: "Not verified any more, the user may ask again"},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such user"),
+					"409": errorResponse("Not verified"),
+				},
+			},
+		},
+		"/admin/verifications": {
+			"get": {
+				Summary:     "Pending verification requests, oldest first, admins only",
+				OperationID: "listVerifications",
+				Responses: map[string]response{
+					"200": {Description: fmt.Sprintf("At most %d requests", VERIFICATION_PAGE_SIZE), Content: jsonContent(&schema{Type: "array", Items: ref("VerificationRequest")})},
+					"403": errorResponse("Not an admin"),
+				},
+			},
+		},
+		"/admin/verifications/{username}/approve": {
+			"post": {
+				Summary:     "Verify the account of a pending request, admins only",
+				OperationID: "approveVerification",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"200": {Description: "The approved request", Content: jsonContent(ref("VerificationRequest"))},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No pending request of the user"),
+				},
+			},
+		},
+		"/admin/verifications/{username}/reject": {
+			"post": {
+				Summary:     "Turn a pending request down, the user sees the reason and may ask again. Admins only",
+				OperationID: "rejectVerification",
+				Parameters:  []parameter{usernameParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"reason"}, Properties: map[string]*schema{
+					"reason": {Type: "string", MinLength: length(1), MaxLength: length(MODERATION_MAX_REASON)},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "The rejected request", Content: jsonContent(ref("VerificationRequest"))},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No pending request of the user"),
+				},
+			},
+		},
+		"/verification": {
+			"post": {
+				Summary:     "Ask admins to verify the caller's account",
+				OperationID: "requestVerification",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"reason"}, Properties: map[string]*schema{
+					"reason": {Type: "string", MinLength: length(1), MaxLength: length(VERIFICATION_MAX_REASON), Description: "Who the account belongs to and how admins can check."},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "A request is pending already, it is answered as it is", Content: jsonContent(ref("VerificationRequest"))},
+					"201": {Description: "Asked", Content: jsonContent(ref("VerificationRequest"))},
+					"409": errorResponse("Already verified"),
+				},
+			},
+			"get": {
+				Summary:     "The caller's verification request",
+				OperationID: "getVerification",
+				Responses: map[string]response{
+					"200": {Description: "The request", Content: jsonContent(ref("VerificationRequest"))},
+					"404": errorResponse("Never asked"),
+				},
+			},
+		},
+		"/admin/posts/{id}/remove": {
+			"post": {
+				Summary:     "Take a post down as a moderator, the author can't restore it. Admins only",
+				OperationID: "removePost",
+				Parameters:  []parameter{postIDParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"reason"}, Properties: map[string]*schema{
+					"reason": {Type: "string", MinLength: length(1), MaxLength: length(MODERATION_MAX_REASON)},
+				}})},
+				Responses: map[string]response{
+					"204": {Description: "Removed"},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such post"),
+					"409": errorResponse("Already removed"),
+				},
+			},
+		},
+		"/admin/dead-letters": {
+			"get": {
+				Summary:     "Side effects that failed after their retries, oldest first. Admins only",
+				OperationID: "listDeadLetters",
+				Parameters: []parameter{
+					{Name: "op", In: "query", Description: "Only those of this op.", Schema: &schema{Type: "string"}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "The dead letters", Content: jsonContent(&schema{Type: "array", Items: ref("DeadLetter")})},
+					"403": errorResponse("Not an admin"),
+				},
+			},
+		},
+		"/admin/dead-letters/{id}/replay": {
+			"post": {
+				Summary:     "Run a dead letter again, it is removed when that goes through. Admins only",
+				OperationID: "replayDeadLetter",
+				Parameters:  []parameter{{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}},
+				Responses: map[string]response{
+					"204": {Description: "Done and removed"},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such dead letter"),
+					"503": errorResponse("Failed again, the dead letter has the new error"),
+				},
+			},
+		},
+		"/admin/dead-letters/{id}": {
+			"delete": {
+				Summary:     "Remove a dead letter without running it, admins only",
+				OperationID: "dropDeadLetter",
+				Parameters:  []parameter{{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}},
+				Responses: map[string]response{
+					"204": {Description: "Removed"},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such dead letter"),
+				},
+			},
+		},
+		"/admin/moderation": {
+			"get": {
+				Summary:     "What moderators did to a user or a post, newest first. Admins only",
+				OperationID: "moderationLog",
+				Parameters: []parameter{
+					{Name: "user", In: "query", Description: "Either this or post.", Schema: usernameSchema},
+					{Name: "post", In: "query", Description: "Either this or user.", Schema: &schema{Type: "string"}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(MODERATION_PAGE_MAX_SIZE)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "The records", Content: jsonContent(&schema{Type: "array", Items: ref("ModerationAction")})},
+					"400": errorResponse("Neither or both of user and post"),
+					"403": errorResponse("Not an admin"),
+				},
+			},
+		},
+		"/admin/service-accounts": {
+			"post": {
+				Summary:     "Register a bot or integration that acts as an account with scoped tokens, admins only",
+				OperationID: "createServiceAccount",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("ServiceAccountRequest"))},
+				Responses: map[string]response{
+					"201": {Description: "The service account with its secret", Content: jsonContent(ref("ServiceAccount"))},
+					"400": errorResponse("Invalid service account"),
+					"403": errorResponse("Not an admin"),
+				},
+			},
+			"get": {
+				Summary:     "Every service account, newest first. Admins only",
+				OperationID: "listServiceAccounts",
+				Responses: map[string]response{
+					"200": {Description: "The service accounts", Content: jsonContent(&schema{Type: "array", Items: ref("ServiceAccount")})},
+					"403": errorResponse("Not an admin"),
+				},
+			},
+		},
+		"/admin/service-accounts/{id}": {
+			"delete": {
+				Summary:     "Stop a service account from getting tokens, the ones it has expire within " + SERVICE_TOKEN_TTL.String() + ". Admins only",
+				OperationID: "disableServiceAccount",
+				Parameters:  []parameter{{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1), MaxLength: length(64)}}},
+				Responses: map[string]response{
+					"204": {Description: "Disabled"},
+					"403": errorResponse("Not an admin"),
+					"404": errorResponse("No such service account"),
+				},
+			},
+		},
+		"/post/{id}/analytics": {
+			"get": {
+				Summary:     "Views, likes, shares and viewer distances of the caller's post, per day",
+				OperationID: "postAnalytics",
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "days", In: "query", Description: "How many days back, today included.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(ANALYTICS_MAX_DAYS)}},
+					dayZoneParam,
+				},
+				Responses: map[string]response{
+					"200": {Description: "The analytics", Content: jsonContent(ref("PostAnalytics"))},
+					"403": errorResponse("Not the caller's post"),
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/post/{id}/reactions": {
+			"put": {
+				Summary:     "Set the reaction of the caller, replacing an earlier one. like ❤️, laugh 😂, wow 😮, sad 😢, angry 😠, up 👍",
+				OperationID: "react",
+				Parameters:  []parameter{postIDParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"type"}, Properties: map[string]*schema{
+					"type": {Type: "string", Enum: reactionNames()},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "The post with the new counts", Content: jsonContent(ref("Post"))},
+					"404": errorResponse("No such post"),
+				},
+			},
+			"delete": {
+				Summary:     "Take the reaction of the caller back",
+				OperationID: "unreact",
+				Parameters:  []parameter{postIDParam},
+				Responses: map[string]response{
+					"204": {Description: "No reaction any more"},
+					"404": errorResponse("No such post"),
+				},
+			},
+			"get": {
+				Summary:     "Who reacted how, newest first",
+				OperationID: "listReactions",
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "type", In: "query", Schema: &schema{Type: "string", Enum: reactionNames()}},
+					{Name: "offset", In: "query", Schema: &schema{Type: "integer", Minimum: num(0)}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(REACTIONS_PAGE_MAX_SIZE)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "Counts per type and a page of reactions, next is the offset of the following page", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"counts":    {Type: "object"},
+						"reactions": {Type: "array", Items: ref("Reaction")},
+						"next":      {Type: "integer"},
+					}})},
+					"404": errorResponse("No such post"),
+				},
+			},
+		},
+		"/ws": {
+			"get": {
+				Summary:     "Websocket with new posts around a location, the token may be sent as ?token=",
+				OperationID: "liveFeed",
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Schema: latSchema},
+					{Name: "lon", In: "query", Schema: lonSchema},
+					{Name: "range", In: "query", Schema: &schema{Type: "number", Minimum: num(0), Maximum: num(FEED_MAX_RANGE_KM)}},
+				},
+				Responses: map[string]response{
+					"101": {Description: "Switched to websocket, every message is {type, post} or {type, message}"},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/stream": {
+			"get": {
+				Summary:     "Server-Sent Events with new posts around a location, the token may be sent as ?token=",
+				OperationID: "postStream",
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Required: true, Schema: latSchema},
+					{Name: "lon", In: "query", Required: true, Schema: lonSchema},
+					{Name: "range", In: "query", Schema: &schema{Type: "number", Minimum: num(0), Maximum: num(FEED_MAX_RANGE_KM)}},
+					{Name: "Last-Event-ID", In: "header", Description: "Resume after this post id.", Schema: &schema{Type: "string"}},
+					{Name: "last_event_id", In: "query", Description: "Last-Event-ID for clients that can't set headers.", Schema: &schema{Type: "string"}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "One post event per new post, the event id is the post id", Content: map[string]mediaType{"text/event-stream": {Schema: ref("Post")}}},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/feed.atom": {
+			"get": {
+				Summary:     "Newest posts around a location as Atom feed",
+				OperationID: "atomFeed",
+				Security:    noAuth,
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Required: true, Schema: latSchema},
+					{Name: "lon", In: "query", Required: true, Schema: lonSchema},
+					{Name: "range", In: "query", Schema: rangeSchema},
+				},
+				Responses: map[string]response{
+					"200": {Description: "Atom 1.0 with GeoRSS points", Content: map[string]mediaType{"application/atom+xml": {Schema: &schema{Type: "string"}}}},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/devices": {
+			"post": {
+				Summary:     "Register a device for push notifications of the caller",
+				OperationID: "registerDevice",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("DeviceRequest"))},
+				Responses: map[string]response{
+					"201": {Description: "The device", Content: jsonContent(ref("Device"))},
+					"400": errorResponse("Invalid device"),
+				},
+			},
+		},
+		"/devices/{token}": {
+			"delete": {
+				Summary:     "Stop pushes to a device of the caller",
+				OperationID: "unregisterDevice",
+				Parameters:  []parameter{{Name: "token", In: "path", Required: true, Schema: &schema{Type: "string", MinLength: length(1)}}},
+				Responses: map[string]response{
+					"204": {Description: "Unregistered"},
+					"404": errorResponse("No such device of the caller"),
+				},
+			},
+		},
+		"/webpush/key": {
+			"get": {
+				Summary:     "The VAPID public key to subscribe browsers with",
+				OperationID: "webPushKey",
+				Responses: map[string]response{
+					"200": {Description: "The key, base64url", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"public_key": {Type: "string"},
+					}})},
+					"404": errorResponse("Web push is not setup"),
+				},
+			},
+		},
+		"/webpush/subscriptions": {
+			"post": {
+				Summary:     "Store the push subscription of the caller's browser",
+				OperationID: "webPushSubscribe",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("WebPushSubscription"))},
+				Responses: map[string]response{
+					"201": {Description: "The subscription", Content: jsonContent(ref("WebPushSubscription"))},
+					"400": errorResponse("Invalid subscription"),
+				},
+			},
+			"delete": {
+				Summary:     "Forget a push subscription of the caller",
+				OperationID: "webPushUnsubscribe",
+				Parameters:  []parameter{{Name: "endpoint", In: "query", Required: true, Schema: &schema{Type: "string", Format: "uri"}}},
+				Responses: map[string]response{
+					"204": {Description: "Forgotten"},
+					"404": errorResponse("No such subscription of the caller"),
+				},
+			},
+		},
+		"/geofences": {
+			"post": {
+				Summary:     "Get notified of new posts in an area",
+				OperationID: "createGeofence",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("GeofenceRequest"))},
+				Responses: map[string]response{
+					"201": {Description: "The geofence", Content: jsonContent(ref("Geofence"))},
+					"400": errorResponse("Invalid geofence"),
+					"409": errorResponse("Too many geofences"),
+				},
+			},
+			"get": {
+				Summary:     "Geofences of the caller",
+				OperationID: "listGeofences",
+				Responses: map[string]response{
+					"200": {Description: "The geofences", Content: jsonContent(&schema{Type: "array", Items: ref("Geofence")})},
+				},
+			},
+		},
+		"/geofences/{id}": {
+			"delete": {
+				Summary:     "Stop the notifications of a geofence",
+				OperationID: "deleteGeofence",
+				Parameters:  []parameter{{Name: "id", In: "path", Required: true, Schema: &schema{Type: "string"}}},
+				Responses: map[string]response{
+					"204": {Description: "Deleted"},
+					"404": errorResponse("No such geofence of the caller"),
+				},
+			},
+		},
+		"/webhooks": {
+			"post": {
+				Summary:     "Register a webhook for new posts in an area",
+				OperationID: "createWebhook",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("WebhookRequest"))},
+				Responses: map[string]response{
+					"201": {Description: "The webhook with its secret", Content: jsonContent(ref("Webhook"))},
+					"400": errorResponse("Invalid webhook"),
+					"409": errorResponse("Too many webhooks"),
+				},
+			},
+			"get": {
+				Summary:     "Webhooks of the caller, without secrets",
+				OperationID: "listWebhooks",
+				Responses: map[string]response{
+					"200": {Description: "The webhooks", Content: jsonContent(&schema{Type: "array", Items: ref("Webhook")})},
+				},
+			},
+		},
+		"/webhooks/{id}/rotate": {
+			"post": {
+				Summary:     "Replace the signing secret",
+				OperationID: "rotateWebhook",
+				Parameters:  []parameter{webhookIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The webhook with its new secret", Content: jsonContent(ref("Webhook"))},
+					"404": errorResponse("No such webhook"),
+				},
+			},
+		},
+		"/webhooks/{id}/disable": {
+			"post": {
+				Summary:     "Stop deliveries",
+				OperationID: "disableWebhook",
+				Parameters:  []parameter{webhookIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The webhook", Content: jsonContent(ref("Webhook"))},
+					"404": errorResponse("No such webhook"),
+				},
+			},
+		},
+		"/webhooks/{id}/enable": {
+			"post": {
+				Summary:     "Resume deliveries and reset the failure count",
+				OperationID: "enableWebhook",
+				Parameters:  []parameter{webhookIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The webhook", Content: jsonContent(ref("Webhook"))},
+					"404": errorResponse("No such webhook"),
+				},
+			},
+		},
+		"/graphql": {
+			"post": {
+				Summary:     "GraphQL queries over posts and users, the schema is in graphql.go",
+				OperationID: "graphql",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"query"}, Properties: map[string]*schema{
+					"query":         {Type: "string", MinLength: length(1)},
+					"operationName": {Type: "string", Nullable: true},
+					"variables":     {Type: "object", Nullable: true},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "data and errors as in the GraphQL spec"},
+				},
+			},
+		},
+		"/posts/lookup": {
+			"post": {
+				Summary:     "Many posts by id at once, up to " + strconv.Itoa(POST_LOOKUP_MAX),
+				OperationID: "lookupPosts",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("LookupRequest"))},
+				Responses: map[string]response{
+					"200": {Description: "The posts in the order asked for and the ids that were not found", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"posts":   {Type: "array", Items: ref("Post")},
+						"missing": {Type: "array", Items: &schema{Type: "string"}, Description: "Ids that don't exist, are deleted or not visible to the caller."},
+					}})},
+					"400": errorResponse("Invalid lookup"),
+				},
+			},
+		},
+		"/collections": {
+			"post": {
+				Summary:     "Group posts of the caller into a named collection",
+				OperationID: "createCollection",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("CollectionRequest"))},
+				Responses: map[string]response{
+					"201": {Description: "The new collection", Content: jsonContent(ref("Collection"))},
+					"400": errorResponse("Invalid collection or posts of somebody else"),
+					"409": errorResponse("Too many collections"),
+				},
+			},
+			"get": {
+				Summary:     "Collections of a user, the caller by default, newest first",
+				OperationID: "listCollections",
+				Parameters: []parameter{
+					{Name: "user", In: "query", Schema: usernameSchema},
+				},
+				Responses: map[string]response{
+					"200": {Description: "The collections, empty for private accounts the caller doesn't follow", Content: jsonContent(&schema{Type: "array", Items: ref("Collection")})},
+				},
+			},
+		},
+		"/collections/{id}": {
+			"get": {
+				Summary:     "A collection with its posts in order and the bounds to fit a map to",
+				OperationID: "getCollection",
+				Parameters:  []parameter{collectionIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The collection", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"collection": ref("Collection"),
+						"posts":      {Type: "array", Items: ref("Post")},
+						"bounds": {Type: "object", Properties: map[string]*schema{
+							"north": latSchema,
+							"south": latSchema,
+							"east":  lonSchema,
+							"west":  lonSchema,
+						}},
+					}})},
+					"404": errorResponse("No such collection"),
+				},
+			},
+			"put": {
+				Summary:     "Rename a collection or change its posts and their order",
+				OperationID: "updateCollection",
+				Parameters:  []parameter{collectionIDParam},
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("CollectionRequest"))},
+				Responses: map[string]response{
+					"200": {Description: "The collection", Content: jsonContent(ref("Collection"))},
+					"400": errorResponse("Invalid collection or posts of somebody else"),
+					"404": errorResponse("No collection of the caller"),
+				},
+			},
+			"delete": {
+				Summary:     "Delete a collection, its posts stay",
+				OperationID: "deleteCollection",
+				Parameters:  []parameter{collectionIDParam},
+				Responses: map[string]response{
+					"204": {Description: "Deleted"},
+					"404": errorResponse("No collection of the caller"),
+				},
+			},
+		},
+		"/users/{username}": {
+			"get": {
+				Summary:     "Public profile of a user with a page of their posts, newest first",
+				OperationID: "getUserPage",
+				Parameters: []parameter{
+					usernameParam,
+					{Name: "offset", In: "query", Schema: &schema{Type: "integer", Minimum: num(0)}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(USER_PAGE_MAX_SIZE)}},
+					ifNoneMatchParam,
+				},
+				Responses: map[string]response{
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"200": {Description: "The user and their posts, next is the offset of the following page", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"user":  ref("PublicProfile"),
+						"posts": {Type: "array", Items: ref("Post")},
+						"next":  {Type: "integer"},
+					}})},
+					"301": {Description: "A previous username, Location has the current one"},
+					"404": errorResponse("No such user"),
+				},
+			},
+		},
+		"/users/{username}/qr": {
+			"get": {
+				Summary:     "QR code of the user's profile in the web app",
+				OperationID: "getUserQR",
+				Parameters:  []parameter{usernameParam, qrFormatParam, qrSizeParam},
+				Responses: map[string]response{
+					"200": qrResponse,
+					"301": {Description: "A previous username, Location has the current one"},
+					"404": errorResponse("No such user"),
+				},
+			},
+		},
+		"/users/{username}/previous-usernames": {
+			"get": {
+				Summary:     "The usernames a user had before, newest first",
+				OperationID: "listPreviousUsernames",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"200": {Description: "The names and when they were changed", Content: jsonContent(&schema{Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+						"name":       {Type: "string"},
+						"changed_at": {Type: "string", Format: "date-time"},
+					}}})},
+					"301": {Description: "A previous username, Location has the current one"},
+					"404": errorResponse("No such user"),
+				},
+			},
+		},
+		"/users/{username}/follow": {
+			"post": {
+				Summary:     "Follow a user, pending until accepted when the account is private",
+				OperationID: "follow",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"200": {Description: "Already following or asked", Content: jsonContent(ref("Follow"))},
+					"201": {Description: "Followed or asked", Content: jsonContent(ref("Follow"))},
+					"404": errorResponse("No such user"),
+				},
+			},
+			"delete": {
+				Summary:     "Unfollow, or withdraw a follow request",
+				OperationID: "unfollow",
+				Parameters:  []parameter{usernameParam},
+				Responses:   map[string]response{"204": {Description: "Not following any more"}},
+			},
+		},
+		"/users/{username}/mute": {
+			"post": {
+				Summary:     "Hide the user's posts from the caller's searches and feeds, the user is not told",
+				OperationID: "mute",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"204": {Description: "Muted"},
+					"404": errorResponse("No such user"),
+				},
+			},
+			"delete": {
+				Summary:     "Unmute the user",
+				OperationID: "unmute",
+				Parameters:  []parameter{usernameParam},
+				Responses:   map[string]response{"204": {Description: "Not muted any more"}},
+			},
+		},
+		"/mutes": {
+			"get": {
+				Summary:     "Users the caller muted",
+				OperationID: "listMutes",
+				Responses: map[string]response{
+					"200": {Description: "Usernames, sorted", Content: jsonContent(&schema{Type: "array", Items: &schema{Type: "string"}})},
+				},
+			},
+		},
+		"/follow-requests": {
+			"get": {
+				Summary:     "Pending follow requests to the caller",
+				OperationID: "listFollowRequests",
+				Responses: map[string]response{
+					"200": {Description: "The requests", Content: jsonContent(&schema{Type: "array", Items: ref("Follow")})},
+				},
+			},
+		},
+		"/follow-requests/{username}/accept": {
+			"post": {
+				Summary:     "Let the user see the caller's posts",
+				OperationID: "acceptFollow",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"200": {Description: "The accepted follow", Content: jsonContent(ref("Follow"))},
+					"404": errorResponse("No request from the user"),
+				},
+			},
+		},
+		"/follow-requests/{username}/decline": {
+			"post": {
+				Summary:     "Drop the follow request of the user",
+				OperationID: "declineFollow",
+				Parameters:  []parameter{usernameParam},
+				Responses: map[string]response{
+					"204": {Description: "Declined"},
+					"404": errorResponse("No request from the user"),
+				},
+			},
+		},
+		"/notifications": {
+			"get": {
+				Summary:     "Notifications of the caller, newest first",
+				OperationID: "listNotifications",
+				Parameters: []parameter{
+					{Name: "unread", In: "query", Description: "Only the unread ones.", Schema: &schema{Type: "boolean"}},
+					{Name: "offset", In: "query", Schema: &schema{Type: "integer", Minimum: num(0), Maximum: num(USER_PAGE_MAX_OFFSET)}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(NOTIFICATIONS_PAGE_MAX_SIZE)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "A page of notifications", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"unread":        {Type: "integer"},
+						"notifications": {Type: "array", Items: ref("Notification")},
+						"next":          {Type: "integer", Description: "Offset of the next page, absent on the last one."},
+					}})},
+				},
+			},
+		},
+		"/notifications/unread": {
+			"get": {
+				Summary:     "Count the unread notifications of the caller per kind",
+				OperationID: "countUnreadNotifications",
+				Responses: map[string]response{
+					"200": {Description: "The counts", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"total": {Type: "integer"},
+						"kinds": {Type: "object", Description: "Kind to count, kinds without unread ones are left out."},
+					}})},
+				},
+			},
+		},
+		"/notifications/read-all": {
+			"post": {
+				Summary:     "Mark every unread notification of the caller read",
+				OperationID: "readAllNotifications",
+				Parameters:  []parameter{{Name: "kind", In: "query", Description: "Only this kind.", Schema: &schema{Type: "string", Enum: notificationKinds}}},
+				Responses: map[string]response{
+					"200": {Description: "How many were marked", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"marked": {Type: "integer"},
+					}})},
+				},
+			},
+		},
+		"/notifications/{id}/read": {
+			"post": {
+				Summary:     "Mark a notification of the caller read",
+				OperationID: "readNotification",
+				Parameters:  []parameter{notificationIDParam},
+				Responses: map[string]response{
+					"200": {Description: "The notification", Content: jsonContent(ref("Notification"))},
+					"404": errorResponse("No such notification of the caller"),
+				},
+			},
+		},
+		"/badges": {
+			"get": {
+				Summary:     "Every badge there is, with name and description",
+				OperationID: "listBadges",
+				Responses: map[string]response{
+					"200": {Description: "The badges", Content: jsonContent(&schema{Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+						"id":          {Type: "string"},
+						"name":        {Type: "string"},
+						"description": {Type: "string"},
+					}}})},
+				},
+			},
+		},
+		"/categories": {
+			"get": {
+				Summary:     "The categories posts can have, names in the language of the request",
+				OperationID: "listCategories",
+				Responses: map[string]response{
+					"200": {Description: "The categories", Content: jsonContent(&schema{Type: "array", Items: ref("PostCategory")})},
+				},
+			},
+		},
+		"/tiles/{z}/{x}/{y}": {
+			"get": {
+				Summary:     "Post counts of a slippy map tile in cells of about an eighth of the tile, for drawing clusters at any zoom",
+				OperationID: "getTile",
+				Parameters: []parameter{
+					{Name: "z", In: "path", Required: true, Schema: &schema{Type: "integer", Minimum: num(0), Maximum: num(TILE_MAX_ZOOM)}},
+					{Name: "x", In: "path", Required: true, Description: "0 to 2^z - 1.", Schema: &schema{Type: "integer", Minimum: num(0)}},
+					{Name: "y", In: "path", Required: true, Description: "0 to 2^z - 1, from the north.", Schema: &schema{Type: "integer", Minimum: num(0)}},
+					{Name: "category", In: "query", Description: "Only posts of this category.", Schema: &schema{Type: "string", Enum: categoryIds()}},
+					ifNoneMatchParam,
+				},
+				Responses: map[string]response{
+					"200": {Description: "The cells with posts, a cell with count 1 is a single post", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"z":         {Type: "integer"},
+						"x":         {Type: "integer"},
+						"y":         {Type: "integer"},
+						"precision": {Type: "integer", Description: "Geohash length of the cells."},
+						"total":     {Type: "integer"},
+						"cells": {Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+							"geohash": {Type: "string"},
+							"lat":     {Type: "number", Description: "The middle of the cell, moved into the tile for cells at its edge."},
+							"lon":     {Type: "number"},
+							"count":   {Type: "integer"},
+						}}},
+					}})},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"404": errorResponse("x or y is not a tile of the zoom"),
+				},
+			},
+		},
+		"/media/{id}": {
+			"get": {
+				Summary:     "The media of a post, for those who may see the post",
+				OperationID: "getMedia",
+				Security:    &[]map[string][]string{{}, {"bearer": {}}},
+				Parameters: []parameter{
+					postIDParam,
+					{Name: "token", In: "query", Description: "The token for media of private accounts, image tags can't send the Authorization header.", Schema: &schema{Type: "string"}},
+					{Name: "w", In: "query", Description: "Width of a smaller image, videos and images no larger are served as they are.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(RESIZE_MAX_SIDE)}},
+					{Name: "h", In: "query", Description: "Height of a smaller image, the aspect ratio stays with only one of w and h.", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(RESIZE_MAX_SIDE)}},
+					{Name: "fit", In: "query", Description: "contain scales the image into w by h, cover cuts w by h from the middle. Needs w and h.", Schema: &schema{Type: "string", Enum: []string{"contain", "cover"}}},
+					ifNoneMatchParam,
+				},
+				Responses: map[string]response{
+					"200": {Description: "The media as uploaded", Content: map[string]mediaType{"application/octet-stream": {Schema: &schema{Type: "string", Format: "binary"}}}},
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"404": errorResponse("No such post to the caller, or it has no media"),
+				},
+			},
+		},
+		"/leaderboard": {
+			"get": {
+				Summary:     "Most active posters of an area, or those whose posts got the most reactions",
+				OperationID: "leaderboard",
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Required: true, Schema: latSchema},
+					{Name: "lon", In: "query", Required: true, Schema: lonSchema},
+					{Name: "range", In: "query", Schema: rangeSchema},
+					{Name: "period", In: "query", Description: "week when missing.", Schema: &schema{Type: "string", Enum: []string{"day", "week", "month", "all"}}},
+					{Name: "by", In: "query", Description: "posts when missing.", Schema: &schema{Type: "string", Enum: []string{"posts", "reactions"}}},
+					{Name: "limit", In: "query", Schema: &schema{Type: "integer", Minimum: num(1), Maximum: num(LEADERBOARD_MAX_SIZE)}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "Ranked posters, cached for a few minutes", Content: jsonContent(&schema{Type: "array", Items: &schema{Type: "object", Properties: map[string]*schema{
+						"rank":         {Type: "integer"},
+						"username":     {Type: "string"},
+						"display_name": {Type: "string"},
+						"avatar":       {Type: "string", Format: "uri"},
+						"posts":        {Type: "integer"},
+						"reactions":    {Type: "integer"},
+					}}})},
+					"400": errorResponse("Invalid query"),
+				},
+			},
+		},
+		"/presence": {
+			"post": {
+				Summary:     "Heartbeat of an opted in client, the location is coarsened and kept for two minutes",
+				OperationID: "reportPresence",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("Location"))},
+				Responses: map[string]response{
+					"204": {Description: "Recorded"},
+					"400": errorResponse("Invalid location"),
+					"403": errorResponse("share_presence is off"),
+				},
+			},
+			"delete": {
+				Summary:     "Stop showing up in nearby users right away",
+				OperationID: "leavePresence",
+				Responses:   map[string]response{"204": {Description: "Removed"}},
+			},
+		},
+		"/nearby-users": {
+			"get": {
+				Summary:     "Users who sent a heartbeat around a location lately, closest first",
+				OperationID: "nearbyUsers",
+				Parameters: []parameter{
+					{Name: "lat", In: "query", Required: true, Schema: latSchema},
+					{Name: "lon", In: "query", Required: true, Schema: lonSchema},
+					{Name: "range", In: "query", Schema: &schema{Type: "number", Minimum: num(0), Maximum: num(PRESENCE_MAX_RANGE_KM), Description: "Distance in km, 50 when missing."}},
+				},
+				Responses: map[string]response{
+					"200": {Description: "The users", Content: jsonContent(&schema{Type: "array", Items: ref("NearbyUser")})},
+					"400": errorResponse("Invalid query"),
+					"403": errorResponse("share_presence is off"),
+				},
+			},
+		},
+		"/phone": {
+			"post": {
+				Summary:     "Set the phone of the caller and text it a verification code",
+				OperationID: "setPhone",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"phone"}, Properties: map[string]*schema{
+					"phone": phoneSchema,
+				}})},
+				Responses: map[string]response{
+					"202": {Description: "Code sent, the phone is unverified until POST /phone/verify"},
+					"400": errorResponse("Invalid phone"),
+					"404": errorResponse("SMS is not setup"),
+					"429": errorResponse("Too many codes sent"),
+				},
+			},
+			"delete": {
+				Summary:     "Remove the phone of the caller, turning two factor login off",
+				OperationID: "deletePhone",
+				Responses: map[string]response{
+					"204": {Description: "Removed"},
+				},
+			},
+		},
+		"/phone/verify": {
+			"post": {
+				Summary:     "Verify the phone of the caller with the texted code",
+				OperationID: "verifyPhone",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(&schema{Type: "object", Required: []string{"code"}, Properties: map[string]*schema{
+					"code": {Type: "string", MinLength: length(1), MaxLength: length(16)},
+				}})},
+				Responses: map[string]response{
+					"200": {Description: "The profile", Content: jsonContent(ref("Profile"))},
+					"400": errorResponse("Wrong or expired code"),
+					"409": errorResponse("No phone to verify"),
+				},
+			},
+		},
+		"/profile": {
+			"get": {
+				Summary:     "Profile of the caller, never the password",
+				OperationID: "getProfile",
+				Parameters:  []parameter{ifNoneMatchParam},
+				Responses: map[string]response{
+					"304": {Description: "Same as the response with the ETag in If-None-Match"},
+					"200": {Description: "The profile", Content: jsonContent(ref("Profile"))},
+					"404": errorResponse("The account is gone"),
+				},
+			},
+			"put": {
+				Summary:     "Change profile fields of the caller",
+				OperationID: "updateProfile",
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("ProfileUpdate"))},
+				Responses: map[string]response{
+					"200": {Description: "The updated profile", Content: jsonContent(ref("Profile"))},
+					"400": errorResponse("Invalid field"),
+				},
+			},
+		},
+		"/login": {
+			"post": {
+				Summary:     "Exchange username and password for a token",
+				OperationID: "login",
+				Security:    noAuth,
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("Credentials"))},
+				Responses: map[string]response{
+					"200": {Description: "The token", Content: map[string]mediaType{"text/plain": {Schema: &schema{Type: "string"}}}},
+					"202": {Description: "Two factor login, a code was texted. Log in again with it.", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"two_factor": {Type: "string", Enum: []string{"sms"}},
+						"phone":      {Type: "string", Description: "Masked, only the last digits show."},
+					}})},
+					"401": errorResponse("Wrong username or password"),
+					"403": errorResponse("Wrong or expired code"),
+					"429": errorResponse("Too many codes sent"),
+				},
+			},
+		},
+		"/guest": {
+			"post": {
+				Summary:     "A token that can only search, valid for " + GUEST_TOKEN_TTL.String() + ", for showing posts before sign up",
+				OperationID: "guestToken",
+				Security:    noAuth,
+				Responses: map[string]response{
+					"200": {Description: "The token, other endpoints answer it with 403", Content: map[string]mediaType{"text/plain": {Schema: &schema{Type: "string"}}}},
+				},
+			},
+		},
+		"/oauth/token": {
+			"post": {
+				Summary:     "OAuth 2 client credentials grant of a service account, a token valid for " + SERVICE_TOKEN_TTL.String() + " that may only call its scopes",
+				OperationID: "serviceToken",
+				Security:    noAuth,
+				RequestBody: &requestBody{Required: true, Content: map[string]mediaType{"application/x-www-form-urlencoded": {Schema: &schema{
+					Type:        "object",
+					Description: "client_id and client_secret can also come as HTTP basic auth.",
+					Required:    []string{"grant_type"},
+					Properties: map[string]*schema{
+						"grant_type":    {Type: "string", Enum: []string{"client_credentials"}},
+						"client_id":     {Type: "string", MaxLength: length(64)},
+						"client_secret": {Type: "string", MaxLength: length(128)},
+					},
+				}}}},
+				Responses: map[string]response{
+					"200": {Description: "The token", Content: jsonContent(&schema{Type: "object", Properties: map[string]*schema{
+						"access_token": {Type: "string"},
+						"token_type":   {Type: "string", Enum: []string{"Bearer"}},
+						"expires_in":   {Type: "integer", Description: "Seconds."},
+						"scope":        {Type: "string", Description: "Operation ids separated by spaces, others answer 403."},
+					}})},
+					"400": errorResponse("Invalid grant"),
+					"401": errorResponse("Wrong or disabled client credentials"),
+				},
+			},
+		},
+		"/signup": {
+			"post": {
+				Summary:     "Create a user",
+				OperationID: "signup",
+				Security:    noAuth,
+				RequestBody: &requestBody{Required: true, Content: jsonContent(ref("Credentials"))},
+				Responses: map[string]response{
+					"200": {Description: "User created"},
+					"400": errorResponse("Invalid user"),
+				},
+			},
+		},
+	},
+}
+
+// compiled Pattern of every schema, filled lazily
+var (
+	schemaPatterns   = map[string]*regexp.Regexp{}
+	schemaPatternsMu sync.Mutex
+)
+
+// handlerOpenAPI serves apiSpec, it needs no token so tools can fetch it
+func handlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+	js, err := json.MarshalIndent(apiSpec, "", "  ")
+	if err != nil {
+		writeBackendError(w, r, "Failed to encode OpenAPI document", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// fieldError is one problem found by validateRequest
+type fieldError struct {
+	Name    string `json:"name"`
+	In      string `json:"in"`
+	Message string `json:"message"`
+}
+
+// validateRequest checks parameters and body of a request against the operation
+// of its route in apiSpec. It wraps the handlers of the v1 routes, so the matched
+// route template tells which operation applies. All problems are sent back at once.
+func validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, ok := operationFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// handlers see text in NFC, see text.go
+		normalizeQuery(r)
+
+		var errs []fieldError
+		for _, p := range op.Parameters {
+			errs = append(errs, validateParameter(r, p)...)
+		}
+		if op.RequestBody != nil {
+			errs = append(errs, validateBody(r, op.RequestBody)...)
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// specPath is the key of a route template in apiSpec.Paths, relative to
+// API_V1. Later versions keep theirs, /api/v2/search is /v2/search.
+func specPath(tpl string) string {
+	if strings.HasPrefix(tpl, API_V1+"/") {
+		return strings.TrimPrefix(tpl, API_V1)
+	}
+	return strings.TrimPrefix(tpl, API_ROOT)
+}
+
+func operationFor(r *http.Request) (operation, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return operation{}, false
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return operation{}, false
+	}
+	op, ok := apiSpec.Paths[specPath(tpl)][strings.ToLower(r.Method)]
+	return op, ok
+}
+
+func validateParameter(r *http.Request, p parameter) []fieldError {
+	var raw string
+	var present bool
+	switch p.In {
+	case "query":
+		vals, ok := r.URL.Query()[p.Name]
+		if ok && len(vals) > 0 {
+			raw, present = vals[0], vals[0] != ""
+		}
+	case "header":
+		raw = r.Header.Get(p.Name)
+		present = raw != ""
+	case "path":
+		raw, present = mux.Vars(r)[p.Name]
+	}
+	if !present {
+		if p.Required {
+			return []fieldError{{Name: p.Name, In: p.In, Message: "is required"}}
+		}
+		return nil
+	}
+	if msg := checkString(raw, p.Schema); msg != "" {
+		return []fieldError{{Name: p.Name, In: p.In, Message: msg}}
+	}
+	return nil
+}
+
+func validateBody(r *http.Request, body *requestBody) []fieldError {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	media, ok := body.Content[contentType]
+	if !ok {
+		types := make([]string, 0, len(body.Content))
+		for t := range body.Content {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return []fieldError{{Name: "Content-Type", In: "header", Message: "must be " + strings.Join(types, " or ")}}
+	}
+	s := resolve(media.Schema)
+
+	if contentType == "multipart/form-data" {
+		// same limit as handlerPost, the parsed form stays on r for the handler
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return []fieldError{{Name: "body", In: "body", Message: "is not a valid multipart form"}}
+		}
+		normalizeForm(r)
+		return validateForm(r, s)
+	}
+	if contentType == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			return []fieldError{{Name: "body", In: "body", Message: "is not a valid form"}}
+		}
+		normalizeForm(r)
+		return validateForm(r, s)
+	}
+
+	// read the body and put it back for the handler, in NFC. JSON is ASCII
+	// around the strings, so normalizing all of it only changes them.
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	b = norm.NFC.Bytes(b)
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return []fieldError{{Name: "body", In: "body", Message: "cannot be read"}}
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		if body.Required {
+			return []fieldError{{Name: "body", In: "body", Message: "is required"}}
+		}
+		return nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return []fieldError{{Name: "body", In: "body", Message: "is not valid JSON"}}
+	}
+	return checkValue("", v, s)
+}
+
+func validateForm(r *http.Request, s *schema) []fieldError {
+	var errs []fieldError
+	for _, name := range sortedKeys(s.Properties) {
+		prop := resolve(s.Properties[name])
+		required := contains(s.Required, name)
+		if prop.Format == "binary" {
+			if required && (r.MultipartForm == nil || len(r.MultipartForm.File[name]) == 0) {
+				errs = append(errs, fieldError{Name: name, In: "body", Message: "is required"})
+			}
+			continue
+		}
+		raw := r.FormValue(name)
+		if raw == "" {
+			if required {
+				errs = append(errs, fieldError{Name: name, In: "body", Message: "is required"})
+			}
+			continue
+		}
+		if msg := checkString(raw, prop); msg != "" {
+			errs = append(errs, fieldError{Name: name, In: "body", Message: msg})
+		}
+	}
+	return errs
+}
+
+// checkString validates a value that arrives as text (query, header, path, form field)
+func checkString(raw string, s *schema) string {
+	s = resolve(s)
+	switch s.Type {
+	case "number", "integer":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "must be a number"
+		}
+		if s.Type == "integer" && f != math.Trunc(f) {
+			return "must be an integer"
+		}
+		return checkNumber(f, s)
+	case "boolean":
+		if _, err := strconv.ParseBool(raw); err != nil {
+			return "must be true or false"
+		}
+		return ""
+	}
+	return checkText(raw, s)
+}
+
+// checkValue validates a decoded JSON value, name is its path like "location.lat"
+func checkValue(name string, v interface{}, s *schema) []fieldError {
+	s = resolve(s)
+	label := name
+	if label == "" {
+		label = "body"
+	}
+	fail := func(msg string) []fieldError {
+		return []fieldError{{Name: label, In: "body", Message: msg}}
+	}
+	if v == nil {
+		if s.Nullable {
+			return nil
+		}
+		return fail("must not be null")
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("must be an object")
+		}
+		var errs []fieldError
+		for _, req := range s.Required {
+			if _, ok := obj[req]; !ok {
+				errs = append(errs, fieldError{Name: join(name, req), In: "body", Message: "is required"})
+			}
+		}
+		for _, key := range sortedKeys(s.Properties) {
+			if val, ok := obj[key]; ok {
+				errs = append(errs, checkValue(join(name, key), val, s.Properties[key])...)
+			}
+		}
+		if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+			var unknown []string
+			for key := range obj {
+				if _, ok := s.Properties[key]; !ok {
+					unknown = append(unknown, key)
+				}
+			}
+			sort.Strings(unknown)
+			for _, key := range unknown {
+				errs = append(errs, fieldError{Name: join(name, key), In: "body", Message: "is not a known field"})
+			}
+		}
+		return errs
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fail("must be an array")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return fail(fmt.Sprintf("must have at least %d items", *s.MinItems))
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return fail(fmt.Sprintf("must have at most %d items", *s.MaxItems))
+		}
+		var errs []fieldError
+		if s.Items != nil {
+			for i, item := range arr {
+				errs = append(errs, checkValue(fmt.Sprintf("%s[%d]", label, i), item, s.Items)...)
+			}
+		}
+		return errs
+	case "number", "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fail("must be a number")
+		}
+		if s.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fail("must be an integer")
+			}
+		}
+		f, _ := n.Float64()
+		if msg := checkNumber(f, s); msg != "" {
+			return fail(msg)
+		}
+		return nil
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be true or false")
+		}
+		return nil
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if msg := checkText(str, s); msg != "" {
+			return fail(msg)
+		}
+	}
+	return nil
+}
+
+func checkNumber(f float64, s *schema) string {
+	if s.Minimum != nil && f < *s.Minimum {
+		return fmt.Sprintf("must be at least %v", *s.Minimum)
+	}
+	if s.Maximum != nil && f > *s.Maximum {
+		return fmt.Sprintf("must be at most %v", *s.Maximum)
+	}
+	return ""
+}
+
+func checkText(str string, s *schema) string {
+	if len(s.Enum) > 0 && !contains(s.Enum, str) {
+		return "must be one of " + strings.Join(s.Enum, ", ")
+	}
+	n := len([]rune(str))
+	if s.MinLength != nil && n < *s.MinLength {
+		return fmt.Sprintf("must be at least %d characters", *s.MinLength)
+	}
+	if s.MaxLength != nil && n > *s.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", *s.MaxLength)
+	}
+	if s.Pattern != "" {
+		schemaPatternsMu.Lock()
+		re, ok := schemaPatterns[s.Pattern]
+		if !ok {
+			re = regexp.MustCompile(s.Pattern)
+			schemaPatterns[s.Pattern] = re
+		}
+		schemaPatternsMu.Unlock()
+		if !re.MatchString(str) {
+			return "must match " + s.Pattern
+		}
+	}
+	return ""
+}
+
+// resolve follows a $ref into components
+func resolve(s *schema) *schema {
+	for s != nil && s.Ref != "" {
+		s = apiSpec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	if s == nil {
+		return &schema{}
+	}
+	return s
+}
+
+// writeValidationError is the error envelope with one entry per bad field
+func writeValidationError(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	requestLog(r).Printf("[%s] Rejected invalid request to %s: %v\n", requestID(r), r.URL.Path, errs)
+	writeFieldErrors(w, r, http.StatusBadRequest, "invalid_request", errs)
+}
+
+// writeFieldErrors sends the errors of fields with status and code, the 400
+// of writeValidationError or the 422 of a message the rules refuse
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, status int, code string, errs []fieldError) {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		// the names are the parameters, only what is wrong with them is translated
+		errs[i].Message = localize(w, r, e.Message)
+		msgs[i] = e.Name + " " + errs[i].Message
+	}
+	js, _ := json.Marshal(apiError{
+		Code:      code,
+		Message:   strings.Join(msgs, "; "),
+		RequestID: requestID(r),
+		Fields:    errs,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]*schema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
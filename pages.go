@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listPage wraps the items of a list response so clients know how many there
+// are and how to get more:
+//
+//	{"items": [...], "total": 42, "next_cursor": null, "took_ms": 12}
+//
+// total counts every match, items can be fewer when some are hidden from the
+// caller, e.g. posts of private accounts. next_cursor is null on the last page.
+type listPage struct {
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	NextCursor *string     `json:"next_cursor"`
+	// time the server spent on the request
+	TookMs int64 `json:"took_ms"`
+}
+
+// writeList answers with a listPage of items on /api/v2. v1 clients get the
+// bare array they always got, with next in X-Next-Cursor. total goes in
+// X-Total-Count on both. next is the cursor of the next page, "" when there
+// is none. started is when the handler began. A client polling the same list
+// gets a 304 while it doesn't change, took_ms is left out of the ETag.
+func writeList(w http.ResponseWriter, r *http.Request, items interface{}, total int64, next string, started time.Time) {
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	if !strings.HasPrefix(r.URL.Path, API_V2+"/") {
+		if next != "" {
+			w.Header().Set("X-Next-Cursor", next)
+		}
+		js, _ := json.Marshal(items)
+		if notModified(w, r, weakETag(js)) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+
+	page := listPage{Items: items, Total: total}
+	if next != "" {
+		page.NextCursor = &next
+	}
+	js, _ := json.Marshal(page)
+	if notModified(w, r, weakETag(js)) {
+		return
+	}
+	page.TookMs = int64(time.Since(started) / time.Millisecond)
+	js, _ = json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// nonNilPosts is ps, an empty list instead of nil so items is [] and not null
+func nonNilPosts(ps []Post) []Post {
+	if ps == nil {
+		return []Post{}
+	}
+	return ps
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// newPostID returns a ULID: 26 characters, the first 10 encode the creation time in
+// milliseconds, so ids sort by creation time both as strings and as Bigtable row keys.
+func newPostID(t time.Time) string {
+	return ulid.MustNew(ulid.Timestamp(t), rand.Reader).String()
+}
+
+// postIDTime extracts the creation time encoded in a post id. Posts created before
+// ULIDs carry a random UUID (36 characters with dashes), for those ok is false and
+// the caller has to fall back to the created_at field.
+func postIDTime(id string) (t time.Time, ok bool) {
+	if isLegacyPostID(id) {
+		return time.Time{}, false
+	}
+	u, err := ulid.Parse(id)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ulid.Time(u.Time()).UTC(), true
+}
+
+// isLegacyPostID reports whether id is one of the pborman uuid.New() ids,
+// they keep working everywhere an id is accepted but carry no time
+func isLegacyPostID(id string) bool {
+	return len(id) == 36 && id[8] == '-' && id[13] == '-' && id[18] == '-' && id[23] == '-'
+}
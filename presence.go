@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// a client heartbeats more often than this or disappears
+	PRESENCE_TTL = 2 * time.Minute
+	// locations are snapped to this grid, about 1km, before they are stored
+	PRESENCE_GRID         = 0.01
+	PRESENCE_MAX_RANGE_KM = 50
+	PRESENCE_MAX_USERS    = 50
+
+	// GEO set of username -> coarse location and sorted set of username -> last heartbeat
+	PRESENCE_GEO_KEY  = "around:presence:geo"
+	PRESENCE_SEEN_KEY = "around:presence:seen"
+)
+
+type nearbyUser struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Avatar      string `json:"avatar"`
+	// whole km, never closer than 1
+	DistanceKm int `json:"distance_km"`
+}
+
+// without redis presence only covers this instance
+type localPresence struct {
+	loc  Location
+	seen time.Time
+}
+
+type localPresences struct {
+	sync.Mutex
+	users map[string]localPresence
+}
+
+func coarse(loc Location) Location {
+	return Location{
+		Lat: math.Round(loc.Lat/PRESENCE_GRID) * PRESENCE_GRID,
+		Lon: math.Round(loc.Lon/PRESENCE_GRID) * PRESENCE_GRID,
+	}
+}
+
+func (srv *Server) recordPresence(username string, loc Location) error {
+	loc = coarse(loc)
+	if srv.Redis == nil {
+		srv.presenceLocal.Lock()
+		srv.presenceLocal.users[username] = localPresence{loc: loc, seen: time.Now()}
+		srv.presenceLocal.Unlock()
+		return nil
+	}
+	pipe := srv.Redis.TxPipeline()
+	pipe.GeoAdd(PRESENCE_GEO_KEY, &redis.GeoLocation{Name: username, Longitude: loc.Lon, Latitude: loc.Lat})
+	pipe.ZAdd(PRESENCE_SEEN_KEY, redis.Z{Score: float64(time.Now().Unix()), Member: username})
+	_, err := pipe.Exec()
+	return err
+}
+
+func (srv *Server) removePresence(username string) error {
+	if srv.Redis == nil {
+		srv.presenceLocal.Lock()
+		delete(srv.presenceLocal.users, username)
+		srv.presenceLocal.Unlock()
+		return nil
+	}
+	pipe := srv.Redis.TxPipeline()
+	pipe.ZRem(PRESENCE_GEO_KEY, username)
+	pipe.ZRem(PRESENCE_SEEN_KEY, username)
+	_, err := pipe.Exec()
+	return err
+}
+
+// presentNear returns the users seen within PRESENCE_TTL inside km of loc, closest first
+func (srv *Server) presentNear(loc Location, km float64) ([]redis.GeoLocation, error) {
+	cutoff := time.Now().Add(-PRESENCE_TTL)
+	if srv.Redis == nil {
+		srv.presenceLocal.Lock()
+		defer srv.presenceLocal.Unlock()
+		var found []redis.GeoLocation
+		for name, p := range srv.presenceLocal.users {
+			if p.seen.Before(cutoff) {
+				delete(srv.presenceLocal.users, name)
+				continue
+			}
+			if d := distanceKm(loc.Lat, loc.Lon, p.loc.Lat, p.loc.Lon); d <= km {
+				found = append(found, redis.GeoLocation{Name: name, Dist: d})
+			}
+		}
+		sortByDist(found)
+		return found, nil
+	}
+
+	// GEO members have no TTL of their own, drop whoever stopped heartbeating
+	expired, err := srv.Redis.ZRangeByScore(PRESENCE_SEEN_KEY, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(cutoff.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		members := make([]interface{}, len(expired))
+		for i, name := range expired {
+			members[i] = name
+		}
+		pipe := srv.Redis.TxPipeline()
+		pipe.ZRem(PRESENCE_GEO_KEY, members...)
+		pipe.ZRem(PRESENCE_SEEN_KEY, members...)
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+
+	return srv.Redis.GeoRadius(PRESENCE_GEO_KEY, loc.Lon, loc.Lat, &redis.GeoRadiusQuery{
+		Radius:   km,
+		Unit:     "km",
+		WithDist: true,
+		Sort:     "ASC",
+		// room for the ones filtered out below
+		Count: 2 * PRESENCE_MAX_USERS,
+	}).Result()
+}
+
+func sortByDist(found []redis.GeoLocation) {
+	for i := 1; i < len(found); i++ {
+		for j := i; j > 0 && found[j].Dist < found[j-1].Dist; j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+		}
+	}
+}
+
+// sharesPresence answers 403 unless the caller turned on share_presence
+func (srv *Server) sharesPresence(w http.ResponseWriter, r *http.Request, username string) bool {
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return false
+	}
+	if !u.SharePresence {
+		writeError(w, r, http.StatusForbidden, "Turn on share_presence in your profile first")
+		return false
+	}
+	return true
+}
+
+// handlerPresence is the heartbeat of an opted in client, POST /presence with
+// {"lat":..,"lon":..}. Only a location snapped to about 1km is kept, and only
+// for PRESENCE_TTL.
+func (srv *Server) handlerPresence(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var loc Location
+	// ranges are checked by validateRequest already
+	if err := json.NewDecoder(r.Body).Decode(&loc); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode location")
+		return
+	}
+	if !srv.sharesPresence(w, r, username) {
+		return
+	}
+	if err := srv.recordPresence(username, loc); err != nil {
+		writeBackendError(w, r, "Failed to record presence", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerLeavePresence hides the caller right away instead of after PRESENCE_TTL
+func (srv *Server) handlerLeavePresence(w http.ResponseWriter, r *http.Request) {
+	if err := srv.removePresence(usernameFromToken(r)); err != nil {
+		writeBackendError(w, r, "Failed to remove presence", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerNearbyUsers lists who heartbeated near lat/lon lately, closest first.
+// Only users who share their own presence may look.
+//
+//	GET /nearby-users?lat=&lon=&range=
+func (srv *Server) handlerNearbyUsers(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	// types and ranges are checked by validateRequest already
+	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	km := float64(PRESENCE_MAX_RANGE_KM)
+	if v := r.URL.Query().Get("range"); v != "" {
+		km, _ = strconv.ParseFloat(v, 64)
+	}
+	if !srv.sharesPresence(w, r, viewer) {
+		return
+	}
+
+	found, err := srv.presentNear(Location{Lat: lat, Lon: lon}, km)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read presence", err)
+		return
+	}
+	users := []nearbyUser{}
+	for _, g := range found {
+		if len(users) >= PRESENCE_MAX_USERS {
+			break
+		}
+		// private accounts only show to followers, muted users not at all
+		if g.Name == viewer || !srv.inFeed(viewer, g.Name) {
+			continue
+		}
+		u, ok := srv.getUser(g.Name)
+		if !ok || !u.SharePresence {
+			continue
+		}
+		users = append(users, nearbyUser{
+			Username:    u.Username,
+			DisplayName: u.DisplayName,
+			Avatar:      u.Avatar,
+			DistanceKm:  int(math.Max(1, math.Round(g.Dist))),
+		})
+	}
+	srv.Log.Printf("Found %d users near %f, %f for %s\n", len(users), lat, lon, viewer)
+
+	js, _ := json.Marshal(users)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
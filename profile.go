@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	PROFILE_MAX_DISPLAY_NAME = 50
+	PROFILE_MAX_BIO          = 160
+)
+
+// Profile is what GET /profile returns, the User document without credentials.
+// Only this goes out, never a User, so the password can't leak by accident.
+type Profile struct {
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	Avatar      string `json:"avatar"`
+	Birthdate   string `json:"birthdate"`
+	// from the birthdate, 0 when unknown
+	Age               int               `json:"age"`
+	Gender            string            `json:"gender"`
+	Private           bool              `json:"private"`
+	SharePresence     bool              `json:"share_presence"`
+	Verified          bool              `json:"verified"`
+	Badges            []Badge           `json:"badges"`
+	TimeZone          string            `json:"time_zone"`
+	Streak            streakView        `json:"streak"`
+	Digest            string            `json:"digest"`
+	Home              *Location         `json:"home"`
+	NotificationPrefs NotificationPrefs `json:"notification_prefs"`
+	Phone             string            `json:"phone"`
+	PhoneVerified     bool              `json:"phone_verified"`
+	TwoFactor         bool              `json:"two_factor"`
+	// only while it lasts
+	SuspendedUntil *time.Time `json:"suspended_until,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// body of PUT /profile, fields left out keep their value and "" clears a text
+type profileUpdate struct {
+	Email         *string   `json:"email"`
+	DisplayName   *string   `json:"display_name"`
+	Bio           *string   `json:"bio"`
+	Avatar        *string   `json:"avatar"`
+	Birthdate     *string   `json:"birthdate"`
+	Gender        *string   `json:"gender"`
+	Private       *bool     `json:"private"`
+	SharePresence *bool     `json:"share_presence"`
+	TimeZone      *string   `json:"time_zone"`
+	Digest        *string   `json:"digest"`
+	Home          *Location `json:"home"`
+	// replaces all of them
+	NotificationPrefs *NotificationPrefs `json:"notification_prefs"`
+	// the phone itself changes through POST /phone
+	TwoFactor *bool `json:"two_factor"`
+}
+
+func profileOf(u User) Profile {
+	p := Profile{
+		Username:          u.Username,
+		Email:             u.Email,
+		DisplayName:       u.DisplayName,
+		Bio:               u.Bio,
+		Avatar:            u.Avatar,
+		Birthdate:         u.Birthdate,
+		Age:               u.age(time.Now()),
+		Gender:            u.Gender,
+		Private:           u.Private,
+		SharePresence:     u.SharePresence,
+		Verified:          u.Verified,
+		Badges:            badgesOf(u),
+		TimeZone:          u.TimeZone,
+		Streak:            streakOf(u, time.Now()),
+		Digest:            u.Digest,
+		Home:              u.Home,
+		NotificationPrefs: u.NotificationPrefs,
+		Phone:             u.Phone,
+		PhoneVerified:     u.PhoneVerified,
+		TwoFactor:         u.TwoFactor,
+		CreatedAt:         u.CreatedAt,
+	}
+	if u.suspended(time.Now()) {
+		p.SuspendedUntil = u.SuspendedUntil
+	}
+	return p
+}
+
+// handlerGetProfile returns the profile of the caller
+func (srv *Server) handlerGetProfile(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	u, ok := srv.getUser(username)
+	if !ok {
+		// the token outlived the account
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	writeProfile(w, r, u)
+}
+
+// handlerUpdateProfile changes the profile fields of the caller. Username and
+// password are credentials and can't be changed here.
+func (srv *Server) handlerUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	srv.Log.Printf("Received one profile update from %s\n", username)
+
+	var req profileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode profile")
+		return
+	}
+
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if req.Email != nil {
+		u.Email = *req.Email
+	}
+	if req.DisplayName != nil {
+		u.DisplayName = *req.DisplayName
+	}
+	if req.Bio != nil {
+		u.Bio = *req.Bio
+	}
+	if req.Avatar != nil {
+		u.Avatar = *req.Avatar
+	}
+	if req.Birthdate != nil {
+		u.Birthdate = *req.Birthdate
+	}
+	if req.Gender != nil {
+		u.Gender = *req.Gender
+	}
+	wasPrivate := u.Private
+	if req.Private != nil {
+		u.Private = *req.Private
+	}
+	if req.TimeZone != nil {
+		u.TimeZone = *req.TimeZone
+	}
+	if req.Digest != nil {
+		u.Digest = *req.Digest
+	}
+	if req.Home != nil {
+		u.Home = req.Home
+	}
+	if req.NotificationPrefs != nil {
+		u.NotificationPrefs = *req.NotificationPrefs
+	}
+	if req.TwoFactor != nil {
+		u.TwoFactor = *req.TwoFactor
+	}
+	wasSharing := u.SharePresence
+	if req.SharePresence != nil {
+		u.SharePresence = *req.SharePresence
+	}
+
+	normalizeUser(&u)
+	if errs := validateUser(u, time.Now()); len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	if err := srv.updateUser(u); err != nil {
+		writeBackendError(w, r, "Failed to save profile", err)
+		return
+	}
+	if u.Private != wasPrivate {
+		srv.invalidatePrivateUsers()
+	}
+	// nothing to approve any more, whoever asked follows now
+	if wasPrivate && !u.Private {
+		srv.acceptPendingFollows(username)
+	}
+	// opting out hides the user right away, not after PRESENCE_TTL
+	if wasSharing && !u.SharePresence {
+		if err := srv.removePresence(username); err != nil {
+			srv.Log.Printf("Failed to remove presence of %s %v\n", username, err)
+		}
+	}
+	srv.Log.Printf("Profile of %s updated\n", username)
+	writeProfile(w, r, u)
+}
+
+// writeProfile answers with the profile of u, a 304 when the client has it
+func writeProfile(w http.ResponseWriter, r *http.Request, u User) {
+	js, _ := json.Marshal(profileOf(u))
+	if notModified(w, r, weakETag(js)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
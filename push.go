@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_DEVICE = "device"
+
+	FCM_SCOPE   = "https://www.googleapis.com/auth/firebase.messaging"
+	FCM_TIMEOUT = 10 * time.Second
+	// a user with more is probably not cleaning up, the oldest are not pushed to
+	DEVICE_MAX_PER_USER = 20
+	// FCM tokens are around 160 characters
+	DEVICE_MAX_TOKEN = 4096
+)
+
+var devicePlatforms = []string{"android", "ios", "web"}
+
+// Device is a registration token of the app on one phone or browser, pushes for
+// its user go to every device they registered
+type Device struct {
+	Token     string    `json:"token"`
+	User      string    `json:"user"`
+	Platform  string    `json:"platform"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// body of POST /devices
+type deviceRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+// errDeviceGone is what FCM answers for tokens of uninstalled apps, the
+// device is deleted so it isn't tried again
+var errDeviceGone = fmt.Errorf("device token is no longer registered")
+
+// tokens can be long and contain anything, the document id is their hash
+func deviceID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (srv *Server) pushEnabled() bool {
+	return srv.Config.FCMProjectID != ""
+}
+
+// handlerRegisterDevice registers a device token for the caller. A token that
+// belonged to somebody else moves to the caller, the phone changed hands.
+//
+//	POST /devices {"token":"...","platform":"android"}
+func (srv *Server) handlerRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req deviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode device")
+		return
+	}
+	var errs []fieldError
+	if req.Token == "" || len(req.Token) > DEVICE_MAX_TOKEN {
+		errs = append(errs, fieldError{Name: "token", In: "body", Message: fmt.Sprintf("must be 1 to %d characters", DEVICE_MAX_TOKEN)})
+	}
+	if !contains(devicePlatforms, req.Platform) {
+		errs = append(errs, fieldError{Name: "platform", In: "body", Message: "must be one of android, ios, web"})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	d := Device{Token: req.Token, User: username, Platform: req.Platform, CreatedAt: time.Now().UTC()}
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_DEVICE).
+			Id(deviceID(d.Token)).
+			BodyJson(d).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to save device", err)
+		return
+	}
+	srv.Log.Printf("Registered %s device of %s\n", d.Platform, username)
+
+	js, _ := json.Marshal(d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handlerUnregisterDevice stops pushes to a device of the caller, e.g. on logout
+//
+//	DELETE /devices/{token}
+func (srv *Server) handlerUnregisterDevice(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	token := mux.Vars(r)["token"]
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_DEVICE).Id(deviceID(token)).Do()
+		return err
+	})
+	if err != nil && !elastic.IsNotFound(err) {
+		writeBackendError(w, r, "Failed to read device", err)
+		return
+	}
+	var d Device
+	// somebody else's device is as missing as an unknown one
+	if err != nil || !res.Found || res.Source == nil || json.Unmarshal(*res.Source, &d) != nil || d.User != username {
+		writeError(w, r, http.StatusNotFound, "Device not found")
+		return
+	}
+	if err := srv.deleteDevice(client, token); err != nil {
+		writeBackendError(w, r, "Failed to delete device", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) deleteDevice(client *elastic.Client, token string) error {
+	return esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_DEVICE).Id(deviceID(token)).Refresh(true).Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// userDevices lists the devices of username, newest first
+func (srv *Server) userDevices(client *elastic.Client, username string) ([]Device, error) {
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_DEVICE).
+			Query(elastic.NewTermQuery("user", username)).
+			Sort("created_at", false).
+			Size(DEVICE_MAX_PER_USER).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	for _, hit := range res.Hits.Hits {
+		var d Device
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &d) != nil {
+			continue
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// pushNotification sends n to every device of its user through FCM and to
+// their browsers through web push, dropping the ones that are gone
+func (srv *Server) pushNotification(n Notification) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	if srv.webPushEnabled() {
+		if err := srv.pushWebNotification(client, n); err != nil {
+			srv.Log.Printf("Failed to push %s to the browsers of %s %v\n", n.Kind, n.User, err)
+		}
+	}
+	if !srv.pushEnabled() {
+		return nil
+	}
+	devices, err := srv.userDevices(client, n.User)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		err := srv.sendFCM(d.Token, n)
+		if err == errDeviceGone {
+			srv.Log.Printf("Dropping gone %s device of %s\n", d.Platform, d.User)
+			if err := srv.deleteDevice(client, d.Token); err != nil {
+				srv.Log.Printf("Failed to delete device of %s %v\n", d.User, err)
+			}
+			continue
+		}
+		if err != nil {
+			// the notification is still in the inbox
+			srv.Log.Printf("Failed to push to a %s device of %s %v\n", d.Platform, d.User, err)
+		}
+	}
+	return nil
+}
+
+// the token source refreshes its access token itself, one is enough
+var fcmAuth struct {
+	sync.Mutex
+	ts oauth2.TokenSource
+}
+
+func fcmToken() (string, error) {
+	fcmAuth.Lock()
+	defer fcmAuth.Unlock()
+	if fcmAuth.ts == nil {
+		ts, err := google.DefaultTokenSource(context.Background(), FCM_SCOPE)
+		if err != nil {
+			return "", err
+		}
+		fcmAuth.ts = ts
+	}
+	t, err := fcmAuth.ts.Token()
+	if err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+// https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages
+type fcmMessage struct {
+	Message struct {
+		Token        string `json:"token"`
+		Notification struct {
+			Title string `json:"title"`
+			Body  string `json:"body"`
+		} `json:"notification"`
+		// FCM only takes string values
+		Data map[string]string `json:"data"`
+	} `json:"message"`
+}
+
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// sendFCM pushes one notification to one device through the FCM HTTP v1 API
+func (srv *Server) sendFCM(token string, n Notification) error {
+	var m fcmMessage
+	m.Message.Token = token
+	m.Message.Notification.Title = "Around"
+	m.Message.Notification.Body = n.Message
+	m.Message.Data = map[string]string{"id": n.Id, "kind": n.Kind}
+	for k, v := range n.Data {
+		m.Message.Data[k] = v
+	}
+	body, _ := json.Marshal(m)
+	url := "https://fcm.googleapis.com/v1/projects/" + srv.Config.FCMProjectID + "/messages:send"
+	client := &http.Client{Timeout: FCM_TIMEOUT}
+
+	return retry(fcmBreaker, func() error {
+		access, err := fcmToken()
+		if err != nil {
+			return err
+		}
+		req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+access)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			return nil
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		var e fcmError
+		json.Unmarshal(data, &e)
+		// UNREGISTERED comes as 404, a malformed token as 400 INVALID_ARGUMENT
+		if res.StatusCode == http.StatusNotFound || e.Error.Status == "UNREGISTERED" ||
+			(res.StatusCode == http.StatusBadRequest && e.Error.Status == "INVALID_ARGUMENT") {
+			return permanent(errDeviceGone)
+		}
+		err = fmt.Errorf("fcm returned %d %s %s", res.StatusCode, e.Error.Status, e.Error.Message)
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return permanent(err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// pixels of a PNG without ?size=, and the most one can ask for. A flyer
+	// printed at 300 dpi needs about 1000 for a code of 8 cm.
+	QR_DEFAULT_SIZE = 256
+	QR_MIN_SIZE     = 64
+	QR_MAX_SIZE     = 2048
+	// codes are printed and stick on walls, the link doesn't change
+	QR_MAX_AGE = 24 * time.Hour
+)
+
+// handlerPostQR renders a QR code of the share link of a post, for flyers and
+// venues pointing people at it. The post keeps one link, see shareOf, so codes
+// printed earlier still work.
+//
+//	GET /post/{id}/qr?format=png|svg&size=
+func (srv *Server) handlerPostQR(w http.ResponseWriter, r *http.Request) {
+	client, _, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+	if !srv.canSee("", p.User) {
+		writeError(w, r, http.StatusForbidden, "Posts of private accounts can't be shared")
+		return
+	}
+	s, err := srv.shareOf(client, p.Id, usernameFromToken(r))
+	if err != nil {
+		writeBackendError(w, r, "Failed to save share", err)
+		return
+	}
+	srv.writeQR(w, r, shareURL(r, s))
+}
+
+// handlerUserQR renders a QR code of the profile of a user in the web app.
+// Private accounts have one too, their profile tells who to follow.
+//
+//	GET /users/{username}/qr?format=png|svg&size=
+func (srv *Server) handlerUserQR(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	if _, ok := srv.getUser(username); !ok {
+		if !srv.redirectRenamed(w, r, username) {
+			writeError(w, r, http.StatusNotFound, "User not found")
+		}
+		return
+	}
+	srv.writeQR(w, r, externalURL(r, "/users/"+username))
+}
+
+// writeQR answers with a QR code of link, a PNG of ?size= pixels or an SVG
+// that scales to any size. Medium error correction survives a crumpled flyer.
+func (srv *Server) writeQR(w http.ResponseWriter, r *http.Request, link string) {
+	q := r.URL.Query()
+	// types and ranges are checked by validateRequest already
+	size := QR_DEFAULT_SIZE
+	if v := q.Get("size"); v != "" {
+		size, _ = strconv.Atoi(v)
+	}
+	code, err := qrcode.New(link, qrcode.Medium)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Failed to make QR code")
+		srv.Log.Printf("Failed to make QR code of %s %v\n", link, err)
+		return
+	}
+
+	var body []byte
+	switch q.Get("format") {
+	case "svg":
+		body = qrSVG(code.Bitmap())
+		w.Header().Set("Content-Type", "image/svg+xml")
+	default:
+		body, err = code.PNG(size)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Failed to make QR code")
+			srv.Log.Printf("Failed to make QR code of %s %v\n", link, err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(QR_MAX_AGE.Seconds())))
+	w.Write(body)
+}
+
+// qrSVG draws the modules of a code, the quiet zone included, as one path of
+// unit squares in a viewBox of the code's size
+func qrSVG(bitmap [][]bool) []byte {
+	var b bytes.Buffer
+	n := len(bitmap)
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, n, n)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// QuotedPost is what a quote post shows of the post it quotes. The quoted post
+// is looked up whenever the quote is returned, so edits show and deletes take
+// it away. A tombstone can't tell deleted from private, which is the point.
+type QuotedPost struct {
+	Id string `json:"id"`
+	// nil when it is a tombstone
+	Post      *Post `json:"post,omitempty"`
+	Tombstone bool  `json:"tombstone,omitempty"`
+}
+
+// checkQuotable tells whether username may quote the post id, it has to exist,
+// not be deleted and be visible to them
+func (srv *Server) checkQuotable(username, id string) (bool, error) {
+	client, err := srv.es()
+	if err != nil {
+		return false, err
+	}
+	_, p, err := srv.findPost(client, id)
+	if err != nil {
+		return false, err
+	}
+	return p != nil && !p.hidden() && srv.canSee(username, p.User), nil
+}
+
+// withQuotes inlines the quoted posts of the quote posts in ps as viewer may
+// see them, with one ES lookup for all of them. ps itself is not changed.
+// Quotes of quotes only get the id of what the quoted post quotes, not a chain.
+func (srv *Server) withQuotes(viewer string, ps []Post) []Post {
+	var ids []string
+	for _, p := range ps {
+		if p.QuoteOf != "" {
+			ids = append(ids, p.QuoteOf)
+		}
+	}
+	if len(ids) == 0 {
+		return ps
+	}
+
+	quoted, err := srv.postsByID(ids)
+	if err != nil {
+		// the quotes still go out, as tombstones
+		srv.Log.Printf("Failed to load quoted posts %v\n", err)
+	}
+	out := make([]Post, len(ps))
+	for i, p := range ps {
+		out[i] = p
+		if p.QuoteOf == "" {
+			continue
+		}
+		q := &QuotedPost{Id: p.QuoteOf, Tombstone: true}
+		if qp, ok := quoted[p.QuoteOf]; ok && !qp.hidden() && srv.inFeed(viewer, qp.User) {
+			q.Post = &qp
+			q.Tombstone = false
+		}
+		out[i].Quoted = q
+	}
+	return out
+}
+
+// postsByID looks up posts by id through the read alias, missing ones are left out
+func (srv *Server) postsByID(ids []string) (map[string]Post, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(elastic.NewIdsQuery(TYPE).Ids(ids...)).
+			Size(len(ids)).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	posts := map[string]Post{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			srv.Log.Printf("Skipping post %s %v\n", hit.Id, err)
+			continue
+		}
+		posts[hit.Id] = p
+	}
+	return posts, nil
+}
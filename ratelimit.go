@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// limits are requests per window, counted in fixed windows
+	RATE_LIMIT_WINDOW = time.Minute
+	// the in-memory counters without redis forget everything past this many clients
+	RATE_LIMIT_LOCAL_MAX = 100000
+)
+
+// who a request comes from, limits can differ per class
+const (
+	RATE_CLASS_ANONYMOUS = "anonymous"
+	RATE_CLASS_USER      = "user"
+	// tokens of service accounts, see serviceaccounts.go
+	RATE_CLASS_API_KEY = "api_key"
+	RATE_CLASS_ADMIN   = "admin"
+)
+
+var rateLimitClasses = []string{RATE_CLASS_ANONYMOUS, RATE_CLASS_USER, RATE_CLASS_API_KEY, RATE_CLASS_ADMIN}
+
+// the limits in effect, from config at startup and replaced on SIGHUP, see
+// runConfigReload. Requests already counted keep their counts.
+var rateSettings struct {
+	sync.RWMutex
+	limit  int
+	limits RateLimits
+	quotas map[string]UsageQuota
+}
+
+// setRateLimits makes the limits of c the ones in effect
+func setRateLimits(c *Config) {
+	rateSettings.Lock()
+	defer rateSettings.Unlock()
+	rateSettings.limit = c.RateLimit
+	rateSettings.limits = c.RateLimits
+	rateSettings.quotas = c.Quotas
+}
+
+// quotaFor is the daily quota of a principal of class, zero without one
+func quotaFor(class string) UsageQuota {
+	rateSettings.RLock()
+	defer rateSettings.RUnlock()
+	return rateSettings.quotas[class]
+}
+
+// rateLimitFor is the limit of class on route ("POST /login"), most specific
+// first: the route and class, the class, the default. ok tells whether the
+// route has its own limit for the class, those are counted apart.
+func rateLimitFor(route, class string) (limit int, ok bool) {
+	rateSettings.RLock()
+	defer rateSettings.RUnlock()
+	if n, ok := rateSettings.limits.Routes[route][class]; ok {
+		return n, true
+	}
+	if n, ok := rateSettings.limits.Classes[class]; ok {
+		return n, false
+	}
+	return rateSettings.limit, false
+}
+
+// counters when redis is not setup, per instance so the limit is per instance
+// too. Keyed like the redis keys and dropped when the window changes.
+type localRates struct {
+	sync.Mutex
+	window time.Time
+	counts map[string]int64
+}
+
+// rateLimitMiddleware counts the requests of every client and answers 429 past
+// its limit per RATE_LIMIT_WINDOW. Runs after routing, a route with its own
+// limit for the class of the client counts in its own bucket, every other
+// request in the shared one. 0 is no limit. Every response tells the client
+// where it stands:
+//
+//	X-RateLimit-Limit: 600
+//	X-RateLimit-Remaining: 599
+//	X-RateLimit-Reset: 1530403260 (unix time the window ends)
+//	Retry-After: 42 (seconds, on 429 only)
+func (srv *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, class := srv.rateLimitKey(r)
+		route := rateLimitRoute(r)
+		n, own := rateLimitFor(route, class)
+		if n <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if own {
+			key = "route:" + route + ":" + key
+		}
+		now := time.Now()
+		window := now.Truncate(RATE_LIMIT_WINDOW)
+		reset := window.Add(RATE_LIMIT_WINDOW)
+		count, err := srv.countRequest(key, window)
+		if err != nil {
+			// a limiter that is down doesn't take the API with it
+			srv.Log.Printf("[%s] Rate limiter failed, request let through %v\n", requestID(r), err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit := int64(n)
+		remaining := limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+		h.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if count > limit {
+			// rounded up, a client retrying after 0 seconds would just be refused again
+			wait := int64((reset.Sub(now) + time.Second - 1) / time.Second)
+			h.Set("Retry-After", strconv.FormatInt(wait, 10))
+			writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded, retry in %ds", wait))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// countRequest adds one request of key to window and returns the count so far
+func (srv *Server) countRequest(key string, window time.Time) (int64, error) {
+	key = "around:rate:" + key + ":" + strconv.FormatInt(window.Unix(), 10)
+	if srv.Redis != nil {
+		pipe := srv.Redis.TxPipeline()
+		incr := pipe.Incr(key)
+		// a little longer than the window, clocks of the instances differ
+		pipe.Expire(key, 2*RATE_LIMIT_WINDOW)
+		if _, err := pipe.Exec(); err != nil {
+			return 0, err
+		}
+		return incr.Val(), nil
+	}
+	srv.rateLocal.Lock()
+	defer srv.rateLocal.Unlock()
+	if !window.Equal(srv.rateLocal.window) || len(srv.rateLocal.counts) >= RATE_LIMIT_LOCAL_MAX {
+		srv.rateLocal.counts = map[string]int64{}
+		srv.rateLocal.window = window
+	}
+	srv.rateLocal.counts[key]++
+	return srv.rateLocal.counts[key], nil
+}
+
+// rateLimitKey is who the request counts against and their class: the user of
+// a valid token, the client address otherwise. The token is checked again by
+// the route.
+func (srv *Server) rateLimitKey(r *http.Request) (key, class string) {
+	username, claims := srv.tokenUsername(r)
+	switch {
+	case username == "":
+		return "ip:" + srv.clientIP(r), RATE_CLASS_ANONYMOUS
+	case claims["kind"] == TOKEN_KIND_SERVICE:
+		// per service account, not per account it posts as
+		clientID, _ := claims["client_id"].(string)
+		return "service:" + clientID, RATE_CLASS_API_KEY
+	case srv.isAdmin(username):
+		return "user:" + username, RATE_CLASS_ADMIN
+	}
+	return "user:" + username, RATE_CLASS_USER
+}
+
+// rateLimitRoute is the route of r like in the rate_limits config, e.g.
+// "GET /post/{id}", "" outside the API routes
+func rateLimitRoute(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	// one limit for a route in every version
+	return r.Method + " " + strings.TrimPrefix(strings.TrimPrefix(tpl, API_V1), API_V2)
+}
+
+// tokenUsername is the username and claims of the bearer token or ?token=, ""
+// when there is none or it doesn't verify
+func (srv *Server) tokenUsername(r *http.Request) (string, jwt.MapClaims) {
+	raw := requestToken(r)
+	if raw == "" {
+		return "", nil
+	}
+	claims, err := srv.Tokens.Parse(raw)
+	if err != nil {
+		return "", nil
+	}
+	username, _ := claims["username"].(string)
+	return username, claims
+}
+
+// requestToken is the bearer token or ?token= of r, "" when there is none
+func requestToken(r *http.Request) string {
+	raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if raw == "" || raw == r.Header.Get("Authorization") {
+		raw = r.URL.Query().Get("token")
+	}
+	return raw
+}
+
+// clientIP is the address the request came from. X-Forwarded-For only counts
+// when a trusted proxy sent the request: each proxy appends who it got the
+// request from, so the first entry from the right that no trusted proxy added
+// is the client. What is left of it the client may have made up.
+func (srv *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !srv.Config.trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !srv.Config.trustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_REACTION = "reaction"
+
+	REACTIONS_PAGE_SIZE     = 50
+	REACTIONS_PAGE_MAX_SIZE = 500
+)
+
+// reactionTypes maps the names clients send to what they show, "like" is the
+// heart. Names keep URLs and the ES field simple.
+var reactionTypes = map[string]string{
+	"like":  "❤️",
+	"laugh": "😂",
+	"wow":   "😮",
+	"sad":   "😢",
+	"angry": "😠",
+	"up":    "👍",
+}
+
+// Reaction is stored in INDEX with id post>user, a user has at most one
+// reaction per post and reacting again changes its type
+type Reaction struct {
+	PostID    string    `json:"post_id"`
+	User      string    `json:"user"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type reactionRequest struct {
+	Type string `json:"type"`
+}
+
+type reactionsPage struct {
+	// per type, the same as reactions of the post
+	Counts    map[string]int64 `json:"counts"`
+	Reactions []Reaction       `json:"reactions"`
+	// offset of the next page, absent on the last one
+	Next *int `json:"next,omitempty"`
+}
+
+// reactionNames are the keys of reactionTypes, sorted, for the OpenAPI enum
+func reactionNames() []string {
+	names := make([]string, 0, len(reactionTypes))
+	for name := range reactionTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// post ids are ULIDs and usernames can't contain '>'
+func reactionID(postID, username string) string {
+	return postID + ">" + username
+}
+
+// visiblePost loads the post {id} for the caller, answering 404 when it is
+// missing, deleted or hidden from them
+func (srv *Server) visiblePost(w http.ResponseWriter, r *http.Request) (*elastic.Client, *elastic.SearchHit, *Post, bool) {
+	id := mux.Vars(r)["id"]
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return nil, nil, nil, false
+	}
+	hit, p, err := srv.findPost(client, id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read post", err)
+		return nil, nil, nil, false
+	}
+	if p == nil || p.hidden() || !srv.canSee(usernameFromToken(r), p.User) {
+		writeError(w, r, http.StatusNotFound, "Post not found")
+		return nil, nil, nil, false
+	}
+	return client, hit, p, true
+}
+
+// countReactions aggregates the reactions to a post per type
+func (srv *Server) countReactions(client *elastic.Client, postID string) (map[string]int64, error) {
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_REACTION).
+			Query(elastic.NewTermQuery("post_id", postID)).
+			Aggregation("types", elastic.NewTermsAggregation().Field("type").Size(len(reactionTypes))).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	if agg, ok := res.Aggregations.Terms("types"); ok {
+		for _, b := range agg.Buckets {
+			if name, ok := b.Key.(string); ok {
+				counts[name] = b.DocCount
+			}
+		}
+	}
+	return counts, nil
+}
+
+// updateReactionCounts recounts the reactions and stores the counts on the post,
+// so searches return them without a lookup per post. Recounting instead of
+// incrementing means a lost update is fixed by the next reaction.
+func (srv *Server) updateReactionCounts(client *elastic.Client, hit *elastic.SearchHit, p *Post) (map[string]int64, error) {
+	counts, err := srv.countReactions(client, p.Id)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	err = esRetry(func() error {
+		_, err := client.Update().
+			Index(hit.Index).
+			Type(TYPE).
+			Id(hit.Id).
+			Doc(map[string]interface{}{"reactions": counts, "reaction_count": total}).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.Reactions = counts
+	p.ReactionCount = total
+	srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+	srv.syncSearch(*p)
+	return counts, nil
+}
+
+// getReaction reads the reaction of username to a post, nil if there is none
+func (srv *Server) getReaction(client *elastic.Client, postID, username string) (*Reaction, error) {
+	var res *elastic.GetResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_REACTION).Id(reactionID(postID, username)).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var reaction Reaction
+	if err := json.Unmarshal(*res.Source, &reaction); err != nil {
+		return nil, err
+	}
+	return &reaction, nil
+}
+
+// handlerReact sets the reaction of the caller to a post, replacing an earlier one
+//
+//	PUT /post/{id}/reactions {"type":"laugh"}
+func (srv *Server) handlerReact(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req reactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode reaction")
+		return
+	}
+	// checked by validateRequest already, the enum comes from reactionTypes
+	if _, ok := reactionTypes[req.Type]; !ok {
+		writeError(w, r, http.StatusBadRequest, "Unknown reaction type "+req.Type)
+		return
+	}
+	client, hit, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+	srv.Log.Printf("Received one %s reaction to %s from %s\n", req.Type, p.Id, username)
+
+	// liking again, or after another reaction, does not notify again
+	before, err := srv.getReaction(client, p.Id, username)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read reaction", err)
+		return
+	}
+
+	reaction := Reaction{PostID: p.Id, User: username, Type: req.Type, CreatedAt: time.Now().UTC()}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_REACTION).
+			Id(reactionID(p.Id, username)).
+			BodyJson(reaction).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to save reaction", err)
+		return
+	}
+	if _, err := srv.updateReactionCounts(client, hit, p); err != nil {
+		writeBackendError(w, r, "Failed to count reactions", err)
+		return
+	}
+	// hundred_likes for the author
+	srv.awardBadgesLater(p.User)
+	if before == nil && req.Type == "like" && p.User != username {
+		srv.notifyLater(Notification{
+			User:    p.User,
+			Kind:    "like",
+			Message: fmt.Sprintf("%s likes your post", username),
+			Data:    map[string]string{"post_id": p.Id},
+		})
+	}
+
+	js, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerUnreact takes the reaction of the caller back
+//
+//	DELETE /post/{id}/reactions
+func (srv *Server) handlerUnreact(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	client, hit, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+	err := esRetry(func() error {
+		_, err := client.Delete().
+			Index(srv.Names.Index).
+			Type(TYPE_REACTION).
+			Id(reactionID(p.Id, username)).
+			Refresh(true).
+			Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to delete reaction", err)
+		return
+	}
+	if _, err := srv.updateReactionCounts(client, hit, p); err != nil {
+		writeBackendError(w, r, "Failed to count reactions", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerListReactions tells who reacted how, newest first, optionally only one type
+//
+//	GET /post/{id}/reactions?type=&offset=&limit=
+func (srv *Server) handlerListReactions(w http.ResponseWriter, r *http.Request) {
+	// types and ranges are checked by validateRequest already
+	typ := r.URL.Query().Get("type")
+	limit := REACTIONS_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset+limit > USER_PAGE_MAX_OFFSET {
+		writeError(w, r, http.StatusBadRequest, "Cannot page that far")
+		return
+	}
+	client, _, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("post_id", p.Id))
+	if typ != "" {
+		q = q.Filter(elastic.NewTermQuery("type", typ))
+	}
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_REACTION).
+			Query(q).
+			Sort("created_at", false).
+			From(offset).
+			Size(limit).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to read reactions", err)
+		return
+	}
+
+	counts := p.Reactions
+	if counts == nil {
+		counts = map[string]int64{}
+	}
+	page := reactionsPage{Counts: counts, Reactions: []Reaction{}}
+	for _, hit := range res.Hits.Hits {
+		var reaction Reaction
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &reaction) != nil {
+			continue
+		}
+		// muted users and private accounts the caller doesn't follow stay out, as in searches
+		if !srv.inFeed(usernameFromToken(r), reaction.User) {
+			continue
+		}
+		page.Reactions = append(page.Reactions, reaction)
+	}
+	if next := offset + len(res.Hits.Hits); int64(next) < res.TotalHits() && len(res.Hits.Hits) > 0 {
+		page.Next = &next
+	}
+
+	js, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/TianyiSun2333/Around/search"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// prefixed with the tenant, see tenantNames
+const BIGTABLE_TABLE = "post"
+
+// postMutation is the Bigtable row of a post: user, message, location and the
+// times like in ES, RFC 3339 in UTC. updated_at is only there for edited posts.
+// The cell timestamp is the last change of the post, so writing it twice is harmless.
+func postMutation(p Post) *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	t := bigtable.Time(postUpdated(p))
+	mut.Set("post", "user", t, []byte(p.User))
+	mut.Set("post", "message", t, []byte(p.Message))
+	if !p.CreatedAt.IsZero() {
+		mut.Set("post", "created_at", t, []byte(p.CreatedAt.UTC().Format(time.RFC3339)))
+	}
+	if p.UpdatedAt != nil {
+		mut.Set("post", "updated_at", t, []byte(p.UpdatedAt.UTC().Format(time.RFC3339)))
+	}
+	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
+	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
+	return mut
+}
+
+// runReindex implements `around reindex`: every post in ES is written to the
+// Bigtable post table, keyed by post id, or with -search to the copy of the
+// search backend. Rows are overwritten, so after a failure it can simply run
+// again, -since skips what is known to be there.
+//
+//	around reindex -since 2018-06-01T00:00:00Z
+//	around -search-backend postgis reindex -search
+func (srv *Server) runReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	since := fs.String("since", "", "only posts created at or after this RFC 3339 time")
+	batch := fs.Int("batch", EXPORT_BATCH_SIZE, "rows per bulk mutation")
+	toSearch := fs.Bool("search", false, "fill the opensearch or postgis copy of search_backend instead of Bigtable")
+	fs.Parse(args)
+
+	ix, ok := srv.Search.(search.Indexer)
+	if *toSearch {
+		if !ok {
+			return fmt.Errorf("-search: search_backend %s searches ES itself, there is no copy to fill", srv.Config.SearchBackend)
+		}
+		if err := ix.Setup(); err != nil {
+			return err
+		}
+	}
+
+	q := elastic.NewBoolQuery().Filter(notDeleted())
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("-since: %v", err)
+		}
+		q = q.Filter(elastic.NewRangeQuery("created_at").Gte(t))
+	}
+
+	es_client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	scroll := es_client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(*batch).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	total, failed := 0, 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		var muts []*bigtable.Mutation
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var p Post
+			if err := json.Unmarshal(*hit.Source, &p); err != nil {
+				srv.Log.Printf("Skipping post %s %v\n", hit.Id, err)
+				continue
+			}
+			keys = append(keys, hit.Id)
+			muts = append(muts, postMutation(p))
+			if *toSearch {
+				// hits of old posts may lack the id
+				p.Id = hit.Id
+				if err := ix.Put(searchDoc(p)); err != nil {
+					srv.Log.Printf("Failed to index post %s %v\n", hit.Id, err)
+					failed++
+				}
+			}
+		}
+		if len(keys) == 0 || *toSearch {
+			total += len(keys)
+			if *toSearch {
+				srv.Log.Printf("Reindexed %d posts\n", total)
+			}
+			continue
+		}
+
+		rowErrs, err := srv.Tables.ApplyBulk(ctx, srv.Names.PostTable, keys, muts)
+		if err != nil {
+			return err
+		}
+		// nil when every row went through
+		for i, e := range rowErrs {
+			if e != nil {
+				srv.Log.Printf("Failed to write post %s to Bigtable %v\n", keys[i], e)
+				srv.deadLetter("bigtable.post", deadLetterPost{Id: keys[i]}, e)
+				failed++
+			}
+		}
+		total += len(keys)
+		srv.Log.Printf("Reindexed %d posts\n", total)
+	}
+	into := "Bigtable"
+	if *toSearch {
+		into = srv.Config.SearchBackend
+	}
+	srv.Log.Printf("Reindexed %d posts into %s, %d failed\n", total-failed, into, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d posts were not written", failed)
+	}
+	return nil
+}
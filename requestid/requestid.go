@@ -0,0 +1,33 @@
+// Package requestid carries the X-Request-ID of an API request in contexts,
+// from the handler to the backends it calls, so one request can be followed
+// through the logs of each of them.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// the header clients, proxies and the backends that take one use
+const HEADER = "X-Request-ID"
+
+type key struct{}
+
+// With returns ctx carrying id
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, key{}, id)
+}
+
+// From returns the id ctx carries, "" outside of requests
+func From(ctx context.Context) string {
+	id, _ := ctx.Value(key{}).(string)
+	return id
+}
+
+// New makes an id for a request that came without one
+func New() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
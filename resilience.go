@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	RETRY_ATTEMPTS    = 3
+	RETRY_BASE_DELAY  = 100 * time.Millisecond
+	RETRY_MAX_DELAY   = 2 * time.Second
+	BREAKER_THRESHOLD = 5
+	BREAKER_COOLDOWN  = 30 * time.Second
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// one breaker per backend, a broken ML engine should not stop searches
+var (
+	esBreaker  = newCircuitBreaker("elasticsearch")
+	gcsBreaker = newCircuitBreaker("gcs")
+	btBreaker  = newCircuitBreaker("bigtable")
+	mlBreaker  = newCircuitBreaker("ml")
+	fcmBreaker = newCircuitBreaker("fcm")
+	// one for all push services, browsers use a handful of them
+	webPushBreaker = newCircuitBreaker("webpush")
+	smsBreaker     = newCircuitBreaker("sms")
+	// opensearch or postgis when they run the geo search
+	searchBreaker = newCircuitBreaker("search")
+)
+
+// breakerLog is where the breakers and retries log. Like the breakers it is
+// shared by the servers of every tenant, main sets the logger of its server.
+var breakerLog = stdoutLog
+
+// circuitBreaker stops calling a backend after too many failures in a row,
+// after the cooldown a single probe call decides whether to close it again
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: BREAKER_THRESHOLD,
+		cooldown:  BREAKER_COOLDOWN,
+	}
+}
+
+// CircuitOpenError is returned without calling the backend while its breaker is open
+type CircuitOpenError struct {
+	Name string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s is unavailable, circuit open", e.Name)
+}
+
+// allow reports whether a call may go through, in half-open state only the probe may
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		// this caller becomes the probe
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+// isOpen tells if calls are held back right now, for /readyz
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		breakerLog.Printf("Circuit for %s closed\n", b.name)
+	}
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			breakerLog.Printf("Circuit for %s opened after %d failures\n", b.name, b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// permanentError marks a failure that retrying cannot fix (bad request, not found),
+// it is returned as is and does not count against the breaker
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// retry calls fn through the breaker with exponential backoff and full jitter.
+func retry(b *circuitBreaker, fn func() error) error {
+	delay := RETRY_BASE_DELAY
+	var err error
+	for attempt := 1; attempt <= RETRY_ATTEMPTS; attempt++ {
+		if !b.allow() {
+			backendErrors.WithLabelValues(b.name, "circuit_open").Inc()
+			return &CircuitOpenError{b.name}
+		}
+
+		start := time.Now()
+		err = fn()
+		observeBackend(b.name, start, err)
+		if err == nil {
+			b.success()
+			return nil
+		}
+		if p, ok := err.(*permanentError); ok {
+			// the backend answered, so it is healthy
+			b.success()
+			return p.err
+		}
+		b.failure()
+
+		if attempt == RETRY_ATTEMPTS {
+			break
+		}
+		breakerLog.Printf("%s call failed (attempt %d), retrying %v\n", b.name, attempt, err)
+		time.Sleep(time.Duration(rand.Int63n(int64(delay))))
+		if delay *= 2; delay > RETRY_MAX_DELAY {
+			delay = RETRY_MAX_DELAY
+		}
+	}
+	return err
+}
+
+// searchRetry wraps a call of the search backend, 4xx answers of opensearch are not retried
+func searchRetry(fn func() error) error {
+	return retry(searchBreaker, func() error {
+		err := fn()
+		if e, ok := err.(*search.StatusError); ok && e.Status >= 400 && e.Status < 500 {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+// esRetry wraps an ES call, 4xx answers are not retried
+func esRetry(fn func() error) error {
+	return retry(esBreaker, func() error {
+		err := fn()
+		if e, ok := err.(*elastic.Error); ok && e.Status >= 400 && e.Status < 500 {
+			return permanent(err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	// decodes the first frame of gifs
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// the largest ?w= and ?h=, a full view on a big screen
+	RESIZE_MAX_SIDE = 2048
+	// originals above this are served as they are, decoding them takes too much memory
+	RESIZE_MAX_BYTES    = 20 << 20
+	RESIZE_MAX_PIXELS   = 40 * 1000 * 1000
+	RESIZE_JPEG_QUALITY = 85
+	// the resized images are kept next to the media, in
+	// MEDIA_PREFIX+RESIZED_DIR+id+"/"+variant. Cleanup and the purge delete
+	// them with the post.
+	RESIZED_DIR = "resized/"
+)
+
+// mediaSize is the ?w=&h=&fit= of handlerMedia. fit is contain, the image
+// within w by h, or cover, w by h cut from the middle. With only one of w and
+// h the other follows from the aspect ratio.
+type mediaSize struct {
+	W, H int
+	Fit  string
+}
+
+// parseMediaSize reads the query, the zero mediaSize asks for the original.
+// The values are checked by validateRequest already.
+func parseMediaSize(r *http.Request) mediaSize {
+	q := r.URL.Query()
+	s := mediaSize{Fit: "contain"}
+	s.W, _ = strconv.Atoi(q.Get("w"))
+	s.H, _ = strconv.Atoi(q.Get("h"))
+	if s.W == 0 && s.H == 0 {
+		return mediaSize{}
+	}
+	// cover needs both sides, with one it is contain
+	if q.Get("fit") == "cover" && s.W > 0 && s.H > 0 {
+		s.Fit = "cover"
+	}
+	return s
+}
+
+// the name of the resized image of post id in the bucket
+func (s mediaSize) objectName(prefix, id string) string {
+	return fmt.Sprintf("%s%s%s/%dx%d-%s", prefix, RESIZED_DIR, id, s.W, s.H, s.Fit)
+}
+
+// box is the part of a src sized image that is scaled and the size it is
+// scaled to. Images are never made larger, a side that would grow keeps its size.
+func (s mediaSize) box(src image.Rectangle) (crop image.Rectangle, w, h int) {
+	sw, sh := src.Dx(), src.Dy()
+	crop = src
+	switch {
+	case s.Fit == "cover":
+		w, h = s.W, s.H
+		// the largest part of src with the aspect ratio of w by h
+		cw, ch := sw, sw*h/w
+		if ch > sh {
+			cw, ch = sh*w/h, sh
+		}
+		x0, y0 := src.Min.X+(sw-cw)/2, src.Min.Y+(sh-ch)/2
+		crop = image.Rect(x0, y0, x0+cw, y0+ch)
+		if w > cw || h > ch {
+			w, h = cw, ch
+		}
+	case s.W > 0 && (s.H == 0 || s.W*sh <= s.H*sw):
+		w, h = s.W, sh*s.W/sw
+	default:
+		w, h = sw*s.H/sh, s.H
+	}
+	if s.Fit != "cover" && (w > sw || h > sh) {
+		w, h = sw, sh
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return crop, w, h
+}
+
+// scaleImage scales the part crop of src to w by h, each pixel the average of
+// the source pixels it covers. Good for making images smaller, which is all
+// the media proxy does.
+func scaleImage(src image.Image, crop image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	cw, ch := crop.Dx(), crop.Dy()
+	for y := 0; y < h; y++ {
+		y0 := crop.Min.Y + y*ch/h
+		y1 := crop.Min.Y + (y+1)*ch/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := crop.Min.X + x*cw/w
+			x1 := crop.Min.X + (x+1)*cw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
+
+// resizeMedia makes the image of size s from the original in orig. ok is false
+// for media that isn't resized: videos, images that don't decode or are too
+// large, and images that already are the size.
+func resizeMedia(orig []byte, s mediaSize) (out []byte, contentType string, ok bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(orig))
+	if err != nil || cfg.Width*cfg.Height > RESIZE_MAX_PIXELS {
+		return nil, "", false
+	}
+	crop, w, h := s.box(image.Rect(0, 0, cfg.Width, cfg.Height))
+	if crop.Dx() == w && crop.Dy() == h && w == cfg.Width && h == cfg.Height {
+		return nil, "", false
+	}
+	// a resized gif is its first frame, animations would be larger than the original
+	src, _, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return nil, "", false
+	}
+	dst := scaleImage(src, crop.Add(src.Bounds().Min), w, h)
+
+	// png keeps the transparency of pngs and gifs
+	var buf bytes.Buffer
+	contentType = "image/png"
+	if format == "jpeg" {
+		contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: RESIZE_JPEG_QUALITY})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", false
+	}
+	return buf.Bytes(), contentType, true
+}
+
+// serveResized writes the image of size s of post id, from the resize cache
+// or made from the original and put into the cache. false when there is no
+// resized image, the caller serves the original then.
+func (srv *Server) serveResized(w http.ResponseWriter, r *http.Request, id string, s mediaSize) bool {
+	ctx := context.Background()
+	if obj, err := srv.Media.Open(ctx, s.objectName(srv.Names.MediaPrefix, id)); err == nil {
+		defer obj.Close()
+		srv.writeMedia(w, r, id, obj)
+		return true
+	}
+
+	obj, err := srv.Media.Open(ctx, srv.Names.MediaPrefix+id)
+	if err != nil {
+		return false
+	}
+	defer obj.Close()
+	if obj.Size > RESIZE_MAX_BYTES {
+		return false
+	}
+	orig, err := ioutil.ReadAll(io.LimitReader(obj, RESIZE_MAX_BYTES))
+	if err != nil {
+		srv.Log.Printf("Failed to read media of post %s %v\n", id, err)
+		return false
+	}
+	out, contentType, ok := resizeMedia(orig, s)
+	if !ok {
+		return false
+	}
+	// the next request is served from the cache, one that fails to save makes
+	// the image again
+	if _, err := srv.Media.Put(ctx, s.objectName(srv.Names.MediaPrefix, id), bytes.NewReader(out)); err != nil {
+		srv.Log.Printf("Failed to cache resized media of post %s %v\n", id, err)
+	}
+
+	if notModified(w, r, weakETag(out)) {
+		return true
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(out)
+	return true
+}
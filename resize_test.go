@@ -0,0 +1,34 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestMediaSizeBox(t *testing.T) {
+	src := image.Rect(0, 0, 400, 200)
+	tests := []struct {
+		name string
+		size mediaSize
+		src  image.Rectangle
+		crop image.Rectangle
+		w, h int
+	}{
+		{"contain width", mediaSize{W: 100, Fit: "contain"}, src, src, 100, 50},
+		{"contain height", mediaSize{H: 100, Fit: "contain"}, src, src, 200, 100},
+		{"contain both, width binds", mediaSize{W: 100, H: 100, Fit: "contain"}, src, src, 100, 50},
+		{"contain both, height binds", mediaSize{W: 400, H: 50, Fit: "contain"}, src, src, 100, 50},
+		{"contain never upscales", mediaSize{W: 800, Fit: "contain"}, src, src, 400, 200},
+		{"cover", mediaSize{W: 100, H: 100, Fit: "cover"}, src, image.Rect(100, 0, 300, 200), 100, 100},
+		{"cover wide", mediaSize{W: 400, H: 100, Fit: "cover"}, src, image.Rect(0, 50, 400, 150), 400, 100},
+		{"cover never upscales", mediaSize{W: 1000, H: 1000, Fit: "cover"}, src, image.Rect(100, 0, 300, 200), 200, 200},
+		{"cover off the origin", mediaSize{W: 100, H: 100, Fit: "cover"}, image.Rect(10, 10, 410, 210), image.Rect(110, 10, 310, 210), 100, 100},
+		{"at least a pixel", mediaSize{W: 10, Fit: "contain"}, image.Rect(0, 0, 1000, 1), image.Rect(0, 0, 1000, 1), 10, 1},
+	}
+	for _, tt := range tests {
+		crop, w, h := tt.size.box(tt.src)
+		if crop != tt.crop || w != tt.w || h != tt.h {
+			t.Errorf("%s: box = %v %dx%d, want %v %dx%d", tt.name, crop, w, h, tt.crop, tt.w, tt.h)
+		}
+	}
+}
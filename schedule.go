@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// how far ahead publish_at may be
+	POST_MAX_SCHEDULE = 30 * 24 * time.Hour
+	// how often the worker publishes and expires posts, they are due up to this late
+	SCHEDULE_INTERVAL = time.Minute
+)
+
+// scheduleFromForm reads publish_at and expires_at of a new post, RFC 3339.
+// publish_at holds the post back until then, expires_at takes it down. Both
+// are nil when not given.
+func scheduleFromForm(r *http.Request, now time.Time) (publishAt, expiresAt *time.Time, err error) {
+	if v := r.FormValue("publish_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("publish_at should be an RFC 3339 time")
+		}
+		t = t.UTC()
+		if !t.After(now) {
+			return nil, nil, fmt.Errorf("publish_at is in the past")
+		}
+		if t.Sub(now) > POST_MAX_SCHEDULE {
+			return nil, nil, fmt.Errorf("publish_at can't be more than %d days ahead", int(POST_MAX_SCHEDULE.Hours()/24))
+		}
+		publishAt = &t
+	}
+	if v := r.FormValue("expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("expires_at should be an RFC 3339 time")
+		}
+		t = t.UTC()
+		if !t.After(now) {
+			return nil, nil, fmt.Errorf("expires_at is in the past")
+		}
+		if publishAt != nil && !t.After(*publishAt) {
+			return nil, nil, fmt.Errorf("expires_at should be after publish_at")
+		}
+		expiresAt = &t
+	}
+	return publishAt, expiresAt, nil
+}
+
+// hidden tells if p is in no query, see notDeleted: soft deleted or not
+// published yet
+func (p Post) hidden() bool {
+	return p.DeletedAt != nil || p.PublishAt != nil
+}
+
+// publishScheduledPosts puts out the posts whose publish_at is due: it is
+// taken off and they get what handlerPost does for other new posts. A post
+// changed since the scroll, e.g. published by another run, is left alone.
+func (srv *Server) publishScheduledPosts(now time.Time) (int, error) {
+	client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewRangeQuery("publish_at").Lte(now)).
+		MustNot(elastic.NewExistsQuery("deleted_at"))
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(ARCHIVE_BULK_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	published := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return published, err
+		}
+		for _, hit := range res.Hits.Hits {
+			// search hits carry no version, a realtime get on the concrete index does
+			doc, err := client.Get().Index(hit.Index).Type(TYPE).Id(hit.Id).Do()
+			if err != nil || !doc.Found || doc.Source == nil || doc.Version == nil {
+				continue
+			}
+			var p Post
+			if err := json.Unmarshal(*doc.Source, &p); err != nil || p.PublishAt == nil || p.DeletedAt != nil {
+				continue
+			}
+			p.Id = hit.Id
+
+			err = esRetry(func() error {
+				// ES compares with the stored version, a post is published once
+				_, err := client.Update().
+					Index(hit.Index).
+					Type(TYPE).
+					Id(hit.Id).
+					Version(*doc.Version).
+					Doc(map[string]interface{}{"publish_at": nil}).
+					Refresh(true).
+					Do()
+				return err
+			})
+			if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+				continue
+			}
+			if err != nil {
+				return published, err
+			}
+			p.PublishAt = nil
+			srv.syncSearch(p)
+			srv.postSaved(p)
+			published++
+		}
+	}
+	return published, nil
+}
+
+// expirePosts soft deletes the posts whose expires_at is due, as of then. The
+// purge job takes them out of ES, GCS and Bigtable after the restore window,
+// they can't be restored.
+func (srv *Server) expirePosts(now time.Time) (int, error) {
+	client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+
+	q := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("expires_at").Lte(now), notDeleted())
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(q).
+		Size(ARCHIVE_BULK_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	expired := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return expired, err
+		}
+		for _, hit := range res.Hits.Hits {
+			var p Post
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &p) != nil || p.ExpiresAt == nil {
+				continue
+			}
+			if err := setDeletedAt(client, hit, p.ExpiresAt); err != nil {
+				return expired, err
+			}
+			srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+			srv.unindexPost(hit.Id)
+			expired++
+		}
+	}
+	return expired, nil
+}
@@ -0,0 +1,63 @@
+package search
+
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// a search with Text returns snippets of the message of each hit, the
+// matching words in <em>. The rest of a snippet is escaped HTML, the messages
+// are user input.
+const (
+	HIGHLIGHT_PRE  = "<em>"
+	HIGHLIGHT_POST = "</em>"
+	// characters per snippet and snippets per post
+	HIGHLIGHT_FRAGMENT_SIZE = 100
+	HIGHLIGHT_FRAGMENTS     = 3
+)
+
+// the highlighter of ES and OpenSearch on field, the message or one of its
+// multi fields
+func esHighlight(field string) *elastic.Highlight {
+	return elastic.NewHighlight().
+		Field(field).
+		PreTags(HIGHLIGHT_PRE).
+		PostTags(HIGHLIGHT_POST).
+		FragmentSize(HIGHLIGHT_FRAGMENT_SIZE).
+		NumOfFragments(HIGHLIGHT_FRAGMENTS).
+		Encoder("html")
+}
+
+// ts_headline doesn't escape, it marks the words and splits the snippets
+// with these private use characters and headline swaps them for the tags
+// after escaping the rest
+const (
+	headlineStart     = "\uE000"
+	headlineStop      = "\uE001"
+	headlineDelimiter = "\uE002"
+)
+
+// the options of ts_headline for about the snippets of esHighlight, MaxWords
+// is in words where ES counts characters
+var headlineOptions = "StartSel=" + headlineStart + ", StopSel=" + headlineStop +
+	", FragmentDelimiter=" + headlineDelimiter +
+	", MaxFragments=" + strconv.Itoa(HIGHLIGHT_FRAGMENTS) +
+	", MaxWords=" + strconv.Itoa(HIGHLIGHT_FRAGMENT_SIZE/6) + ", MinWords=5"
+
+// headline splits what ts_headline returned into snippets like the ones of ES
+func headline(s string) []string {
+	var out []string
+	for _, frag := range strings.Split(s, headlineDelimiter) {
+		if frag = strings.TrimSpace(frag); frag == "" {
+			continue
+		}
+		frag = html.EscapeString(frag)
+		frag = strings.Replace(frag, headlineStart, HIGHLIGHT_PRE, -1)
+		frag = strings.Replace(frag, headlineStop, HIGHLIGHT_POST, -1)
+		out = append(out, frag)
+	}
+	return out
+}
@@ -0,0 +1,38 @@
+package search
+
+import (
+	"unicode"
+)
+
+// Language is the language of s by its script: zh, ja or ko for Chinese,
+// Japanese and Korean, the scripts without spaces between words, "" for the
+// rest. Kana or Hangul anywhere decide over Han, Japanese and Korean use Han
+// characters too.
+func Language(s string) string {
+	han := false
+	for _, r := range s {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			return "ja"
+		case unicode.Is(unicode.Hangul, r):
+			return "ko"
+		case unicode.Is(unicode.Han, r):
+			han = true
+		}
+	}
+	if han {
+		return "zh"
+	}
+	return ""
+}
+
+// textFields are the fields a Text search runs on, by the language of the
+// text. The standard analyzer makes a word of every CJK character, message.cjk
+// has the bigrams of the cjk analyzer. Other text also matches the stems of
+// message.english, "parks" finds "park". The first field is highlighted.
+func textFields(text string) []string {
+	if Language(text) != "" {
+		return []string{"message.cjk"}
+	}
+	return []string{"message", "message.english"}
+}
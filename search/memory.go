@@ -0,0 +1,136 @@
+package search
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an Indexer in the memory of the process, for development. It
+// scans every doc per search, fine for the few thousand posts of a laptop.
+// The text search matches substrings, without the stemming of the others.
+type Memory struct {
+	mu   sync.RWMutex
+	docs map[string]Doc
+}
+
+func (m *Memory) Setup() error {
+	return nil
+}
+
+func (m *Memory) Put(doc Doc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.docs == nil {
+		m.docs = map[string]Doc{}
+	}
+	m.docs[doc.Id] = doc
+	return nil
+}
+
+func (m *Memory) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.docs, id)
+	return nil
+}
+
+// the earth as a sphere, like the arc distance of ES
+const earthRadiusKm = 6371.0
+
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// matchText tells if message has what the tokens of a q ask for: all the
+// words and phrases of one of the OR alternatives and none after a -
+func matchText(tokens []queryToken, message string) bool {
+	message = strings.ToLower(message)
+	match, groupOk := false, true
+	for _, t := range tokens {
+		if t.operator() {
+			if t.text == "OR" {
+				match = match || groupOk
+				groupOk = true
+			}
+			continue
+		}
+		if strings.Contains(message, strings.ToLower(t.text)) == t.not {
+			groupOk = false
+		}
+	}
+	return match || groupOk
+}
+
+// memoryHighlight marks the words of tokens in message, one snippet of the
+// whole message like a short one gets from ES
+func memoryHighlight(tokens []queryToken, message string) []string {
+	var words []string
+	for _, t := range tokens {
+		if !t.operator() && !t.not {
+			words = append(words, regexp.QuoteMeta(t.text))
+		}
+	}
+	if len(words) == 0 {
+		return nil
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+	return headline(re.ReplaceAllString(message, headlineStart+"$0"+headlineStop))
+}
+
+func (m *Memory) Nearby(n Nearby) (Result, error) {
+	km, err := kilometers(n.Range)
+	if err != nil {
+		return Result{}, err
+	}
+	started := time.Now()
+	tokens := parseQuery(n.Text)
+	skip := map[string]bool{}
+	for _, id := range n.Skip {
+		skip[id] = true
+	}
+
+	m.mu.RLock()
+	var hits []Doc
+	for _, d := range m.docs {
+		switch {
+		case distanceKm(n.Lat, n.Lon, d.Lat, d.Lon) > km:
+		case !n.From.IsZero() && d.CreatedAt.Before(n.From):
+		case !n.To.IsZero() && !d.CreatedAt.Before(n.To):
+		case n.Category != "" && d.Category != n.Category:
+		case n.Text != "" && !matchText(tokens, d.Message):
+		case n.Before != 0 && (d.CreatedAt.UnixNano()/int64(time.Millisecond) > n.Before || skip[d.Id]):
+		default:
+			hits = append(hits, d)
+		}
+	}
+	m.mu.RUnlock()
+
+	// newest first, the id breaks ties like it does in ES
+	sort.Slice(hits, func(i, j int) bool {
+		if !hits[i].CreatedAt.Equal(hits[j].CreatedAt) {
+			return hits[i].CreatedAt.After(hits[j].CreatedAt)
+		}
+		return hits[i].Id > hits[j].Id
+	})
+	out := Result{Total: int64(len(hits))}
+	if n.Size >= 0 && len(hits) > n.Size {
+		hits = hits[:n.Size]
+	}
+	for _, d := range hits {
+		out.Hits = append(out.Hits, d.Source)
+		if n.Text != "" {
+			out.Highlights = append(out.Highlights, memoryHighlight(tokens, d.Message))
+		}
+	}
+	out.TookMs = int64(time.Since(started) / time.Millisecond)
+	return out, nil
+}
@@ -0,0 +1,148 @@
+package search
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostGIS is an Indexer on a Postgres table with the PostGIS extension, for
+// deployments that would rather search in Postgres. It only answers Nearby,
+// the posts themselves stay in the ES of the server. DB is
+// opened by the caller with the driver it links in. Retry wraps every call,
+// nil calls once.
+type PostGIS struct {
+	DB    *sql.DB
+	Table string
+	Retry func(fn func() error) error
+}
+
+func (p *PostGIS) retry(fn func() error) error {
+	if p.Retry == nil {
+		return fn()
+	}
+	return p.Retry(fn)
+}
+
+// quoteIdent quotes a table or index name, the tenant prefix has a dash
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (p *PostGIS) Setup() error {
+	table := quoteIdent(p.Table)
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS postgis`,
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+			id text PRIMARY KEY,
+			location geography(Point, 4326) NOT NULL,
+			created_at timestamptz NOT NULL,
+			post jsonb NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(p.Table+"_location") + ` ON ` + table + ` USING GIST (location)`,
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(p.Table+"_created_at") + ` ON ` + table + ` (created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(p.Table+"_category") + ` ON ` + table + ` ((post->>'category'))`,
+		// the simple configuration, messages are in any language. It splits at
+		// spaces, Chinese and Japanese need an extension like pg_bigm.
+		`CREATE INDEX IF NOT EXISTS ` + quoteIdent(p.Table+"_message") + ` ON ` + table + ` USING GIN (to_tsvector('simple', coalesce(post->>'message', '')))`,
+	}
+	for _, stmt := range statements {
+		if err := p.retry(func() error {
+			_, err := p.DB.Exec(stmt)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PostGIS) Put(doc Doc) error {
+	return p.retry(func() error {
+		_, err := p.DB.Exec(`INSERT INTO `+quoteIdent(p.Table)+` (id, location, created_at, post)
+			VALUES ($1, ST_SetSRID(ST_MakePoint($2, $3), 4326)::geography, $4, $5)
+			ON CONFLICT (id) DO UPDATE SET location = EXCLUDED.location, created_at = EXCLUDED.created_at, post = EXCLUDED.post`,
+			doc.Id, doc.Lon, doc.Lat, doc.CreatedAt.UTC(), string(doc.Source))
+		return err
+	})
+}
+
+func (p *PostGIS) Remove(id string) error {
+	return p.retry(func() error {
+		_, err := p.DB.Exec(`DELETE FROM `+quoteIdent(p.Table)+` WHERE id = $1`, id)
+		return err
+	})
+}
+
+func (p *PostGIS) Nearby(n Nearby) (Result, error) {
+	km, err := kilometers(n.Range)
+	if err != nil {
+		return Result{}, err
+	}
+	args := []interface{}{n.Lon, n.Lat, km * 1000}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	// the snippets of the message, NULL without Text
+	highlight := "NULL"
+	where := []string{`ST_DWithin(location, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, $3)`}
+	if !n.From.IsZero() {
+		where = append(where, "created_at >= "+arg(n.From.UTC()))
+	}
+	if !n.To.IsZero() {
+		where = append(where, "created_at < "+arg(n.To.UTC()))
+	}
+	if n.Category != "" {
+		where = append(where, "post->>'category' = "+arg(n.Category))
+	}
+	if n.Text != "" {
+		tsquery := "websearch_to_tsquery('simple', " + arg(webSearchQuery(n.Text)) + ")"
+		where = append(where, "to_tsvector('simple', coalesce(post->>'message', '')) @@ "+tsquery)
+		highlight = "ts_headline('simple', coalesce(post->>'message', ''), " + tsquery + ", " + arg(headlineOptions) + ")"
+	}
+	if n.Before != 0 {
+		where = append(where, "created_at <= "+arg(time.Unix(0, n.Before*int64(time.Millisecond)).UTC()))
+		if len(n.Skip) > 0 {
+			var ids []string
+			for _, id := range n.Skip {
+				ids = append(ids, arg(id))
+			}
+			where = append(where, "id NOT IN ("+strings.Join(ids, ", ")+")")
+		}
+	}
+	// the total is counted before the limit, like the hits total of ES
+	query := `SELECT post, ` + highlight + `, count(*) OVER () FROM ` + quoteIdent(p.Table) +
+		` WHERE ` + strings.Join(where, " AND ") +
+		` ORDER BY created_at DESC LIMIT ` + arg(n.Size)
+
+	var out Result
+	started := time.Now()
+	err = p.retry(func() error {
+		// a retry starts over
+		out = Result{}
+		rows, err := p.DB.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var post []byte
+			var snippets sql.NullString
+			if err := rows.Scan(&post, &snippets, &out.Total); err != nil {
+				return err
+			}
+			out.Hits = append(out.Hits, post)
+			if n.Text != "" {
+				out.Highlights = append(out.Highlights, headline(snippets.String))
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	out.TookMs = int64(time.Since(started) / time.Millisecond)
+	return out, nil
+}
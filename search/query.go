@@ -0,0 +1,119 @@
+package search
+
+import (
+	"strings"
+)
+
+// the operators of simple_query_string that the translation uses, prefix,
+// fuzzy and the others stay off so a stray * or ~ is just text
+const SIMPLE_QUERY_FLAGS = "AND|OR|NOT|PHRASE|PRECEDENCE|WHITESPACE"
+
+// a word, "phrase", OR or AND of a q, not is the - in front
+type queryToken struct {
+	text   string
+	phrase bool
+	not    bool
+}
+
+// parseQuery splits the q of a search: words that all have to be in the
+// message, "quoted phrases", -word or -"phrase" for what must not be in it,
+// and OR between alternatives. AND is what words do anyway and is accepted
+// too. An unclosed quote runs to the end.
+func parseQuery(q string) []queryToken {
+	var out []queryToken
+	for rest := strings.TrimSpace(q); rest != ""; rest = strings.TrimSpace(rest) {
+		not := false
+		if len(rest) > 1 && rest[0] == '-' && rest[1] != ' ' {
+			not, rest = true, rest[1:]
+		}
+		if rest[0] == '"' {
+			phrase := rest[1:]
+			if end := strings.IndexByte(phrase, '"'); end >= 0 {
+				phrase, rest = phrase[:end], phrase[end+1:]
+			} else {
+				rest = ""
+			}
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				out = append(out, queryToken{text: phrase, phrase: true, not: not})
+			}
+			continue
+		}
+		word := rest
+		if i := strings.IndexAny(rest, " \t\n\""); i >= 0 {
+			word, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		if word != "" {
+			out = append(out, queryToken{text: word, not: not})
+		}
+	}
+	return out
+}
+
+func (t queryToken) operator() bool {
+	return !t.phrase && !t.not && (t.text == "OR" || t.text == "AND")
+}
+
+// SimpleQuery translates the q of a search to simple_query_string syntax, see
+// parseQuery for what q may have
+//
+//	pizza "deep dish" OR calzone -pineapple
+//	=> pizza "deep dish" | calzone -pineapple
+func SimpleQuery(q string) string {
+	var out []string
+	for _, t := range parseQuery(q) {
+		switch {
+		case t.operator() && t.text == "OR":
+			out = append(out, "|")
+		case t.operator():
+			out = append(out, "+")
+		default:
+			s := escapeQuery(t.text)
+			if t.phrase {
+				s = `"` + s + `"`
+			}
+			if t.not {
+				s = "-" + s
+			}
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// webSearchQuery is q for websearch_to_tsquery of Postgres, which reads the
+// same syntax except that AND would be a word
+func webSearchQuery(q string) string {
+	var out []string
+	for _, t := range parseQuery(q) {
+		switch {
+		case t.operator() && t.text == "OR":
+			out = append(out, "or")
+		case t.operator():
+		default:
+			// quotes inside would end the phrase
+			s := strings.Replace(t.text, `"`, " ", -1)
+			if t.phrase {
+				s = `"` + s + `"`
+			}
+			if t.not {
+				s = "-" + s
+			}
+			out = append(out, s)
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// escapeQuery makes the operators of simple_query_string plain text
+func escapeQuery(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`+-|"*()~\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
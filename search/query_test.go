@@ -0,0 +1,63 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []queryToken
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"pizza", []queryToken{{text: "pizza"}}},
+		{`pizza "deep dish" OR calzone -pineapple`, []queryToken{
+			{text: "pizza"},
+			{text: "deep dish", phrase: true},
+			{text: "OR"},
+			{text: "calzone"},
+			{text: "pineapple", not: true},
+		}},
+		{`-"deep dish"`, []queryToken{{text: "deep dish", phrase: true, not: true}}},
+		// an unclosed quote runs to the end
+		{`"deep dish`, []queryToken{{text: "deep dish", phrase: true}}},
+		{`""`, nil},
+		{`" "`, nil},
+		// a - on its own is a word
+		{"- pizza", []queryToken{{text: "-"}, {text: "pizza"}}},
+		{`pizza"deep dish"`, []queryToken{{text: "pizza"}, {text: "deep dish", phrase: true}}},
+		{"pizza\tcalzone\n", []queryToken{{text: "pizza"}, {text: "calzone"}}},
+	}
+	for _, tt := range tests {
+		if got := parseQuery(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSimpleQuery(t *testing.T) {
+	tests := []struct {
+		q, want string
+	}{
+		{"", ""},
+		{"pizza", "pizza"},
+		{`pizza "deep dish" OR calzone -pineapple`, `pizza "deep dish" | calzone -pineapple`},
+		{"pizza AND calzone", "pizza + calzone"},
+		// operators only count on their own
+		{"-OR", "-OR"},
+		{`"OR"`, `"OR"`},
+		{"or", "or"},
+		// the rest of the syntax is text
+		{"c++ (x)", `c\+\+ \(x\)`},
+		{"pizza* ~2", `pizza\* \~2`},
+		{`a|b`, `a\|b`},
+		{`"deep \ dish`, `"deep \\ dish"`},
+	}
+	for _, tt := range tests {
+		if got := SimpleQuery(tt.q); got != tt.want {
+			t.Errorf("SimpleQuery(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
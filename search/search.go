@@ -0,0 +1,216 @@
+// Package search finds posts around a place. The server keeps them in
+// Elasticsearch, the hits are the stored JSON and decoded by the caller.
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// Nearby is a geo search, newest first
+type Nearby struct {
+	Lat, Lon float64
+	// with unit, e.g. "200km"
+	Range string
+	// only posts of this category, "" for all
+	Category string
+	// only posts whose message matches, see parseQuery. "" for all.
+	Text string
+	// a time window of created_at, zero ends are open. To is exclusive.
+	From, To time.Time
+	Size     int
+	// where a page starts: posts created at or before Before (unix
+	// milliseconds), except the ids in Skip that the previous page had. 0 for
+	// the first page.
+	Before int64
+	Skip   []string
+	// ask the backend how it ran the query, Result.Profile has the answer.
+	// Only Elasticsearch profiles, the others leave it empty.
+	Profile bool
+}
+
+// Result is a page of hits and how many match in all
+type Result struct {
+	Hits []json.RawMessage
+	// the snippets of the message of each hit, for a search with Text. In
+	// the order of Hits, see esHighlight.
+	Highlights [][]string
+	Total      int64
+	TookMs     int64
+	// the "profile" of the ES response for a Nearby with Profile
+	Profile json.RawMessage
+}
+
+// Backend runs searches
+type Backend interface {
+	Nearby(q Nearby) (Result, error)
+}
+
+// Indexer is a Backend with its own copy of the posts, the server tells it
+// about every post that is saved, changed or deleted. Elasticsearch searches
+// the posts where the server stores them and is no Indexer.
+type Indexer interface {
+	Backend
+	// Setup creates the index or table when it is missing
+	Setup() error
+	// Put adds doc or replaces the one with its id
+	Put(doc Doc) error
+	// Remove takes the post id out, one that isn't there is no error
+	Remove(id string) error
+}
+
+// Doc is a post as an Indexer keeps it. Deleted posts are removed, not indexed.
+type Doc struct {
+	Id        string
+	Lat, Lon  float64
+	CreatedAt time.Time
+	Category  string
+	Message   string
+	// the post, what a hit returns
+	Source json.RawMessage
+}
+
+// kilometers parses the range of a Nearby, the server always sends km
+func kilometers(r string) (float64, error) {
+	if !strings.HasSuffix(r, "km") {
+		return 0, fmt.Errorf("range %q is not in km", r)
+	}
+	return strconv.ParseFloat(strings.TrimSuffix(r, "km"), 64)
+}
+
+// Elasticsearch is a Backend on an index or alias of posts with a geo_point
+// location and a created_at date. Client returns the client to use, the
+// server shares one. Retry wraps every call, the server passes one with its
+// circuit breaker, nil calls once.
+type Elasticsearch struct {
+	Client func() (*elastic.Client, error)
+	Index  string
+	Type   string
+	Retry  func(fn func() error) error
+}
+
+func (e *Elasticsearch) retry(fn func() error) error {
+	if e.Retry == nil {
+		return fn()
+	}
+	return e.Retry(fn)
+}
+
+func (e *Elasticsearch) Nearby(n Nearby) (Result, error) {
+	client, err := e.Client()
+	if err != nil {
+		return Result{}, err
+	}
+
+	// location: name of query
+	// Define geo distance query as specified in
+	// https://www.elastic.co/guide/en/elasticsearch/reference/5.2/query-dsl-geo-distance-query.html
+	geo := elastic.NewGeoDistanceQuery("location")
+	geo = geo.Distance(n.Range).Lat(n.Lat).Lon(n.Lon)
+	// soft deleted posts have deleted_at, scheduled ones publish_at
+	q := elastic.NewBoolQuery().Filter(geo).MustNot(elastic.NewExistsQuery("deleted_at"), elastic.NewExistsQuery("publish_at"))
+	if !n.From.IsZero() || !n.To.IsZero() {
+		created := elastic.NewRangeQuery("created_at")
+		if !n.From.IsZero() {
+			created = created.Gte(n.From.UTC())
+		}
+		if !n.To.IsZero() {
+			created = created.Lt(n.To.UTC())
+		}
+		q = q.Filter(created)
+	}
+	if n.Category != "" {
+		q = q.Filter(elastic.NewTermQuery("category", n.Category))
+	}
+	fields := textFields(n.Text)
+	if n.Text != "" {
+		text := elastic.NewSimpleQueryStringQuery(SimpleQuery(n.Text)).
+			DefaultOperator("and").
+			Flags(SIMPLE_QUERY_FLAGS)
+		for _, f := range fields {
+			text = text.Field(f)
+		}
+		q = q.Must(text)
+	}
+	if n.Before != 0 {
+		q = q.Filter(elastic.NewRangeQuery("created_at").Lte(n.Before).Format("epoch_millis"))
+		if len(n.Skip) > 0 {
+			q = q.MustNot(elastic.NewIdsQuery(e.Type).Ids(n.Skip...))
+		}
+	}
+
+	src := elastic.NewSearchSource().
+		Query(q).
+		Sort("created_at", false).
+		Size(n.Size)
+	if n.Text != "" {
+		src = src.Highlight(esHighlight(fields[0]))
+	}
+
+	var res *elastic.SearchResult
+	var profile json.RawMessage
+	err = e.retry(func() error {
+		var err error
+		if n.Profile {
+			res, profile, err = e.profiled(client, src)
+			return err
+		}
+		res, err = client.Search().
+			Index(e.Index).
+			Type(e.Type).
+			SearchSource(src).
+			Do()
+		return err
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	out := Result{Total: res.TotalHits(), TookMs: res.TookInMillis, Profile: profile}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source != nil {
+			out.Hits = append(out.Hits, *hit.Source)
+			if n.Text != "" {
+				out.Highlights = append(out.Highlights, hit.Highlight[fields[0]])
+			}
+		}
+	}
+	return out, nil
+}
+
+// profiled runs the search of src with "profile": true, the ES 2.2 profile
+// API. The client of ES 2 has no option for it, so the body goes by hand.
+func (e *Elasticsearch) profiled(client *elastic.Client, src *elastic.SearchSource) (*elastic.SearchResult, json.RawMessage, error) {
+	source, err := src.Source()
+	if err != nil {
+		return nil, nil, err
+	}
+	js, err := json.Marshal(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(js, &body); err != nil {
+		return nil, nil, err
+	}
+	body["profile"] = true
+	resp, err := client.PerformRequest("POST", "/"+e.Index+"/"+e.Type+"/_search", nil, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var res elastic.SearchResult
+	if err := json.Unmarshal(resp.Body, &res); err != nil {
+		return nil, nil, err
+	}
+	var profile struct {
+		Profile json.RawMessage `json:"profile"`
+	}
+	if err := json.Unmarshal(resp.Body, &profile); err != nil {
+		return nil, nil, err
+	}
+	return &res, profile.Profile, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const SEED_PASSWORD = "demo"
+
+// the size of the generated sample images
+const (
+	SEED_IMAGE_WIDTH  = 640
+	SEED_IMAGE_HEIGHT = 480
+)
+
+var seedMessages = []string{
+	"Coffee with a view",
+	"Sunset from the pier",
+	"Found this little place today",
+	"Street art on the way home",
+	"Best tacos in town",
+	"Morning run",
+	"Farmers market haul",
+	"Rainy day vibes",
+	"Live music in the park tonight",
+	"This bakery opens at 6, worth it",
+	"Finally tried the ramen place everyone talks about",
+	"Quiet corner to read",
+	"Dog friendly patio!",
+	"Look at this skyline",
+	"Traffic is terrible here right now",
+	"Hidden staircase with the best view",
+	"Night market is back",
+	"Cherry blossoms already out",
+}
+
+// seedNames make the demo users, demo_ plus a name, with a number once the
+// names run out
+var seedNames = []string{
+	"alice", "bob", "carmen", "daniel", "emma", "felix", "grace", "hiro",
+	"ines", "jamal", "kim", "leo", "maria", "noah", "olga", "priya",
+	"quinn", "rafael", "sofia", "tom", "uma", "victor", "wei", "yara",
+}
+
+// SEED_CITIES are the places -cities can name, posts cluster around hot
+// spots in them like they do around downtowns and parks
+var SEED_CITIES = map[string]Location{
+	"sf":      {Lat: 37.7749, Lon: -122.4194},
+	"la":      {Lat: 34.0522, Lon: -118.2437},
+	"seattle": {Lat: 47.6062, Lon: -122.3321},
+	"nyc":     {Lat: 40.7128, Lon: -74.0060},
+	"london":  {Lat: 51.5074, Lon: -0.1278},
+	"paris":   {Lat: 48.8566, Lon: 2.3522},
+	"berlin":  {Lat: 52.5200, Lon: 13.4050},
+	"tokyo":   {Lat: 35.6762, Lon: 139.6503},
+	"beijing": {Lat: 39.9042, Lon: 116.4074},
+	"sydney":  {Lat: -33.8688, Lon: 151.2093},
+}
+
+// parseSeedCities reads -cities: names of SEED_CITIES or lat:lon pairs
+func parseSeedCities(v string) ([]Location, error) {
+	var out []Location
+	for _, c := range splitList(v) {
+		if loc, ok := SEED_CITIES[strings.ToLower(c)]; ok {
+			out = append(out, loc)
+			continue
+		}
+		parts := strings.Split(c, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("-cities: unknown city %q, use lat:lon or one of %s", c, strings.Join(seedCityNames(), ", "))
+		}
+		lat, err1 := strconv.ParseFloat(parts[0], 64)
+		lon, err2 := strconv.ParseFloat(parts[1], 64)
+		if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("-cities: %q is no lat:lon", c)
+		}
+		out = append(out, Location{Lat: lat, Lon: lon})
+	}
+	return out, nil
+}
+
+func seedCityNames() []string {
+	var names []string
+	for name := range SEED_CITIES {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seedOffset is loc moved by north and east km
+func seedOffset(loc Location, north, east float64) Location {
+	return Location{
+		Lat: loc.Lat + north/111.0,
+		Lon: loc.Lon + east/111.0/math.Max(math.Cos(loc.Lat*math.Pi/180), 0.01),
+	}
+}
+
+// seedArea is a city of the seed with its hot spots
+type seedArea struct {
+	center Location
+	spots  []Location
+}
+
+// seedLocation picks where a post is: most are near a hot spot of a random
+// area, a normal distribution with radius/10 km deviation, the rest anywhere
+// within radius of the center
+func seedLocation(rnd *rand.Rand, areas []seedArea, radius float64) Location {
+	a := areas[rnd.Intn(len(areas))]
+	if len(a.spots) == 0 || rnd.Float64() < 0.2 {
+		// uniform over the disc, sqrt keeps the center from getting crowded
+		d := radius * math.Sqrt(rnd.Float64())
+		angle := rnd.Float64() * 2 * math.Pi
+		return seedOffset(a.center, d*math.Sin(angle), d*math.Cos(angle))
+	}
+	spot := a.spots[rnd.Intn(len(a.spots))]
+	return seedOffset(spot, rnd.NormFloat64()*radius/10, rnd.NormFloat64()*radius/10)
+}
+
+// seedImage draws a sample jpeg: a sky to ground gradient in random colors
+// with a sun, something that looks like a photo in a list of thumbnails
+func seedImage(rnd *rand.Rand) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, SEED_IMAGE_WIDTH, SEED_IMAGE_HEIGHT))
+	sky := color.RGBA{uint8(rnd.Intn(128)), uint8(64 + rnd.Intn(128)), uint8(128 + rnd.Intn(128)), 255}
+	ground := color.RGBA{uint8(rnd.Intn(160)), uint8(64 + rnd.Intn(160)), uint8(rnd.Intn(96)), 255}
+	horizon := SEED_IMAGE_HEIGHT/2 + rnd.Intn(SEED_IMAGE_HEIGHT/4)
+	sunX, sunY := rnd.Intn(SEED_IMAGE_WIDTH), rnd.Intn(horizon)
+	sunR := 20 + rnd.Intn(40)
+	for y := 0; y < SEED_IMAGE_HEIGHT; y++ {
+		for x := 0; x < SEED_IMAGE_WIDTH; x++ {
+			c := ground
+			if y < horizon {
+				// lighter towards the horizon
+				f := float64(y) / float64(horizon)
+				c = color.RGBA{
+					uint8(float64(sky.R) + (255-float64(sky.R))*f*0.6),
+					uint8(float64(sky.G) + (255-float64(sky.G))*f*0.6),
+					uint8(float64(sky.B) + (255-float64(sky.B))*f*0.6),
+					255,
+				}
+				if dx, dy := x-sunX, y-sunY; dx*dx+dy*dy < sunR*sunR {
+					c = color.RGBA{255, 230, 140, 255}
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runSeed implements `around seed`: signs up -users demo accounts (password
+// SEED_PASSWORD, existing ones are reused) and gives them -posts posts
+// clustered around hot spots within -radius km of -cities, created over the
+// last -days days. -images of them get a generated jpeg in GCS, all of them
+// go to ES, the search backend and Bigtable, for demos and for load testing
+// the search.
+//
+//	around seed -posts 50000 -cities sf,nyc,tokyo -url https://around.example.com
+func (srv *Server) runSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	users := fs.Int("users", 5, "demo users to create, named demo_alice, demo_bob, ...")
+	posts := fs.Int("posts", 100, "posts to create")
+	lat := fs.Float64("lat", 37.7749, "latitude the posts are spread around without -cities")
+	lon := fs.Float64("lon", -122.4194, "longitude the posts are spread around without -cities")
+	cities := fs.String("cities", "", "comma separated cities ("+strings.Join(seedCityNames(), ", ")+") or lat:lon pairs to spread the posts over")
+	clusters := fs.Int("clusters", 5, "hot spots per city most posts are close to, 0 spreads them evenly")
+	radius := fs.Float64("radius", 10, "km from each city")
+	days := fs.Int("days", 30, "posts are spread over this many days back")
+	images := fs.Float64("images", 0.5, "share of the posts with a sample image, the rest are text")
+	base := fs.String("url", "http://localhost"+srv.Config.ListenAddr, "where the server is reached, for the media links of the posts")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed, the same seed gives the same posts")
+	fs.Parse(args)
+
+	if *users < 1 || *posts < 0 || *radius <= 0 || *days < 1 || *clusters < 0 {
+		return fmt.Errorf("-users, -radius and -days should be positive")
+	}
+	if *images < 0 || *images > 1 {
+		return fmt.Errorf("-images should be between 0 and 1")
+	}
+	if srv.without("gcs") {
+		*images = 0
+	}
+	centers := []Location{{Lat: *lat, Lon: *lon}}
+	if *cities != "" {
+		var err error
+		if centers, err = parseSeedCities(*cities); err != nil {
+			return err
+		}
+	}
+	mediaBase, err := url.Parse(*base)
+	if err != nil || mediaBase.Host == "" {
+		return fmt.Errorf("-url %q should be like https://host", *base)
+	}
+	rnd := rand.New(rand.NewSource(*seed))
+
+	var areas []seedArea
+	for _, c := range centers {
+		a := seedArea{center: c}
+		for i := 0; i < *clusters; i++ {
+			d := *radius * 0.7 * math.Sqrt(rnd.Float64())
+			angle := rnd.Float64() * 2 * math.Pi
+			a.spots = append(a.spots, seedOffset(c, d*math.Sin(angle), d*math.Cos(angle)))
+		}
+		areas = append(areas, a)
+	}
+
+	names := make([]string, *users)
+	for i := range names {
+		name := seedNames[i%len(seedNames)]
+		names[i] = "demo_" + name
+		if i >= len(seedNames) {
+			names[i] += strconv.Itoa(i / len(seedNames))
+		}
+		if _, ok := srv.getUser(names[i]); ok {
+			continue
+		}
+		u := User{Username: names[i], Password: SEED_PASSWORD, DisplayName: strings.ToUpper(name[:1]) + name[1:], Bio: "Demo account"}
+		if !srv.addUser(u) {
+			return fmt.Errorf("cannot create user %s", names[i])
+		}
+		srv.Log.Printf("Created user %s\n", names[i])
+	}
+
+	// a few images go round, each post has its own copy in GCS
+	var samples [][]byte
+	for i := 0; i < 8 && *images > 0; i++ {
+		js, err := seedImage(rnd)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, js)
+	}
+
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	// so running servers don't keep serving cached searches without the new posts
+	srv.initSearchCache()
+	if err := srv.setupSearch(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	categories := categoryIds()
+	now := time.Now().UTC()
+	cells := map[string]Location{}
+	bulk := client.Bulk()
+	// the posts in bulk, for the search backend and Bigtable
+	var batch []Post
+	flush := func() error {
+		if err := bulkDo(bulk); err != nil {
+			return err
+		}
+		var keys []string
+		var muts []*bigtable.Mutation
+		for _, p := range batch {
+			srv.syncSearch(p)
+			keys = append(keys, p.Id)
+			muts = append(muts, postMutation(p))
+		}
+		rowErrs, err := srv.Tables.ApplyBulk(ctx, srv.Names.PostTable, keys, muts)
+		if err != nil {
+			// the posts are in ES, `around reindex` copies them again
+			srv.Log.Printf("Failed to write %d posts to Bigtable %v\n", len(keys), err)
+		}
+		for i, e := range rowErrs {
+			if e != nil {
+				srv.Log.Printf("Failed to write post %s to Bigtable %v\n", keys[i], e)
+			}
+		}
+		bulk, batch = client.Bulk(), nil
+		return nil
+	}
+	withImages := 0
+	for i := 0; i < *posts; i++ {
+		loc := seedLocation(rnd, areas, *radius)
+		created := now.Add(-time.Duration(rnd.Int63n(int64(*days) * int64(24*time.Hour))))
+		p := Post{
+			Id:        newPostID(created),
+			User:      names[rnd.Intn(len(names))],
+			Message:   seedMessages[rnd.Intn(len(seedMessages))],
+			Type:      "text",
+			Location:  loc,
+			CreatedAt: created,
+		}
+		// some posts go without a category, like real ones
+		if rnd.Float64() < 0.7 {
+			p.Category = categories[rnd.Intn(len(categories))]
+		}
+		if rnd.Float64() < *images {
+			img := samples[rnd.Intn(len(samples))]
+			if _, err := srv.Media.Put(ctx, srv.Names.MediaPrefix+p.Id, bytes.NewReader(img)); err != nil {
+				return err
+			}
+			u := *mediaBase
+			u.Path = strings.TrimSuffix(u.Path, "/") + API_V1 + "/media/" + p.Id
+			p.Type, p.Url = "image", u.String()
+			withImages++
+		}
+		bulk.Add(elastic.NewBulkIndexRequest().Index(srv.Names.PostWriteAlias).Type(TYPE).Id(p.Id).Doc(p))
+		batch = append(batch, p)
+		cells[cellKey(cellIndex(loc.Lat), wrapLonCell(cellIndex(loc.Lon)))] = loc
+
+		if bulk.NumberOfActions() >= IMPORT_BATCH_SIZE {
+			if err := flush(); err != nil {
+				return err
+			}
+			srv.Log.Printf("Seeded %d posts\n", i+1)
+		}
+	}
+	if bulk.NumberOfActions() > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, loc := range cells {
+		srv.invalidateSearchCache(loc.Lat, loc.Lon)
+	}
+	srv.Log.Printf("Seeded %d posts, %d with images, for %d users around %d places\n", *posts, withImages, *users, len(areas))
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/storage"
+	"github.com/TianyiSun2333/Around/auth"
+	"github.com/TianyiSun2333/Around/bigtablestore"
+	"github.com/TianyiSun2333/Around/blobstore"
+	"github.com/TianyiSun2333/Around/moderation"
+	"github.com/TianyiSun2333/Around/search"
+	"github.com/go-redis/redis"
+	"golang.org/x/crypto/acme/autocert"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// uploads go through the same server, so reads get more room than a plain API
+	SERVER_READ_TIMEOUT  = 60 * time.Second
+	SERVER_WRITE_TIMEOUT = 60 * time.Second
+	SERVER_IDLE_TIMEOUT  = 120 * time.Second
+	// how long in-flight posts get to finish after SIGTERM
+	SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
+// Server is what the handlers and commands of one tenant share: the config,
+// the logger, the clients of ES, GCS and Bigtable, the keys that sign tokens
+// and what is cached of the tenant's data. The clients are made on first use
+// and then kept, they are safe for concurrent use.
+type Server struct {
+	// the config of the tenant, see Config.forTenant
+	Config *Config
+	Log    *log.Logger
+	// "" for the app from before tenants, and the names its data is stored
+	// under, see tenant.go
+	Tenant string
+	Names  tenantNames
+	// the config of the deployment, the servers of other tenants start from it
+	deployment *Config
+	// nil when redis is not reachable, then every search goes to ES
+	Redis *redis.Client
+
+	// the backends behind the interfaces of their packages, see wireBackends. A
+	// test or another binary can put its own in. Archive is the bucket of
+	// archiveOldPosts.
+	Media      blobstore.Store
+	Archive    blobstore.Store
+	Tables     bigtablestore.Store
+	Classifier moderation.Classifier
+	Search     search.Backend
+	Tokens     *auth.Tokens
+
+	// who muted and follows whom, for the searches
+	mutedCache     *userSets
+	followingCache *userSets
+	// what else this instance keeps of the tenant's data, see the types
+	userLookupCache *userCache
+	privateCache    privateUsers
+	webhookCache    enabledWebhooks
+	geofenceCache   geofenceSet
+	adminStatsCache adminStatsSet
+	liveFeed        *feedHub
+	counters        pendingCounters
+	exposures       pendingExposures
+	workerRuns      localWorkerRuns
+	// what it counts when redis is not setup
+	rateLocal         localRates
+	usageLocal        localUsage
+	presenceLocal     localPresences
+	postCooldownLocal localCooldowns
+	localIdempotency  localIdempotencyEntries
+	viewLocal         localViews
+
+	// guards the clients below
+	mu        sync.Mutex
+	esClient  *elastic.Client
+	gcsClient *storage.Client
+	btClient  *bigtable.Client
+}
+
+// stdoutLog is for what logs outside of a server, like the servers' own
+// loggers it writes to stdout
+var stdoutLog = log.New(os.Stdout, "", 0)
+
+// NewServer makes the server of c.Tenant. Nothing is dialed yet, the clients
+// are made when a handler first needs them.
+func NewServer(c *Config) *Server {
+	tc := c.forTenant(c.Tenant)
+	srv := &Server{
+		Config:     tc,
+		Log:        log.New(os.Stdout, "", 0),
+		Tenant:     tc.Tenant,
+		Names:      namesOf(tc.Tenant),
+		deployment: c,
+		Tokens:     &auth.Tokens{Key: []byte(tc.TokenKey), Tenant: tc.Tenant},
+	}
+	srv.mutedCache = newUserSets(srv.loadMuted)
+	srv.followingCache = newUserSets(srv.loadFollowing)
+	srv.userLookupCache = newUserCache(USER_CACHE_SIZE, USER_CACHE_TTL)
+	srv.liveFeed = &feedHub{subs: map[*feedSubscriber]struct{}{}}
+	srv.counters.counts = map[string]*postCounts{}
+	srv.presenceLocal.users = map[string]localPresence{}
+	srv.localIdempotency.entries = map[string]idempotencyEntry{}
+	return srv
+}
+
+// es returns the ES client, a failed attempt is not kept so the next call tries again
+func (srv *Server) es() (*elastic.Client, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.esClient == nil {
+		// the nodes of the config, see esconn.go
+		client, err := srv.newESClient()
+		if err != nil {
+			return nil, err
+		}
+		srv.esClient = client
+	}
+	return srv.esClient, nil
+}
+
+// gcs returns the GCS client. ctx is only for making it, the client outlives
+// the request that made it.
+func (srv *Server) gcs(ctx context.Context) (*storage.Client, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.gcsClient == nil {
+		// the emulator of gcs_endpoint when there is one, see emulator.go
+		client, err := srv.newGCSClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		srv.gcsClient = client
+	}
+	return srv.gcsClient, nil
+}
+
+// bigtable returns the client of the instance of the config
+func (srv *Server) bigtable(ctx context.Context) (*bigtable.Client, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.btClient == nil {
+		client, err := srv.newBigtableClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		srv.btClient = client
+	}
+	return srv.btClient, nil
+}
+
+// Close closes the clients that were made, the server is not used afterwards
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.gcsClient != nil {
+		srv.gcsClient.Close()
+	}
+	if srv.btClient != nil {
+		srv.btClient.Close()
+	}
+	if srv.esClient != nil {
+		srv.esClient.Stop()
+	}
+}
+
+// serve runs the http server until SIGTERM/SIGINT, then stops accepting new
+// connections and waits for in-flight requests before returning. It serves
+// https itself when the config has a certificate or autocert domains.
+func (srv *Server) serve(addr string, handler http.Handler) error {
+	hs := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  SERVER_READ_TIMEOUT,
+		WriteTimeout: SERVER_WRITE_TIMEOUT,
+		IdleTimeout:  SERVER_IDLE_TIMEOUT,
+	}
+
+	// ListenAndServe blocks, run it in its own go routine so we can wait for signals
+	errc := make(chan error, 2)
+	// the port 80 server of autocert, nil otherwise
+	var challenge *http.Server
+	switch {
+	case srv.Config.TLSCert != "":
+		hs.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		go func() {
+			srv.Log.Printf("Listening on %s with TLS from %s\n", addr, srv.Config.TLSCert)
+			errc <- hs.ListenAndServeTLS(srv.Config.TLSCert, srv.Config.TLSKey)
+		}()
+
+	case len(srv.Config.AutocertDomains) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(srv.Config.AutocertDomains...),
+			Cache:      autocert.DirCache(srv.Config.AutocertCache),
+		}
+		hs.TLSConfig = m.TLSConfig()
+		hs.TLSConfig.MinVersion = tls.VersionTLS12
+		challenge = &http.Server{
+			Addr: srv.Config.AutocertHTTPAddr,
+			// nil redirects everything that is not a challenge to https
+			Handler:      m.HTTPHandler(nil),
+			ReadTimeout:  SERVER_READ_TIMEOUT,
+			WriteTimeout: SERVER_WRITE_TIMEOUT,
+		}
+		go func() {
+			srv.Log.Printf("Listening on %s for ACME challenges\n", srv.Config.AutocertHTTPAddr)
+			errc <- challenge.ListenAndServe()
+		}()
+		go func() {
+			srv.Log.Printf("Listening on %s with TLS for %v\n", addr, srv.Config.AutocertDomains)
+			// the certificates come from TLSConfig.GetCertificate
+			errc <- hs.ListenAndServeTLS("", "")
+		}()
+
+	default:
+		go func() {
+			srv.Log.Printf("Listening on %s\n", addr)
+			errc <- hs.ListenAndServe()
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errc:
+		// failed to start, e.g. port already in use
+		return err
+	case sig := <-stop:
+		srv.Log.Printf("Received %v, shutting down\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if challenge != nil {
+		challenge.Shutdown(ctx)
+	}
+	// Shutdown returns once all handlers are done or ctx expires
+	if err := hs.Shutdown(ctx); err != nil {
+		return err
+	}
+	// the views and impressions counted since the last flush
+	srv.flushCounters()
+	srv.Log.Println("Server stopped")
+	return nil
+}
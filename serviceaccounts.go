@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// service accounts live next to the users in the legacy index
+	TYPE_SERVICE_ACCOUNT = "service_account"
+	TOKEN_KIND_SERVICE   = "service"
+	// a disabled service account keeps working until its tokens expire
+	SERVICE_TOKEN_TTL          = time.Hour
+	SERVICE_ACCOUNT_MAX_NAME   = 100
+	SERVICE_ACCOUNT_MAX_SCOPES = 50
+)
+
+// ServiceAccount is a bot or integration, e.g. one that posts city events. It
+// exchanges its client id and secret for a token that acts as Account, the
+// user its posts appear under, and may only call the operations in Scopes.
+// Admins create them, Account is marked as a bot on its profile.
+type ServiceAccount struct {
+	// also the client id
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Account string   `json:"account"`
+	Scopes  []string `json:"scopes"`
+	// hex SHA-256 of the secret, the secret itself is only shown when created
+	SecretHash string    `json:"secret_hash,omitempty"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	Disabled   bool      `json:"disabled"`
+}
+
+// body of POST /admin/service-accounts
+type serviceAccountRequest struct {
+	Name    string   `json:"name"`
+	Account string   `json:"account"`
+	Scopes  []string `json:"scopes"`
+}
+
+// public is s without its secret
+func (s ServiceAccount) public() ServiceAccount {
+	s.SecretHash = ""
+	s.Secret = ""
+	return s
+}
+
+func hashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newClientSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "sasec_" + hex.EncodeToString(b)
+}
+
+// serviceScopes are the operations a service account can be given, every one
+// of apiSpec except the admin ones
+func serviceScopes() []string {
+	var ops []string
+	for path, methods := range apiSpec.Paths {
+		if strings.HasPrefix(path, "/admin/") {
+			continue
+		}
+		for _, op := range methods {
+			ops = append(ops, op.OperationID)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+func (srv *Server) saveServiceAccount(s ServiceAccount) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	return esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_SERVICE_ACCOUNT).
+			Id(s.Id).
+			BodyJson(s).
+			Refresh(true).
+			Do()
+		return err
+	})
+}
+
+// getServiceAccount reads one service account, nil if there is none with that id
+func (srv *Server) getServiceAccount(id string) (*ServiceAccount, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_SERVICE_ACCOUNT).Id(id).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) || (err == nil && (!res.Found || res.Source == nil)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s ServiceAccount
+	if err := json.Unmarshal(*res.Source, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// handlerCreateServiceAccount registers a service account, admins only. The
+// secret is in the response and never again.
+//
+//	POST /admin/service-accounts {"name":"City events","account":"city_events","scopes":["createPost"]}
+func (srv *Server) handlerCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	var req serviceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode service account")
+		return
+	}
+	// lengths and the username pattern are checked by validateRequest already
+	var errs []fieldError
+	if _, ok := srv.getUser(req.Account); !ok {
+		errs = append(errs, fieldError{Name: "account", In: "body", Message: "is not a user"})
+	} else if srv.isAdmin(req.Account) {
+		errs = append(errs, fieldError{Name: "account", In: "body", Message: "is an admin, bots post as an account of their own"})
+	}
+	allowed := serviceScopes()
+	for i, s := range req.Scopes {
+		if !contains(allowed, s) {
+			errs = append(errs, fieldError{Name: "scopes[" + strconv.Itoa(i) + "]", In: "body", Message: "is not an operation of the API"})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+
+	secret := newClientSecret()
+	s := ServiceAccount{
+		Id:         newPostID(time.Now()),
+		Name:       req.Name,
+		Account:    req.Account,
+		Scopes:     req.Scopes,
+		SecretHash: hashClientSecret(secret),
+		CreatedBy:  admin,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := srv.saveServiceAccount(s); err != nil {
+		writeBackendError(w, r, "Failed to save service account", err)
+		return
+	}
+	if err := srv.updateUserFields(req.Account, map[string]interface{}{"bot": true}); err != nil {
+		srv.Log.Printf("Failed to mark %s as a bot %v\n", req.Account, err)
+	}
+	srv.Log.Printf("Service account %s for %s created by %s\n", s.Id, s.Account, admin)
+
+	s = s.public()
+	s.Secret = secret
+	js, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handlerListServiceAccounts returns every service account without secrets
+func (srv *Server) handlerListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_SERVICE_ACCOUNT).
+			Sort("created_at", false).
+			Size(1000).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to read service accounts", err)
+		return
+	}
+	accounts := []ServiceAccount{}
+	for _, hit := range res.Hits.Hits {
+		var s ServiceAccount
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &s) != nil {
+			continue
+		}
+		accounts = append(accounts, s.public())
+	}
+	js, _ := json.Marshal(accounts)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerDisableServiceAccount stops a service account from getting tokens,
+// the ones it has run out within SERVICE_TOKEN_TTL
+func (srv *Server) handlerDisableServiceAccount(w http.ResponseWriter, r *http.Request) {
+	s, err := srv.getServiceAccount(mux.Vars(r)["id"])
+	if err != nil {
+		writeBackendError(w, r, "Failed to read service account", err)
+		return
+	}
+	if s == nil {
+		writeError(w, r, http.StatusNotFound, "Service account not found")
+		return
+	}
+	s.Disabled = true
+	if err := srv.saveServiceAccount(*s); err != nil {
+		writeBackendError(w, r, "Failed to save service account", err)
+		return
+	}
+	srv.Log.Printf("Service account %s disabled by %s\n", s.Id, usernameFromToken(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerServiceToken is the OAuth 2 client credentials grant: a service
+// account trades its id and secret, as form fields or HTTP basic auth, for a
+// token. Errors are the usual error bodies.
+//
+//	POST /oauth/token grant_type=client_credentials&client_id=...&client_secret=...
+func (srv *Server) handlerServiceToken(w http.ResponseWriter, r *http.Request) {
+	// grant_type is checked by validateRequest already
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	s, err := srv.getServiceAccount(id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read service account", err)
+		return
+	}
+	if s == nil || s.Disabled || !hmac.Equal([]byte(s.SecretHash), []byte(hashClientSecret(secret))) {
+		srv.Log.Printf("Rejected client credentials of %q\n", id)
+		writeError(w, r, http.StatusUnauthorized, "Invalid client credentials")
+		return
+	}
+
+	tokenString, err := srv.Tokens.Sign(jwt.MapClaims{
+		"username":  s.Account,
+		"kind":      TOKEN_KIND_SERVICE,
+		"client_id": s.Id,
+		"scope":     s.Scopes,
+		"exp":       time.Now().Add(SERVICE_TOKEN_TTL).Unix(),
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to sign token", err)
+		return
+	}
+	js, _ := json.Marshal(map[string]interface{}{
+		"access_token": tokenString,
+		"token_type":   "Bearer",
+		"expires_in":   int(SERVICE_TOKEN_TTL / time.Second),
+		"scope":        strings.Join(s.Scopes, " "),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(js)
+}
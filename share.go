@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_SHARE = "share"
+
+	// where the share pages are, on the root and not under the API so the
+	// links stay short: https://around.example/s/Xy3kP9aQ
+	SHARE_PATH = "/s/"
+	// characters of a share token, 62^8 of them is plenty to not be guessed
+	// and still fits a chat message
+	SHARE_TOKEN_LENGTH = 8
+	SHARE_ALPHABET     = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// runes of the message in og:description, chat apps cut longer ones anyway
+	SHARE_EXCERPT = 200
+	// width of the image the unfurl gets, the size Facebook and Twitter ask for
+	SHARE_IMAGE_WIDTH = 1200
+	// chat apps refetch a page now and then, a deleted post is gone after this
+	SHARE_MAX_AGE = 10 * time.Minute
+)
+
+// Share is a short link to a post, minted by whoever shares it. The token is
+// the document id. The page of it only shows posts anyone may see, a post of
+// an account that turned private since is not found like a deleted one.
+type Share struct {
+	Token     string    `json:"token"`
+	PostID    string    `json:"post_id"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// shareResponse is what POST /post/{id}/share answers
+type shareResponse struct {
+	Token string `json:"token"`
+	Url   string `json:"url"`
+}
+
+func newShareToken() string {
+	b := make([]byte, SHARE_TOKEN_LENGTH)
+	max := big.NewInt(int64(len(SHARE_ALPHABET)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = SHARE_ALPHABET[n.Int64()]
+	}
+	return string(b)
+}
+
+// handlerShare mints a share link of a post the caller may see. Only posts of
+// public accounts can be shared, the page is for people without an account.
+//
+//	POST /post/{id}/share
+func (srv *Server) handlerShare(w http.ResponseWriter, r *http.Request) {
+	client, _, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+	if !srv.canSee("", p.User) {
+		writeError(w, r, http.StatusForbidden, "Posts of private accounts can't be shared")
+		return
+	}
+
+	s, err := srv.mintShare(client, p.Id, usernameFromToken(r))
+	if err != nil {
+		writeBackendError(w, r, "Failed to save share", err)
+		return
+	}
+	js, _ := json.Marshal(shareResponse{Token: s.Token, Url: shareURL(r, s)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+func shareURL(r *http.Request, s Share) string {
+	return externalURL(r, SHARE_PATH+s.Token)
+}
+
+// mintShare saves a new share of post id by username
+func (srv *Server) mintShare(client *elastic.Client, id, username string) (Share, error) {
+	s := Share{PostID: id, CreatedBy: username, CreatedAt: time.Now().UTC()}
+	// a token that is taken already gets a new one, with 62^8 that's rare
+	var err error
+	for tries := 0; tries < 3; tries++ {
+		s.Token = newShareToken()
+		err = esRetry(func() error {
+			_, err := client.Index().
+				Index(srv.Names.Index).
+				Type(TYPE_SHARE).
+				Id(s.Token).
+				OpType("create").
+				BodyJson(s).
+				Do()
+			return err
+		})
+		if e, ok := err.(*elastic.Error); !ok || e.Status != http.StatusConflict {
+			break
+		}
+	}
+	if err != nil {
+		return Share{}, err
+	}
+	srv.Log.Printf("Post %s shared by %s as %s\n", id, username, s.Token)
+	return s, nil
+}
+
+// shareOf is the oldest share of post id, minted for username when there is
+// none yet. For links that are printed, like the QR codes, a post keeps one.
+func (srv *Server) shareOf(client *elastic.Client, id, username string) (Share, error) {
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_SHARE).
+			Query(elastic.NewTermQuery("post_id", id)).
+			Sort("created_at", true).
+			Size(1).
+			Do()
+		return err
+	})
+	// an index without shares has no created_at to sort on yet
+	if err == nil && len(res.Hits.Hits) > 0 {
+		var s Share
+		if err := json.Unmarshal(*res.Hits.Hits[0].Source, &s); err == nil && s.PostID == id {
+			return s, nil
+		}
+	}
+	return srv.mintShare(client, id, username)
+}
+
+func (srv *Server) getShare(client *elastic.Client, token string) (*Share, error) {
+	var res *elastic.GetResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_SHARE).Id(token).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var s Share
+	if err := json.Unmarshal(*res.Source, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// sharePage is what sharePageHTML renders
+type sharePage struct {
+	Title       string
+	Description string
+	// the page itself, og:url
+	Url string
+	// where people go from the page, the post in the SPA
+	Target string
+	// the media of the post resized for the card, empty for text posts
+	Image string
+	// a map of where the post is, the only image of a text post
+	Map string
+	// summary_large_image when there is a picture to show big
+	Card string
+	Lat  float64
+	Lon  float64
+}
+
+// the tags chat apps, Facebook and Twitter read for the preview, and a
+// redirect for the people who open the link
+var sharePageHTML = htmltemplate.Must(htmltemplate.New("share").Parse(`<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="article">
+<meta property="og:site_name" content="Around">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.Url}}">
+{{if .Image}}<meta property="og:image" content="{{.Image}}">
+{{end}}{{if .Map}}<meta property="og:image" content="{{.Map}}">
+{{end}}<meta property="place:location:latitude" content="{{.Lat}}">
+<meta property="place:location:longitude" content="{{.Lon}}">
+<meta name="twitter:card" content="{{.Card}}">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+{{if .Image}}<meta name="twitter:image" content="{{.Image}}">
+{{else if .Map}}<meta name="twitter:image" content="{{.Map}}">
+{{end}}<link rel="canonical" href="{{.Url}}">
+<meta http-equiv="refresh" content="0; url={{.Target}}">
+</head><body style="font-family:sans-serif">
+<p>{{.Description}}</p>
+<p><a href="{{.Target}}">Open in Around</a></p>
+</body></html>
+`))
+
+// shareExcerpt is the start of message for og:description, cut at a space
+// when there is one near the end
+func shareExcerpt(message string) string {
+	runes := []rune(strings.Join(strings.Fields(message), " "))
+	if len(runes) <= SHARE_EXCERPT {
+		return string(runes)
+	}
+	cut := string(runes[:SHARE_EXCERPT-1])
+	if i := strings.LastIndex(cut, " "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// shareMapURL fills the share_map template with where p is, "" without one
+func (srv *Server) shareMapURL(p Post) string {
+	if srv.Config.ShareMap == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{lat}", fmt.Sprintf("%f", p.Location.Lat),
+		"{lon}", fmt.Sprintf("%f", p.Location.Lon),
+	).Replace(srv.Config.ShareMap)
+}
+
+// handlerSharePage renders the page of a share link. It needs no token, the
+// crawlers of chat apps fetch it like any visitor would.
+//
+//	GET /s/{token}
+func (srv *Server) handlerSharePage(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	s, err := srv.getShare(client, token)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read share", err)
+		return
+	}
+	if s == nil {
+		http.Error(w, "Share not found", http.StatusNotFound)
+		return
+	}
+	_, p, err := srv.findPost(client, s.PostID)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read post", err)
+		return
+	}
+	// the page is public, it shows what a signed out visitor may see
+	if p == nil || p.hidden() || !srv.canSee("", p.User) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	page := sharePage{
+		Title:       "Post by " + p.User,
+		Description: shareExcerpt(p.Message),
+		Url:         shareURL(r, *s),
+		Target:      externalURL(r, "/post/"+p.Id),
+		Map:         srv.shareMapURL(*p),
+		Card:        "summary",
+		Lat:         p.Location.Lat,
+		Lon:         p.Location.Lon,
+	}
+	if page.Description == "" {
+		page.Description = page.Title
+	}
+	if p.Type == "image" {
+		page.Image = fmt.Sprintf("%s?w=%d", mediaURL(r, p.Id), SHARE_IMAGE_WIDTH)
+	}
+	if page.Image != "" || page.Map != "" {
+		page.Card = "summary_large_image"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(SHARE_MAX_AGE.Seconds())))
+	if err := sharePageHTML.Execute(w, page); err != nil {
+		srv.Log.Printf("Failed to render share %s %v\n", s.Token, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/TianyiSun2333/Around/search"
+)
+
+// the most of a request body the slow query log keeps, bulk requests can be
+// megabytes
+const SLOW_QUERY_MAX_BODY = 8 << 10
+
+// slowQueryTransport is the transport of the ES client, it logs the requests
+// that take slow_query or longer with their body and the took of ES. A long
+// took is ES being slow at the query, a short one with a long total is the
+// network or a queue in front of the node.
+type slowQueryTransport struct {
+	srv  *Server
+	next http.RoundTripper
+}
+
+func (t *slowQueryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is read up front to have it for the log, the client sends
+	// bytes it has in memory anyway
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start)
+	if elapsed < t.srv.Config.SlowQuery {
+		return resp, err
+	}
+	if err != nil {
+		t.srv.Log.Printf("Slow ES query %s %s failed after %v %v: %s\n", req.Method, req.URL.Path, elapsed, err, slowQueryBody(body))
+		return resp, err
+	}
+
+	// search responses tell how long ES itself took, the rest doesn't
+	took := "-"
+	js, rerr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(js))
+	if rerr != nil {
+		return resp, rerr
+	}
+	var res struct {
+		Took *int64 `json:"took"`
+	}
+	if json.Unmarshal(js, &res) == nil && res.Took != nil {
+		took = time.Duration(*res.Took * int64(time.Millisecond)).String()
+	}
+	t.srv.Log.Printf("Slow ES query %s %s %d took %s in ES and %v in all: %s\n", req.Method, req.URL.RequestURI(), resp.StatusCode, took, elapsed, slowQueryBody(body))
+	return resp, nil
+}
+
+func slowQueryBody(body []byte) string {
+	if len(body) > SLOW_QUERY_MAX_BODY {
+		return string(body[:SLOW_QUERY_MAX_BODY]) + "..."
+	}
+	return string(body)
+}
+
+// searchProfile is the /search response with ?profile=true, the page and
+// how ES ran the query. Never cached, admins ask for it to see why a search
+// is slow or ranks the way it does.
+type searchProfile struct {
+	listPage
+	Profile json.RawMessage `json:"profile"`
+}
+
+// writeSearchProfile answers /search?profile=true with q, which has Profile
+// set. The other search backends don't profile, their answer has no profile.
+func (srv *Server) writeSearchProfile(w http.ResponseWriter, r *http.Request, q search.Nearby, viewer string, started time.Time) {
+	res, err := srv.Search.Nearby(q)
+	if err != nil {
+		writeBackendError(w, r, "Failed to search posts", err)
+		return
+	}
+	ps := srv.searchPosts(res)
+	page := searchProfile{
+		listPage: listPage{Items: nonNilPosts(srv.rankSearch(r, q.Lat, q.Lon, srv.searchResults(viewer, ps))), Total: res.Total},
+		Profile:  res.Profile,
+	}
+	if page.Profile == nil {
+		page.Profile = json.RawMessage("null")
+	}
+	srv.Log.Printf("Profiled search by %s took %d milliseconds in ES\n", viewer, res.TookMs)
+	page.TookMs = int64(time.Since(started) / time.Millisecond)
+	js, _ := json.Marshal(page)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(js)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_PHONE_CODE = "phone_code"
+
+	SMS_TIMEOUT = 10 * time.Second
+
+	PHONE_CODE_DIGITS = 6
+	PHONE_CODE_TTL    = 10 * time.Minute
+	// wrong guesses before the code is thrown away, 6 digits need a new code
+	// long before they can be guessed
+	PHONE_CODE_MAX_ATTEMPTS = 5
+	// between two codes to the same user, and how many they may get in a window
+	PHONE_CODE_RESEND_AFTER = time.Minute
+	PHONE_CODE_MAX_SENDS    = 5
+	PHONE_CODE_SEND_WINDOW  = time.Hour
+)
+
+// what a code is for, a verification code can't log in and the other way round
+const (
+	PHONE_PURPOSE_VERIFY = "verify"
+	PHONE_PURPOSE_LOGIN  = "login"
+)
+
+// E.164, what Twilio takes: +, country code, up to 15 digits
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`).MatchString
+
+var (
+	errCodeWrong = fmt.Errorf("wrong or expired code")
+	// too many sends, the error message says when to try again
+	errCodeTooSoon = fmt.Errorf("a code was sent recently, wait before asking for another")
+	errCodeTooMany = fmt.Errorf("too many codes sent, try again later")
+)
+
+// PhoneCode is the one code a user has outstanding per purpose. Only its hash
+// is stored, the user gets the code by SMS.
+type PhoneCode struct {
+	User      string    `json:"user"`
+	Purpose   string    `json:"purpose"`
+	Phone     string    `json:"phone"`
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Attempts  int       `json:"attempts"`
+	// for the resend limits, Sends counts since WindowStart
+	SentAt      time.Time `json:"sent_at"`
+	Sends       int       `json:"sends"`
+	WindowStart time.Time `json:"window_start"`
+
+	// the ES version it was read at, 0 for a new one, see savePhoneCode
+	version int64
+}
+
+// body of POST /phone
+type phoneRequest struct {
+	Phone string `json:"phone"`
+}
+
+// body of POST /phone/verify
+type phoneCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// Twilio sends the SMS, other providers would only need another sendSMS
+func (srv *Server) smsEnabled() bool {
+	return srv.Config.TwilioAccountSID != ""
+}
+
+func phoneCodeID(username, purpose string) string {
+	return username + ">" + purpose
+}
+
+// codes are short, the hash is keyed so a leaked index doesn't give them away
+func (srv *Server) hashPhoneCode(username, purpose, code string) string {
+	mac := hmac.New(sha256.New, srv.Tokens.Key)
+	mac.Write([]byte(username + ">" + purpose + ">" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newPhoneCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < PHONE_CODE_DIGITS; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", PHONE_CODE_DIGITS, n), nil
+}
+
+func (srv *Server) getPhoneCode(client *elastic.Client, username, purpose string) (*PhoneCode, error) {
+	var res *elastic.GetResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_PHONE_CODE).Id(phoneCodeID(username, purpose)).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var c PhoneCode
+	if err := json.Unmarshal(*res.Source, &c); err != nil {
+		return nil, err
+	}
+	if res.Version != nil {
+		c.version = *res.Version
+	}
+	return &c, nil
+}
+
+// savePhoneCode stores c unless it changed since it was read, then ES
+// refuses with a 409. Two requests racing for the same code can't both count
+// their attempt or send.
+func (srv *Server) savePhoneCode(client *elastic.Client, c PhoneCode) error {
+	return esRetry(func() error {
+		index := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_PHONE_CODE).
+			Id(phoneCodeID(c.User, c.Purpose)).
+			BodyJson(c).
+			Refresh(true)
+		if c.version > 0 {
+			index = index.Version(c.version)
+		} else {
+			// the user had no code when it was read
+			index = index.OpType("create")
+		}
+		_, err := index.Do()
+		return err
+	})
+}
+
+func (srv *Server) deletePhoneCode(client *elastic.Client, username, purpose string) error {
+	return esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_PHONE_CODE).Id(phoneCodeID(username, purpose)).Refresh(true).Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// sendPhoneCode texts a new code for purpose to phone, replacing the one the
+// user had. It refuses with errCodeTooSoon or errCodeTooMany past the limits.
+func (srv *Server) sendPhoneCode(username, purpose, phone string) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	c, err := srv.getPhoneCode(client, username, purpose)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		c = &PhoneCode{User: username, Purpose: purpose}
+	}
+	if now.Sub(c.SentAt) < PHONE_CODE_RESEND_AFTER {
+		return errCodeTooSoon
+	}
+	if now.Sub(c.WindowStart) >= PHONE_CODE_SEND_WINDOW {
+		c.WindowStart, c.Sends = now, 0
+	}
+	if c.Sends >= PHONE_CODE_MAX_SENDS {
+		return errCodeTooMany
+	}
+
+	code, err := newPhoneCode()
+	if err != nil {
+		return err
+	}
+	c.Phone = phone
+	c.Hash = srv.hashPhoneCode(username, purpose, code)
+	c.ExpiresAt = now.Add(PHONE_CODE_TTL)
+	c.Attempts = 0
+	c.SentAt = now
+	c.Sends++
+	// saved first, a code that was texted but not stored can't be used anyway
+	err = srv.savePhoneCode(client, *c)
+	if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+		// another request sent a code in between
+		return errCodeTooSoon
+	}
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Your Around code is %s, it expires in %d minutes.", code, int(PHONE_CODE_TTL.Minutes()))
+	if err := srv.sendSMS(phone, body); err != nil {
+		return err
+	}
+	srv.Log.Printf("Sent %s code to %s\n", purpose, username)
+	return nil
+}
+
+// checkPhoneCode reports whether code is the outstanding one of username for
+// purpose and was sent to phone. A right code is used up, a wrong one counts
+// against PHONE_CODE_MAX_ATTEMPTS. Checks of the same code that race are
+// each counted: the one that saves second reads the code again, and counts as
+// a wrong attempt even with the right code.
+func (srv *Server) checkPhoneCode(username, purpose, phone, code string) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	// set when the right code lost the race to another check
+	lost := false
+	for {
+		c, err := srv.getPhoneCode(client, username, purpose)
+		if err != nil {
+			return err
+		}
+		// an expired code keeps its document for the send limits
+		if c == nil || c.Hash == "" || time.Now().After(c.ExpiresAt) || c.Phone != phone {
+			return errCodeWrong
+		}
+		if !lost && hmac.Equal([]byte(c.Hash), []byte(srv.hashPhoneCode(username, purpose, strings.TrimSpace(code)))) {
+			c.Hash = ""
+			err := srv.savePhoneCode(client, *c)
+			if e, ok := err.(*elastic.Error); !ok || e.Status != http.StatusConflict {
+				return err
+			}
+			lost = true
+			continue
+		}
+		c.Attempts++
+		if c.Attempts >= PHONE_CODE_MAX_ATTEMPTS {
+			srv.Log.Printf("Too many wrong %s codes for %s, code dropped\n", purpose, username)
+			c.Hash = ""
+		}
+		err = srv.savePhoneCode(client, *c)
+		if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return errCodeWrong
+	}
+}
+
+type twilioError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// sendSMS texts body to phone through the Twilio messages API
+func (srv *Server) sendSMS(phone, body string) error {
+	form := url.Values{"To": {phone}, "From": {srv.Config.TwilioFrom}, "Body": {body}}
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + srv.Config.TwilioAccountSID + "/Messages.json"
+	client := &http.Client{Timeout: SMS_TIMEOUT}
+
+	return retry(smsBreaker, func() error {
+		req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+		req.SetBasicAuth(srv.Config.TwilioAccountSID, srv.Config.TwilioAuthToken)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode < 300 {
+			return nil
+		}
+		data, _ := ioutil.ReadAll(res.Body)
+		var e twilioError
+		json.Unmarshal(data, &e)
+		err = fmt.Errorf("twilio returned %d %d %s", res.StatusCode, e.Code, e.Message)
+		// a bad number or a blocked destination won't get better by retrying
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return permanent(err)
+		}
+		return err
+	})
+}
+
+func writePhoneCodeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errCodeTooSoon, errCodeTooMany:
+		writeError(w, r, http.StatusTooManyRequests, err.Error())
+	default:
+		writeBackendError(w, r, "Failed to send code", err)
+	}
+}
+
+// handlerSetPhone sets the phone number of the caller and texts it a code,
+// the number counts once POST /phone/verify gets it. A new number turns two
+// factor login off until it is verified.
+//
+//	POST /phone {"phone":"+4915112345678"}
+func (srv *Server) handlerSetPhone(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	if !srv.smsEnabled() {
+		writeError(w, r, http.StatusNotFound, "SMS is not setup")
+		return
+	}
+	var req phoneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode phone")
+		return
+	}
+	req.Phone = normalizePhone(req.Phone)
+	if !phonePattern(req.Phone) {
+		writeValidationError(w, r, []fieldError{{Name: "phone", In: "body", Message: "must be a number with country code like +4915112345678"}})
+		return
+	}
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if u.Phone != req.Phone {
+		fields := map[string]interface{}{"phone": req.Phone, "phone_verified": false, "two_factor": false}
+		if err := srv.updateUserFields(username, fields); err != nil {
+			writeBackendError(w, r, "Failed to save phone", err)
+			return
+		}
+	}
+	if err := srv.sendPhoneCode(username, PHONE_PURPOSE_VERIFY, req.Phone); err != nil {
+		writePhoneCodeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerVerifyPhone marks the phone of the caller verified with the code
+// texted to it
+//
+//	POST /phone/verify {"code":"123456"}
+func (srv *Server) handlerVerifyPhone(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req phoneCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode code")
+		return
+	}
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if u.Phone == "" {
+		writeError(w, r, http.StatusConflict, "No phone number to verify")
+		return
+	}
+	err := srv.checkPhoneCode(username, PHONE_PURPOSE_VERIFY, u.Phone, req.Code)
+	if err == errCodeWrong {
+		writeValidationError(w, r, []fieldError{{Name: "code", In: "body", Message: "is wrong or expired"}})
+		return
+	}
+	if err != nil {
+		writeBackendError(w, r, "Failed to check code", err)
+		return
+	}
+	if err := srv.updateUserFields(username, map[string]interface{}{"phone_verified": true}); err != nil {
+		writeBackendError(w, r, "Failed to save phone", err)
+		return
+	}
+	srv.Log.Printf("Phone of %s verified\n", username)
+	u.PhoneVerified = true
+	writeProfile(w, r, u)
+}
+
+// handlerDeletePhone removes the phone number of the caller, and with it two
+// factor login
+//
+//	DELETE /phone
+func (srv *Server) handlerDeletePhone(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	fields := map[string]interface{}{"phone": "", "phone_verified": false, "two_factor": false}
+	if err := srv.updateUserFields(username, fields); err != nil {
+		writeBackendError(w, r, "Failed to remove phone", err)
+		return
+	}
+	srv.Log.Printf("Phone of %s removed\n", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// normalizePhone drops the spaces, dashes and brackets people type numbers with
+func normalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// the aggregations read every post and view of the window, admins can wait
+	// this long for fresh numbers
+	ADMIN_STATS_CACHE_TTL = 5 * time.Minute
+	// geohash cells of about 150km, roughly a metro area
+	ADMIN_STATS_REGION_PRECISION = 3
+	ADMIN_STATS_TOP_REGIONS      = 10
+)
+
+// adminStats is the service wide picture GET /admin/stats returns. There is no
+// moderation queue in the service yet, so its depth isn't part of it.
+type adminStats struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Users       int64     `json:"users"`
+	Posts       int64     `json:"posts"`
+	// the IANA zone the days are in
+	TimeZone string `json:"time_zone"`
+	// a user is active on a day they posted, reacted or viewed a post
+	Days       []statsDay    `json:"days"`
+	TopRegions []statsRegion `json:"top_regions"`
+	Storage    statsStorage  `json:"storage"`
+}
+
+type statsDay struct {
+	Day         string `json:"day"`
+	ActiveUsers int64  `json:"active_users"`
+	Posts       int64  `json:"posts"`
+}
+
+// statsRegion is a geohash cell with the most posts of the window
+type statsRegion struct {
+	Geohash string  `json:"geohash"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Posts   int64   `json:"posts"`
+}
+
+// statsStorage is what ES keeps on disk, replicas included. Media in GCS is
+// not counted, summing the bucket means listing every object.
+type statsStorage struct {
+	Bytes   int64            `json:"bytes"`
+	Indices map[string]int64 `json:"indices"`
+	Docs    int64            `json:"docs"`
+}
+
+type adminStatsSet struct {
+	sync.Mutex
+	// per number of days and time zone, "30 Europe/Berlin"
+	stats map[string]adminStats
+}
+
+// handlerAdminStats shows service wide numbers to admins, the days in ?tz= or
+// the admin's own time zone
+//
+//	GET /admin/stats?days=&tz=
+func (srv *Server) handlerAdminStats(w http.ResponseWriter, r *http.Request) {
+	// types and ranges are checked by validateRequest already
+	n := ANALYTICS_DAYS
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, _ = strconv.Atoi(v)
+	}
+	loc, err := srv.displayLocation(r)
+	if err != nil {
+		writeValidationError(w, r, []fieldError{{Name: "tz", In: "query", Message: err.Error()}})
+		return
+	}
+	key := strconv.Itoa(n) + " " + loc.String()
+	srv.adminStatsCache.Lock()
+	s, ok := srv.adminStatsCache.stats[key]
+	srv.adminStatsCache.Unlock()
+	if !ok || time.Since(s.GeneratedAt) > ADMIN_STATS_CACHE_TTL {
+		if s, err = srv.loadAdminStats(n, time.Now(), loc); err != nil {
+			writeBackendError(w, r, "Failed to read stats", err)
+			return
+		}
+		srv.adminStatsCache.Lock()
+		if srv.adminStatsCache.stats == nil {
+			srv.adminStatsCache.stats = map[string]adminStats{}
+		}
+		srv.adminStatsCache.stats[key] = s
+		srv.adminStatsCache.Unlock()
+	}
+	js, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (srv *Server) loadAdminStats(n int, now time.Time, loc *time.Location) (adminStats, error) {
+	s := adminStats{GeneratedAt: now.UTC(), TimeZone: loc.String(), TopRegions: []statsRegion{}}
+	client, err := srv.es()
+	if err != nil {
+		return s, err
+	}
+	today := startOfDay(now, loc)
+	from := today.AddDate(0, 0, -(n - 1))
+
+	err = esRetry(func() error {
+		var err error
+		s.Users, err = client.Count(srv.Names.Index).Type(TYPE_USER).Do()
+		return err
+	})
+	if err != nil {
+		return s, err
+	}
+	err = esRetry(func() error {
+		var err error
+		s.Posts, err = client.Count(srv.Names.PostReadAlias).Type(TYPE).Query(notDeleted()).Do()
+		return err
+	})
+	if err != nil {
+		return s, err
+	}
+
+	regions := elastic.NewGeoHashGridAggregation().Field("location").Precision(ADMIN_STATS_REGION_PRECISION).Size(ADMIN_STATS_TOP_REGIONS)
+	posts, err := dailyCounts(client, srv.Names.PostReadAlias, TYPE, elastic.NewMatchAllQuery(), from, loc,
+		map[string]elastic.Aggregation{"regions": regions})
+	if err != nil {
+		return s, err
+	}
+	postsPerDay := map[string]int64{}
+	if days, ok := posts.Aggregations.DateHistogram("days"); ok {
+		for _, b := range days.Buckets {
+			if b.KeyAsString != nil {
+				postsPerDay[*b.KeyAsString] = b.DocCount
+			}
+		}
+	}
+	if cells, ok := posts.Aggregations.GeoHash("regions"); ok {
+		for _, b := range cells.Buckets {
+			hash, ok := b.Key.(string)
+			if !ok {
+				continue
+			}
+			lat, lon := geohashCenter(hash)
+			s.TopRegions = append(s.TopRegions, statsRegion{Geohash: hash, Lat: lat, Lon: lon, Posts: b.DocCount})
+		}
+	}
+
+	active, err := srv.activeUsers(client, from, loc)
+	if err != nil {
+		return s, err
+	}
+	for d := from; !d.After(today); d = d.AddDate(0, 0, 1) {
+		day := d.Format(DAY_FORMAT)
+		s.Days = append(s.Days, statsDay{Day: day, ActiveUsers: active[day], Posts: postsPerDay[day]})
+	}
+
+	s.Storage, err = srv.storageStats(client)
+	return s, err
+}
+
+// activeUsers counts the distinct users per day that posted, reacted or viewed
+// in loc since from. The cardinality is approximate, exact below a few thousand.
+func (srv *Server) activeUsers(client *elastic.Client, from time.Time, loc *time.Location) (map[string]int64, error) {
+	days := perDay(loc).SubAggregation("users", elastic.NewCardinalityAggregation().Field("user"))
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index, srv.Names.PostReadAlias).
+			Type(TYPE, TYPE_REACTION, TYPE_VIEW).
+			Query(elastic.NewRangeQuery("created_at").Gte(from)).
+			Aggregation("days", days).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]int64{}
+	if buckets, ok := res.Aggregations.DateHistogram("days"); ok {
+		for _, b := range buckets.Buckets {
+			if b.KeyAsString == nil {
+				continue
+			}
+			if users, ok := b.Aggregations.Cardinality("users"); ok && users.Value != nil {
+				active[*b.KeyAsString] = int64(*users.Value)
+			}
+		}
+	}
+	return active, nil
+}
+
+// storageStats sums the around indices ES has, posts, archive and the rest
+func (srv *Server) storageStats(client *elastic.Client) (statsStorage, error) {
+	st := statsStorage{Indices: map[string]int64{}}
+	var res *elastic.IndicesStatsResponse
+	err := esRetry(func() error {
+		var err error
+		res, err = client.IndexStats(srv.Names.Index+"*").Metric("store", "docs").Do()
+		return err
+	})
+	if err != nil {
+		return st, err
+	}
+	for name, idx := range res.Indices {
+		if idx.Total == nil || idx.Total.Store == nil {
+			continue
+		}
+		st.Indices[name] = idx.Total.Store.SizeInBytes
+		st.Bytes += idx.Total.Store.SizeInBytes
+		// the primaries, replicas hold the same documents
+		if idx.Primaries != nil && idx.Primaries.Docs != nil {
+			st.Docs += idx.Primaries.Docs.Count
+		}
+	}
+	return st, nil
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashCenter is the middle of the cell hash names
+func geohashCenter(hash string) (lat, lon float64) {
+	latMin, latMax := -90.0, 90.0
+	lonMin, lonMax := -180.0, 180.0
+	even := true
+	for _, c := range hash {
+		v := strings.IndexRune(geohashAlphabet, c)
+		if v < 0 {
+			break
+		}
+		for bit := 4; bit >= 0; bit-- {
+			on := v&(1<<uint(bit)) != 0
+			// bits alternate between longitude and latitude, longitude first
+			if even {
+				mid := (lonMin + lonMax) / 2
+				if on {
+					lonMin = mid
+				} else {
+					lonMax = mid
+				}
+			} else {
+				mid := (latMin + latMax) / 2
+				if on {
+					latMin = mid
+				} else {
+					latMax = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return (latMin + latMax) / 2, (lonMin + lonMax) / 2
+}
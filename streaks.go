@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// a calendar day, what streaks, daily counts and quotas are keyed by
+	DAY_FORMAT = "2006-01-02"
+	// how often the reminder job looks for streaks about to lapse
+	STREAK_REMINDER_INTERVAL = time.Hour
+	// local time after which a user who hasn't posted today is reminded
+	STREAK_REMINDER_HOUR = 20
+	// a one day streak is not worth a notification
+	STREAK_REMINDER_MIN = 2
+)
+
+// Streak counts the consecutive days, in the user's time zone, on which they
+// posted. Days are DAY_FORMAT dates.
+type Streak struct {
+	Current int    `json:"current"`
+	Best    int    `json:"best"`
+	LastDay string `json:"last_day,omitempty"`
+	// the day a reminder was sent for, so it is sent once
+	RemindedOn string `json:"reminded_on,omitempty"`
+}
+
+// location of the user's time zone, UTC when unset or unknown
+func (u User) location() *time.Location {
+	if u.TimeZone != "" {
+		if loc, err := time.LoadLocation(u.TimeZone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func localDay(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format(DAY_FORMAT)
+}
+
+// streakView is the streak as profiles show it
+type streakView struct {
+	Current int    `json:"current"`
+	Best    int    `json:"best"`
+	LastDay string `json:"last_day,omitempty"`
+}
+
+// streakOf reports a current streak of 0 once it lapsed, the stored one is
+// only reset by the next post
+func streakOf(u User, now time.Time) streakView {
+	s := u.Streak
+	v := streakView{Current: s.Current, Best: s.Best, LastDay: s.LastDay}
+	loc := u.location()
+	if s.LastDay != localDay(now, loc) && s.LastDay != localDay(now.AddDate(0, 0, -1), loc) {
+		v.Current = 0
+	}
+	return v
+}
+
+// recordCheckIn counts a post of username made at t towards their streak
+func (srv *Server) recordCheckIn(username string, t time.Time) error {
+	// the cached user may not have the post of a moment ago
+	srv.userLookupCache.invalidate(username)
+	u, ok := srv.getUser(username)
+	if !ok {
+		return fmt.Errorf("no user %s", username)
+	}
+	loc := u.location()
+	s := u.Streak
+	today := localDay(t, loc)
+	switch s.LastDay {
+	case today:
+		return nil
+	case localDay(t.AddDate(0, 0, -1), loc):
+		s.Current++
+	default:
+		s.Current = 1
+	}
+	s.LastDay = today
+	if s.Current > s.Best {
+		s.Best = s.Current
+	}
+	return srv.updateUserFields(username, map[string]interface{}{"streak": s})
+}
+
+// checkInLater is recordCheckIn in the background, called after a post is saved
+func (srv *Server) checkInLater(username string, t time.Time) {
+	go func() {
+		if err := srv.recordCheckIn(username, t); err != nil {
+			srv.Log.Printf("Failed to update the streak of %s %v\n", username, err)
+		}
+	}()
+}
+
+func (srv *Server) sendStreakReminders(now time.Time) (int, error) {
+	client, err := srv.es()
+	if err != nil {
+		return 0, err
+	}
+	scroll := client.Scroll(srv.Names.Index).
+		Type(TYPE_USER).
+		Query(elastic.NewRangeQuery("streak.current").Gte(STREAK_REMINDER_MIN)).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+
+	sent := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		for _, hit := range res.Hits.Hits {
+			var u User
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &u) != nil {
+				continue
+			}
+			loc := u.location()
+			today := localDay(now, loc)
+			// posted today already, lapsed already, too early or reminded already
+			if u.Streak.LastDay != localDay(now.AddDate(0, 0, -1), loc) ||
+				now.In(loc).Hour() < STREAK_REMINDER_HOUR || u.Streak.RemindedOn == today {
+				continue
+			}
+			err := srv.notify(Notification{
+				User:    u.Username,
+				Kind:    "streak_reminder",
+				Message: fmt.Sprintf("Post today to keep your %d day streak", u.Streak.Current),
+				Data:    map[string]string{"streak": strconv.Itoa(u.Streak.Current)},
+			})
+			if err != nil {
+				srv.Log.Printf("Failed to remind %s of their streak %v\n", u.Username, err)
+				continue
+			}
+			s := u.Streak
+			s.RemindedOn = today
+			if err := srv.updateUserFields(u.Username, map[string]interface{}{"streak": s}); err != nil {
+				srv.Log.Printf("Failed to record the streak reminder of %s %v\n", u.Username, err)
+			}
+			sent++
+		}
+	}
+}
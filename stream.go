@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// comment lines keep proxies from closing an idle stream
+	STREAM_HEARTBEAT = 15 * time.Second
+	// a response can't outlive SERVER_WRITE_TIMEOUT, so the stream ends a bit
+	// earlier and the browser reconnects with Last-Event-ID on its own
+	STREAM_DURATION = SERVER_WRITE_TIMEOUT - 10*time.Second
+	// ms the client waits before reconnecting
+	STREAM_RETRY = 1000
+	// posts replayed on resume, older ones are lost
+	STREAM_BACKFILL = 100
+)
+
+// handlerStream is /ws for clients without websockets: GET /stream?lat=&lon=&range=
+// sends every new post in range as an SSE event whose id is the post id. Post ids
+// sort by time, so on reconnect the posts after Last-Event-ID are replayed from ES.
+func (srv *Server) handlerStream(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	// types are checked by validateRequest already
+	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	ran, _ := parseKm(srv.Config.DefaultDistance)
+	if v := r.URL.Query().Get("range"); v != "" {
+		ran, _ = strconv.ParseFloat(v, 64)
+	}
+	sub := feedSubscription{Lat: lat, Lon: lon, Range: ran}
+	if !sub.valid() {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("range should be up to %dkm", FEED_MAX_RANGE_KM))
+		return
+	}
+
+	// subscribe before the backfill so nothing falls in between, duplicates are skipped below
+	s := &feedSubscriber{username: username, send: make(chan feedEvent, FEED_BUFFER), sub: sub}
+	srv.liveFeed.add(s)
+	defer srv.liveFeed.remove(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx would buffer the whole response otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", STREAM_RETRY)
+
+	// EventSource sends the header, the query parameter is for clients that can't
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	if isLegacyPostID(lastID) {
+		// can't resume from those, and they don't compare with ULIDs
+		lastID = ""
+	}
+	if lastID != "" {
+		missed, err := srv.postsAfter(lastID, sub)
+		if err != nil {
+			srv.Log.Printf("Failed to replay stream of %s after %s %v\n", username, lastID, err)
+		}
+		for _, p := range srv.withQuotes(username, srv.feedPosts(username, missed)) {
+			if err := writeStreamEvent(w, p); err != nil {
+				return
+			}
+			lastID = p.Id
+		}
+	}
+	flusher.Flush()
+	srv.Log.Printf("Stream opened by %s\n", username)
+
+	heartbeat := time.NewTicker(STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+	end := time.After(STREAM_DURATION)
+	for {
+		select {
+		case ev := <-s.send:
+			// already sent by the backfill
+			if ev.Post == nil || (!isLegacyPostID(ev.Post.Id) && ev.Post.Id <= lastID) || !srv.inFeed(username, ev.Post.User) {
+				continue
+			}
+			if err := writeStreamEvent(w, srv.withQuotes(username, []Post{*ev.Post})[0]); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-end:
+			return
+		case <-r.Context().Done():
+			srv.Log.Printf("Stream closed by %s\n", username)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, p Post) error {
+	js, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: post\ndata: %s\n\n", p.Id, js)
+	return err
+}
+
+// postsAfter returns the posts in sub created after the post lastID, oldest
+// first. Legacy ids carry no time, nothing can be replayed after those.
+func (srv *Server) postsAfter(lastID string, sub feedSubscription) ([]Post, error) {
+	since, ok := postIDTime(lastID)
+	if !ok {
+		return nil, nil
+	}
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+
+	geo := elastic.NewGeoDistanceQuery("location").
+		Distance(fmt.Sprintf("%gkm", sub.Range)).Lat(sub.Lat).Lon(sub.Lon)
+	q := elastic.NewBoolQuery().Filter(geo, notDeleted(),
+		elastic.NewRangeQuery("created_at").Gte(since))
+
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(q).
+			Sort("created_at", true).
+			Size(STREAM_BACKFILL).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []Post
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			continue
+		}
+		// same millisecond as lastID, the random part of the ULID decides
+		if p.Id <= lastID {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const SUSPENSION_MAX_REASON = 500
+
+// what a suspended user may still do besides GETs: requests that only read
+// but are POSTs, and cleaning up or protecting their own account
+var suspendedAllowed = []string{
+	"viewPost", "graphql",
+	"readNotification", "readAllNotifications",
+	"registerDevice", "unregisterDevice", "webPushSubscribe", "webPushUnsubscribe",
+	"setPhone", "verifyPhone", "deletePhone",
+	"deletePost", "unfollow", "mute", "unmute", "leavePresence", "deleteGeofence",
+}
+
+// body of POST /admin/users/{username}/suspension
+type suspensionRequest struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// suspended reports whether u may only read at now
+func (u User) suspended(now time.Time) bool {
+	return u.SuspendedUntil != nil && now.Before(*u.SuspendedUntil)
+}
+
+// suspensionMiddleware answers 403 to writes of suspended users. Runs after the
+// token check. The user comes from the user cache, so a suspension reaches
+// other instances within USER_CACHE_TTL, the token may be older than it.
+func (srv *Server) suspensionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if op, ok := operationFor(r); ok && contains(suspendedAllowed, op.OperationID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, ok := srv.getUser(usernameFromToken(r))
+		if ok && u.suspended(time.Now()) {
+			writeError(w, r, http.StatusForbidden, "Account suspended until "+u.SuspendedUntil.UTC().Format(time.RFC3339))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlerSuspendUser makes an account read only until the given time, admins
+// only. Suspending again replaces the earlier suspension.
+//
+//	POST /admin/users/{username}/suspension {"until":"2018-07-01T00:00:00Z","reason":"spam"}
+func (srv *Server) handlerSuspendUser(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	username := mux.Vars(r)["username"]
+	var req suspensionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode suspension")
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	var errs []fieldError
+	if !req.Until.After(time.Now()) {
+		errs = append(errs, fieldError{Name: "until", In: "body", Message: "must be in the future"})
+	}
+	if utf8.RuneCountInString(req.Reason) > SUSPENSION_MAX_REASON {
+		errs = append(errs, fieldError{Name: "reason", In: "body", Message: fmt.Sprintf("must be at most %d characters", SUSPENSION_MAX_REASON)})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+	if _, ok := srv.getUser(username); !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	until := req.Until.UTC()
+	err := srv.logModeration(ModerationAction{
+		Moderator: admin,
+		Action:    MODERATION_SUSPEND,
+		User:      username,
+		Reason:    req.Reason,
+		Details:   map[string]string{"until": until.Format(time.RFC3339)},
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to log suspension", err)
+		return
+	}
+	fields := map[string]interface{}{"suspended_until": until, "suspension_reason": req.Reason}
+	if err := srv.updateUserFields(username, fields); err != nil {
+		writeBackendError(w, r, "Failed to suspend user", err)
+		return
+	}
+	srv.Log.Printf("%s suspended %s until %s: %s\n", admin, username, until.Format(time.RFC3339), req.Reason)
+	srv.writeSuspension(w, username)
+}
+
+// handlerLiftSuspension ends the suspension of an account early, admins only
+//
+//	DELETE /admin/users/{username}/suspension
+func (srv *Server) handlerLiftSuspension(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	username := mux.Vars(r)["username"]
+	if _, ok := srv.getUser(username); !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if err := srv.logModeration(ModerationAction{Moderator: admin, Action: MODERATION_LIFT_SUSPENSION, User: username}); err != nil {
+		writeBackendError(w, r, "Failed to log lifting the suspension", err)
+		return
+	}
+	// nil clears the field, the update merges the rest
+	fields := map[string]interface{}{"suspended_until": nil, "suspension_reason": nil}
+	if err := srv.updateUserFields(username, fields); err != nil {
+		writeBackendError(w, r, "Failed to lift suspension", err)
+		return
+	}
+	srv.Log.Printf("%s lifted the suspension of %s\n", admin, username)
+	srv.writeSuspension(w, username)
+}
+
+func (srv *Server) writeSuspension(w http.ResponseWriter, username string) {
+	u, _ := srv.getUser(username)
+	js, _ := json.Marshal(map[string]interface{}{
+		"username":          username,
+		"suspended":         u.suspended(time.Now()),
+		"suspended_until":   u.SuspendedUntil,
+		"suspension_reason": u.SuspensionReason,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
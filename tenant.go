@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/TianyiSun2333/Around/auth"
+)
+
+// Tenants are separate apps hosted by one deployment, each with its own users
+// and posts. Every tenant has a Server of its own with the tenant's config,
+// caches and names, and every name it stores data under gets the tenant in
+// front:
+//
+//	ES       acme-around, acme-around-posts-2018.07, ...
+//	Bigtable acme-post, acme-moderation
+//	GCS      acme/<post id>, acme/archive/... in the tenant's buckets
+//	redis    the tenant's redis_db, pub/sub channels get the prefix
+//	search   acme-around_search with opensearch or postgis
+//
+// serve answers every tenant, tenantHandler picks the server of a request by
+// the tenant claim of its token, or by its host when it has none. Tokens carry
+// the tenant they were issued for and the servers of the others reject them.
+// An empty tenant is the app from before tenants, its names are unchanged,
+// and gets the requests of no other tenant. worker runs the jobs of every
+// tenant too, the other commands work on config.Tenant.
+var tenantPattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,19}$`)
+
+// TenantConfig is what a tenant has of its own, set in the config under
+// tenants and applied over the rest for its server. Empty fields keep the
+// deployment wide value.
+type TenantConfig struct {
+	// where the tenant's app is served, requests without a token go by them
+	Hosts         []string `yaml:"hosts"`
+	BucketName    string   `yaml:"bucket_name"`
+	ArchiveBucket string   `yaml:"archive_bucket"`
+	BTInstance    string   `yaml:"bt_instance"`
+	// keys aren't prefixed, so every tenant needs a database of its own
+	RedisDB  int      `yaml:"redis_db"`
+	Admins   []string `yaml:"admins"`
+	MailFrom string   `yaml:"mail_from"`
+}
+
+// tenantNames are the names a tenant stores its data under
+type tenantNames struct {
+	Index           string
+	PostIndexPrefix string
+	PostWriteAlias  string
+	PostReadAlias   string
+	PostTable       string
+	ModerationTable string
+	FeedChannel     string
+	SearchIndex     string
+	MediaPrefix     string
+	ArchivePrefix   string
+}
+
+// namesOf are the names of tenant, the unprefixed ones for ""
+func namesOf(tenant string) tenantNames {
+	n := tenantNames{
+		Index:           INDEX,
+		PostIndexPrefix: POST_INDEX_PREFIX,
+		PostWriteAlias:  POST_WRITE_ALIAS,
+		PostReadAlias:   POST_READ_ALIAS,
+		PostTable:       BIGTABLE_TABLE,
+		ModerationTable: MODERATION_TABLE,
+		FeedChannel:     FEED_CHANNEL,
+		SearchIndex:     SEARCH_INDEX,
+		MediaPrefix:     MEDIA_PREFIX,
+		ArchivePrefix:   ARCHIVE_PREFIX,
+	}
+	if tenant == "" {
+		return n
+	}
+	prefix := tenant + "-"
+	for _, name := range []*string{&n.Index, &n.PostIndexPrefix, &n.PostWriteAlias, &n.PostReadAlias, &n.PostTable, &n.ModerationTable, &n.FeedChannel, &n.SearchIndex} {
+		*name = prefix + *name
+	}
+	n.MediaPrefix = tenant + "/" + n.MediaPrefix
+	n.ArchivePrefix = tenant + "/" + n.ArchivePrefix
+	return n
+}
+
+// forTenant is the config of the server of tenant: a copy of c with the
+// settings under tenants over the deployment wide ones
+func (c *Config) forTenant(tenant string) *Config {
+	tc := *c
+	tc.Tenant = tenant
+	t, ok := c.Tenants[tenant]
+	if tenant == "" || !ok {
+		// validate complains about an unknown tenant
+		return &tc
+	}
+	overrides := []struct {
+		field *string
+		value string
+	}{
+		{&tc.BucketName, t.BucketName},
+		{&tc.ArchiveBucket, t.ArchiveBucket},
+		{&tc.BTInstance, t.BTInstance},
+		{&tc.MailFrom, t.MailFrom},
+	}
+	for _, o := range overrides {
+		if o.value != "" {
+			*o.field = o.value
+		}
+	}
+	if len(t.Admins) > 0 {
+		tc.Admins = t.Admins
+	}
+	tc.RedisDB = t.RedisDB
+	if tc.ArchiveIndex != "" {
+		tc.ArchiveIndex = tenant + "-" + tc.ArchiveIndex
+	}
+	return &tc
+}
+
+func (c *Config) validateTenants() []string {
+	var problems []string
+	if c.Tenant != "" {
+		if _, ok := c.Tenants[c.Tenant]; !ok {
+			problems = append(problems, fmt.Sprintf("tenant %q is not under tenants", c.Tenant))
+		}
+	}
+	// serve runs the default tenant next to the others, it keeps its own database
+	dbs := map[int]string{c.RedisDB: "redis_db"}
+	hosts := map[string]string{}
+	for name, t := range c.Tenants {
+		if !tenantPattern.MatchString(name) {
+			problems = append(problems, fmt.Sprintf("tenants: %q should be lowercase letters and digits, starting with a letter", name))
+		}
+		if t.RedisDB <= 0 {
+			problems = append(problems, fmt.Sprintf("tenants.%s.redis_db should be positive, 0 is the default tenant's", name))
+		} else if other, ok := dbs[t.RedisDB]; ok {
+			problems = append(problems, fmt.Sprintf("tenants.%s.redis_db is the same as %s", name, other))
+		}
+		dbs[t.RedisDB] = "tenants." + name + ".redis_db"
+		for _, h := range t.Hosts {
+			if other, ok := hosts[strings.ToLower(h)]; ok {
+				problems = append(problems, fmt.Sprintf("tenants.%s.hosts has %s of %s too", name, h, other))
+			}
+			hosts[strings.ToLower(h)] = name
+		}
+	}
+	return problems
+}
+
+// tenantServers are the servers of every tenant of the config, srv for its
+// own, the default tenant's and those under tenants. The others are wired
+// like srv and share its log.
+func (srv *Server) tenantServers() (map[string]*Server, error) {
+	servers := map[string]*Server{srv.Tenant: srv}
+	names := []string{""}
+	for name := range srv.deployment.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := servers[name]; ok {
+			continue
+		}
+		c := *srv.deployment
+		c.Tenant = name
+		s := NewServer(&c)
+		s.Log = srv.Log
+		if err := s.wireBackends(); err != nil {
+			return nil, err
+		}
+		servers[name] = s
+	}
+	return servers, nil
+}
+
+// tenantHandler sends each request to the handler of its tenant: the one of
+// the tenant claim when it has a token, else the one whose hosts have its
+// host, else the default tenant's. The claim isn't checked here, the server
+// of the tenant checks the token like any other.
+func (srv *Server) tenantHandler(handlers map[string]http.Handler) http.Handler {
+	hosts := map[string]string{}
+	for name, t := range srv.deployment.Tenants {
+		for _, h := range t.Hosts {
+			hosts[strings.ToLower(h)] = name
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := auth.TenantOf(requestToken(r))
+		if !ok {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			tenant = hosts[strings.ToLower(host)]
+		}
+		h, ok := handlers[tenant]
+		if !ok {
+			writeError(w, r, http.StatusUnauthorized, "Unknown tenant")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
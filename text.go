@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// the characters of a username beyond a-z, 0-9 and _ with unicode usernames:
+// lower case and caseless letters of every script, their combining marks and
+// digits. Upper case letters stay out like with ASCII, so nobody needs to
+// guess the case of a name.
+const usernameUnicodeClass = `\p{Ll}\p{Lm}\p{Lo}\p{Mn}\p{Mc}\p{Nd}_`
+
+// UsernamePolicy is what new usernames may look like, set under usernames in
+// the config. Login and the routes with a username take every name the policy
+// allows, so turning unicode off again locks out who signed up with one.
+type UsernamePolicy struct {
+	// letters and digits of every script, not only a-z and 0-9
+	Unicode bool `yaml:"unicode"`
+	// with unicode, the scripts letters may come from, e.g. [Latin, Han].
+	// Empty allows all, limiting them keeps out look alikes like a Cyrillic а.
+	Scripts []string `yaml:"scripts"`
+	// characters, 0 is no limit
+	MaxLength int `yaml:"max_length"`
+}
+
+func (p UsernamePolicy) validate() []string {
+	var problems []string
+	if len(p.Scripts) > 0 && !p.Unicode {
+		problems = append(problems, "usernames.scripts needs usernames.unicode")
+	}
+	for _, s := range p.Scripts {
+		if _, ok := unicode.Scripts[s]; !ok {
+			problems = append(problems, fmt.Sprintf("usernames.scripts: unknown script %q, names are like Latin or Han", s))
+		}
+	}
+	if p.MaxLength < 0 {
+		problems = append(problems, "usernames.max_length is negative, 0 is no limit")
+	}
+	return problems
+}
+
+// useUsernamePolicy makes the checks of usernames, the API description and
+// mentions follow config.Usernames. Runs once at startup.
+func (srv *Server) useUsernamePolicy() {
+	class := "a-z0-9_"
+	if srv.Config.Usernames.Unicode {
+		class = usernameUnicodeClass
+	}
+	usernameSchema.Pattern = "^[" + class + "]+$"
+	usernamePattern = regexp.MustCompile(usernameSchema.Pattern).MatchString
+	mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([` + class + `]+)`)
+}
+
+// usernameProblem is what is wrong with a new username by config.Usernames,
+// "" when nothing. The characters themselves are checked by usernamePattern.
+func (srv *Server) usernameProblem(name string) string {
+	p := srv.Config.Usernames
+	if p.MaxLength > 0 && utf8.RuneCountInString(name) > p.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", p.MaxLength)
+	}
+	if len(p.Scripts) == 0 {
+		return ""
+	}
+	for _, c := range name {
+		// digits, _ and combining marks belong to no script or to the one before
+		if !unicode.IsLetter(c) || c < utf8.RuneSelf {
+			continue
+		}
+		ok := false
+		for _, s := range p.Scripts {
+			if unicode.Is(unicode.Scripts[s], c) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Sprintf("may only have letters of %s", strings.Join(p.Scripts, ", "))
+		}
+	}
+	return ""
+}
+
+// normalizeQuery puts the query parameters of r in NFC, the same text typed
+// on two keyboards can arrive composed or decomposed
+func normalizeQuery(r *http.Request) {
+	if r.URL.RawQuery == "" {
+		return
+	}
+	q := r.URL.Query()
+	changed := false
+	for name, vals := range q {
+		for i, v := range vals {
+			if n := norm.NFC.String(v); n != v {
+				vals[i] = n
+				changed = true
+			}
+		}
+		q[name] = vals
+	}
+	if changed {
+		r.URL.RawQuery = q.Encode()
+	}
+}
+
+// normalizeForm is normalizeQuery for the fields of a parsed form
+func normalizeForm(r *http.Request) {
+	forms := []map[string][]string{r.Form, r.PostForm}
+	if r.MultipartForm != nil {
+		forms = append(forms, r.MultipartForm.Value)
+	}
+	for _, form := range forms {
+		for _, vals := range form {
+			for i, v := range vals {
+				vals[i] = norm.NFC.String(v)
+			}
+		}
+	}
+}
+
+// cleanText is text users write for others, like messages, without what can
+// hide or disguise content: control characters other than newline and tab,
+// bidi overrides and isolates, zero width spaces and other invisible format
+// characters. The joiners stay, emoji sequences and several scripts need them,
+// and so do the tags of subdivision flags.
+func cleanText(s string) string {
+	// \r\n from Windows clients and old Macs' \r are one line break
+	s = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(norm.NFC.String(s))
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c == '\n' || c == '\t':
+			return c
+		case c == '\u200c' || c == '\u200d':
+			return c
+		case c >= '\U000e0020' && c <= '\U000e007f':
+			return c
+		case unicode.IsControl(c), unicode.Is(unicode.Cf, c):
+			return -1
+		}
+		return c
+	}, s)
+}
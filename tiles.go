@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// the deepest zoom of the slippy maps, a tile is a few meters by then
+	TILE_MAX_ZOOM = 22
+	// cells across a tile, 256 pixels in cells of 32
+	TILE_CELLS = 8
+	// buckets of a tile at most, TILE_CELLS squared with room for the cells
+	// at the edges
+	TILE_MAX_BUCKETS = 1024
+	// the map pans over the same tiles again and again, browsers keep them this long
+	TILE_MAX_AGE = time.Minute
+)
+
+// tileCell is a cluster of the posts of a tile, a single post when Count is 1
+type tileCell struct {
+	Geohash string  `json:"geohash"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Count   int64   `json:"count"`
+}
+
+type tileCounts struct {
+	Z         int        `json:"z"`
+	X         int        `json:"x"`
+	Y         int        `json:"y"`
+	Precision int        `json:"precision"`
+	Total     int64      `json:"total"`
+	Cells     []tileCell `json:"cells"`
+}
+
+// tileBounds is the box of the web mercator tile z/x/y, the numbering of
+// OpenStreetMap and every slippy map
+func tileBounds(z, x, y int) (north, south, east, west float64) {
+	n := math.Exp2(float64(z))
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return lat(y), lat(y + 1), float64(x+1)/n*360 - 180, float64(x)/n*360 - 180
+}
+
+// tilePrecision is the geohash precision with cells that fit TILE_CELLS times
+// across a tile of zoom z. A geohash of precision p has 5p bits, longitude
+// takes the odd ones.
+func tilePrecision(z int) int {
+	width := 360 / math.Exp2(float64(z)) / TILE_CELLS
+	for p := 1; p < 12; p++ {
+		if 360/math.Exp2(float64((5*p+1)/2)) <= width {
+			return p
+		}
+	}
+	return 12
+}
+
+// handlerTile counts the posts of a map tile in cells for the map to draw as
+// clusters, the zoom picks the cell size
+//
+//	GET /tiles/{z}/{x}/{y}?category=
+//
+// geotile_grid would give cells that are the tiles of the next zooms, but it
+// came with ES 7 and the posts are in ES 2, so the cells are geohashes of
+// about the size. Counts are the same for every viewer and include posts of
+// private accounts, no post is shown.
+func (srv *Server) handlerTile(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	// types are checked by validateRequest already
+	z, _ := strconv.Atoi(mux.Vars(r)["z"])
+	x, _ := strconv.Atoi(mux.Vars(r)["x"])
+	y, _ := strconv.Atoi(mux.Vars(r)["y"])
+	if n := 1 << uint(z); x >= n || y >= n {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("Zoom %d has tiles 0 to %d", z, n-1))
+		return
+	}
+
+	north, south, east, west := tileBounds(z, x, y)
+	box := elastic.NewGeoBoundingBoxQuery("location").TopLeft(north, west).BottomRight(south, east)
+	query := elastic.NewBoolQuery().Filter(box, notDeleted())
+	if category := r.URL.Query().Get("category"); category != "" {
+		query = query.Filter(elastic.NewTermQuery("category", category))
+	}
+	t := tileCounts{Z: z, X: x, Y: y, Precision: tilePrecision(z), Cells: []tileCell{}}
+	cells := elastic.NewGeoHashGridAggregation().Field("location").Precision(t.Precision).Size(TILE_MAX_BUCKETS)
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.PostReadAlias).
+			Type(TYPE).
+			Query(query).
+			Aggregation("cells", cells).
+			Size(0).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to count posts", err)
+		return
+	}
+	t.Total = res.TotalHits()
+	if buckets, ok := res.Aggregations.GeoHash("cells"); ok {
+		for _, b := range buckets.Buckets {
+			hash, ok := b.Key.(string)
+			if !ok {
+				continue
+			}
+			// a cell at the edge reaches into the next tile, its point stays in this one
+			lat, lon := geohashCenter(hash)
+			lat = math.Max(south, math.Min(north, lat))
+			lon = math.Max(west, math.Min(east, lon))
+			t.Cells = append(t.Cells, tileCell{Geohash: hash, Lat: lat, Lon: lon, Count: b.DocCount})
+		}
+	}
+	srv.Log.Printf("Tile %d/%d/%d has %d posts in %d cells, took %v\n", z, x, y, t.Total, len(t.Cells), time.Since(started))
+
+	js, _ := json.Marshal(t)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(TILE_MAX_AGE.Seconds())))
+	if notModified(w, r, weakETag(js)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
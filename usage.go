@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// days of usage kept and the most GET /account/usage shows
+	USAGE_RETENTION_DAYS = 31
+	USAGE_DEFAULT_DAYS   = 7
+	// the in-memory counters without redis forget everything past this many entries
+	USAGE_LOCAL_MAX = 100000
+)
+
+// usageDay is what one principal did on one UTC day. Bytes are bodies as the
+// handlers read and wrote them, before compression.
+type usageDay struct {
+	Day          string  `json:"day"`
+	Requests     int64   `json:"requests"`
+	ClientErrors int64   `json:"client_errors"`
+	ServerErrors int64   `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	BytesIn      int64   `json:"bytes_in"`
+	BytesOut     int64   `json:"bytes_out"`
+}
+
+type usageReport struct {
+	// who the counts are of, like in the rate limiter: user:alice, service:01CK...
+	Principal string     `json:"principal"`
+	Class     string     `json:"class"`
+	Quota     UsageQuota `json:"quota"`
+	// newest first, today included
+	Days []usageDay `json:"days"`
+}
+
+// counters when redis is not setup, per instance like the rate limit counters
+type localUsage struct {
+	sync.Mutex
+	counts map[string]map[string]int64
+}
+
+// a redis hash with requests, client_errors, server_errors, bytes_in and bytes_out
+func usageKey(principal, day string) string {
+	return "around:usage:" + principal + ":" + day
+}
+
+// addUsage adds to the counters of principal on day and returns them after
+func (srv *Server) addUsage(principal, day string, add map[string]int64) (map[string]int64, error) {
+	key := usageKey(principal, day)
+	if srv.Redis != nil {
+		pipe := srv.Redis.TxPipeline()
+		for field, n := range add {
+			pipe.HIncrBy(key, field, n)
+		}
+		if len(add) > 0 {
+			// a day longer, clocks of the instances differ
+			pipe.Expire(key, (USAGE_RETENTION_DAYS+1)*24*time.Hour)
+		}
+		all := pipe.HGetAll(key)
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+		counts := map[string]int64{}
+		for field, v := range all.Val() {
+			counts[field], _ = strconv.ParseInt(v, 10, 64)
+		}
+		return counts, nil
+	}
+	srv.usageLocal.Lock()
+	defer srv.usageLocal.Unlock()
+	if srv.usageLocal.counts == nil || len(srv.usageLocal.counts) >= USAGE_LOCAL_MAX {
+		srv.usageLocal.counts = map[string]map[string]int64{}
+	}
+	counts, ok := srv.usageLocal.counts[key]
+	if !ok && len(add) > 0 {
+		counts = map[string]int64{}
+		srv.usageLocal.counts[key] = counts
+	}
+	for field, n := range add {
+		counts[field] += n
+	}
+	copied := map[string]int64{}
+	for field, n := range counts {
+		copied[field] = n
+	}
+	return copied, nil
+}
+
+// readUsage is the counters of principal over the last days UTC days, newest first
+func (srv *Server) readUsage(principal string, days int, now time.Time) ([]usageDay, error) {
+	now = now.UTC()
+	var out []usageDay
+	for i := 0; i < days; i++ {
+		day := now.AddDate(0, 0, -i).Format(DAY_FORMAT)
+		counts, err := srv.addUsage(principal, day, nil)
+		if err != nil {
+			return nil, err
+		}
+		d := usageDay{
+			Day:          day,
+			Requests:     counts["requests"],
+			ClientErrors: counts["client_errors"],
+			ServerErrors: counts["server_errors"],
+			BytesIn:      counts["bytes_in"],
+			BytesOut:     counts["bytes_out"],
+		}
+		if d.Requests > 0 {
+			d.ErrorRate = float64(d.ClientErrors+d.ServerErrors) / float64(d.Requests)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// usageMiddleware counts the requests, errors and bytes of every principal
+// per UTC day and refuses them with 429 once they are over the daily quota of
+// their class, see Config.Quotas. Runs after routing but before the rate
+// limiter, requests it refuses count too. The request is counted before it is
+// served, its errors and bytes after.
+func (srv *Server) usageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, class := srv.rateLimitKey(r)
+		now := time.Now().UTC()
+		day := now.Format(DAY_FORMAT)
+		counts, err := srv.addUsage(principal, day, map[string]int64{"requests": 1})
+		if err != nil {
+			// like the rate limiter, usage that is down lets requests through
+			srv.Log.Printf("[%s] Usage counting failed %v\n", requestID(r), err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		q := quotaFor(class)
+		if (q.Requests > 0 && counts["requests"] > q.Requests) || (q.Bytes > 0 && counts["bytes_out"] >= q.Bytes) {
+			midnight := now.Truncate(24*time.Hour).AddDate(0, 0, 1)
+			wait := int64((midnight.Sub(now) + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+			srv.addUsage(principal, day, map[string]int64{"client_errors": 1})
+			writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("Daily quota exceeded, retry in %ds", wait))
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		add := map[string]int64{"bytes_out": rec.bytes}
+		if r.ContentLength > 0 {
+			add["bytes_in"] = r.ContentLength
+		}
+		switch {
+		case rec.status >= 500:
+			add["server_errors"] = 1
+		case rec.status >= 400:
+			add["client_errors"] = 1
+		}
+		if _, err := srv.addUsage(principal, day, add); err != nil {
+			srv.Log.Printf("[%s] Usage counting failed %v\n", requestID(r), err)
+		}
+	})
+}
+
+// handlerUsage returns what the caller's token used per day and its quota.
+// Admins can look at anyone with ?principal=, e.g. service:<client id>.
+//
+//	GET /account/usage?days=7
+func (srv *Server) handlerUsage(w http.ResponseWriter, r *http.Request) {
+	principal, class := srv.rateLimitKey(r)
+	if p := r.URL.Query().Get("principal"); p != "" {
+		if _, scoped := tokenScope(r); scoped || !srv.isAdmin(usernameFromToken(r)) {
+			writeError(w, r, http.StatusForbidden, "Admin only")
+			return
+		}
+		principal, class = p, ""
+	}
+	days := USAGE_DEFAULT_DAYS
+	if v := r.URL.Query().Get("days"); v != "" {
+		// the range is checked by validateRequest already
+		days, _ = strconv.Atoi(v)
+	}
+
+	usage, err := srv.readUsage(principal, days, time.Now())
+	if err != nil {
+		writeBackendError(w, r, "Failed to read usage", err)
+		return
+	}
+	report := usageReport{Principal: principal, Class: class, Days: usage}
+	if class != "" {
+		report.Quota = quotaFor(class)
+	}
+	js, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -3,14 +3,18 @@ package main
 import (
 	elastic "gopkg.in/olivere/elastic.v3"
 
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
-	"reflect"
+	"net/mail"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 const (
@@ -23,155 +27,529 @@ var (
 	// $: ending
 	// [the message range]
 	// _: one or more
+	// letters of other scripts too with config.Usernames.Unicode, see useUsernamePolicy
 	usernamePattern = regexp.MustCompile(`^[a-z0-9_]+$`).MatchString
 )
 
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
-	Age      int    `json:”age”`
-	Gender   string `json:”gender”`
+	// profile, see profile.go
+	Email       string `json:"email,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	// YYYY-MM-DD
+	Birthdate string `json:"birthdate,omitempty"`
+	// one of genders or empty
+	Gender string `json:"gender,omitempty"`
+	// posts are only shown to accepted followers, see follow.go
+	Private bool `json:"private,omitempty"`
+	// shows up in GET /nearby-users while heartbeating, see presence.go
+	SharePresence bool `json:"share_presence,omitempty"`
+	// acts through a service account, see serviceaccounts.go
+	Bot bool `json:"bot,omitempty"`
+	// awarded by badges.go, in the order they were earned
+	Badges []Badge `json:"badges,omitempty"`
+	// oldest first, they redirect to this user, see username.go
+	PreviousUsernames []PreviousUsername `json:"previous_usernames,omitempty"`
+	// set by admins on request, see verification.go
+	Verified   bool       `json:"verified,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// IANA name like "Europe/Berlin", streak days end at its midnight, UTC if empty
+	TimeZone string `json:"time_zone,omitempty"`
+	// consecutive days with a post, kept by streaks.go
+	Streak Streak `json:"streak"`
+	// "daily" or "weekly" email of what is popular around Home, see digest.go
+	Digest       string     `json:"digest,omitempty"`
+	Home         *Location  `json:"home,omitempty"`
+	DigestSentAt *time.Time `json:"digest_sent_at,omitempty"`
+	// push and email per kind of notification, see notifications.go
+	NotificationPrefs NotificationPrefs `json:"notification_prefs"`
+	// E.164, only set through POST /phone. Login asks for a code texted to it
+	// when TwoFactor is on, see sms.go.
+	Phone         string `json:"phone,omitempty"`
+	PhoneVerified bool   `json:"phone_verified,omitempty"`
+	TwoFactor     bool   `json:"two_factor,omitempty"`
+	// read only until then, set by admins, see suspension.go
+	SuspendedUntil   *time.Time `json:"suspended_until,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	// what users gave at signup before birthdate existed, the tags were broken
+	// then so old documents have it as "Age" (decoding ignores case)
+	LegacyAge int `json:"age,omitempty"`
+	// the migration time for users from before the field existed
+	CreatedAt time.Time `json:"created_at"`
 }
 
-// checkUser checks whether user is valid
-func checkUser(username, password string) bool {
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+const (
+	BIRTHDATE_FORMAT = "2006-01-02"
+	// younger users need parental consent in most places
+	USER_MIN_AGE = 13
+)
+
+var genders = []string{"female", "male", "non_binary", "other"}
+
+// age in years from the birthdate, the legacy age without one, 0 if unknown
+func (u User) age(now time.Time) int {
+	b, err := time.Parse(BIRTHDATE_FORMAT, u.Birthdate)
 	if err != nil {
-		fmt.Printf("ES is not setup %v\n", err)
+		return u.LegacyAge
+	}
+	years := now.Year() - b.Year()
+	if now.YearDay() < b.YearDay() {
+		years--
+	}
+	return years
+}
+
+// normalizeUser lower cases what is compared case insensitively
+func normalizeUser(u *User) {
+	u.Email = strings.ToLower(strings.TrimSpace(u.Email))
+	u.Gender = strings.ToLower(strings.TrimSpace(u.Gender))
+	u.DisplayName = strings.TrimSpace(cleanText(u.DisplayName))
+	u.Bio = cleanText(u.Bio)
+	u.TimeZone = strings.TrimSpace(u.TimeZone)
+	u.Digest = strings.ToLower(strings.TrimSpace(u.Digest))
+	u.Phone = normalizePhone(u.Phone)
+}
+
+// validateUser checks the profile fields, signup and PUT /profile both go through it
+func validateUser(u User, now time.Time) []fieldError {
+	var errs []fieldError
+	bad := func(name, msg string) {
+		errs = append(errs, fieldError{Name: name, In: "body", Message: msg})
+	}
+	if u.Email != "" {
+		if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email {
+			bad("email", "must be an email address")
+		}
+	}
+	if len([]rune(u.DisplayName)) > PROFILE_MAX_DISPLAY_NAME {
+		bad("display_name", fmt.Sprintf("must be at most %d characters", PROFILE_MAX_DISPLAY_NAME))
+	}
+	if len([]rune(u.Bio)) > PROFILE_MAX_BIO {
+		bad("bio", fmt.Sprintf("must be at most %d characters", PROFILE_MAX_BIO))
+	}
+	if u.Avatar != "" {
+		if a, err := url.Parse(u.Avatar); err != nil || (a.Scheme != "http" && a.Scheme != "https") || a.Host == "" {
+			bad("avatar", "must be an http or https url")
+		}
+	}
+	if u.Birthdate != "" {
+		if b, err := time.Parse(BIRTHDATE_FORMAT, u.Birthdate); err != nil {
+			bad("birthdate", "must be a date like 2000-12-31")
+		} else if b.After(now) {
+			bad("birthdate", "must not be in the future")
+		} else if u.age(now) < USER_MIN_AGE {
+			bad("birthdate", fmt.Sprintf("users must be at least %d years old", USER_MIN_AGE))
+		}
+	}
+	if u.Gender != "" && !contains(genders, u.Gender) {
+		bad("gender", "must be one of "+strings.Join(genders, ", "))
+	}
+	if u.Home != nil && (math.Abs(u.Home.Lat) > 90 || math.Abs(u.Home.Lon) > 180) {
+		bad("home", "must be a lat between -90 and 90 and a lon between -180 and 180")
+	}
+	if u.Digest != "" {
+		if !contains(digestFrequencies, u.Digest) {
+			bad("digest", "must be one of "+strings.Join(digestFrequencies, ", "))
+		} else if u.Email == "" || u.Home == nil {
+			bad("digest", "needs an email and a home location")
+		}
+	}
+	if u.Phone != "" && !phonePattern(u.Phone) {
+		bad("phone", "must be a number with country code like +4915112345678")
+	}
+	if u.TwoFactor && !u.PhoneVerified {
+		bad("two_factor", "needs a verified phone")
+	}
+	errs = append(errs, u.NotificationPrefs.validate()...)
+	// LoadLocation takes "Local" too, that is the server's zone and not a user's
+	if u.TimeZone != "" {
+		if _, err := time.LoadLocation(u.TimeZone); err != nil || u.TimeZone == "Local" {
+			bad("time_zone", "must be a time zone like Europe/Berlin")
+		}
+	}
+	return errs
+}
+
+// checkUser checks whether user is valid
+func (srv *Server) checkUser(username, password string) bool {
+	u, ok := srv.getUser(username)
+	if !ok {
 		return false
 	}
+	return u.Password == password && u.Username == username
+}
 
-	// termquery: key word search
-	// termquery: only recognize lower case
-	// so we only allow lower case in username
-	// index: name DB
-	termQuery :=
-		elastic.NewTermQuery("username", username)
-	queryResult, err := es_client.Search().
-		Index(INDEX).
-		Query(termQuery).
-		Pretty(true).
-		Do()
+// getUser reads the user document, served from the in-process cache when possible
+func (srv *Server) getUser(username string) (User, bool) {
+	if u, ok := srv.userLookupCache.get(username); ok {
+		return u, true
+	}
+
+	es_client, err := srv.es()
 	if err != nil {
-		fmt.Printf("ES query failed %v\n", err)
-		return false
+		srv.Log.Printf("ES is not setup %v\n", err)
+		return User{}, false
+	}
+
+	var queryResult *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		queryResult, err = es_client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Query(userQuery(username)).
+			Pretty(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		srv.Log.Printf("ES query failed %v\n", err)
+		return User{}, false
 	}
 
-	var tyu User
-	// return value is a slice
-	// though iteration will run only once
-	for _, item := range queryResult.Each(reflect.TypeOf(tyu)) {
-		u := item.(User)
-		return u.Password == password && u.Username == username
+	if _, u := userHit(queryResult, username); u != nil {
+		// only cache hits, a missing user may sign up any moment
+		srv.userLookupCache.put(*u)
+		return *u, true
 	}
+	return User{}, false
+}
 
-	return false
+// userQuery finds the user document of username. username.raw has the name
+// as it is, users indexed before it existed only have the analyzed username,
+// which splits names in scripts without spaces like 张三. `around
+// migrate-users` gives them username.raw.
+func userQuery(username string) elastic.Query {
+	return elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("username.raw", username),
+		elastic.NewTermQuery("username", username))
+}
 
+// userHit is the hit of res that is the document of username, nil if none.
+// The analyzed field matches more than the name, e.g. 张 matches 张三.
+func userHit(res *elastic.SearchResult, username string) (*elastic.SearchHit, *User) {
+	if res.Hits == nil {
+		return nil, nil
+	}
+	for _, hit := range res.Hits.Hits {
+		var u User
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &u) != nil {
+			continue
+		}
+		if u.Username == username {
+			return hit, &u
+		}
+	}
+	return nil, nil
 }
 
 // Add a user. return true if success
-func addUser(user User) bool {
-	es_client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))
+func (srv *Server) addUser(user User) bool {
+	es_client, err := srv.es()
 	if err != nil {
-		fmt.Printf("ES is not setup %v\n", err)
+		srv.Log.Printf("ES is not setup %v\n", err)
 		return false
 
 	}
 
-	// check if user exist
-	termQuery := elastic.NewTermQuery("username", user.Username)
-	queryResult, err := es_client.Search().
-		Index(INDEX).
-		Query(termQuery).
-		Pretty(true).
-		Do()
+	// check if user exist, legacy users have random ids the create below can't see
+	var queryResult *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		queryResult, err = es_client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Query(userQuery(user.Username)).
+			Pretty(true).
+			Do()
+		return err
+	})
 	if err != nil {
-		fmt.Printf("ES query failed %v\n", err)
+		srv.Log.Printf("ES query failed %v\n", err)
 		return false
 	}
 
 	// just check if the user exist
 	// just to see result is none
-	if queryResult.TotalHits() > 0 {
-		fmt.Printf("User %s already exists, cannot create a new user", user.Username)
+	if hit, _ := userHit(queryResult, user.Username); hit != nil {
+		srv.Log.Printf("User %s already exists, cannot create a new user", user.Username)
 		return false
 	}
 
-	_, err = es_client.Index().
-		Index(INDEX).
-		Type(TYPE_USER).
-		Id(user.Username).
-		BodyJson(user).
-		Refresh(true).
-		Do()
+	// create fails on an existing id, two signups of one name can't both win
+	err = esRetry(func() error {
+		_, err := es_client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Id(user.Username).
+			OpType("create").
+			BodyJson(user).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+		srv.Log.Printf("User %s already exists, cannot create a new user", user.Username)
+		return false
+	}
 	if err != nil {
-		fmt.Printf("ES save user failed")
+		srv.Log.Printf("ES save user failed")
 		return false
 	}
+	srv.userLookupCache.invalidate(user.Username)
 	return true
 }
 
-func signupHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one sign up")
+func (srv *Server) signupHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Log.Println("Received one sign up")
 
 	decoder := json.NewDecoder(r.Body)
 	var u User
 	if err := decoder.Decode(&u); err != nil {
-		panic(err)
+		writeError(w, r, http.StatusBadRequest, "Cannot decode user data")
+		return
 	}
 
 	if u.Username != "" && u.Password != "" && usernamePattern(u.Username) {
-		if addUser(u) {
-			fmt.Println("User added successfully")
-			w.Write([]byte("User added successfully"))
+		normalizeUser(&u)
+		errs := validateUser(u, time.Now())
+		if msg := srv.usernameProblem(u.Username); msg != "" {
+			errs = append(errs, fieldError{Name: "username", In: "body", Message: msg})
+		} else if owner, _ := srv.renamedTo(u.Username); owner != "" {
+			// previous usernames stay with their user
+			errs = append(errs, fieldError{Name: "username", In: "body", Message: "is taken"})
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, r, errs)
+			return
+		}
+		// the legacy field is only read, signups give a birthdate
+		u.LegacyAge = 0
+		// a phone is only verified by the code texted to it
+		u.PhoneVerified = false
+		u.TwoFactor = false
+		// only admins verify accounts
+		u.Verified = false
+		u.VerifiedAt = nil
+		u.PreviousUsernames = nil
+		u.CreatedAt = time.Now().UTC()
+		if srv.addUser(u) {
+			srv.Log.Println("User added successfully")
+			if u.Phone != "" && srv.smsEnabled() {
+				// the user can ask for another code with POST /phone
+				go func() {
+					if err := srv.sendPhoneCode(u.Username, PHONE_PURPOSE_VERIFY, u.Phone); err != nil {
+						srv.Log.Printf("Failed to send the signup code of %s %v\n", u.Username, err)
+					}
+				}()
+			}
+			w.Write([]byte(localize(w, r, "User added successfully")))
 		} else {
-			fmt.Println("Failed to add a new user.")
-			http.Error(w, "Failed to add a new user", http.StatusInternalServerError)
+			srv.Log.Println("Failed to add a new user.")
+			writeError(w, r, http.StatusInternalServerError, "Failed to add a new user")
 
 		}
 
 	} else {
-		fmt.Println("Empty password or username.")
-		http.Error(w, "Empty password or username", http.StatusInternalServerError)
+		srv.Log.Println("Empty password or username.")
+		writeError(w, r, http.StatusBadRequest, "Empty password or username")
 
 	}
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 }
 
-// If login is successful, a new token is created.
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one login request")
+// updateUser overwrites the document of an existing user
+func (srv *Server) updateUser(user User) error {
+	es_client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	id, err := srv.userDocID(es_client, user.Username)
+	if err != nil {
+		return err
+	}
+
+	err = esRetry(func() error {
+		_, err := es_client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Id(id).
+			BodyJson(user).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	srv.userLookupCache.invalidate(user.Username)
+	return nil
+}
+
+// updateUserFields changes only the given fields of an existing user, for
+// background jobs that must not write back a stale document
+func (srv *Server) updateUserFields(username string, fields map[string]interface{}) error {
+	es_client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	id, err := srv.userDocID(es_client, username)
+	if err != nil {
+		return err
+	}
+
+	err = esRetry(func() error {
+		_, err := es_client.Update().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Id(id).
+			Doc(fields).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	srv.userLookupCache.invalidate(username)
+	return nil
+}
+
+// userDocID is the ES id of the user document. Users from before addUser set
+// the id have a random one, keep writing to that.
+func (srv *Server) userDocID(es_client *elastic.Client, username string) (string, error) {
+	var queryResult *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		queryResult, err = es_client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_USER).
+			Query(userQuery(username)).
+			Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if hit, _ := userHit(queryResult, username); hit != nil {
+		return hit.Id, nil
+	}
+	return username, nil
+}
+
+// usernameFromToken reads the username claim of the token checked by jwtMiddleware
+func usernameFromToken(r *http.Request) string {
+	return usernameFromContext(r.Context())
+}
+
+// usernameFromContext is usernameFromToken for code that only has the context, like GraphQL resolvers
+func usernameFromContext(ctx context.Context) string {
+	// "user" now is the token
+	// .(*jwt.Token) cast to a token type
+	// .(jwt.MapClaims) cast to a map token
+	// this map can get value from token string
+	user, ok := ctx.Value("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	username, _ := user.Claims.(jwt.MapClaims)["username"].(string)
+	return username
+}
+
+// body of POST /login, Code is only needed with two factor login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// userToken is the token a login of username gets, only this tenant accepts it
+func (srv *Server) userToken(username string) string {
+	tokenString, _ := srv.Tokens.Sign(jwt.MapClaims{
+		"username": username,
+		// Unix() change to second
+		"exp": time.Now().Add(time.Hour * 24).Unix(),
+		// the same user lands in the same variants on every login, see experiments.go
+		"experiments": assignBuckets(username),
+	})
+	return tokenString
+}
+
+// If login is successful, a new token is created. Users with two factor login
+// get 202 and a code by SMS for the right password, then log in again with it.
+func (srv *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	srv.Log.Println("Received one login request")
 
 	decoder := json.NewDecoder(r.Body)
-	var u User
+	var u loginRequest
 	if err := decoder.Decode(&u); err != nil {
-		panic(err)
+		writeError(w, r, http.StatusBadRequest, "Cannot decode user data")
 		return
 	}
 
 	// generate token
-	if checkUser(u.Username, u.Password) {
-		// generate token
-		token := jwt.New(jwt.SigningMethodHS256)
-		// payload
-		claims := token.Claims.(jwt.MapClaims)
-		/* Set token claims */
-		claims["username"] = u.Username
-		// Unix() change to second
-		claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-
-		/* Sign the token with our secret */
-		tokenString, _ := token.SignedString(mySigningKey)
+	if srv.checkUser(u.Username, u.Password) {
+		if !srv.secondFactor(w, r, u) {
+			return
+		}
+		tokenString := srv.userToken(u.Username)
 
 		/* Finally, write the token to the browser window */
 		w.Write([]byte(tokenString))
 	} else {
-		fmt.Println("Invalid password or username.")
-		http.Error(w, "Invalid password or username", http.StatusForbidden)
+		srv.Log.Println("Invalid password or username.")
+		writeError(w, r, http.StatusForbidden, "Invalid password or username")
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// secondFactor checks the SMS code of a two factor login, texting one when
+// it is missing. It answers the request itself when the login can't go on.
+func (srv *Server) secondFactor(w http.ResponseWriter, r *http.Request, req loginRequest) bool {
+	u, _ := srv.getUser(req.Username)
+	if !u.TwoFactor || !u.PhoneVerified {
+		return true
+	}
+	if req.Code == "" {
+		if !srv.smsEnabled() {
+			// no way to get a code, better locked out than let in without one
+			writeError(w, r, http.StatusServiceUnavailable, "SMS is not setup, two factor login is unavailable")
+			return false
+		}
+		err := srv.sendPhoneCode(u.Username, PHONE_PURPOSE_LOGIN, u.Phone)
+		// the earlier code is still good
+		if err != nil && err != errCodeTooSoon {
+			writePhoneCodeError(w, r, err)
+			return false
+		}
+		js, _ := json.Marshal(map[string]string{"two_factor": "sms", "phone": maskPhone(u.Phone)})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(js)
+		return false
+	}
+	err := srv.checkPhoneCode(u.Username, PHONE_PURPOSE_LOGIN, u.Phone, req.Code)
+	if err == errCodeWrong {
+		srv.Log.Printf("Wrong login code for %s\n", u.Username)
+		writeError(w, r, http.StatusForbidden, "Wrong or expired code")
+		return false
+	}
+	if err != nil {
+		writeBackendError(w, r, "Failed to check code", err)
+		return false
+	}
+	return true
+}
+
+// maskPhone shows the last digits only, for "code sent to ...78"
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return phone
+	}
+	return strings.Repeat("*", len(phone)-2) + phone[len(phone)-2:]
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	USER_CACHE_SIZE = 1024
+	USER_CACHE_TTL  = 5 * time.Minute
+)
+
+// userCache is a small LRU of user documents keyed by username,
+// entries expire after ttl so changes made by other instances show up eventually
+type userCache struct {
+	// handlers run in their own go routines
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	// front is the most recently used
+	order *list.List
+	items map[string]*list.Element
+}
+
+type userCacheEntry struct {
+	username string
+	user     User
+	expires  time.Time
+}
+
+func newUserCache(capacity int, ttl time.Duration) *userCache {
+	return &userCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached user, ok is false on miss or if the entry expired
+func (c *userCache) get(username string) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[username]
+	if !ok {
+		return User{}, false
+	}
+	entry := e.Value.(*userCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.items, username)
+		return User{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.user, true
+}
+
+func (c *userCache) put(u User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[u.Username]; ok {
+		entry := e.Value.(*userCacheEntry)
+		entry.user = u
+		entry.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(e)
+		return
+	}
+
+	e := c.order.PushFront(&userCacheEntry{
+		username: u.Username,
+		user:     u,
+		expires:  time.Now().Add(c.ttl),
+	})
+	c.items[u.Username] = e
+
+	// evict the least recently used
+	if c.order.Len() > c.capacity {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*userCacheEntry).username)
+	}
+}
+
+// invalidate must be called whenever the user document changes (profile, password)
+func (c *userCache) invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[username]; ok {
+		c.order.Remove(e)
+		delete(c.items, username)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_PREVIOUS_USERNAME = "previous_username"
+
+	// between two changes of a username, so links and mentions can catch up
+	USERNAME_CHANGE_COOLDOWN = 30 * 24 * time.Hour
+)
+
+// PreviousUsername is a name a user had, kept on the user document
+type PreviousUsername struct {
+	Name      string    `json:"name"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// usernameRedirect is stored in INDEX with the previous name as id and points
+// at the current name of its user. Previous names stay taken so links to them
+// keep working.
+type usernameRedirect struct {
+	Name      string    `json:"name"`
+	User      string    `json:"user"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// the payload of username.move, see moveUserDataLater
+type deadLetterRename struct {
+	Old  string `json:"old"`
+	Name string `json:"name"`
+}
+
+// ownedTypes are the documents in INDEX that name their user in a field. Their
+// ids don't have the name in them, a rename only updates the field.
+var ownedTypes = []struct{ typ, field string }{
+	{TYPE_COLLECTION, "owner"},
+	{TYPE_GEOFENCE, "owner"},
+	{TYPE_WEBHOOK, "owner"},
+	{TYPE_DEVICE, "user"},
+	{TYPE_WEBPUSH, "user"},
+	{TYPE_NOTIFICATION, "user"},
+}
+
+// addUser doesn't tell why it failed, mostly it is a signup taking the name first
+var errUsernameTaken = errors.New("username is taken")
+
+// body of PUT /account/username
+type usernameChange struct {
+	Username string `json:"username"`
+}
+
+// renamedTo is the current name of the user who had name before, "" when
+// nobody did
+func (srv *Server) renamedTo(name string) (string, error) {
+	client, err := srv.es()
+	if err != nil {
+		return "", err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_PREVIOUS_USERNAME).Id(name).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !res.Found || res.Source == nil {
+		return "", nil
+	}
+	var red usernameRedirect
+	if err := json.Unmarshal(*res.Source, &red); err != nil {
+		return "", err
+	}
+	return red.User, nil
+}
+
+// redirectRenamed answers a lookup of a previous username with a permanent
+// redirect to the same path with the current one. false when username is no
+// previous name, the handler answers then.
+func (srv *Server) redirectRenamed(w http.ResponseWriter, r *http.Request, username string) bool {
+	to, err := srv.renamedTo(username)
+	if err != nil {
+		srv.Log.Printf("Failed to look up previous username %s %v\n", username, err)
+		return false
+	}
+	if to == "" {
+		return false
+	}
+	u := *r.URL
+	u.Path = strings.Replace(u.Path, "/users/"+username, "/users/"+to, 1)
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	return true
+}
+
+// renamedMiddleware answers 401 to tokens of a username that was changed
+// since, the user logs in again with the new one. Users come from the user
+// cache, only a token without a user makes it look for a previous name.
+func (srv *Server) renamedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := usernameFromToken(r)
+		if username == "" || isGuest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := srv.getUser(username); !ok {
+			if to, err := srv.renamedTo(username); err == nil && to != "" {
+				writeError(w, r, http.StatusUnauthorized, "Username was changed, log in again")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlerChangeUsername gives the caller a new username. The user document
+// moves to the new name at once and the answer has a token for it, tokens of
+// the old name stop working. The old name redirects to the new one from then
+// on. Everything else of the user moves in the background, see moveUserData.
+//
+//	PUT /account/username {"username":"new_name"}
+func (srv *Server) handlerChangeUsername(w http.ResponseWriter, r *http.Request) {
+	old := usernameFromToken(r)
+	var req usernameChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode username")
+		return
+	}
+	name := strings.TrimSpace(req.Username)
+	msg := srv.usernameProblem(name)
+	if !usernamePattern(name) {
+		msg = "must be lower case letters, digits and _"
+	}
+	if name == old {
+		msg = "is the current username"
+	}
+	if msg != "" {
+		writeValidationError(w, r, []fieldError{{Name: "username", In: "body", Message: msg}})
+		return
+	}
+
+	u, ok := srv.getUser(old)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	now := time.Now().UTC()
+	if n := len(u.PreviousUsernames); n > 0 {
+		if retry := u.PreviousUsernames[n-1].ChangedAt.Add(USERNAME_CHANGE_COOLDOWN); now.Before(retry) {
+			// rounded up, a client retrying after 0 seconds would just be refused again
+			wait := int64((retry.Sub(now) + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+			writeError(w, r, http.StatusTooManyRequests, "Username was changed recently, retry on "+retry.Format(DAY_FORMAT))
+			return
+		}
+	}
+	if _, taken := srv.getUser(name); taken {
+		writeError(w, r, http.StatusConflict, "Username is taken")
+		return
+	}
+	// a previous name of someone else stays theirs, one's own can be taken back
+	owner, err := srv.renamedTo(name)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read username", err)
+		return
+	}
+	if owner != "" && owner != old {
+		writeError(w, r, http.StatusConflict, "Username is taken")
+		return
+	}
+
+	if err := srv.renameUser(u, name, now); err != nil {
+		writeBackendError(w, r, "Failed to change username", err)
+		return
+	}
+	srv.Log.Printf("%s is now %s\n", old, name)
+	srv.moveUserDataLater(old, name)
+
+	js, _ := json.Marshal(map[string]string{"username": name, "token": srv.userToken(name)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// renameUser saves u under name and points the old name and the ones before
+// it at name. The new document goes first, a failure leaves the old one.
+func (srv *Server) renameUser(u User, name string, now time.Time) error {
+	old := u.Username
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	oldID, err := srv.userDocID(client, old)
+	if err != nil {
+		return err
+	}
+
+	u.Username = name
+	u.PreviousUsernames = append(u.PreviousUsernames, PreviousUsername{Name: old, ChangedAt: now})
+	if !srv.addUser(u) {
+		return errUsernameTaken
+	}
+
+	bulk := client.Bulk()
+	bulk.Add(elastic.NewBulkIndexRequest().Index(srv.Names.Index).Type(TYPE_PREVIOUS_USERNAME).Id(old).Doc(usernameRedirect{Name: old, User: name, ChangedAt: now}))
+	// taking a previous name back, it isn't one any more
+	bulk.Add(elastic.NewBulkDeleteRequest().Index(srv.Names.Index).Type(TYPE_PREVIOUS_USERNAME).Id(name))
+	for _, p := range u.PreviousUsernames[:len(u.PreviousUsernames)-1] {
+		if p.Name != name {
+			bulk.Add(elastic.NewBulkUpdateRequest().Index(srv.Names.Index).Type(TYPE_PREVIOUS_USERNAME).Id(p.Name).Doc(map[string]string{"user": name}))
+		}
+	}
+	bulk.Add(elastic.NewBulkDeleteRequest().Index(srv.Names.Index).Type(TYPE_USER).Id(oldID))
+	var res *elastic.BulkResponse
+	err = esRetry(func() error {
+		var err error
+		res, err = bulk.Refresh(true).Do()
+		return err
+	})
+	srv.userLookupCache.invalidate(old)
+	srv.userLookupCache.invalidate(name)
+	if err != nil {
+		return err
+	}
+	// a name that wasn't a previous one has nothing to delete
+	for _, item := range res.Failed() {
+		if item.Status != http.StatusNotFound {
+			srv.Log.Printf("Failed to rename %s %s to %s %v\n", item.Type, item.Id, name, item.Error)
+		}
+	}
+	return nil
+}
+
+// moveUserDataLater is moveUserData in the background. A failure is dead
+// lettered as username.move, replaying it picks up where it stopped.
+func (srv *Server) moveUserDataLater(old, name string) {
+	go func() {
+		if err := srv.moveUserData(old, name); err != nil {
+			srv.deadLetter("username.move", deadLetterRename{Old: old, Name: name}, err)
+		}
+	}()
+}
+
+// moveUserData attributes what old did and has to name: the posts in ES,
+// Bigtable and the search backend, the follows and mutes from and of them, the
+// ownedTypes and the verification request. Reactions and views keep the old
+// name, it redirects. Every step looks for what still has old, so running it
+// again after a failure only does what is left.
+func (srv *Server) moveUserData(old, name string) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+
+	// deleted posts too, they can be restored
+	scroll := client.Scroll(srv.Names.PostReadAlias).
+		Type(TYPE).
+		Query(elastic.NewTermQuery("user", old)).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+	moved := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		bulk := client.Bulk()
+		var keys []string
+		var muts []*bigtable.Mutation
+		for _, hit := range res.Hits.Hits {
+			var p Post
+			if hit.Source == nil || json.Unmarshal(*hit.Source, &p) != nil {
+				continue
+			}
+			// hits of old posts may lack the id
+			p.Id, p.User = hit.Id, name
+			bulk.Add(elastic.NewBulkUpdateRequest().Index(hit.Index).Type(TYPE).Id(hit.Id).Doc(map[string]string{"user": name}))
+			keys = append(keys, hit.Id)
+			muts = append(muts, postMutation(p))
+			srv.syncSearch(p)
+			srv.invalidateSearchCache(p.Location.Lat, p.Location.Lon)
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		if err := bulkDo(bulk.Refresh(true)); err != nil {
+			return err
+		}
+		rowErrs, err := srv.Tables.ApplyBulk(context.Background(), srv.Names.PostTable, keys, muts)
+		if err != nil {
+			return err
+		}
+		for i, e := range rowErrs {
+			if e != nil {
+				srv.deadLetter("bigtable.post", deadLetterPost{Id: keys[i]}, e)
+			}
+		}
+		moved += len(keys)
+	}
+
+	follows, err := srv.queryFollows(elastic.NewBoolQuery().Should(
+		elastic.NewTermQuery("follower", old),
+		elastic.NewTermQuery("followee", old)))
+	if err != nil {
+		return err
+	}
+	for _, f := range follows {
+		if err := srv.deleteFollow(f.Follower, f.Followee); err != nil {
+			return err
+		}
+		if f.Follower == old {
+			f.Follower = name
+		}
+		if f.Followee == old {
+			f.Followee = name
+		}
+		if err := srv.saveFollow(f); err != nil {
+			return err
+		}
+	}
+
+	// mutes have ids like follows, muter>muted, but no helpers of their own
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_MUTE).
+			Query(elastic.NewBoolQuery().Should(
+				elastic.NewTermQuery("muter", old),
+				elastic.NewTermQuery("muted", old))).
+			Size(10000).
+			Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bulk := client.Bulk()
+	mutes := 0
+	for _, hit := range res.Hits.Hits {
+		var m Mute
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &m) != nil {
+			continue
+		}
+		bulk.Add(elastic.NewBulkDeleteRequest().Index(srv.Names.Index).Type(TYPE_MUTE).Id(hit.Id))
+		if m.Muter == old {
+			m.Muter = name
+		}
+		if m.Muted == old {
+			m.Muted = name
+		}
+		bulk.Add(elastic.NewBulkIndexRequest().Index(srv.Names.Index).Type(TYPE_MUTE).Id(m.Muter + ">" + m.Muted).Doc(m))
+		srv.mutedCache.invalidate(m.Muter)
+		mutes++
+	}
+	if bulk.NumberOfActions() > 0 {
+		if err := bulkDo(bulk.Refresh(true)); err != nil {
+			return err
+		}
+	}
+	srv.mutedCache.invalidate(old)
+	srv.invalidatePrivateUsers()
+
+	owned := 0
+	for _, o := range ownedTypes {
+		n, err := srv.renameOwner(client, o.typ, o.field, old, name)
+		if err != nil {
+			return err
+		}
+		owned += n
+	}
+	srv.invalidateGeofences()
+	srv.invalidateWebhooks()
+
+	if err := srv.moveVerification(client, old, name); err != nil {
+		return err
+	}
+	srv.Log.Printf("Moved %d posts, %d follows, %d mutes and %d other documents of %s to %s\n", moved, len(follows), mutes, owned, old, name)
+	return nil
+}
+
+// renameOwner sets field of the typ documents in INDEX that have old to name
+// and returns how many there were
+func (srv *Server) renameOwner(client *elastic.Client, typ, field, old, name string) (int, error) {
+	scroll := client.Scroll(srv.Names.Index).
+		Type(typ).
+		Query(elastic.NewTermQuery(field, old)).
+		Size(EXPORT_BATCH_SIZE).
+		Scroll(EXPORT_KEEP_ALIVE)
+	n := 0
+	for {
+		res, err := scroll.Do()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		bulk := client.Bulk()
+		for _, hit := range res.Hits.Hits {
+			bulk.Add(elastic.NewBulkUpdateRequest().Index(srv.Names.Index).Type(typ).Id(hit.Id).Doc(map[string]string{field: name}))
+		}
+		if bulk.NumberOfActions() == 0 {
+			continue
+		}
+		if err := bulkDo(bulk.Refresh(true)); err != nil {
+			return n, err
+		}
+		n += len(res.Hits.Hits)
+	}
+}
+
+// moveVerification stores the verification request of old, which has the
+// username as id, under name
+func (srv *Server) moveVerification(client *elastic.Client, old, name string) error {
+	v, err := srv.getVerification(old)
+	if err != nil || v == nil {
+		return err
+	}
+	v.Username = name
+	if err := srv.saveVerification(*v); err != nil {
+		return err
+	}
+	err = esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_VERIFICATION).Id(old).Refresh(true).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// handlerUsernameHistory lists the previous names of a user, newest first
+//
+//	GET /users/{username}/previous-usernames
+func (srv *Server) handlerUsernameHistory(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	u, ok := srv.getUser(username)
+	if !ok {
+		if !srv.redirectRenamed(w, r, username) {
+			writeError(w, r, http.StatusNotFound, "User not found")
+		}
+		return
+	}
+	names := make([]PreviousUsername, len(u.PreviousUsernames))
+	for i, p := range u.PreviousUsernames {
+		names[len(names)-1-i] = p
+	}
+	js, _ := json.Marshal(names)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
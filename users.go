@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	USER_PAGE_SIZE     = 20
+	USER_PAGE_MAX_SIZE = 100
+	// ES refuses from+size beyond its max_result_window
+	USER_PAGE_MAX_OFFSET = 10000
+)
+
+// PublicProfile is what other users see, no email, birthdate or age
+type PublicProfile struct {
+	Username    string     `json:"username"`
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"`
+	Avatar      string     `json:"avatar"`
+	Private     bool       `json:"private"`
+	Bot         bool       `json:"bot"`
+	Verified    bool       `json:"verified"`
+	Badges      []Badge    `json:"badges"`
+	Streak      streakView `json:"streak"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PostCount   int64      `json:"post_count"`
+}
+
+type userPage struct {
+	User  PublicProfile `json:"user"`
+	Posts []Post        `json:"posts"`
+	// offset of the next page, absent on the last one
+	Next *int `json:"next,omitempty"`
+}
+
+// handlerUserPage returns the public profile of a user and a page of their posts,
+// newest first. The posts of private accounts are only listed for followers.
+//
+//	GET /users/{username}?offset=&limit=
+func (srv *Server) handlerUserPage(w http.ResponseWriter, r *http.Request) {
+	viewer := usernameFromToken(r)
+	username := mux.Vars(r)["username"]
+	// types and ranges are checked by validateRequest already
+	limit := USER_PAGE_SIZE
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset+limit > USER_PAGE_MAX_OFFSET {
+		writeError(w, r, http.StatusBadRequest, "Cannot page that far, the newest posts come first")
+		return
+	}
+
+	u, ok := srv.getUser(username)
+	if !ok {
+		// links to a previous username keep working, see username.go
+		if !srv.redirectRenamed(w, r, username) {
+			writeError(w, r, http.StatusNotFound, "User not found")
+		}
+		return
+	}
+
+	ps, total, err := srv.postsByUser(username, offset, limit)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read posts", err)
+		return
+	}
+	if !srv.canSee(viewer, username) {
+		// the count is shown, like on the profile of a private account elsewhere
+		ps = nil
+	}
+
+	page := userPage{
+		User: PublicProfile{
+			Username:    u.Username,
+			DisplayName: u.DisplayName,
+			Bio:         u.Bio,
+			Avatar:      u.Avatar,
+			Private:     u.Private,
+			Bot:         u.Bot,
+			Verified:    u.Verified,
+			Badges:      badgesOf(u),
+			Streak:      streakOf(u, time.Now()),
+			CreatedAt:   u.CreatedAt,
+			PostCount:   total,
+		},
+		Posts: srv.withQuotes(viewer, ps),
+	}
+	if page.Posts == nil {
+		page.Posts = []Post{}
+	}
+	if next := offset + len(ps); int64(next) < total && len(ps) > 0 {
+		page.Next = &next
+	}
+
+	js, _ := json.Marshal(page)
+	if notModified(w, r, weakETag(js)) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
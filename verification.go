@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_VERIFICATION = "verification"
+
+	VERIFICATION_PENDING  = "pending"
+	VERIFICATION_APPROVED = "approved"
+	VERIFICATION_REJECTED = "rejected"
+
+	// runes of what the user tells admins, e.g. who they are and where to check
+	VERIFICATION_MAX_REASON = 1000
+	// pending requests an admin gets at once, the oldest first
+	VERIFICATION_PAGE_SIZE = 100
+)
+
+// VerificationRequest is stored in INDEX with the username as id, a user has
+// at most one. A rejected request can be submitted again and replaces the old
+// one, an approved one stays as the record of who verified the account.
+type VerificationRequest struct {
+	Username  string    `json:"username"`
+	Reason    string    `json:"reason"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	// the admin and when, once approved or rejected
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	// why it was rejected, shown to the user
+	Note string `json:"note,omitempty"`
+}
+
+// body of POST /verification and of POST /admin/verifications/{username}/reject
+type verificationReason struct {
+	Reason string `json:"reason"`
+}
+
+func (srv *Server) getVerification(username string) (*VerificationRequest, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_VERIFICATION).Id(username).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var v VerificationRequest
+	if err := json.Unmarshal(*res.Source, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (srv *Server) saveVerification(v VerificationRequest) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	return esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_VERIFICATION).
+			Id(v.Username).
+			BodyJson(v).
+			Refresh(true).
+			Do()
+		return err
+	})
+}
+
+func (srv *Server) pendingVerifications() ([]VerificationRequest, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_VERIFICATION).
+			Query(elastic.NewTermQuery("state", VERIFICATION_PENDING)).
+			Sort("created_at", true).
+			Size(VERIFICATION_PAGE_SIZE).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	vs := []VerificationRequest{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var v VerificationRequest
+		if err := json.Unmarshal(*hit.Source, &v); err != nil {
+			srv.Log.Printf("Skipping verification request %s %v\n", hit.Id, err)
+			continue
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// decodeVerificationReason reads the reason of the body. It answers the
+// request itself when the reason is missing or longer than max runes.
+func decodeVerificationReason(w http.ResponseWriter, r *http.Request, max int) (string, bool) {
+	var req verificationReason
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode verification request")
+		return "", false
+	}
+	req.Reason = strings.TrimSpace(cleanText(req.Reason))
+	n := utf8.RuneCountInString(req.Reason)
+	if n == 0 || n > max {
+		writeValidationError(w, r, []fieldError{{Name: "reason", In: "body", Message: fmt.Sprintf("must be 1 to %d characters", max)}})
+		return "", false
+	}
+	return req.Reason, true
+}
+
+// handlerRequestVerification asks admins to verify the caller's account. A
+// pending request is answered as it is, asking again doesn't move it back in
+// the queue.
+//
+//	POST /verification {"reason":"I run the bakery on Main St, see bakery.example"}
+func (srv *Server) handlerRequestVerification(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	reason, ok := decodeVerificationReason(w, r, VERIFICATION_MAX_REASON)
+	if !ok {
+		return
+	}
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if u.Verified {
+		writeError(w, r, http.StatusConflict, "Account is already verified")
+		return
+	}
+	v, err := srv.getVerification(username)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read verification request", err)
+		return
+	}
+	if v != nil && v.State == VERIFICATION_PENDING {
+		writeVerification(w, http.StatusOK, *v)
+		return
+	}
+	v = &VerificationRequest{Username: username, Reason: reason, State: VERIFICATION_PENDING, CreatedAt: time.Now().UTC()}
+	if err := srv.saveVerification(*v); err != nil {
+		writeBackendError(w, r, "Failed to save verification request", err)
+		return
+	}
+	srv.Log.Printf("%s asked to be verified\n", username)
+	writeVerification(w, http.StatusCreated, *v)
+}
+
+// handlerGetVerification tells the caller where their request stands
+//
+//	GET /verification
+func (srv *Server) handlerGetVerification(w http.ResponseWriter, r *http.Request) {
+	v, err := srv.getVerification(usernameFromToken(r))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read verification request", err)
+		return
+	}
+	if v == nil {
+		writeError(w, r, http.StatusNotFound, "No verification request")
+		return
+	}
+	writeVerification(w, http.StatusOK, *v)
+}
+
+// handlerPendingVerifications lists the requests waiting for an admin, admins only
+//
+//	GET /admin/verifications
+func (srv *Server) handlerPendingVerifications(w http.ResponseWriter, r *http.Request) {
+	vs, err := srv.pendingVerifications()
+	if err != nil {
+		writeBackendError(w, r, "Failed to read verification requests", err)
+		return
+	}
+	js, _ := json.Marshal(vs)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerApproveVerification verifies the account of a pending request, admins only
+//
+//	POST /admin/verifications/{username}/approve
+func (srv *Server) handlerApproveVerification(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	v, ok := srv.pendingVerification(w, r)
+	if !ok {
+		return
+	}
+	if err := srv.logModeration(ModerationAction{Moderator: admin, Action: MODERATION_VERIFY, User: v.Username}); err != nil {
+		writeBackendError(w, r, "Failed to log verification", err)
+		return
+	}
+	now := time.Now().UTC()
+	if err := srv.updateUserFields(v.Username, map[string]interface{}{"verified": true, "verified_at": now}); err != nil {
+		writeBackendError(w, r, "Failed to verify user", err)
+		return
+	}
+	v.State, v.DecidedBy, v.DecidedAt = VERIFICATION_APPROVED, admin, &now
+	if err := srv.saveVerification(*v); err != nil {
+		// the user is verified, the request only stays in the queue
+		srv.Log.Printf("Failed to save verification request of %s %v\n", v.Username, err)
+	}
+	srv.Log.Printf("%s verified %s\n", admin, v.Username)
+	srv.notifyLater(Notification{User: v.Username, Kind: "verification", Message: "Your account is verified", Data: map[string]string{"state": v.State}})
+	writeVerification(w, http.StatusOK, *v)
+}
+
+// handlerRejectVerification turns a pending request down with a reason the
+// user sees, admins only. The user may ask again.
+//
+//	POST /admin/verifications/{username}/reject {"reason":"The website doesn't mention you"}
+func (srv *Server) handlerRejectVerification(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	reason, ok := decodeVerificationReason(w, r, MODERATION_MAX_REASON)
+	if !ok {
+		return
+	}
+	v, ok := srv.pendingVerification(w, r)
+	if !ok {
+		return
+	}
+	if err := srv.logModeration(ModerationAction{Moderator: admin, Action: MODERATION_REJECT_VERIFICATION, User: v.Username, Reason: reason}); err != nil {
+		writeBackendError(w, r, "Failed to log rejection", err)
+		return
+	}
+	now := time.Now().UTC()
+	v.State, v.DecidedBy, v.DecidedAt, v.Note = VERIFICATION_REJECTED, admin, &now, reason
+	if err := srv.saveVerification(*v); err != nil {
+		writeBackendError(w, r, "Failed to reject verification request", err)
+		return
+	}
+	srv.Log.Printf("%s rejected the verification of %s: %s\n", admin, v.Username, reason)
+	srv.notifyLater(Notification{User: v.Username, Kind: "verification", Message: "Your verification request was declined: " + reason, Data: map[string]string{"state": v.State}})
+	writeVerification(w, http.StatusOK, *v)
+}
+
+// handlerRevokeVerification takes the verified flag off an account, e.g. one
+// that was sold, admins only. The user may ask again.
+//
+//	DELETE /admin/users/{username}/verification
+func (srv *Server) handlerRevokeVerification(w http.ResponseWriter, r *http.Request) {
+	admin := usernameFromToken(r)
+	username := mux.Vars(r)["username"]
+	u, ok := srv.getUser(username)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "User not found")
+		return
+	}
+	if !u.Verified {
+		writeError(w, r, http.StatusConflict, "Account is not verified")
+		return
+	}
+	if err := srv.logModeration(ModerationAction{Moderator: admin, Action: MODERATION_UNVERIFY, User: username}); err != nil {
+		writeBackendError(w, r, "Failed to log revoking the verification", err)
+		return
+	}
+	// nil clears the field, the update merges the rest
+	if err := srv.updateUserFields(username, map[string]interface{}{"verified": nil, "verified_at": nil}); err != nil {
+		writeBackendError(w, r, "Failed to revoke verification", err)
+		return
+	}
+	srv.Log.Printf("%s revoked the verification of %s\n", admin, username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pendingVerification loads the pending request of the {username} in the
+// path, answering 404 when there is none
+func (srv *Server) pendingVerification(w http.ResponseWriter, r *http.Request) (*VerificationRequest, bool) {
+	v, err := srv.getVerification(mux.Vars(r)["username"])
+	if err != nil {
+		writeBackendError(w, r, "Failed to read verification request", err)
+		return nil, false
+	}
+	if v == nil || v.State != VERIFICATION_PENDING {
+		writeError(w, r, http.StatusNotFound, "No pending verification request")
+		return nil, false
+	}
+	return v, true
+}
+
+func writeVerification(w http.ResponseWriter, status int, v VerificationRequest) {
+	js, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// /api/v2, /api/v10 ... anything that already names a version
+var versionedPath = regexp.MustCompile(`^` + API_ROOT + `/v[0-9]+(/|$)`)
+
+// legacyAPIShim serves the unversioned paths (/api/post, /api/search, ...) of apps
+// released before versioning as /api/v1. The response says so in Deprecation and
+// Link headers, so clients can move over before v1 is retired.
+// A version we don't have, e.g. /api/v3, is a plain 404.
+func legacyAPIShim(v1 http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if versionedPath.MatchString(r.URL.Path) {
+			writeError(w, r, http.StatusNotFound, "Unknown API version")
+			return
+		}
+
+		path := API_V1 + strings.TrimPrefix(r.URL.Path, API_ROOT)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+path+">; rel=\"successor-version\"")
+
+		// shallow copy is enough, only the path changes
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = path
+		u.RawPath = ""
+		r2.URL = &u
+		v1.ServeHTTP(w, r2)
+	})
+}
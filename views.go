@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_VIEW = "view"
+
+	// counters are added up in memory and written to the posts this often
+	COUNTER_FLUSH_INTERVAL = 10 * time.Second
+	// a user viewing a post again the same (UTC) day is not another view
+	VIEW_DEDUP_TTL = 24 * time.Hour
+	// the in-memory dedup without redis forgets everything past this many
+	VIEW_LOCAL_MAX = 100000
+)
+
+// postCounts are the increments of one post waiting for the next flush
+type postCounts struct {
+	Views       int64
+	Impressions int64
+}
+
+// View is the tracking record of one counted view, what analytics.go
+// aggregates. Stored in INDEX as post>user>day, so writing it twice is harmless.
+type View struct {
+	PostID string `json:"post_id"`
+	User   string `json:"user"`
+	// from where the viewer was to the post, absent when the client didn't say
+	DistanceKm *float64  `json:"distance_km,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// what is counted until the next flush
+type pendingCounters struct {
+	sync.Mutex
+	// post id -> increments not written yet
+	counts map[string]*postCounts
+	// views not written yet
+	views []View
+}
+
+// dedup of views when redis is not setup, keyed like the redis keys and
+// dropped when the day changes
+type localViews struct {
+	sync.Mutex
+	seen map[string]bool
+	day  string
+}
+
+func (srv *Server) addCounts(id string, views, impressions int64) {
+	srv.counters.Lock()
+	defer srv.counters.Unlock()
+	c, ok := srv.counters.counts[id]
+	if !ok {
+		c = &postCounts{}
+		srv.counters.counts[id] = c
+	}
+	c.Views += views
+	c.Impressions += impressions
+}
+
+// countImpressions counts one impression for each post that goes out in a search response
+func (srv *Server) countImpressions(ps []Post) {
+	for _, p := range ps {
+		srv.addCounts(p.Id, 0, 1)
+	}
+}
+
+// firstView is true the first time username views post id on the UTC day of now
+func (srv *Server) firstView(id, username string, now time.Time) (bool, error) {
+	day := now.UTC().Format(DAY_FORMAT)
+	key := "around:view:" + day + ":" + id + ":" + username
+	if srv.Redis != nil {
+		return srv.Redis.SetNX(key, 1, VIEW_DEDUP_TTL).Result()
+	}
+	srv.viewLocal.Lock()
+	defer srv.viewLocal.Unlock()
+	if day != srv.viewLocal.day || len(srv.viewLocal.seen) >= VIEW_LOCAL_MAX {
+		srv.viewLocal.seen = map[string]bool{}
+		srv.viewLocal.day = day
+	}
+	if srv.viewLocal.seen[key] {
+		return false, nil
+	}
+	srv.viewLocal.seen[key] = true
+	return true, nil
+}
+
+func (srv *Server) addView(v View) {
+	srv.counters.Lock()
+	defer srv.counters.Unlock()
+	srv.counters.views = append(srv.counters.views, v)
+}
+
+// handlerView counts a view of the post by the caller, once per day. Clients
+// that know where the viewer is send lat and lon for the distance analytics.
+//
+//	POST /post/{id}/view?lat=&lon=
+func (srv *Server) handlerView(w http.ResponseWriter, r *http.Request) {
+	_, _, p, ok := srv.visiblePost(w, r)
+	if !ok {
+		return
+	}
+	username := usernameFromToken(r)
+	now := time.Now().UTC()
+	first, err := srv.firstView(p.Id, username, now)
+	if err != nil {
+		// a view is not worth failing the client for, it just isn't counted
+		srv.Log.Printf("Failed to dedup view of %s %v\n", p.Id, err)
+	} else if first {
+		srv.addCounts(p.Id, 1, 0)
+		v := View{PostID: p.Id, User: username, CreatedAt: now}
+		// types are checked by validateRequest already, one without the other is ignored
+		if q := r.URL.Query(); q.Get("lat") != "" && q.Get("lon") != "" {
+			lat, _ := strconv.ParseFloat(q.Get("lat"), 64)
+			lon, _ := strconv.ParseFloat(q.Get("lon"), 64)
+			d := distanceKm(lat, lon, p.Location.Lat, p.Location.Lon)
+			v.DistanceKm = &d
+		}
+		srv.addView(v)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func viewID(v View) string {
+	return v.PostID + ">" + v.User + ">" + v.CreatedAt.Format(DAY_FORMAT)
+}
+
+// runCounterFlush writes the pending counters every COUNTER_FLUSH_INTERVAL,
+// started by the server
+func (srv *Server) runCounterFlush() {
+	for {
+		time.Sleep(COUNTER_FLUSH_INTERVAL)
+		srv.flushCounters()
+	}
+}
+
+// flushCounters adds the pending increments to the posts with one bulk of
+// scripted updates. What fails is put back for the next flush.
+func (srv *Server) flushCounters() {
+	srv.counters.Lock()
+	pending, views := srv.counters.counts, srv.counters.views
+	srv.counters.counts, srv.counters.views = map[string]*postCounts{}, nil
+	srv.counters.Unlock()
+
+	if len(views) > 0 {
+		if err := srv.writeViews(views); err != nil {
+			srv.Log.Printf("Failed to write %d views %v\n", len(views), err)
+			// ids are deterministic, the ones that did go through are only overwritten
+			for _, v := range views {
+				srv.addView(v)
+			}
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	failed, err := srv.writeCounters(pending)
+	if err != nil {
+		srv.Log.Printf("Failed to write counters of %d posts %v\n", len(failed), err)
+	}
+	for _, id := range failed {
+		srv.addCounts(id, pending[id].Views, pending[id].Impressions)
+	}
+}
+
+// writeCounters returns the ids whose counts were not written
+func (srv *Server) writeCounters(pending map[string]*postCounts) ([]string, error) {
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	client, err := srv.es()
+	if err != nil {
+		return ids, err
+	}
+	// posts live in monthly indices, the update has to name the one holding the post
+	indices, err := srv.postIndices(client, ids)
+	if err != nil {
+		return ids, err
+	}
+
+	bulk := client.Bulk()
+	for id, index := range indices {
+		c := pending[id]
+		// a script adds to what is there, a partial doc would overwrite what other instances counted
+		script := elastic.NewScript("ctx._source.views = (ctx._source.views ?: 0) + views; " +
+			"ctx._source.impressions = (ctx._source.impressions ?: 0) + impressions").
+			Params(map[string]interface{}{"views": c.Views, "impressions": c.Impressions})
+		bulk.Add(elastic.NewBulkUpdateRequest().Index(index).Type(TYPE).Id(id).Script(script))
+	}
+	// posts purged in the meantime are dropped with their counts
+	if bulk.NumberOfActions() == 0 {
+		return nil, nil
+	}
+	// not bulkDo, the items that went through must not be counted again
+	var bres *elastic.BulkResponse
+	err = esRetry(func() error {
+		var err error
+		bres, err = bulk.Do()
+		return err
+	})
+	if err != nil {
+		return ids, err
+	}
+	var failed []string
+	for _, item := range bres.Failed() {
+		failed = append(failed, item.Id)
+	}
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("%d bulk items failed, first: %s %v", len(failed), failed[0], bres.Failed()[0].Error)
+	}
+	return nil, nil
+}
+
+func (srv *Server) writeViews(views []View) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	bulk := client.Bulk()
+	for _, v := range views {
+		bulk.Add(elastic.NewBulkIndexRequest().Index(srv.Names.Index).Type(TYPE_VIEW).Id(viewID(v)).Doc(v))
+	}
+	return bulkDo(bulk)
+}
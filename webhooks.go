@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TianyiSun2333/Around/requestid"
+	"github.com/gorilla/mux"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	// webhooks live next to the users in the legacy index
+	TYPE_WEBHOOK = "webhook"
+	// enabled hooks are matched in memory, reloaded from ES this often
+	WEBHOOK_CACHE_TTL = time.Minute
+	// per attempt
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	// 1s, 2s, 4s ... between attempts, capped at WEBHOOK_MAX_DELAY
+	WEBHOOK_ATTEMPTS   = 6
+	WEBHOOK_BASE_DELAY = time.Second
+	WEBHOOK_MAX_DELAY  = time.Minute
+	// a hook that failed this many posts in a row is disabled
+	WEBHOOK_MAX_FAILURES = 20
+	WEBHOOK_MAX_PER_USER = 10
+	WEBHOOK_MAX_KEYWORDS = 20
+)
+
+// Webhook is a URL that gets every new post inside its geofence, optionally only
+// posts whose message contains one of the keywords.
+type Webhook struct {
+	Id       string   `json:"id"`
+	Owner    string   `json:"owner"`
+	URL      string   `json:"url"`
+	Location Location `json:"location"`
+	Range    float64  `json:"range"` // km
+	Keywords []string `json:"keywords,omitempty"`
+	// signs every delivery, only returned when created or rotated
+	Secret    string    `json:"secret,omitempty"`
+	Disabled  bool      `json:"disabled"`
+	Failures  int       `json:"failures"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// body of POST /webhooks
+type webhookRequest struct {
+	URL      string   `json:"url"`
+	Lat      float64  `json:"lat"`
+	Lon      float64  `json:"lon"`
+	Range    float64  `json:"range"`
+	Keywords []string `json:"keywords"`
+}
+
+// webhookPayload is what a hook receives. The receiver checks X-Around-Signature,
+// hex HMAC-SHA256 with the secret over "<X-Around-Timestamp>.<body>".
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	Delivery  string    `json:"delivery"`
+	WebhookID string    `json:"webhook_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Post      Post      `json:"post"`
+}
+
+func (h *Webhook) matches(p Post) bool {
+	if h.Disabled || distanceKm(h.Location.Lat, h.Location.Lon, p.Location.Lat, p.Location.Lon) > h.Range {
+		return false
+	}
+	if len(h.Keywords) == 0 {
+		return true
+	}
+	message := strings.ToLower(p.Message)
+	for _, k := range h.Keywords {
+		if strings.Contains(message, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// public hides the secret
+func (h Webhook) public() Webhook {
+	h.Secret = ""
+	return h
+}
+
+// enabled hooks, cached so creating a post doesn't cost an extra ES query
+type enabledWebhooks struct {
+	sync.Mutex
+	hooks    []Webhook
+	loadedAt time.Time
+}
+
+func (srv *Server) enabledWebhooks() ([]Webhook, error) {
+	srv.webhookCache.Lock()
+	defer srv.webhookCache.Unlock()
+	if srv.webhookCache.hooks != nil && time.Since(srv.webhookCache.loadedAt) < WEBHOOK_CACHE_TTL {
+		return srv.webhookCache.hooks, nil
+	}
+	hooks, err := srv.queryWebhooks(elastic.NewTermQuery("disabled", false))
+	if err != nil {
+		return nil, err
+	}
+	srv.webhookCache.hooks = hooks
+	srv.webhookCache.loadedAt = time.Now()
+	return hooks, nil
+}
+
+// invalidateWebhooks makes the next post reload, other instances catch up within WEBHOOK_CACHE_TTL
+func (srv *Server) invalidateWebhooks() {
+	srv.webhookCache.Lock()
+	srv.webhookCache.hooks = nil
+	srv.webhookCache.Unlock()
+}
+
+func (srv *Server) queryWebhooks(q elastic.Query) ([]Webhook, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.SearchResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_WEBHOOK).
+			Query(q).
+			Size(1000).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	for _, hit := range res.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var h Webhook
+		if err := json.Unmarshal(*hit.Source, &h); err != nil {
+			srv.Log.Printf("Skipping webhook %s %v\n", hit.Id, err)
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+func (srv *Server) saveWebhook(h Webhook) error {
+	client, err := srv.es()
+	if err != nil {
+		return err
+	}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_WEBHOOK).
+			Id(h.Id).
+			BodyJson(h).
+			Refresh(true).
+			Do()
+		return err
+	})
+	srv.invalidateWebhooks()
+	return err
+}
+
+// getWebhook reads one hook, nil if there is none with that id
+func (srv *Server) getWebhook(id string) (*Webhook, error) {
+	client, err := srv.es()
+	if err != nil {
+		return nil, err
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_WEBHOOK).Id(id).Do()
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !res.Found || res.Source == nil {
+		return nil, nil
+	}
+	var h Webhook
+	if err := json.Unmarshal(*res.Source, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// validWebhookURL only allows https to a public host, the resolved address is
+// checked again when dialing
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return false
+	}
+	return u.Hostname() != "localhost"
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	// 10/8, 172.16/12, 192.168/16, fc00::/7
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookClient refuses to connect to internal addresses, so a hook can't be
+// pointed at the metadata server or ES behind a public DNS name
+var webhookClient = &http.Client{
+	Timeout: WEBHOOK_TIMEOUT,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if publicIP(ip.IP) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+				}
+			}
+			return nil, fmt.Errorf("webhook host %s has no public address", host)
+		},
+		TLSHandshakeTimeout: WEBHOOK_TIMEOUT,
+	},
+	// a redirect could lead anywhere
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// notifyWebhooks delivers p to every matching hook, each in its own go routine
+// so a slow receiver only delays itself. Called after a post is saved.
+func (srv *Server) notifyWebhooks(p Post) {
+	hooks, err := srv.enabledWebhooks()
+	if err != nil {
+		srv.Log.Printf("Failed to load webhooks, post %s not delivered %v\n", p.Id, err)
+		return
+	}
+	for i := range hooks {
+		// a hook gets what the feed of its owner would
+		if hooks[i].matches(p) && srv.inFeed(hooks[i].Owner, p.User) {
+			go srv.deliverWebhook(hooks[i], p)
+		}
+	}
+}
+
+// deliverWebhook posts the payload with backoff until the receiver answers 2xx.
+// A 4xx other than 408/429 means the receiver rejects it, that is not retried.
+// Pending retries are lost if the process stops.
+func (srv *Server) deliverWebhook(h Webhook, p Post) {
+	body, err := json.Marshal(webhookPayload{
+		Event:     "post.created",
+		Delivery:  requestid.New(),
+		WebhookID: h.Id,
+		CreatedAt: time.Now().UTC(),
+		Post:      p,
+	})
+	if err != nil {
+		srv.Log.Printf("Failed to encode webhook payload %v\n", err)
+		return
+	}
+
+	delay := WEBHOOK_BASE_DELAY
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		start := time.Now()
+		err = sendWebhook(h, body)
+		observeBackend("webhook", start, err)
+		if err == nil {
+			if h.Failures > 0 {
+				srv.recordWebhookResult(h.Id, true)
+			}
+			return
+		}
+		if _, ok := err.(*permanentError); ok {
+			break
+		}
+		if attempt < WEBHOOK_ATTEMPTS {
+			time.Sleep(delay)
+			if delay *= 2; delay > WEBHOOK_MAX_DELAY {
+				delay = WEBHOOK_MAX_DELAY
+			}
+		}
+	}
+	srv.Log.Printf("Webhook %s gave up on post %s %v\n", h.Id, p.Id, err)
+	srv.recordWebhookResult(h.Id, false)
+}
+
+func sendWebhook(h Webhook, body []byte) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Around-Webhooks/1")
+	req.Header.Set("X-Around-Event", "post.created")
+	req.Header.Set("X-Around-Timestamp", ts)
+	req.Header.Set("X-Around-Signature", "sha256="+signWebhook(h.Secret, ts, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return permanent(fmt.Errorf("webhook answered %d", resp.StatusCode))
+	}
+	return fmt.Errorf("webhook answered %d", resp.StatusCode)
+}
+
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// recordWebhookResult resets or counts consecutive failures, too many disable the hook
+func (srv *Server) recordWebhookResult(id string, ok bool) {
+	h, err := srv.getWebhook(id)
+	if err != nil || h == nil {
+		return
+	}
+	if ok {
+		h.Failures = 0
+	} else {
+		h.Failures++
+		if h.Failures >= WEBHOOK_MAX_FAILURES && !h.Disabled {
+			srv.Log.Printf("Disabling webhook %s of %s after %d failures\n", h.Id, h.Owner, h.Failures)
+			h.Disabled = true
+		}
+	}
+	if err := srv.saveWebhook(*h); err != nil {
+		srv.Log.Printf("Failed to update webhook %s %v\n", id, err)
+	}
+}
+
+// handlerCreateWebhook registers a hook for the caller, the response is the only
+// time the secret is shown besides rotating it.
+func (srv *Server) handlerCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode webhook")
+		return
+	}
+	if !validWebhookURL(req.URL) {
+		writeError(w, r, http.StatusBadRequest, "url should be https to a public host")
+		return
+	}
+	if len(req.Keywords) > WEBHOOK_MAX_KEYWORDS {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("At most %d keywords", WEBHOOK_MAX_KEYWORDS))
+		return
+	}
+
+	own, err := srv.queryWebhooks(elastic.NewTermQuery("owner", username))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read webhooks", err)
+		return
+	}
+	if len(own) >= WEBHOOK_MAX_PER_USER {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("At most %d webhooks per user", WEBHOOK_MAX_PER_USER))
+		return
+	}
+
+	h := Webhook{
+		Id:        newPostID(time.Now()),
+		Owner:     username,
+		URL:       req.URL,
+		Location:  Location{Lat: req.Lat, Lon: req.Lon},
+		Range:     req.Range,
+		Keywords:  req.Keywords,
+		Secret:    newWebhookSecret(),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := srv.saveWebhook(h); err != nil {
+		writeBackendError(w, r, "Failed to save webhook", err)
+		return
+	}
+	srv.Log.Printf("Webhook %s registered by %s\n", h.Id, username)
+
+	js, _ := json.Marshal(h)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handlerListWebhooks returns the hooks of the caller without secrets
+func (srv *Server) handlerListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := srv.queryWebhooks(elastic.NewTermQuery("owner", usernameFromToken(r)))
+	if err != nil {
+		writeBackendError(w, r, "Failed to read webhooks", err)
+		return
+	}
+	for i := range hooks {
+		hooks[i] = hooks[i].public()
+	}
+	js, _ := json.Marshal(hooks)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerRotateWebhook replaces the secret, deliveries are signed with the new one right away
+func (srv *Server) handlerRotateWebhook(w http.ResponseWriter, r *http.Request) {
+	h, ok := srv.ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	h.Secret = newWebhookSecret()
+	if err := srv.saveWebhook(*h); err != nil {
+		writeBackendError(w, r, "Failed to save webhook", err)
+		return
+	}
+	js, _ := json.Marshal(h)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerDisableWebhook and handlerEnableWebhook switch deliveries off and on,
+// enabling also forgets past failures
+func (srv *Server) handlerDisableWebhook(w http.ResponseWriter, r *http.Request) {
+	srv.setWebhookDisabled(w, r, true)
+}
+
+func (srv *Server) handlerEnableWebhook(w http.ResponseWriter, r *http.Request) {
+	srv.setWebhookDisabled(w, r, false)
+}
+
+func (srv *Server) setWebhookDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	h, ok := srv.ownWebhook(w, r)
+	if !ok {
+		return
+	}
+	h.Disabled = disabled
+	if !disabled {
+		h.Failures = 0
+	}
+	if err := srv.saveWebhook(*h); err != nil {
+		writeBackendError(w, r, "Failed to save webhook", err)
+		return
+	}
+	js, _ := json.Marshal(h.public())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// ownWebhook reads the hook in the path, answering 404 unless the caller owns it
+func (srv *Server) ownWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	id := mux.Vars(r)["id"]
+	h, err := srv.getWebhook(id)
+	if err != nil {
+		writeBackendError(w, r, "Failed to read webhook", err)
+		return nil, false
+	}
+	// somebody else's hook is none of your business, not even its existence
+	if h == nil || h.Owner != usernameFromToken(r) {
+		writeError(w, r, http.StatusNotFound, "Webhook not found")
+		return nil, false
+	}
+	return h, true
+}
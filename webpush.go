@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+const (
+	TYPE_WEBPUSH = "webpush"
+
+	WEBPUSH_TIMEOUT = 10 * time.Second
+	// how long the push service keeps a message for an offline browser
+	WEBPUSH_TTL = 24 * time.Hour
+	// VAPID tokens may live up to 24h, fresh ones are cheap
+	WEBPUSH_JWT_TTL = 12 * time.Hour
+	// record size of the aes128gcm encoding, the payload is one record
+	WEBPUSH_RECORD_SIZE = 4096
+)
+
+// WebPushSubscription is what PushManager.subscribe() gives the browser, stored
+// per endpoint. Pushes for the user go to these next to their FCM devices.
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// the browser's P-256 public key and the auth secret, base64url
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (srv *Server) webPushEnabled() bool {
+	return srv.Config.VAPIDPrivateKey != ""
+}
+
+func webPushID(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(sum[:])
+}
+
+// browsers send unpadded base64url, some libraries pad it
+func decodeBase64URL(s string) ([]byte, error) {
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// vapidKey parses the private key of the config, base64url of the 32 byte scalar
+// like `around vapid-keys` prints it
+func (srv *Server) vapidKey() (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64URL(srv.Config.VAPIDPrivateKey)
+	if err != nil || len(d) != 32 {
+		return nil, fmt.Errorf("vapid_private_key should be 32 bytes of base64url")
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = elliptic.P256()
+	key.X, key.Y = key.Curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+func vapidPublicKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// handlerWebPushKey tells the web app the applicationServerKey to subscribe with
+//
+//	GET /webpush/key
+func (srv *Server) handlerWebPushKey(w http.ResponseWriter, r *http.Request) {
+	if !srv.webPushEnabled() {
+		writeError(w, r, http.StatusNotFound, "Web push is not setup")
+		return
+	}
+	key, err := srv.vapidKey()
+	if err != nil {
+		writeBackendError(w, r, "Web push is misconfigured", err)
+		return
+	}
+	js, _ := json.Marshal(map[string]string{"public_key": vapidPublicKey(key)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handlerWebPushSubscribe stores the subscription of the caller's browser, the
+// body is PushSubscription.toJSON()
+//
+//	POST /webpush/subscriptions
+func (srv *Server) handlerWebPushSubscribe(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	var s WebPushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Cannot decode subscription")
+		return
+	}
+	var errs []fieldError
+	if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, fieldError{Name: "endpoint", In: "body", Message: "must be an https url"})
+	}
+	if k, err := decodeBase64URL(s.Keys.P256dh); err != nil || len(k) != 65 || k[0] != 4 {
+		errs = append(errs, fieldError{Name: "keys.p256dh", In: "body", Message: "must be an uncompressed P-256 key"})
+	}
+	if a, err := decodeBase64URL(s.Keys.Auth); err != nil || len(a) != 16 {
+		errs = append(errs, fieldError{Name: "keys.auth", In: "body", Message: "must be 16 bytes"})
+	}
+	if len(errs) > 0 {
+		writeValidationError(w, r, errs)
+		return
+	}
+	s.User = username
+	s.CreatedAt = time.Now().UTC()
+
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	err = esRetry(func() error {
+		_, err := client.Index().
+			Index(srv.Names.Index).
+			Type(TYPE_WEBPUSH).
+			Id(webPushID(s.Endpoint)).
+			BodyJson(s).
+			Refresh(true).
+			Do()
+		return err
+	})
+	if err != nil {
+		writeBackendError(w, r, "Failed to save subscription", err)
+		return
+	}
+	srv.Log.Printf("Web push subscription of %s saved\n", username)
+
+	js, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
+}
+
+// handlerWebPushUnsubscribe forgets a subscription of the caller
+//
+//	DELETE /webpush/subscriptions?endpoint=
+func (srv *Server) handlerWebPushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	username := usernameFromToken(r)
+	endpoint := r.URL.Query().Get("endpoint")
+	client, err := srv.es()
+	if err != nil {
+		writeBackendError(w, r, "ES is not setup", err)
+		return
+	}
+	var res *elastic.GetResult
+	err = esRetry(func() error {
+		var err error
+		res, err = client.Get().Index(srv.Names.Index).Type(TYPE_WEBPUSH).Id(webPushID(endpoint)).Do()
+		return err
+	})
+	if err != nil && !elastic.IsNotFound(err) {
+		writeBackendError(w, r, "Failed to read subscription", err)
+		return
+	}
+	var s WebPushSubscription
+	if err != nil || !res.Found || res.Source == nil || json.Unmarshal(*res.Source, &s) != nil || s.User != username {
+		writeError(w, r, http.StatusNotFound, "Subscription not found")
+		return
+	}
+	if err := srv.deleteWebPush(client, endpoint); err != nil {
+		writeBackendError(w, r, "Failed to delete subscription", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) deleteWebPush(client *elastic.Client, endpoint string) error {
+	return esRetry(func() error {
+		_, err := client.Delete().Index(srv.Names.Index).Type(TYPE_WEBPUSH).Id(webPushID(endpoint)).Refresh(true).Do()
+		if elastic.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (srv *Server) userWebPushSubscriptions(client *elastic.Client, username string) ([]WebPushSubscription, error) {
+	var res *elastic.SearchResult
+	err := esRetry(func() error {
+		var err error
+		res, err = client.Search().
+			Index(srv.Names.Index).
+			Type(TYPE_WEBPUSH).
+			Query(elastic.NewTermQuery("user", username)).
+			Sort("created_at", false).
+			Size(DEVICE_MAX_PER_USER).
+			Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var subs []WebPushSubscription
+	for _, hit := range res.Hits.Hits {
+		var s WebPushSubscription
+		if hit.Source == nil || json.Unmarshal(*hit.Source, &s) != nil {
+			continue
+		}
+		subs = append(subs, s)
+	}
+	return subs, nil
+}
+
+// pushWebNotification sends n to every browser of its user
+func (srv *Server) pushWebNotification(client *elastic.Client, n Notification) error {
+	subs, err := srv.userWebPushSubscriptions(client, n.User)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+	// the service worker shows it, same fields as the FCM data
+	data := map[string]string{"id": n.Id, "kind": n.Kind, "title": "Around", "body": n.Message}
+	for k, v := range n.Data {
+		data[k] = v
+	}
+	payload, _ := json.Marshal(data)
+	for _, s := range subs {
+		err := srv.sendWebPush(s, payload)
+		if err == errDeviceGone {
+			srv.Log.Printf("Dropping expired web push subscription of %s\n", s.User)
+			if err := srv.deleteWebPush(client, s.Endpoint); err != nil {
+				srv.Log.Printf("Failed to delete web push subscription of %s %v\n", s.User, err)
+			}
+			continue
+		}
+		if err != nil {
+			srv.Log.Printf("Failed to push to a browser of %s %v\n", s.User, err)
+		}
+	}
+	return nil
+}
+
+// sendWebPush encrypts payload for the subscription (RFC 8291) and posts it to
+// the push service with a VAPID signature (RFC 8292)
+func (srv *Server) sendWebPush(s WebPushSubscription, payload []byte) error {
+	body, err := encryptWebPush(s, payload)
+	if err != nil {
+		return err
+	}
+	key, err := srv.vapidKey()
+	if err != nil {
+		return err
+	}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(WEBPUSH_JWT_TTL).Unix(),
+		"sub": srv.Config.VAPIDSubject,
+	})
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: WEBPUSH_TIMEOUT}
+	return retry(webPushBreaker, func() error {
+		req, _ := http.NewRequest("POST", s.Endpoint, bytes.NewReader(body))
+		req.Header.Set("Authorization", "vapid t="+signed+", k="+vapidPublicKey(key))
+		req.Header.Set("Content-Encoding", "aes128gcm")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("TTL", fmt.Sprint(int(WEBPUSH_TTL.Seconds())))
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		switch {
+		case res.StatusCode >= 200 && res.StatusCode < 300:
+			return nil
+		// the browser unsubscribed or the subscription expired
+		case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+			return permanent(errDeviceGone)
+		case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests:
+			return permanent(fmt.Errorf("push service returned %d", res.StatusCode))
+		}
+		return fmt.Errorf("push service returned %d", res.StatusCode)
+	})
+}
+
+func hmacSHA256(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+// encryptWebPush is the aes128gcm content encoding of RFC 8188 with the keys
+// derived as RFC 8291 says, the whole payload in one record
+func encryptWebPush(s WebPushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := decodeBase64URL(s.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := decodeBase64URL(s.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, fmt.Errorf("p256dh is not a P-256 point")
+	}
+
+	// a fresh key pair per message, its public key goes in the header
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sx, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sx.FillBytes(ecdhSecret)
+
+	// HKDF with one block of output each time, all that is needed
+	prkKey := hmacSHA256(authSecret, ecdhSecret)
+	ikm := hmacSHA256(prkKey, []byte("WebPush: info\x00"), uaPublic, asPublic, []byte{1})
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk := hmacSHA256(salt, ikm)
+	cek := hmacSHA256(prk, []byte("Content-Encoding: aes128gcm\x00\x01"))[:16]
+	nonce := hmacSHA256(prk, []byte("Content-Encoding: nonce\x00\x01"))[:12]
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last record, no padding after it
+	plain := append(append([]byte{}, payload...), 2)
+	if len(plain)+gcm.Overhead() > WEBPUSH_RECORD_SIZE {
+		return nil, fmt.Errorf("web push payload of %d bytes is too big", len(payload))
+	}
+
+	var out bytes.Buffer
+	out.Write(salt)
+	binary.Write(&out, binary.BigEndian, uint32(WEBPUSH_RECORD_SIZE))
+	out.WriteByte(byte(len(asPublic)))
+	out.Write(asPublic)
+	out.Write(gcm.Seal(nil, nonce, plain, nil))
+	return out.Bytes(), nil
+}
+
+// runVAPIDKeys implements `around vapid-keys`, prints a new key pair for the config
+func (srv *Server) runVAPIDKeys(args []string) error {
+	flag.NewFlagSet("vapid-keys", flag.ExitOnError).Parse(args)
+	d, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	srv.Log.Printf("vapid_private_key: %s\n", base64.RawURLEncoding.EncodeToString(d))
+	srv.Log.Printf("# the public key, what GET /webpush/key answers\n# %s\n",
+		base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)))
+	return nil
+}
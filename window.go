@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// the longest within= of /search, older posts are asked for with from=
+const SEARCH_MAX_WITHIN = 365 * 24 * time.Hour
+
+// postWindow reads the time filters of /search on when posts were created, a
+// zero from or to is open:
+//
+//	within=90m|24h|7d   the last 90 minutes, 24 hours or 7 days
+//	from=&to=           RFC 3339, posts created in [from, to)
+//
+// within says where the window starts, so it doesn't go with from.
+func postWindow(q url.Values, now time.Time) (from, to time.Time, err error) {
+	if v := q.Get("within"); v != "" {
+		if q.Get("from") != "" {
+			err = fmt.Errorf("within and from can't be used together")
+			return
+		}
+		var d time.Duration
+		if d, err = parseWithin(v); err != nil {
+			return
+		}
+		from = now.Add(-d)
+	}
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			err = fmt.Errorf("from should be an RFC 3339 time")
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			err = fmt.Errorf("to should be an RFC 3339 time")
+			return
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !to.After(from) {
+		err = fmt.Errorf("the time window ends before it starts")
+	}
+	return
+}
+
+// parseWithin is a duration like 30m, 24h or 7d, Go durations have no days
+func parseWithin(v string) (time.Duration, error) {
+	bad := fmt.Errorf("within should be minutes, hours or days like 30m, 24h or 7d")
+	tooLong := fmt.Errorf("within can be at most %dd", int(SEARCH_MAX_WITHIN/(24*time.Hour)))
+	if len(v) < 2 {
+		return 0, bad
+	}
+	n, err := strconv.Atoi(v[:len(v)-1])
+	if err != nil || n <= 0 {
+		return 0, bad
+	}
+	// more minutes than that would overflow below
+	if n > int(SEARCH_MAX_WITHIN/time.Minute) {
+		return 0, tooLong
+	}
+	var d time.Duration
+	switch v[len(v)-1] {
+	case 'm':
+		d = time.Duration(n) * time.Minute
+	case 'h':
+		d = time.Duration(n) * time.Hour
+	case 'd':
+		d = time.Duration(n) * 24 * time.Hour
+	default:
+		return 0, bad
+	}
+	if d > SEARCH_MAX_WITHIN {
+		return 0, tooLong
+	}
+	return d, nil
+}
+
+// windowFilters are the cache key filters of a time window. within is kept as
+// given rather than resolved, so a cached "last hour" is reused for the
+// SEARCH_CACHE_TTL it lives and starts up to that much late.
+func windowFilters(q url.Values) []string {
+	var filters []string
+	for _, name := range []string{"within", "from", "to"} {
+		if v := q.Get(name); v != "" {
+			filters = append(filters, name+"="+v)
+		}
+	}
+	return filters
+}
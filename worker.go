@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a job that is due runs within this, most jobs are hours apart
+const WORKER_POLL = time.Minute
+
+// workerJob is a task the worker runs every so often. With redis one instance
+// of the deployment runs it per interval, see claimRun, without redis every
+// instance does and should be the only one.
+type workerJob struct {
+	name  string
+	every time.Duration
+	// the first run is one interval after the start, for jobs that are heavy
+	// or that startup does already
+	delay bool
+	// nil for jobs that always run
+	enabled func(srv *Server) bool
+	// how many things it did, for the log
+	run func(srv *Server) (int, error)
+}
+
+// the jobs of the worker
+var workerJobs = []workerJob{
+	// scheduled posts go out and ephemeral ones are taken down
+	{name: "publish", every: SCHEDULE_INTERVAL, run: func(srv *Server) (int, error) {
+		return srv.publishScheduledPosts(time.Now().UTC())
+	}},
+	{name: "expire", every: SCHEDULE_INTERVAL, run: func(srv *Server) (int, error) {
+		return srv.expirePosts(time.Now().UTC())
+	}},
+	// soft deleted posts are gone for good after the restore window
+	{name: "purge", every: PURGE_INTERVAL, run: func(srv *Server) (int, error) {
+		return srv.purgeDeletedPosts(srv.Config.RestoreWindow)
+	}},
+	// move old posts to GCS once a day, off unless -archive-retention is set
+	{name: "archive", every: ARCHIVE_INTERVAL,
+		enabled: func(srv *Server) bool {
+			return srv.Config.ArchiveRetention > 0 && !srv.without("gcs") && !srv.Config.Dev
+		},
+		run: func(srv *Server) (int, error) {
+			return srv.archiveOldPosts(srv.Config.ArchiveRetention, srv.Config.ArchiveIndex)
+		}},
+	// media that no post refers to, e.g. of posts whose save failed
+	{name: "cleanup", every: CLEANUP_INTERVAL, delay: true,
+		enabled: func(srv *Server) bool { return !srv.without("gcs") && !srv.Config.Dev },
+		run: func(srv *Server) (int, error) {
+			_, _, deleted, err := srv.cleanupOrphans(true, ARCHIVE_BULK_SIZE)
+			return deleted, err
+		}},
+	// a new monthly post index, startup makes the current one
+	{name: "rollover", every: ROLLOVER_CHECK_INTERVAL, delay: true, run: func(srv *Server) (int, error) {
+		client, err := srv.es()
+		if err != nil {
+			return 0, err
+		}
+		return 0, srv.rolloverPostIndex(client, time.Now())
+	}},
+	// badges that ingest missed, e.g. for reactions to old posts
+	{name: "badges", every: BADGE_INTERVAL, delay: true, run: (*Server).evaluateAllBadges},
+	// daily and weekly emails of what is popular near home, off without smtp_addr
+	{name: "digests", every: DIGEST_INTERVAL, enabled: (*Server).emailEnabled, run: func(srv *Server) (int, error) {
+		return srv.sendDigests(time.Now())
+	}},
+	// tell users in their evening that their streak ends at midnight
+	{name: "streak-reminders", every: STREAK_REMINDER_INTERVAL, run: func(srv *Server) (int, error) {
+		return srv.sendStreakReminders(time.Now())
+	}},
+}
+
+// the last run of each job on this instance, what claimRun goes by without redis
+type localWorkerRuns struct {
+	sync.Mutex
+	last map[string]time.Time
+}
+
+// claimRun tells if job is due and takes the run. The redis key lives for an
+// interval, the instance that sets it first runs the job and the others see it
+// ran. An instance that dies mid run is covered, the key expires. A job that
+// runs longer than its interval can start a second time somewhere else.
+func (srv *Server) claimRun(job workerJob, now time.Time) (bool, error) {
+	if srv.Redis != nil {
+		host, _ := os.Hostname()
+		return srv.Redis.SetNX("around:worker:"+job.name, fmt.Sprintf("%s:%d", host, os.Getpid()), job.every).Result()
+	}
+	srv.workerRuns.Lock()
+	defer srv.workerRuns.Unlock()
+	if srv.workerRuns.last == nil {
+		srv.workerRuns.last = map[string]time.Time{}
+	}
+	if last, ok := srv.workerRuns.last[job.name]; ok && now.Sub(last) < job.every {
+		return false, nil
+	}
+	srv.workerRuns.last[job.name] = now
+	return true, nil
+}
+
+// runJob runs job now and logs how it went
+func (srv *Server) runJob(job workerJob) error {
+	started := time.Now()
+	n, err := job.run(srv)
+	if err != nil {
+		srv.Log.Printf("Job %s failed after %d in %v %v\n", job.name, n, time.Since(started), err)
+		return err
+	}
+	srv.Log.Printf("Job %s did %d in %v\n", job.name, n, time.Since(started))
+	return nil
+}
+
+// startWorker runs the jobs in the background, those in names or all of them
+// when it is empty
+func (srv *Server) startWorker(names []string) {
+	if srv.Redis == nil {
+		srv.Log.Println("Redis is not setup, every instance runs the jobs of the worker")
+	}
+	for _, job := range workerJobs {
+		if len(names) > 0 && !contains(names, job.name) {
+			continue
+		}
+		if job.enabled != nil && !job.enabled(srv) {
+			continue
+		}
+		go srv.runJobLoop(job)
+	}
+}
+
+func (srv *Server) runJobLoop(job workerJob) {
+	if job.delay {
+		// the first due time is an interval out, as if it had just run
+		if _, err := srv.claimRun(job, time.Now()); err != nil {
+			srv.Log.Printf("Failed to schedule job %s %v\n", job.name, err)
+		}
+	}
+	for {
+		due, err := srv.claimRun(job, time.Now())
+		if err != nil {
+			srv.Log.Printf("Failed to schedule job %s %v\n", job.name, err)
+		} else if due {
+			srv.runJob(job)
+		}
+		time.Sleep(WORKER_POLL)
+	}
+}
+
+// runWorker implements `around worker`: the jobs of every tenant without the
+// API, for deployments that run the API instances with -worker=false. -once
+// runs them one after the other and exits, e.g. from cron.
+//
+//	around worker [-jobs purge,digests] [-once]
+func (srv *Server) runWorker(args []string) error {
+	var names []string
+	for _, job := range workerJobs {
+		names = append(names, job.name)
+	}
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	only := fs.String("jobs", "", "comma separated jobs to run, all by default: "+strings.Join(names, ", "))
+	once := fs.Bool("once", false, "run the jobs once and exit, without asking redis who runs them")
+	fs.Parse(args)
+
+	selected := splitList(*only)
+	for _, name := range selected {
+		if !contains(names, name) {
+			return fmt.Errorf("unknown job %q, one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	servers, err := srv.tenantServers()
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		s.initSearchCache()
+	}
+
+	if *once {
+		failed := 0
+		for _, s := range servers {
+			failed += s.runJobsOnce(selected)
+			if s != srv {
+				s.Close()
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d jobs failed", failed)
+		}
+		return nil
+	}
+	for _, s := range servers {
+		s.startWorker(selected)
+	}
+	select {}
+}
+
+// runJobsOnce runs the selected jobs, all when none are, and returns how many failed
+func (srv *Server) runJobsOnce(selected []string) int {
+	failed := 0
+	for _, job := range workerJobs {
+		if len(selected) > 0 && !contains(selected, job.name) {
+			continue
+		}
+		if job.enabled != nil && !job.enabled(srv) {
+			continue
+		}
+		if srv.runJob(job) != nil {
+			failed++
+		}
+	}
+	return failed
+}
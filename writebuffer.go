@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v3"
+)
+
+// how often the buffered posts are offered to ES again while it is down
+const WRITE_BUFFER_RETRY = 15 * time.Second
+
+// the ids of the buffered posts of all instances, cleanup leaves their media alone
+const WRITE_BUFFER_KEY = "around:write-buffer"
+
+// bufferedPost is a new post ES didn't take, a file in the write buffer
+type bufferedPost struct {
+	Id         string    `json:"id"`
+	Post       Post      `json:"post"`
+	BufferedAt time.Time `json:"buffered_at"`
+}
+
+// esRejected tells the errors of an ES that is up and refused the document
+// from those of an ES that can't be reached. Only the latter are buffered,
+// the post would be refused again.
+func esRejected(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Status < 500
+}
+
+// writeBufferDir is where this instance keeps its buffered posts, one file
+// each named after the post. "" when write_buffer is off.
+func (srv *Server) writeBufferDir() string {
+	if srv.Config.WriteBuffer == "" {
+		return ""
+	}
+	// tenants on one host each have their own
+	return filepath.Join(srv.Config.WriteBuffer, srv.Config.Tenant)
+}
+
+// bufferPost keeps p on local disk when saveToES failed with ES out of
+// reach, replayWriteBuffer indexes it once ES is back. The media is in GCS
+// already, the post isn't lost with the request. The file is synced before
+// the rename so a crash leaves the whole post or none of it.
+func (srv *Server) bufferPost(p *Post, id string) error {
+	dir := srv.writeBufferDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	js, err := json.Marshal(bufferedPost{Id: id, Post: *p, BufferedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(js); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, id+".json")); err != nil {
+		return err
+	}
+	if srv.Redis != nil {
+		srv.Redis.SAdd(WRITE_BUFFER_KEY, id)
+	}
+	srv.Log.Printf("ES is unreachable, post %s is buffered in %s\n", id, dir)
+	return nil
+}
+
+// bufferedPostIDs are the posts waiting in the write buffers, of every
+// instance with redis and of this one without
+func (srv *Server) bufferedPostIDs() map[string]bool {
+	ids := map[string]bool{}
+	if srv.Redis != nil {
+		members, err := srv.Redis.SMembers(WRITE_BUFFER_KEY).Result()
+		if err == nil {
+			for _, id := range members {
+				ids[id] = true
+			}
+		}
+	}
+	if dir := srv.writeBufferDir(); dir != "" {
+		names, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+		for _, name := range names {
+			ids[strings.TrimSuffix(filepath.Base(name), ".json")] = true
+		}
+	}
+	return ids
+}
+
+// replayWriteBuffer indexes the buffered posts of this instance, oldest first,
+// and stops at the first one ES can't take yet. A post ES refuses becomes a
+// dead letter, one that doesn't parse is renamed to .rejected for a look by
+// hand. It returns how many were indexed.
+func (srv *Server) replayWriteBuffer() (int, error) {
+	dir := srv.writeBufferDir()
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	// post ids are time ordered
+	sort.Strings(names)
+	done := 0
+	for _, name := range names {
+		js, err := ioutil.ReadFile(name)
+		if err != nil {
+			return done, err
+		}
+		var b bufferedPost
+		if err := json.Unmarshal(js, &b); err != nil {
+			srv.Log.Printf("Failed to read buffered post %s %v\n", name, err)
+			os.Rename(name, name+".rejected")
+			continue
+		}
+		if err := srv.saveToES(&b.Post, b.Id); err != nil {
+			if !esRejected(err) {
+				return done, err
+			}
+			srv.Log.Printf("ES refused buffered post %s %v\n", b.Id, err)
+			srv.deadLetter("es.post", b, err)
+			os.Remove(name)
+			if srv.Redis != nil {
+				srv.Redis.SRem(WRITE_BUFFER_KEY, b.Id)
+			}
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			return done, err
+		}
+		if srv.Redis != nil {
+			srv.Redis.SRem(WRITE_BUFFER_KEY, b.Id)
+		}
+		srv.Log.Printf("Buffered post %s is indexed after %v\n", b.Id, time.Since(b.BufferedAt))
+		// what handlerPost would have done right away
+		srv.postSaved(b.Post)
+		done++
+	}
+	return done, nil
+}
+
+// runWriteBuffer replays the buffer of this instance every WRITE_BUFFER_RETRY,
+// on every instance and not in the worker, each has its own files
+func (srv *Server) runWriteBuffer() {
+	for {
+		if n, err := srv.replayWriteBuffer(); err != nil {
+			srv.Log.Printf("Write buffer is waiting for ES, %d posts indexed %v\n", n, err)
+		}
+		time.Sleep(WRITE_BUFFER_RETRY)
+	}
+}